@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// Structure
+
+// One of several provider accounts, e.g. VastAI accounts with separate quotas
+type providerAccount struct {
+	name string
+	provider ComputeProvider
+	weight int
+	current int // Smooth weighted round robin credit
+	failures int // Consecutive failed calls
+	open_until time.Time // The breaker skips the account until then
+}
+
+// Spreads instances across accounts by weighted round robin. An account failing
+// accountBreakerThreshold calls in a row is skipped for accountBreakerCooldown, creates fail over
+// to the next account. Calls on an instance go to the account that rented it
+type MultiProvider struct {
+	accounts []*providerAccount
+	owners map[string]*providerAccount // Account per instance ID
+	mu sync.Mutex
+}
+
+// Named VastAI key of VAST_ACCOUNTS
+type vastAccount struct {
+	name string
+	api_key string
+	weight int
+}
+
+//// Functionality
+
+const (
+	accountBreakerThreshold = 3
+	accountBreakerCooldown = 30 * time.Second
+)
+
+var errNoProviderAccount = errors.New("no provider account available")
+
+// Parses VAST_ACCOUNTS, a comma separated list of name:weight:api_key
+func parseVastAccounts(value string) ([]vastAccount, error) {
+	var accounts []vastAccount
+	for i, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		// The entry holds a key, errors only name its position
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid VAST_ACCOUNTS entry %d: expected name:weight:api_key", i+1)
+		}
+		if slices.ContainsFunc(accounts, func(account vastAccount) bool { return account.name == parts[0] }) {
+			return nil, fmt.Errorf("duplicate VAST_ACCOUNTS name %s", parts[0])
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid VAST_ACCOUNTS weight of %s: must be at least 1", parts[0])
+		}
+		accounts = append(accounts, vastAccount{name: parts[0], api_key: parts[2], weight: weight})
+	}
+	return accounts, nil
+}
+
+func NewMultiProvider() *MultiProvider {
+	return &MultiProvider{owners: make(map[string]*providerAccount)}
+}
+
+func (p *MultiProvider) AddAccount(name string, provider ComputeProvider, weight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accounts = append(p.accounts, &providerAccount{name: name, provider: provider, weight: weight})
+}
+
+// Accounts to try a create on, ordered by the weighted round robin pick first and the rest in
+// configuration order. Accounts with an open breaker are left out
+func (p *MultiProvider) candidates(now time.Time) []*providerAccount {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var available []*providerAccount
+	total := 0
+	var picked *providerAccount
+	for _, account := range p.accounts {
+		if now.Before(account.open_until) {
+			continue
+		}
+		available = append(available, account)
+		account.current += account.weight
+		total += account.weight
+		if picked == nil || account.current > picked.current {
+			picked = account
+		}
+	}
+	if picked == nil {
+		return nil
+	}
+	picked.current -= total
+
+	ordered := []*providerAccount{picked}
+	for _, account := range available {
+		if account != picked {
+			ordered = append(ordered, account)
+		}
+	}
+	return ordered
+}
+
+// Feeds the breaker of the account, cancellations say nothing about the account's health
+func (p *MultiProvider) record(account *providerAccount, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The account answered, it just doesn't have the instance
+	if err == nil || errors.Is(err, ErrInstanceNotFound) {
+		account.failures = 0
+		return
+	}
+	account.failures++
+	if account.failures >= accountBreakerThreshold {
+		if time.Now().After(account.open_until) {
+			log.Println("provider account breaker open", account.name, err)
+		}
+		account.open_until = time.Now().Add(accountBreakerCooldown)
+	}
+}
+
+func (p *MultiProvider) owner(instance_id string) *providerAccount {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.owners[instance_id]
+}
+
+func (p *MultiProvider) claim(instance_id string, account *providerAccount) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.owners[instance_id] = account
+}
+
+// Runs op on the account that rented the instance. Instances rented before a restart have no
+// known owner, they are tried on every account until one knows them
+func (p *MultiProvider) onOwner(instance_id string, op func(account *providerAccount) error) error {
+	if account := p.owner(instance_id); account != nil {
+		err := op(account)
+		p.record(account, err)
+		return err
+	}
+
+	p.mu.Lock()
+	accounts := append([]*providerAccount(nil), p.accounts...)
+	p.mu.Unlock()
+
+	err := errNoProviderAccount
+	for _, account := range accounts {
+		if err = op(account); err == nil {
+			p.claim(instance_id, account)
+			return nil
+		}
+	}
+	return err
+}
+
+func (p *MultiProvider) CreateInstance(ctx context.Context, spec InstanceSpec) (*InstanceInfo, error) {
+	err := errNoProviderAccount
+	for _, account := range p.candidates(time.Now()) {
+		var info *InstanceInfo
+		info, err = account.provider.CreateInstance(ctx, spec)
+		p.record(account, err)
+		if err == nil {
+			p.claim(info.ID, account)
+			info.Account = account.name
+			return info, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Println("provider account create error, failing over", account.name, err)
+	}
+	return nil, err
+}
+
+func (p *MultiProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	err := p.onOwner(instance_id, func(account *providerAccount) error {
+		return account.provider.DestroyInstance(ctx, instance_id)
+	})
+	if err == nil {
+		p.mu.Lock()
+		delete(p.owners, instance_id)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+func (p *MultiProvider) InstanceStatus(ctx context.Context, instance_id string) (*InstanceInfo, error) {
+	var info *InstanceInfo
+	err := p.onOwner(instance_id, func(account *providerAccount) error {
+		var err error
+		if info, err = account.provider.InstanceStatus(ctx, instance_id); err == nil {
+			info.Account = account.name
+		}
+		return err
+	})
+	return info, err
+}
+
+func (p *MultiProvider) PauseInstance(ctx context.Context, instance_id string) error {
+	return p.onOwner(instance_id, func(account *providerAccount) error {
+		return pauseInstance(ctx, account.provider, instance_id)
+	})
+}
+
+func (p *MultiProvider) ResumeInstance(ctx context.Context, instance_id string) error {
+	return p.onOwner(instance_id, func(account *providerAccount) error {
+		return resumeInstance(ctx, account.provider, instance_id)
+	})
+}
+
+// Instances of every account, an account that fails to list fails the whole list so orphan
+// cleanup never acts on a partial view
+func (p *MultiProvider) ListInstances(ctx context.Context) ([]InstanceInfo, error) {
+	p.mu.Lock()
+	accounts := append([]*providerAccount(nil), p.accounts...)
+	p.mu.Unlock()
+
+	var instances []InstanceInfo
+	for _, account := range accounts {
+		listed, err := account.provider.ListInstances(ctx)
+		p.record(account, err)
+		if err != nil {
+			return nil, fmt.Errorf("account %s: %w", account.name, err)
+		}
+		for _, info := range listed {
+			info.Account = account.name
+			p.claim(info.ID, account)
+			instances = append(instances, info)
+		}
+	}
+	return instances, nil
+}
+
+// Succeeds while any account is reachable, the failing ones are logged
+func (p *MultiProvider) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	accounts := append([]*providerAccount(nil), p.accounts...)
+	p.mu.Unlock()
+
+	var failures []error
+	for _, account := range accounts {
+		err := account.provider.Ping(ctx)
+		p.record(account, err)
+		if err != nil {
+			log.Println("provider account ping error", account.name, err)
+			failures = append(failures, fmt.Errorf("account %s: %w", account.name, err))
+		}
+	}
+	if len(failures) == len(accounts) {
+		return errors.Join(append(failures, errNoProviderAccount)...)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"RASBERRY_api/testsupport/providertest"
+)
+
+// Multi provider over fake accounts a and b with the given weights
+func fakeAccounts(weight_a int, weight_b int) (*MultiProvider, *providertest.FakeProvider, *providertest.FakeProvider) {
+	a, b := providertest.NewFakeProvider(), providertest.NewFakeProvider()
+	multi := NewMultiProvider()
+	multi.AddAccount("a", a, weight_a)
+	multi.AddAccount("b", b, weight_b)
+	return multi, a, b
+}
+
+func TestMultiProviderDistribution(t *testing.T) {
+	tests := []struct {
+		name string
+		weight_a int
+		weight_b int
+		creates int
+		want_a int
+		want_b int
+	}{
+		{"even", 1, 1, 6, 3, 3},
+		{"two to one", 2, 1, 6, 4, 2},
+		{"three to one", 3, 1, 8, 6, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			multi, a, b := fakeAccounts(test.weight_a, test.weight_b)
+			for range test.creates {
+				if _, err := multi.CreateInstance(context.Background(), DefaultInstanceSpec()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if a.Calls("create") != test.want_a || b.Calls("create") != test.want_b {
+				t.Fatalf("a got %d and b %d creates, want %d and %d", a.Calls("create"), b.Calls("create"), test.want_a, test.want_b)
+			}
+		})
+	}
+}
+
+func TestMultiProviderFailover(t *testing.T) {
+	multi, a, b := fakeAccounts(1, 1)
+	a.FailNext("create", ErrProviderNoCapacity)
+	info, err := multi.CreateInstance(context.Background(), DefaultInstanceSpec())
+	if err != nil || info.Account != "b" {
+		t.Fatalf("got %+v %v, want an instance on b", info, err)
+	}
+	if _, ok := b.Instance(info.ID); !ok {
+		t.Fatalf("b has no instance %s", info.ID)
+	}
+
+	// Calls on the instance go to the account that rented it
+	if err := multi.DestroyInstance(context.Background(), info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if a.Calls("destroy") != 0 || b.Calls("destroy") != 1 {
+		t.Fatalf("a got %d and b %d destroys", a.Calls("destroy"), b.Calls("destroy"))
+	}
+
+	b.FailNext("create", ErrProviderNoCapacity)
+	a.FailNext("create", ErrProviderNoCapacity)
+	if _, err := multi.CreateInstance(context.Background(), DefaultInstanceSpec()); !errors.Is(err, ErrProviderNoCapacity) {
+		t.Fatalf("got %v with every account failing", err)
+	}
+}
+
+// An account failing accountBreakerThreshold creates in a row is skipped
+func TestMultiProviderBreaker(t *testing.T) {
+	multi, a, b := fakeAccounts(1, 1)
+	for range accountBreakerThreshold {
+		a.FailNext("create", errors.New("connection reset"))
+	}
+	creates := 3 * accountBreakerThreshold
+	for range creates {
+		if info, err := multi.CreateInstance(context.Background(), DefaultInstanceSpec()); err != nil || info.Account != "b" {
+			t.Fatalf("got %+v %v, want an instance on b", info, err)
+		}
+	}
+	// a stays out once its breaker opened
+	if a.Calls("create") != accountBreakerThreshold || b.Calls("create") != creates {
+		t.Fatalf("a got %d and b %d creates, want %d and %d", a.Calls("create"), b.Calls("create"), accountBreakerThreshold, creates)
+	}
+}
+
+// The account serving the instance shows in the status
+func TestAccountInStatus(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	multi, _, _ := fakeAccounts(1, 1)
+	api.Provider = tracedProvider{multi}
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	status, body := doRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+	var frame StatusResponse
+	if err := json.Unmarshal(body, &frame); status != http.StatusOK || err != nil || frame.Account != "a" {
+		t.Fatalf("got %d %s, want account a", status, body)
+	}
+}
+
+func TestParseVastAccounts(t *testing.T) {
+	tests := []struct {
+		value string
+		accounts int
+		err bool
+	}{
+		{"", 0, false},
+		{"main:2:key-one, spare:1:key-two", 2, false},
+		{"sk-secret", 0, true},
+		{"main:0:sk-secret", 0, true},
+		{"main:x:sk-secret", 0, true},
+		{"main:1:key,main:1:sk-secret", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			accounts, err := parseVastAccounts(test.value)
+			if (err != nil) != test.err || len(accounts) != test.accounts {
+				t.Fatalf("got %d accounts %v", len(accounts), err)
+			}
+			if err != nil && strings.Contains(err.Error(), "sk-secret") {
+				t.Fatalf("error %q leaks the key", err)
+			}
+		})
+	}
+}
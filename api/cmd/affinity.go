@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+//// Structure
+
+// Device whose last status websocket dropped while it held an instance, the instance is kept
+// for WS_DISCONNECT_GRACE so a reconnecting device finds it again
+type disconnectedDevice struct {
+	instance_id string
+	timer *time.Timer
+}
+
+//// Functionality
+
+// Starts the grace window once the last status websocket of the device is gone. Without
+// WS_DISCONNECT_GRACE devices keep their instance however long they stay away
+func (api *APIServer) noteDisconnect(device_id string) {
+	grace := api.Config().WSDisconnectGrace
+	if grace <= 0 {
+		return
+	}
+
+	api.SubscribersMu.Lock()
+	connected := len(api.Subscribers[device_id]) > 0
+	api.SubscribersMu.Unlock()
+	if connected {
+		return
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	instance_id := compute_state.ID
+	holding := compute_state.IsRunning && instance_id != ""
+	compute_state.Mu.Unlock()
+	if !holding {
+		return
+	}
+
+	api.affinity_mu.Lock()
+	defer api.affinity_mu.Unlock()
+	if previous, ok := api.disconnected[device_id]; ok {
+		previous.timer.Stop()
+	}
+	api.disconnected[device_id] = &disconnectedDevice{
+		instance_id: instance_id,
+		timer: time.AfterFunc(grace, func() { api.releaseDisconnected(device_id, instance_id) }),
+	}
+}
+
+// Ends the grace window of a device that connected again, it keeps the instance it had
+func (api *APIServer) noteReconnect(device_id string) {
+	api.affinity_mu.Lock()
+	disconnected, ok := api.disconnected[device_id]
+	if ok {
+		disconnected.timer.Stop()
+		delete(api.disconnected, device_id)
+	}
+	api.affinity_mu.Unlock()
+	if !ok {
+		return
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	same := compute_state.ID == disconnected.instance_id
+	compute_state.Mu.Unlock()
+	if same {
+		log.Println("device reconnected to its instance", device_id, disconnected.instance_id)
+	}
+}
+
+// Stops the compute of a device that stayed away for the whole grace window, unless it came back
+// or its instance changed in the meantime
+func (api *APIServer) releaseDisconnected(device_id string, instance_id string) {
+	api.affinity_mu.Lock()
+	disconnected, ok := api.disconnected[device_id]
+	if !ok || disconnected.instance_id != instance_id {
+		api.affinity_mu.Unlock()
+		return
+	}
+	delete(api.disconnected, device_id)
+	api.affinity_mu.Unlock()
+
+	// Shutdown closed the websocket, it decides on its own what happens to the instances
+	if api.lifecycle_ctx.Err() != nil {
+		return
+	}
+
+	api.SubscribersMu.Lock()
+	connected := len(api.Subscribers[device_id]) > 0
+	api.SubscribersMu.Unlock()
+	if connected {
+		return
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	if !compute_state.IsRunning || compute_state.ID != instance_id {
+		compute_state.Mu.Unlock()
+		return
+	}
+	// Marking the state first keeps the idle reaper and cost caps from stopping it too
+	log.Println("releasing instance of disconnected device", device_id, instance_id)
+	compute_state.Status = "disconnected"
+	frame := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+
+	api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+	// A stop or restart that got to the device first wins, the release is skipped then
+	if err := api.stopMarkedDevice(device_id, "disconnected"); err != nil {
+		log.Println("disconnected device teardown error", device_id, err)
+	}
+}
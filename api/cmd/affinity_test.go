@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDisconnectGrace(t *testing.T) {
+	tests := []struct {
+		name string
+		grace string
+		away time.Duration
+		reconnect bool
+		kept bool
+	}{
+		{"reconnect within the window", "300ms", 50 * time.Millisecond, true, true},
+		{"away past the window", "100ms", 300 * time.Millisecond, false, false},
+		{"no grace window", "0s", 300 * time.Millisecond, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"WS_DISCONNECT_GRACE": test.grace})
+			startDevice(t, api, server, testAPIKey, "pi")
+			instance_id := instanceID(api, "pi")
+			conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readStatusFrame(t, conn)
+			conn.Close()
+			waitFor(t, "the disconnect", func() bool {
+				api.SubscribersMu.Lock()
+				defer api.SubscribersMu.Unlock()
+				return len(api.Subscribers["pi"]) == 0
+			})
+
+			time.Sleep(test.away)
+			if test.reconnect {
+				conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if frame := readStatusFrame(t, conn); frame.Status != "ready" || frame.ComputeInstance != instance_id {
+					t.Fatalf("reconnected to %+v, want instance %s", frame, instance_id)
+				}
+				// Past the end of the window it would have had
+				time.Sleep(300 * time.Millisecond)
+			}
+
+			if !test.kept {
+				waitFor(t, "the release", func() bool { return deviceStatus(api, "pi") == "stopped" })
+				if ids := instanceIDs(t, api); len(ids) != 0 {
+					t.Fatalf("instances %v left after the release", ids)
+				}
+				return
+			}
+			if status, id := deviceStatus(api, "pi"), instanceID(api, "pi"); status != "ready" || id != instance_id {
+				t.Fatalf("device %s on %q, want ready on %s", status, id, instance_id)
+			}
+		})
+	}
+}
+
+// A control stop racing the end of the grace window stops the device once, run with -race
+func TestDisconnectGraceStopRace(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"WS_DISCONNECT_GRACE": "1h"})
+	mock := mockProvider(api)
+	// Slow destroys leave time for a second teardown to start before the first one is done
+	api.Provider = &slowDestroyProvider{ComputeProvider: api.Provider, delay: 20 * time.Millisecond}
+	var mu sync.Mutex
+	stops := 0
+	api.Events.Subscribe(func(event Event) {
+		if _, ok := event.(InstanceStopped); ok {
+			mu.Lock()
+			stops++
+			mu.Unlock()
+		}
+	})
+	tests := []struct {
+		name string
+		release_first bool
+	}{
+		{"release first", true},
+		{"stop first", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for round := range 10 {
+				startDevice(t, api, server, testAPIKey, "pi")
+				instance_id := instanceID(api, "pi")
+				conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				readStatusFrame(t, conn)
+				conn.Close()
+				waitFor(t, "the grace window", func() bool {
+					api.affinity_mu.Lock()
+					defer api.affinity_mu.Unlock()
+					return api.disconnected["pi"] != nil
+				})
+				mu.Lock()
+				stops = 0
+				mu.Unlock()
+
+				// The window ends as the stop comes in, in either order
+				start := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					<-start
+					if !test.release_first {
+						time.Sleep(time.Millisecond)
+					}
+					api.releaseDisconnected("pi", instance_id)
+				}()
+				go func() {
+					defer wg.Done()
+					<-start
+					if test.release_first {
+						time.Sleep(time.Millisecond)
+					}
+					status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false})
+					if status != http.StatusAccepted && status != http.StatusConflict {
+						t.Errorf("round %d: stop got %d %s", round, status, body)
+					}
+				}()
+				close(start)
+				wg.Wait()
+
+				waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+				// Outlasts a second teardown that would still be on its way
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				got := stops
+				mu.Unlock()
+				if got != 1 {
+					t.Fatalf("round %d: instance stopped %d times", round, got)
+				}
+				if instances, _ := mock.ListInstances(context.Background()); len(instances) != 0 {
+					t.Fatalf("round %d: instances %v left", round, instances)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+)
+
+//// Functionality
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// Reads the attachment parts of a multipart request enforcing the per file and total size limits
+func (api *APIServer) readAttachments(headers []*multipart.FileHeader) ([]Attachment, error) {
+	config := api.Config()
+
+	var attachments []Attachment
+	var total int64
+	for _, header := range headers {
+		if header.Size > config.AttachmentMaxBytes {
+			return nil, fmt.Errorf("%w: %s exceeds %d bytes", errAttachmentTooLarge, header.Filename, config.AttachmentMaxBytes)
+		}
+		total += header.Size
+		if total > config.AttachmentMaxTotalBytes {
+			return nil, fmt.Errorf("%w: attachments exceed %d bytes in total", errAttachmentTooLarge, config.AttachmentMaxTotalBytes)
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		content_type := header.Header.Get("Content-Type")
+		if content_type == "" {
+			content_type = "application/octet-stream"
+		}
+		attachments = append(attachments, Attachment{Filename: header.Filename, ContentType: content_type, Data: data})
+	}
+	return attachments, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Wraps the mock backend keeping the attachments of the last completion
+type attachmentBackend struct {
+	InferenceBackend
+	attachments []Attachment
+	mu sync.Mutex
+}
+
+func (b *attachmentBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	b.mu.Lock()
+	b.attachments = request.Attachments
+	b.mu.Unlock()
+	return b.InferenceBackend.Complete(ctx, endpoint, request)
+}
+
+func TestPromptAttachments(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		want int
+	}{
+		{"forwarded", nil, http.StatusOK},
+		{"file over the limit", map[string]string{"ATTACHMENT_MAX_BYTES": "8"}, http.StatusRequestEntityTooLarge},
+		{"total over the limit", map[string]string{"ATTACHMENT_MAX_TOTAL_BYTES": "8"}, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			backend := &attachmentBackend{InferenceBackend: api.Backend}
+			api.Backend = backend
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			fields := map[string]string{"device_id": "pi", "prompt": "describe it"}
+			status, body := doMultipart(t, server, "/respond", testAPIKey, fields, map[string][2]string{"attachment": {"cat.png", "\x89PNG data"}})
+			if status != test.want {
+				t.Fatalf("got %d %s, want %d", status, body, test.want)
+			}
+			if test.want != http.StatusOK {
+				return
+			}
+			backend.mu.Lock()
+			defer backend.mu.Unlock()
+			if len(backend.attachments) != 1 || backend.attachments[0].Filename != "cat.png" || string(backend.attachments[0].Data) != "\x89PNG data" {
+				t.Fatalf("backend got attachments %+v", backend.attachments)
+			}
+		})
+	}
+}
+
+// The OpenAI backend sends the attachments as file parts next to the prompt
+func TestBackendMultipartForwarding(t *testing.T) {
+	var prompt, filename, content_type, data string
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		prompt = r.FormValue("prompt")
+		if files := r.MultipartForm.File["file"]; len(files) == 1 {
+			file, _ := files[0].Open()
+			contents, _ := io.ReadAll(file)
+			file.Close()
+			filename, content_type, data = files[0].Filename, files[0].Header.Get("Content-Type"), string(contents)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "a cat")
+	}))
+	defer instance.Close()
+
+	backend := NewOpenAIBackend("model", "/health", 0, "Authorization", "", nil, nil)
+	completion, err := backend.Complete(context.Background(), strings.TrimPrefix(instance.URL, "http://"), InferenceRequest{
+		Prompt: "describe it",
+		Attachments: []Attachment{{Filename: "cat.png", ContentType: "image/png", Data: []byte("\x89PNG data")}},
+	})
+	if err != nil || completion != "a cat" {
+		t.Fatalf("got %q %v", completion, err)
+	}
+	if prompt != "describe it" || filename != "cat.png" || content_type != "image/png" || data != "\x89PNG data" {
+		t.Fatalf("backend received prompt %q file %q %q %q", prompt, filename, content_type, data)
+	}
+}
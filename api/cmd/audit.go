@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+//// Structure
+
+// Json log entry of an action the server took on its own, e.g. force-stopping an instance
+type AuditRecord struct {
+	Level string `json:"level"`
+	Action string `json:"action"`
+	DeviceID string `json:"device_id,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Detail map[string]any `json:"detail,omitempty"`
+	At string `json:"at"`
+}
+
+//// Functionality
+
+func (api *APIServer) audit(record AuditRecord) {
+	record.Level = "audit"
+	record.At = api.Clock.Now().UTC().Format(time.RFC3339Nano)
+	entry, err := json.Marshal(record)
+	if err != nil {
+		log.Println("audit record encoding error", err)
+		return
+	}
+	log.Println(string(entry))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//// Structure
+
+// Backend Structures
+type InferenceBackend interface {
+	Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error)
+	Stream(ctx context.Context, endpoint string, request InferenceRequest, on_token func(token string) error) error
+	Ready(ctx context.Context, endpoint string) error // nil once the inference server can take requests
+}
+
+// Talks to the OpenAI compatible completions API served by vLLM on the instance
+type OpenAIBackend struct {
+	model string
+	health_path string
+	health_timeout time.Duration
+	auth_header string // Header the token goes in, "Authorization" sends it as a bearer token
+	auth_token string // BACKEND_AUTH_TOKEN, a per-instance token from the provider takes precedence
+	response_path responsePath // Where completions carry the text, see BACKEND_RESPONSE_PATH
+	stream_path responsePath // Same for streamed chunks
+	client *http.Client
+}
+
+type openAICompletionRequest struct {
+	Model string `json:"model,omitempty"`
+	Prompt string `json:"prompt"`
+	Stream bool `json:"stream"`
+	MaxTokens *int `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP *float64 `json:"top_p,omitempty"`
+	Stop []string `json:"stop,omitempty"`
+}
+
+//// Functionality
+
+const backendTokenContextKey contextKey = "backend_token"
+
+func NewOpenAIBackend(model string, health_path string, health_timeout time.Duration, auth_header string, auth_token string, response_path responsePath, stream_path responsePath) *OpenAIBackend {
+	return &OpenAIBackend{
+		model: model,
+		health_path: health_path,
+		health_timeout: health_timeout,
+		auth_header: auth_header,
+		auth_token: auth_token,
+		response_path: response_path,
+		stream_path: stream_path,
+		client: http.DefaultClient,
+	}
+}
+
+// Carries the token of the instance to the backend, an empty token leaves BACKEND_AUTH_TOKEN in charge
+func withBackendToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, backendTokenContextKey, token)
+}
+
+// Sets the auth header on a request to the instance. The token is never logged, errors of the
+// http client only carry the url
+func (b *OpenAIBackend) authorize(req *http.Request) {
+	token := b.auth_token
+	if instance_token, ok := req.Context().Value(backendTokenContextKey).(string); ok {
+		token = instance_token
+	}
+	if token == "" {
+		return
+	}
+	if strings.EqualFold(b.auth_header, "Authorization") {
+		token = "Bearer " + token
+	}
+	req.Header.Set(b.auth_header, token)
+}
+
+// The instance reports running as soon as the container starts, the model takes a while longer to load
+func (b *OpenAIBackend) Ready(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, b.health_timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+endpoint+b.health_path, nil)
+	if err != nil {
+		return err
+	}
+	b.authorize(req)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend: health check status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Builds the completion request, as json or, when the prompt carries attachments, as a multipart
+// form with the same fields plus one file part per attachment
+func (b *OpenAIBackend) encode(request InferenceRequest, stream bool) (io.Reader, string, error) {
+	if len(request.Attachments) == 0 {
+		body, err := json.Marshal(openAICompletionRequest{
+			Model: b.model,
+			Prompt: request.Prompt,
+			Stream: stream,
+			MaxTokens: request.MaxTokens,
+			Temperature: request.Temperature,
+			TopP: request.TopP,
+			Stop: request.Stop,
+		})
+		return bytes.NewReader(body), "application/json", err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if b.model != "" {
+		form.WriteField("model", b.model)
+	}
+	form.WriteField("prompt", request.Prompt)
+	form.WriteField("stream", strconv.FormatBool(stream))
+	if request.MaxTokens != nil {
+		form.WriteField("max_tokens", strconv.Itoa(*request.MaxTokens))
+	}
+	if request.Temperature != nil {
+		form.WriteField("temperature", strconv.FormatFloat(*request.Temperature, 'g', -1, 64))
+	}
+	if request.TopP != nil {
+		form.WriteField("top_p", strconv.FormatFloat(*request.TopP, 'g', -1, 64))
+	}
+	for _, stop := range request.Stop {
+		form.WriteField("stop", stop)
+	}
+	for _, attachment := range request.Attachments {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, attachment.Filename))
+		header.Set("Content-Type", attachment.ContentType)
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(attachment.Data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, "", err
+	}
+	return &body, form.FormDataContentType(), nil
+}
+
+func (b *OpenAIBackend) post(ctx context.Context, endpoint string, request InferenceRequest, stream bool) (*http.Response, error) {
+	body, content_type, err := b.encode(request, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+endpoint+"/v1/completions", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", content_type)
+	b.authorize(req)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, &BackendStatusError{Status: resp.StatusCode, Body: readBodySnippet(resp.Body)}
+	}
+	return resp, nil
+}
+
+// Largest plain text completion read from the backend
+const maxBackendTextBytes = 4 << 20
+
+// Decodes the json completion. Model servers that answer plain text have it taken as the completion,
+// anything else (typically the html error page of a proxy) fails with a BackendBodyError
+func (b *OpenAIBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	resp, err := b.post(ctx, endpoint, request, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	media_type, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case media_type == "text/plain":
+		text, err := io.ReadAll(io.LimitReader(resp.Body, maxBackendTextBytes))
+		return string(text), err
+	case media_type != "" && media_type != "application/json" && !strings.HasSuffix(media_type, "+json"):
+		return "", &BackendBodyError{ContentType: media_type, Body: readBodySnippet(resp.Body)}
+	}
+
+	text, ok, err := b.response_path.extract(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("backend: completion without text at %s", b.response_path)
+	}
+	return text, nil
+}
+
+// Streams the completion as server sent events, calling on_token for every chunk
+func (b *OpenAIBackend) Stream(ctx context.Context, endpoint string, request InferenceRequest, on_token func(token string) error) error {
+	resp, err := b.post(ctx, endpoint, request, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return nil
+		}
+
+		// Chunks without text, like the final one carrying the finish reason, are skipped
+		token, ok, err := b.stream_path.extract(strings.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if ok && token != "" {
+			if err := on_token(token); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
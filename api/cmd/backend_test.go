@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Wraps the mock backend with a health check the test flips
+type gatedBackend struct {
+	InferenceBackend
+	ready atomic.Bool
+	checks atomic.Int32
+}
+
+func (b *gatedBackend) Ready(ctx context.Context, endpoint string) error {
+	b.checks.Add(1)
+	if !b.ready.Load() {
+		return errors.New("backend: health check status 503")
+	}
+	return nil
+}
+
+func TestBackendHealthCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		status int
+		delay time.Duration
+		ok bool
+	}{
+		{"ready", http.StatusOK, 0, true},
+		{"loading", http.StatusServiceUnavailable, 0, false},
+		{"timeout", http.StatusOK, 200 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/healthz" {
+					http.NotFound(w, r)
+					return
+				}
+				time.Sleep(test.delay)
+				w.WriteHeader(test.status)
+			}))
+			defer instance.Close()
+
+			backend := NewOpenAIBackend("model", "/v1/healthz", 50*time.Millisecond, "Authorization", "", nil, nil)
+			err := backend.Ready(context.Background(), strings.TrimPrefix(instance.URL, "http://"))
+			if (err == nil) != test.ok {
+				t.Fatalf("Ready = %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+// The provider reports running long before the model is loaded
+func TestReadyWaitsForBackend(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	backend := &gatedBackend{InferenceBackend: api.Backend}
+	api.Backend = backend
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true}); status != http.StatusOK {
+		t.Fatalf("start: %d %s", status, body)
+	}
+	waitFor(t, "the first health check", func() bool { return backend.checks.Load() > 0 })
+	if status := deviceStatus(api, "pi"); status == "ready" {
+		t.Fatal("device ready while its backend answers 503")
+	}
+
+	backend.ready.Store(true)
+	// The next poll is pollInterval away
+	deadline := time.Now().Add(pollInterval + 5*time.Second)
+	for deviceStatus(api, "pi") != "ready" {
+		if time.Now().After(deadline) {
+			t.Fatal("device never became ready once its backend did")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendAuthHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		header string
+		token string
+		instance_token string
+		want_header string
+		want string
+	}{
+		{"bearer token", "Authorization", "config-token", "", "Authorization", "Bearer config-token"},
+		{"custom header", "X-Backend-Key", "config-token", "", "X-Backend-Key", "config-token"},
+		{"instance token wins", "Authorization", "config-token", "instance-token", "Authorization", "Bearer instance-token"},
+		{"no token", "Authorization", "", "", "Authorization", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var received []string
+			instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				received = append(received, r.Header.Get(test.want_header))
+				mu.Unlock()
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("ok"))
+			}))
+			defer instance.Close()
+			endpoint := strings.TrimPrefix(instance.URL, "http://")
+
+			backend := NewOpenAIBackend("model", "/health", time.Second, test.header, test.token, nil, nil)
+			ctx := withBackendToken(context.Background(), test.instance_token)
+			if err := backend.Ready(ctx, endpoint); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := backend.Complete(ctx, endpoint, InferenceRequest{Prompt: "hi"}); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, got := range received {
+				if got != test.want {
+					t.Fatalf("backend got %s %q, want %q", test.want_header, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+// A failing backend call names neither the configured nor the instance token
+func TestBackendTokenKeptOutOfErrors(t *testing.T) {
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer instance.Close()
+	endpoint := strings.TrimPrefix(instance.URL, "http://")
+
+	backend := NewOpenAIBackend("model", "/health", time.Second, "Authorization", "config-secret", nil, nil)
+	ctx := withBackendToken(context.Background(), "instance-secret")
+	errs := []error{backend.Ready(ctx, endpoint)}
+	_, err := backend.Complete(ctx, endpoint, InferenceRequest{Prompt: "hi"})
+	errs = append(errs, err)
+	for _, err := range errs {
+		if err == nil {
+			t.Fatal("failing backend call succeeded")
+		}
+		if strings.Contains(err.Error(), "secret") {
+			t.Fatalf("error %q carries the token", err)
+		}
+	}
+}
+
+// Sends completions to a stand-in instance whatever the endpoint of the device, health checks stay on the mock
+type standInBackend struct {
+	InferenceBackend
+	completions InferenceBackend
+	endpoint string
+}
+
+func (b *standInBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	return b.completions.Complete(ctx, b.endpoint, request)
+}
+
+func TestBackendNonJSON(t *testing.T) {
+	html_page := "<html><body>" + strings.Repeat("bad gateway ", 100) + "</body></html>"
+	tests := []struct {
+		name string
+		content_type string
+		body string
+		status int
+		want string // Response, or the detail of the error
+	}{
+		{"plain text", "text/plain; charset=utf-8", "just the text", http.StatusOK, "just the text"},
+		{"html error page", "text/html", html_page, http.StatusBadGateway, html_page[:backendBodySnippet]},
+		{"json", "application/json", `{"choices":[{"text":"decoded"}]}`, http.StatusOK, "decoded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.content_type)
+				w.Write([]byte(test.body))
+			}))
+			defer instance.Close()
+			api, server := newTestServer(t, nil)
+			api.Backend = &standInBackend{
+				InferenceBackend: api.Backend,
+				completions: NewOpenAIBackend("model", "/health", 0, "Authorization", "", []string{"choices", "0", "text"}, nil),
+				endpoint: strings.TrimPrefix(instance.URL, "http://"),
+			}
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status == http.StatusOK {
+				var response InferenceResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Response != test.want {
+					t.Fatalf("got %s, want %q", body, test.want)
+				}
+				return
+			}
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); err != nil || response.Error != "backend_invalid_response" || response.Detail != test.want {
+				t.Fatalf("got %s, want backend_invalid_response with the truncated page", body)
+			}
+		})
+	}
+}
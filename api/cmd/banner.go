@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+)
+
+//// Structure
+
+// Info entry logged once on boot with everything the server runs with, json so it can be diffed
+// between deployments when one misbehaves
+type startupBanner struct {
+	Level string `json:"level"`
+	Msg string `json:"msg"`
+	Addr string `json:"addr"`
+	Build VersionResponse `json:"build"`
+	TLS bool `json:"tls"`
+	Features []string `json:"features"`
+	Config map[string]any `json:"config"`
+}
+
+//// Functionality
+
+const redactedSecret = "****"
+
+// Config fields holding credentials, never logged as they are
+var secretConfigFields = map[string]bool{
+	"BackendAuthToken": true,
+}
+
+// Unset secrets stay empty so a missing one is still visible
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+// Effective configuration with every secret replaced by ****, keyed by field name
+func (c *Config) Redacted() map[string]any {
+	redacted := make(map[string]any)
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch current := value.Field(i).Interface().(type) {
+		case time.Duration:
+			redacted[field.Name] = current.String()
+		case []blockedPattern:
+			redacted[field.Name] = len(current)
+		case responsePath:
+			redacted[field.Name] = current.String()
+		case string:
+			if secretConfigFields[field.Name] {
+				current = redact(current)
+			}
+			redacted[field.Name] = current
+		default:
+			redacted[field.Name] = current
+		}
+	}
+
+	if security := c.security; security != nil {
+		accounts := make([]string, 0, len(security.vast_accounts))
+		for _, account := range security.vast_accounts {
+			accounts = append(accounts, fmt.Sprintf("%s:%d:%s", account.name, account.weight, redact(account.api_key)))
+		}
+		tenants := make([]string, 0, len(security.tenants))
+		for _, tenant := range security.tenants {
+			tenants = append(tenants, tenant.Name+":"+tenant.Role)
+		}
+		sort.Strings(tenants)
+		// Tenants are indexed by every key they accept, a rotating one shows up twice
+		tenants = slices.Compact(tenants)
+
+		redacted["APIKey"] = redact(security.api_key)
+		redacted["APIKeyPrevious"] = redact(security.api_key_previous)
+		redacted["AcceptedOrigin"] = security.accepted_origin
+		redacted["VastAPIKey"] = redact(security.vast_api_key)
+		redacted["VastAccounts"] = accounts
+		redacted["Tenants"] = tenants
+	}
+	return redacted
+}
+
+// Optional behaviour switched on by the configuration
+func (c *Config) features() []string {
+	enabled := map[string]bool{
+		"tls": c.TLSEnabled(),
+		"h2c": c.H2C,
+		"mock_provider": c.MockProvider,
+		"provider_warmup": c.ProviderWarmup,
+		"multi_account": c.security != nil && len(c.security.vast_accounts) > 0,
+		"idle_stop": c.IdleTimeout > 0,
+		"provider_credit_check": c.ProviderMinCredit > 0,
+		"max_cost": c.MaxCost > 0,
+		"cost_ceiling": c.CostCeiling > 0,
+		"interruption_reprovision": c.InterruptionReprovision,
+		"orphan_cleanup": c.OrphanCleanup,
+		"ws_compression": c.WSCompression,
+		"ws_disconnect_grace": c.WSDisconnectGrace > 0,
+		"inference_queue": c.InferenceQueueMaxAge > 0,
+		"backend_warmup": c.BackendWarmupPrompt != "",
+		"prompt_blocklist": len(c.PromptBlocklist) > 0,
+		"maintenance_mode": c.MaintenanceMode,
+		"tracing": c.TracingEnabled,
+		"state_file": c.StateFile != "",
+	}
+	features := []string{}
+	for feature, on := range enabled {
+		if on {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+func logStartupBanner(addr string, config *Config) {
+	entry, err := json.Marshal(startupBanner{
+		Level: "info",
+		Msg: "startup",
+		Addr: addr,
+		Build: currentVersion(),
+		TLS: config.TLSEnabled(),
+		Features: config.features(),
+		Config: config.Redacted(),
+	})
+	if err != nil {
+		log.Println("startup banner encoding error", err)
+		return
+	}
+	log.Println(string(entry))
+}
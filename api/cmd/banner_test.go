@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigRedacted(t *testing.T) {
+	t.Setenv("API_KEY", "sk-api-secret")
+	t.Setenv("API_KEY_PREVIOUS", "sk-previous-secret")
+	t.Setenv("VAST_API_KEY", "sk-vast-secret")
+	t.Setenv("BACKEND_AUTH_TOKEN", "sk-backend-secret")
+	t.Setenv("VAST_ACCOUNTS", "main:2:sk-account-secret")
+	t.Setenv("IDLE_TIMEOUT", "15m")
+	t.Setenv("ACCEPTED_ORIGIN", testOrigin)
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := config.Redacted()
+
+	tests := []struct {
+		field string
+		want any
+	}{
+		{"APIKey", redactedSecret},
+		{"APIKeyPrevious", redactedSecret},
+		{"VastAPIKey", redactedSecret},
+		{"BackendAuthToken", redactedSecret},
+		{"VastAccounts", []string{"main:2:" + redactedSecret}},
+		{"IdleTimeout", "15m0s"},
+		{"AcceptedOrigin", testOrigin},
+		{"TLSCertFile", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.field, func(t *testing.T) {
+			got, ok := redacted[test.field]
+			if !ok {
+				t.Fatalf("%s missing", test.field)
+			}
+			if !jsonEqual(got, test.want) {
+				t.Fatalf("%s is %v, want %v", test.field, got, test.want)
+			}
+		})
+	}
+
+	t.Run("banner", func(t *testing.T) {
+		logs := captureLog(t)
+		logStartupBanner(":8000", config)
+		output := logs.String()
+		if strings.Contains(output, "secret") {
+			t.Fatalf("banner leaks a secret:\n%s", output)
+		}
+		var banner startupBanner
+		if err := json.Unmarshal([]byte(output[strings.Index(output, "{"):]), &banner); err != nil {
+			t.Fatal(err)
+		}
+		if banner.Addr != ":8000" || banner.TLS || !slices.Contains(banner.Features, "idle_stop") || !slices.Contains(banner.Features, "multi_account") {
+			t.Fatalf("banner %+v", banner)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// Structure
+
+type BatchInferenceRequest struct {
+	DeviceID string `json:"device_id"`
+	Prompts []string `json:"prompts"`
+	InferenceParameters // Applied to every prompt
+}
+
+// Result of one prompt, Index is its position in the request since results may complete out of order
+type BatchResult struct {
+	Index int `json:"index"`
+	Status string `json:"status"` // completed or error
+	Response string `json:"response,omitempty"`
+	Error string `json:"error,omitempty"`
+	Latency Duration `json:"latency"`
+}
+
+type BatchInferenceResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+//// Functionality
+
+// Upper bound on the prompts of one batch
+const maxBatchPrompts = 256
+
+const ndjsonContentType = "application/x-ndjson"
+
+func wantsNDJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if media_type, _, err := mime.ParseMediaType(strings.TrimSpace(accepted)); err == nil && media_type == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+func (api *APIServer) completeBatchPrompt(ctx context.Context, endpoint string, device_id string, params InferenceParameters, index int, prompt string) BatchResult {
+	start := time.Now()
+	result := BatchResult{Index: index, Status: "error"}
+
+	prompt, err := sanitizePrompt(prompt, api.Config().PromptSanitize)
+	if err == nil && !api.allowPrompt(device_id, tenantFromContext(ctx).Name, prompt) {
+		err = errPromptBlocked
+	}
+	if err == nil {
+		result.Response, err = api.forwardInference(ctx, endpoint, InferenceRequest{DeviceID: device_id, Prompt: prompt, InferenceParameters: params})
+		api.Events.Publish(InferenceCompleted{DeviceID: device_id, Latency: time.Since(start), Err: err})
+		if err != nil {
+			log.Println("batch inference error", device_id, index, err)
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = errors.New("inference timed out")
+			} else {
+				err = errors.New("inference failed")
+			}
+		}
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Status = "completed"
+	}
+	result.Latency = Duration(time.Since(start))
+	return result
+}
+
+// Runs every prompt of the batch against the device, at most STREAM_MAX_CONCURRENT at a time.
+// Results are returned as one array, or streamed as json lines as they finish with Accept: application/x-ndjson
+func (api *APIServer) handleBatchRespond(w http.ResponseWriter, r *http.Request) {
+	timeout, err := api.requestTimeout(r, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var batch BatchInferenceRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxPromptBytes)
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		var max_bytes_err *http.MaxBytesError
+		if errors.As(err, &max_bytes_err) {
+			http.Error(w, "Prompt too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	noteRequestDevice(r, batch.DeviceID)
+	if batch.DeviceID == "" {
+		http.Error(w, "missing device id", http.StatusBadRequest)
+		return
+	}
+	if len(batch.Prompts) == 0 || len(batch.Prompts) > maxBatchPrompts {
+		http.Error(w, fmt.Sprintf("batch must have between 1 and %d prompts", maxBatchPrompts), http.StatusBadRequest)
+		return
+	}
+
+	if writeValidationErrors(w, r, http.StatusBadRequest, batch.InferenceParameters.validate(api.Config())) {
+		return
+	}
+	params := batch.InferenceParameters.withDefaults(api.Config())
+
+	endpoint, backend_token, ok := api.inferenceEndpoint(w, r, batch.DeviceID)
+	if !ok {
+		return
+	}
+	defer api.endInference(batch.DeviceID)
+	ctx = withBackendToken(ctx, backend_token)
+
+	results := make(chan BatchResult)
+	slots := make(chan struct{}, api.Config().StreamMaxConcurrent)
+	var wg sync.WaitGroup
+	for index, prompt := range batch.Prompts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results <- api.completeBatchPrompt(ctx, endpoint, batch.DeviceID, params, index, prompt)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	if !wantsNDJSON(r) {
+		response := BatchInferenceResponse{Results: make([]BatchResult, len(batch.Prompts))}
+		for result := range results {
+			response.Results[result.Index] = result
+		}
+		if err := encodeResponse(w, r, response); err != nil {
+			logWriteError("batch response encoding error", err)
+		}
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+
+	write_failed := false
+	for result := range results {
+		// Keep draining so the workers finish, their requests are cancelled with the client anyway
+		if write_failed {
+			continue
+		}
+		// Each line is marshalled on its own so a bad result can't leave half a line behind
+		line, err := json.Marshal(result)
+		if err != nil {
+			log.Println("batch line encoding error", result.Index, err)
+			line, _ = json.Marshal(BatchResult{Index: result.Index, Status: "error", Error: "response encoding failed", Latency: result.Latency})
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			logWriteError("batch line write error", err)
+			write_failed = true
+			continue
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBatchNDJSON(t *testing.T) {
+	const latency = 200 * time.Millisecond
+	api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": latency.String(), "STREAM_MAX_CONCURRENT": "1"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	prompts := []string{"zero", "one", "two"}
+
+	request := newRequest(t, server, "POST", "/respond/batch", testAPIKey, map[string]any{"device_id": "pi", "prompts": prompts})
+	request.Header.Set("Accept", ndjsonContentType)
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("got %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	lines := bufio.NewScanner(response.Body)
+	seen := make(map[int]bool)
+	for lines.Scan() {
+		// One prompt at a time, the first line must not wait for the rest of the batch
+		if len(seen) == 0 && time.Since(start) >= latency*time.Duration(len(prompts)) {
+			t.Fatalf("first line after %s, results were not streamed", time.Since(start))
+		}
+		var result BatchResult
+		if err := json.Unmarshal(lines.Bytes(), &result); err != nil {
+			t.Fatalf("line %q: %v", lines.Text(), err)
+		}
+		if result.Index < 0 || result.Index >= len(prompts) || seen[result.Index] {
+			t.Fatalf("line with index %d", result.Index)
+		}
+		if want := "echo: " + prompts[result.Index]; result.Status != "completed" || result.Response != want {
+			t.Fatalf("result %+v, want %q", result, want)
+		}
+		seen[result.Index] = true
+	}
+	if err := lines.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != len(prompts) {
+		t.Fatalf("%d lines for %d prompts", len(seen), len(prompts))
+	}
+}
+
+// Other Accept headers keep the array, in prompt order
+func TestBatchArray(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+	prompts := []string{"zero", "one", "two", "three", "four"}
+
+	status, body := doRequest(t, server, "POST", "/respond/batch", testAPIKey, map[string]any{"device_id": "pi", "prompts": prompts})
+	var response BatchInferenceResponse
+	if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || len(response.Results) != len(prompts) {
+		t.Fatalf("got %d %s", status, body)
+	}
+	for i, result := range response.Results {
+		if result.Index != i || result.Response != "echo: "+prompts[i] {
+			t.Fatalf("result %d is %+v", i, result)
+		}
+	}
+}
+
+// A prompt whose backend try times out is reported as timed out, not just failed
+func TestBatchTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		status string
+		err string
+	}{
+		{"try timeout", map[string]string{"INFERENCE_TRY_TIMEOUT": "50ms", "INFERENCE_MAX_ATTEMPTS": "1"}, "error", "inference timed out"},
+		{"inference deadline", map[string]string{"INFERENCE_DEADLINE": "50ms"}, "error", "inference timed out"},
+		{"in time", nil, "completed", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"MOCK_LATENCY": "300ms"}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			api, server := newTestServer(t, env)
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			status, body := doRequest(t, server, "POST", "/respond/batch", testAPIKey, map[string]any{"device_id": "pi", "prompts": []string{"hi"}})
+			var response BatchInferenceResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || len(response.Results) != 1 {
+				t.Fatalf("got %d %s", status, body)
+			}
+			if result := response.Results[0]; result.Status != test.status || result.Error != test.err {
+				t.Fatalf("result %+v, want %s %q", result, test.status, test.err)
+			}
+		})
+	}
+}
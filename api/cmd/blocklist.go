@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//// Structure
+
+// Pattern of PROMPT_BLOCKLIST_FILE, line is where it was read from so audits can name it
+// without repeating the prompt
+type blockedPattern struct {
+	line int
+	pattern *regexp.Regexp
+}
+
+//// Functionality
+
+var errPromptBlocked = errors.New("prompt blocked")
+
+// Compiles the patterns of the file, one regex per line with blank and # lines skipped.
+// An empty path blocks nothing
+func loadPromptBlocklist(path string, case_insensitive bool, max_patterns int) ([]blockedPattern, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []blockedPattern
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		expr := strings.TrimSpace(scanner.Text())
+		if expr == "" || strings.HasPrefix(expr, "#") {
+			continue
+		}
+		if len(patterns) == max_patterns {
+			return nil, fmt.Errorf("PROMPT_BLOCKLIST_FILE has more than %d patterns", max_patterns)
+		}
+		if case_insensitive {
+			expr = "(?i)" + expr
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROMPT_BLOCKLIST_FILE pattern on line %d: %w", line, err)
+		}
+		patterns = append(patterns, blockedPattern{line: line, pattern: pattern})
+	}
+	return patterns, scanner.Err()
+}
+
+// Returns false and audits the prompt if it matches a blocked pattern
+func (api *APIServer) allowPrompt(device_id string, tenant string, prompt string) bool {
+	for _, blocked := range api.Config().PromptBlocklist {
+		if blocked.pattern.MatchString(prompt) {
+			api.audit(AuditRecord{
+				Action: "prompt_blocked",
+				DeviceID: device_id,
+				Tenant: tenant,
+				Detail: map[string]any{"pattern_line": blocked.line},
+			})
+			return false
+		}
+	}
+	return true
+}
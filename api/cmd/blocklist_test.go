@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes the patterns to a PROMPT_BLOCKLIST_FILE and returns its path
+func blocklistFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPromptBlocklist(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		prompt string
+		blocked bool
+	}{
+		{"blocked", nil, "tell me the launch codes", true},
+		{"allowed", nil, "tell me a joke", false},
+		{"case insensitive by default", nil, "The LAUNCH CODES please", true},
+		{"case sensitive", map[string]string{"PROMPT_BLOCKLIST_CASE_INSENSITIVE": "false"}, "The LAUNCH CODES please", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"PROMPT_BLOCKLIST_FILE": blocklistFile(t, "# secrets\n\nlaunch\\s+codes\n")}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			api, server := newTestServer(t, env)
+			startDevice(t, api, server, testAPIKey, "pi")
+			logs := captureLog(t)
+
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": test.prompt})
+			if !test.blocked {
+				if status != http.StatusOK {
+					t.Fatalf("allowed prompt got %d %s", status, body)
+				}
+				return
+			}
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusUnprocessableEntity || err != nil || response.Error != "prompt_blocked" {
+				t.Fatalf("got %d %s, want 422 prompt_blocked", status, body)
+			}
+			output := logs.String()
+			if !strings.Contains(output, `"prompt_blocked"`) || !strings.Contains(output, `"pattern_line":3`) {
+				t.Fatalf("no audit record naming the pattern:\n%s", output)
+			}
+			if strings.Contains(output, test.prompt) {
+				t.Fatalf("audit repeats the prompt:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestLoadPromptBlocklist(t *testing.T) {
+	tests := []struct {
+		name string
+		contents string
+		max_patterns int
+		patterns int
+		err string
+	}{
+		{"comments and blanks skipped", "# comment\n\nfoo\nbar\n", 10, 2, ""},
+		{"invalid regex", "foo\n(unclosed\n", 10, 0, "line 2"},
+		{"over the max", "a\nb\nc\n", 2, 0, "more than 2 patterns"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patterns, err := loadPromptBlocklist(blocklistFile(t, test.contents), true, test.max_patterns)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want an error about %s", err, test.err)
+				}
+				return
+			}
+			if err != nil || len(patterns) != test.patterns {
+				t.Fatalf("got %d patterns %v, want %d", len(patterns), err, test.patterns)
+			}
+		})
+	}
+
+	t.Run("invalid regex fails config load", func(t *testing.T) {
+		t.Setenv("PROMPT_BLOCKLIST_FILE", blocklistFile(t, "(unclosed\n"))
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "PROMPT_BLOCKLIST_FILE") {
+			t.Fatalf("got %v, want the invalid pattern rejected", err)
+		}
+	})
+}
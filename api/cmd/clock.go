@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+//// Structure
+
+// Source of the current time, replaceable so tests can control it. Activity, cost and quota
+// bookkeeping read it, latencies, tickers and network deadlines stay on the real clock
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+//// Functionality
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Server time a response is encoded at, lets clients measure clock skew and round trip latency
+func (api *APIServer) servedAt() string {
+	return api.Clock.Now().UTC().Format(time.RFC3339Nano)
+}
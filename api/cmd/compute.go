@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//// Functionality
+
+// How often the provider is polled while waiting for an instance to come up
+const pollInterval = 5 * time.Second
+
+// Builds the status frame for the current state, caller must hold state.Mu
+func (state *ComputeState) statusResponse() StatusResponse {
+	return StatusResponse{
+		DeviceID: state.DeviceID,
+		Label: state.Label,
+		ComputeInstance: state.ID,
+		Endpoint: state.Endpoint,
+		Status: state.Status,
+		Ready: state.Status == "ready",
+		AcceptingInference: state.Status == "ready" && state.AcceptingInference,
+		CostPerHour: state.CostPerHour,
+		Metadata: state.Metadata,
+		Account: state.Account,
+		tenant: state.Tenant,
+	}
+}
+
+// Cost the current instance accrued since it was created, caller must hold state.Mu.
+// A paused instance accrues nothing until it is resumed
+func (state *ComputeState) accruedCost(now time.Time) float64 {
+	if state.ID == "" || state.Attached {
+		return 0
+	}
+	if !state.PausedAt.IsZero() {
+		now = state.PausedAt
+	}
+	// Restored start times carry no monotonic reading, a wall clock set back must not refund cost
+	return state.CostPerHour * max(now.Sub(state.StartedAt), 0).Hours()
+}
+
+// Updates the status of the device and publishes the change
+func (api *APIServer) setStatus(device_id string, status string) {
+	compute_state := api.getComputeState(device_id)
+
+	compute_state.Mu.Lock()
+	compute_state.Status = status
+	compute_state.LastActive = api.Clock.Now()
+	frame := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+
+	api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+}
+
+// Announces the freshly provisioned instance of the device as ready, or with reused a resumed or claimed one
+func (api *APIServer) instanceReady(device_id string, reused bool) {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	instance_id := compute_state.ID
+	compute_state.Mu.Unlock()
+
+	api.Events.Publish(InstanceReady{DeviceID: device_id, InstanceID: instance_id, Reused: reused})
+	api.setStatus(device_id, "ready")
+	if api.Config().BackendWarmupPrompt != "" {
+		go api.warmupInstance(device_id)
+	} else {
+		api.warmupInstance(device_id)
+	}
+}
+
+// Runs op, and while the provider rate limits it waits the Retry-After delay and tries again.
+// The device shows "rate_limited" meanwhile. on_limited (if not nil) runs on the first rate limit.
+// Gives up once the total wait would exceed the provisioning timeout
+func (api *APIServer) retryRateLimited(ctx context.Context, device_id string, on_limited func(), op func() error) error {
+	deadline := api.Clock.Now().Add(api.Config().ProvisionTimeout)
+
+	for {
+		err := op()
+		var rate_limit *RateLimitError
+		if !errors.As(err, &rate_limit) || api.Clock.Now().Add(rate_limit.RetryAfter).After(deadline) {
+			return err
+		}
+
+		log.Println("provider rate limited, retrying", device_id, rate_limit.RetryAfter)
+		if on_limited != nil {
+			on_limited()
+			on_limited = nil
+		}
+		api.setStatus(device_id, "rate_limited")
+
+		timer := time.NewTimer(rate_limit.RetryAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Rents an instance with the given spec and blocks until its inference endpoint is reachable,
+// pending_status is broadcast while the instance boots. The outcome of the first create call is sent
+// on created (if not nil) so a caller can report provider errors without waiting for the boot, a
+// rate limited create counts as accepted since it is retried in the background. An instance that
+// doesn't match the spec is traded for another one when SPEC_MISMATCH_POLICY is reprovision
+func (api *APIServer) provisionInstance(ctx context.Context, device_id string, spec InstanceSpec, pending_status string, created chan<- error) (err error) {
+	ctx, span := tracer.Start(ctx, "provision", trace.WithAttributes(attribute.String("device_id", device_id)))
+	defer func() { endSpan(span, err) }()
+
+	for attempt := 1; ; attempt++ {
+		var instance_id string
+		instance_id, err = api.createInstance(ctx, device_id, spec, pending_status, created)
+		created = nil
+		if err != nil {
+			return err
+		}
+
+		err = api.waitForInstance(ctx, device_id, instance_id, spec)
+		if !errors.Is(err, errSpecMismatch) || api.Config().SpecMismatchPolicy != "reprovision" || attempt == maxSpecMismatchAttempts {
+			return err
+		}
+		log.Println("instance spec mismatch, reprovisioning", device_id, err)
+		if err := api.destroyInstance(ctx, device_id); err != nil {
+			return err
+		}
+	}
+}
+
+// Rents one instance for the device and records it, returns its ID
+func (api *APIServer) createInstance(ctx context.Context, device_id string, spec InstanceSpec, pending_status string, created chan<- error) (string, error) {
+	compute_state := api.getComputeState(device_id)
+	api.Events.Publish(InstanceStarting{DeviceID: device_id, Spec: spec})
+
+	var instance *InstanceInfo
+	err := api.retryRateLimited(ctx, device_id, func() {
+		if created != nil {
+			created <- nil
+			created = nil
+		}
+	}, func() error {
+		var err error
+		instance, err = api.Provider.CreateInstance(ctx, spec)
+		return err
+	})
+	if created != nil {
+		created <- err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	compute_state.Mu.Lock()
+	compute_state.ID = instance.ID
+	compute_state.CostPerHour = instance.CostPerHour
+	compute_state.Metadata = redactMetadata(instance.Metadata)
+	compute_state.Account = instance.Account
+	compute_state.BackendToken = instance.BackendToken
+	compute_state.StartedAt = api.Clock.Now()
+	compute_state.Mu.Unlock()
+
+	api.ComputesMu.Lock()
+	api.InstanceRefs[instance.ID] = 1
+	api.ComputesMu.Unlock()
+	api.setStatus(device_id, pending_status)
+
+	return instance.ID, nil
+}
+
+// Polls the provider until the instance is running and its inference server answers, fails with
+// errSpecMismatch as soon as the provider reports attributes that differ from the spec
+func (api *APIServer) waitForInstance(ctx context.Context, device_id string, instance_id string, spec InstanceSpec) (err error) {
+	ctx, span := tracer.Start(ctx, "poll", trace.WithAttributes(attribute.String("instance_id", instance_id)))
+	defer func() { endSpan(span, err) }()
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	ctx = withBackendToken(ctx, compute_state.BackendToken)
+	compute_state.Mu.Unlock()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		wait := ticker.C
+		info, err := api.Provider.InstanceStatus(ctx, instance_id)
+		var rate_limit *RateLimitError
+		if errors.As(err, &rate_limit) && rate_limit.RetryAfter > pollInterval {
+			// Polling faster than the provider allows only extends the throttling
+			log.Println("instance status polling rate limited", rate_limit.RetryAfter)
+			wait = time.After(rate_limit.RetryAfter)
+		} else if err != nil {
+			log.Println("instance status polling error", err)
+		} else if err := verifyInstanceSpec(spec, info); err != nil {
+			log.Println("warning: provider instance does not match the spec", device_id, instance_id, err)
+			return err
+		} else if info.Status == "running" && info.Endpoint == "" {
+			// Broadcasting ready now would hand clients an empty endpoint
+			log.Println("instance running without an endpoint yet", device_id)
+		} else if info.Status == "running" {
+			// Running only means the container is up, wait for the inference server inside
+			if err := api.Backend.Ready(ctx, info.Endpoint); err != nil {
+				log.Println("instance backend not ready yet", device_id, err)
+			} else {
+				compute_state.Mu.Lock()
+				compute_state.Endpoint = info.Endpoint
+				compute_state.Mu.Unlock()
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// Destroys the instance of the device if one is allocated
+func (api *APIServer) destroyInstance(ctx context.Context, device_id string) error {
+	compute_state := api.getComputeState(device_id)
+
+	// Shared instances stay up until the last device detaches
+	if api.detachSharedInstance(compute_state) {
+		return nil
+	}
+
+	compute_state.Mu.Lock()
+	instance_id := compute_state.ID
+	compute_state.Mu.Unlock()
+
+	if instance_id == "" {
+		return nil
+	}
+	err := api.retryRateLimited(ctx, device_id, nil, func() error {
+		return api.Provider.DestroyInstance(ctx, instance_id)
+	})
+	if errors.Is(err, ErrInstanceNotFound) {
+		// Gone already (reclaimed, or destroyed from the console), all that's left is clearing the state
+		log.Println("instance already gone on destroy", device_id, instance_id)
+	} else if err != nil {
+		return err
+	}
+
+	compute_state.Mu.Lock()
+	stopped := InstanceStopped{
+		DeviceID: device_id,
+		InstanceID: instance_id,
+		Tenant: compute_state.Tenant,
+		GPUType: compute_state.Spec.GPUType,
+		Cost: compute_state.accruedCost(api.Clock.Now()),
+	}
+	compute_state.ID = ""
+	compute_state.Endpoint = ""
+	compute_state.CostPerHour = 0
+	compute_state.Metadata = nil
+	compute_state.Account = ""
+	compute_state.BackendToken = ""
+	compute_state.PausedAt = time.Time{}
+	compute_state.AcceptingInference = false
+	compute_state.Mu.Unlock()
+
+	api.ComputesMu.Lock()
+	delete(api.InstanceRefs, instance_id)
+	api.ComputesMu.Unlock()
+
+	api.Events.Publish(stopped)
+	return nil
+}
+
+// Marks the device idle again after a failed provisioning, tearing down any partial instance
+func (api *APIServer) failCompute(device_id string, err error) {
+	log.Println("compute provisioning error", device_id, err)
+
+	// Left running for an operator to look at, a stop destroys it as usual
+	if errors.Is(err, errSpecMismatch) && api.Config().SpecMismatchPolicy == "mark" {
+		api.setStatus(device_id, "spec_mismatch")
+		return
+	}
+
+	if destroy_err := api.destroyInstance(context.Background(), device_id); destroy_err != nil {
+		log.Println("partial instance teardown error", device_id, destroy_err)
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	compute_state.IsRunning = false
+	compute_state.Mu.Unlock()
+	api.setStatus(device_id, "error")
+}
+
+// Tears down whatever a cancelled provisioning left behind and marks the device stopped
+func (api *APIServer) cancelCompute(device_id string) {
+	log.Println("compute provisioning cancelled", device_id)
+
+	if err := api.destroyInstance(context.Background(), device_id); err != nil {
+		log.Println("partial instance teardown error", device_id, err)
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	compute_state.IsRunning = false
+	compute_state.Mu.Unlock()
+	api.setStatus(device_id, "stopped")
+}
+
+// Clears the provisioning cancel func once provisioning is over, returns false if a stop
+// cancelled it in the meantime
+func (api *APIServer) finishProvisioning(ctx context.Context, device_id string) bool {
+	compute_state := api.getComputeState(device_id)
+
+	compute_state.Mu.Lock()
+	defer compute_state.Mu.Unlock()
+
+	cancelled := errors.Is(ctx.Err(), context.Canceled)
+	if compute_state.CancelProvision != nil {
+		compute_state.CancelProvision()
+		compute_state.CancelProvision = nil
+	}
+	return !cancelled
+}
+
+func (api *APIServer) initVastAICompute(ctx context.Context, device_id string, created chan<- error) {
+	defer api.provisioning.Done()
+
+	compute_state := api.getComputeState(device_id)
+
+	compute_state.Mu.Lock()
+	spec := compute_state.Spec
+	compute_state.Mu.Unlock()
+
+	// A stop while the job waited in the provision queue cancelled it before anything was rented
+	err := ctx.Err()
+	if err == nil {
+		err = api.provisionInstance(ctx, device_id, spec, "provisioning", created)
+	} else if created != nil {
+		created <- err
+	}
+	// Settled under OpMu, a stop that finds the provisioning over waits for the outcome instead of
+	// letting the next start in before the teardown ran
+	compute_state.OpMu.Lock()
+	defer compute_state.OpMu.Unlock()
+	if !api.finishProvisioning(ctx, device_id) {
+		api.cancelCompute(device_id)
+		return
+	}
+	if err != nil {
+		api.failCompute(device_id, err)
+		return
+	}
+	api.instanceReady(device_id, false)
+}
+
+func (api *APIServer) stopVastAICompute(device_id string) error {
+	if err := api.destroyInstance(context.Background(), device_id); err != nil {
+		log.Println("compute teardown error", device_id, err)
+		api.setStatus(device_id, "error")
+		return err
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	compute_state.IsRunning = false
+	compute_state.Mu.Unlock()
+	api.setStatus(device_id, "stopped")
+	return nil
+}
+
+// Stops the device unless it stopped meanwhile, serialized with its other start and stop operations.
+// A provisioning underway is cancelled instead, it tears down its instance itself
+func (api *APIServer) stopDevice(device_id string) error {
+	compute_state := api.getComputeState(device_id)
+	compute_state.OpMu.Lock()
+	defer compute_state.OpMu.Unlock()
+
+	compute_state.Mu.Lock()
+	is_running := compute_state.IsRunning
+	cancel_provision := compute_state.CancelProvision
+	compute_state.Mu.Unlock()
+	if !is_running {
+		return nil
+	}
+	if cancel_provision != nil {
+		cancel_provision()
+		return nil
+	}
+	return api.stopVastAICompute(device_id)
+}
+
+// Stops the device on behalf of a background check that marked it with the status when it decided
+// to. Serialized with the other start and stop operations of the device, the stop is skipped if the
+// device was stopped, restarted or reprovisioned since it was marked
+func (api *APIServer) stopMarkedDevice(device_id string, marked string) error {
+	compute_state := api.getComputeState(device_id)
+	compute_state.OpMu.Lock()
+	defer compute_state.OpMu.Unlock()
+
+	compute_state.Mu.Lock()
+	still_marked := compute_state.IsRunning && compute_state.Status == marked
+	compute_state.Mu.Unlock()
+	if !still_marked {
+		log.Println("device changed since it was marked for stopping, keeping it", device_id, marked)
+		return nil
+	}
+	return api.stopVastAICompute(device_id)
+}
+
+// Swaps the instance of a running device for a fresh one with the same spec
+func (api *APIServer) reprovisionVastAICompute(ctx context.Context, device_id string) {
+	defer api.provisioning.Done()
+
+	compute_state := api.getComputeState(device_id)
+
+	// The fresh instance gets a fresh name so it is distinguishable from the old one in the console
+	compute_state.Mu.Lock()
+	compute_state.Name = api.instanceName(device_id, compute_state.Tenant)
+	compute_state.Spec.Label = compute_state.Name
+	spec := compute_state.Spec
+	compute_state.Mu.Unlock()
+
+	api.setStatus(device_id, "reprovisioning")
+
+	if err := api.destroyInstance(ctx, device_id); err != nil {
+		compute_state.OpMu.Lock()
+		defer compute_state.OpMu.Unlock()
+		if !api.finishProvisioning(ctx, device_id) {
+			api.cancelCompute(device_id)
+			return
+		}
+		// The old instance is still alive, keep serving from it rather than leaking a second one
+		log.Println("reprovision teardown error", device_id, err)
+		api.setStatus(device_id, "ready")
+		return
+	}
+
+	err := api.provisionInstance(ctx, device_id, spec, "reprovisioning", nil)
+	compute_state.OpMu.Lock()
+	defer compute_state.OpMu.Unlock()
+	if !api.finishProvisioning(ctx, device_id) {
+		api.cancelCompute(device_id)
+		return
+	}
+	if err != nil {
+		api.failCompute(device_id, fmt.Errorf("reprovision failed: %w", err))
+		return
+	}
+	api.instanceReady(device_id, false)
+}
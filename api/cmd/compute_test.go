@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// A stop finding the instance gone already clears the device like a successful destroy
+func TestStopGoneInstance(t *testing.T) {
+	tests := []struct {
+		name string
+		gone func(mock *MockProvider, instance_id string)
+	}{
+		{"destroyed from the console", func(mock *MockProvider, instance_id string) {
+			mock.DestroyInstance(context.Background(), instance_id)
+		}},
+		{"provider answers not found", func(mock *MockProvider, instance_id string) {
+			mock.FailNext("destroy", fmt.Errorf("%w: vastai DELETE /instances/%s/: status 404", ErrInstanceNotFound, instance_id))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			startDevice(t, api, server, testAPIKey, "pi")
+			statuses := recordStatuses(api, "pi")
+			stopped := testutil.ToFloat64(instanceEvents.WithLabelValues("instance_stopped"))
+			test.gone(mockProvider(api), instanceID(api, "pi"))
+
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+				t.Fatalf("stop: %d %s", status, body)
+			}
+			waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			is_running, id := compute_state.IsRunning, compute_state.ID
+			compute_state.Mu.Unlock()
+			if is_running || id != "" {
+				t.Fatalf("running %v on %q after the stop", is_running, id)
+			}
+			if got := statuses(); len(got) != 1 {
+				t.Fatalf("status transitions %v, want only stopped", got)
+			}
+			if got := testutil.ToFloat64(instanceEvents.WithLabelValues("instance_stopped")) - stopped; got != 1 {
+				t.Fatalf("%g stops counted", got)
+			}
+
+			// The device starts again as usual
+			startDevice(t, api, server, testAPIKey, "pi")
+		})
+	}
+}
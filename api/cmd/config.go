@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+//// Structure
+
+type Config struct {
+	TLSCertFile string // Serving TLS negotiates HTTP/2 through ALPN
+	TLSKeyFile string
+	H2C bool // Serve HTTP/2 over cleartext, for internal deployments behind a terminating proxy
+	ProviderWarmup bool // Ping the provider on boot so auth failures show up in readiness
+	ProviderWarmupTimeout time.Duration
+	ProvisionTimeout time.Duration // Upper bound for an instance to come up before provisioning fails
+	SpecMismatchPolicy string // "reprovision" trades an instance that doesn't match its spec for another, "mark" keeps it as spec_mismatch
+	ProvisionWorkers int // Provisionings running at once, the rest wait in the queue
+	ProvisionQueue int // Provisionings waiting for a worker, requests beyond get a 503
+	AllowEmptyOrigin bool // Accept websocket upgrades without an Origin header, see the upgrader in NewAPIServer
+	MaxConnections int // TCP connections served at once, further ones wait in the OS accept backlog, 0 doesn't limit
+	MaxWSConnections int // Status and inference websockets open at once, upgrades beyond get a 503
+	WSDisconnectGrace time.Duration // How long a device that lost its last status websocket keeps its instance, 0 keeps it indefinitely
+	WSCompression bool // Negotiate permessage-deflate, status frames are repetitive json that compresses well
+	WSCompressionLevel int // flate level from -2 (huffman only) to 9
+	WSSendBuffer int // Status frames queued per websocket, a client falling further behind is dropped
+	WSDuplicatePolicy string // "replace" closes the existing status websocket of a device, "reject" refuses the new one
+	MaxCost float64 // Global per-device cost cap, 0 disables it
+	CostCeiling float64 // Hard per-device cost limit, the instance is force-stopped and audited once reached, 0 disables it
+	CostCheckInterval time.Duration
+	IdleTimeout time.Duration // Stop ready instances without activity for this long, 0 keeps them up
+	IdleCheckInterval time.Duration
+	InferenceDrainTimeout time.Duration // How long an idle stop waits for in-flight inferences before destroying the instance
+	MinUptime time.Duration // Idle instances younger than this are not stopped yet, 0 stops them regardless of age
+	IdleReapConcurrency int // Idle instances destroyed in parallel per sweep
+	StopAllConcurrency int // Instances destroyed in parallel by /compute/stop-all
+	DefaultGPUType string // GPU of control requests whose tenant sets none either
+	DefaultRegion string // Country code instances are rented in by default, empty rents anywhere
+	OfferStrategy string // How VastAI offers are picked: cheapest, fastest or most-reliable
+	WarmPool map[string]int // Ready instances kept per GPU type for control requests to claim, empty disables the pool
+	WarmPoolMaxLifetime time.Duration // Unclaimed pooled instances are replaced once this old, 0 keeps them
+	WarmPoolCheckInterval time.Duration
+	WarmPoolScaleDownInterval time.Duration // Shrink the pool by one instance per interval while nothing is claimed, 0 keeps it full
+	InstanceTag string // Prefix of the label of every instance this server creates, {env} in the name template
+	InstanceNameTemplate string // e.g. {env}-{device_id}-{short_uuid}
+	InterruptionCheckInterval time.Duration // How often ready interruptible instances are checked for having been reclaimed
+	InterruptionReprovision bool // Rent a fresh instance for a device whose interruptible instance was reclaimed
+	OrphanCleanup bool // Destroy tagged instances no device tracks
+	OrphanCleanupDryRun bool // Only log the orphans that would be destroyed
+	OrphanScanInterval time.Duration
+	LogSampleRate int // Log 1 in N successful requests, errors always log
+	LogDebug bool
+	SecurityHeaders bool // Send nosniff, frame denial, the referrer policy and HSTS over TLS
+	ReferrerPolicy string // e.g. no-referrer or strict-origin-when-cross-origin
+	HSTSMaxAge time.Duration // max-age of Strict-Transport-Security, 0 leaves the header out
+	SlowRequestThreshold time.Duration // Requests slower than this log a warn entry, 0 disables it
+	MaintenanceMode bool // Start in maintenance mode, refusing new provisioning
+	ShutdownTimeout time.Duration // Overall deadline of the graceful shutdown
+	ShutdownDestroyInstances bool // Destroy running instances on shutdown instead of preserving them
+	MaxRequestTimeout time.Duration // Cap on the X-Request-Timeout clients may ask for
+	AttachmentMaxBytes int64 // Per file limit of multipart inference attachments
+	AttachmentMaxTotalBytes int64
+	ControlLenientRun bool // Accept "run" as a string boolean like "true" on /control
+	GenerateDeviceID bool // Give a start on /control without device_id a generated one, instead of rejecting it
+	PromptBlocklist []blockedPattern // Prompts matching any of these are refused, compiled from PROMPT_BLOCKLIST_FILE
+	PromptSanitize string // "strip" or "reject" control characters in prompts, "off" forwards them raw
+	ProviderMinCredit float64 // Starts are refused with 402 while the provider account holds less credit, 0 skips the check
+	ProviderCreditCache time.Duration // How long a credit reading is reused
+	ProviderBaseURL string // Base of the VastAI api, absolute http(s) url
+	BackendModel string // Model name sent to the OpenAI compatible backend
+	BackendHealthPath string // Polled on the instance until it answers 200 before the device is ready
+	BackendHealthTimeout time.Duration
+	BackendAuthHeader string
+	BackendAuthToken string // Sent to every instance unless the provider handed out a token of its own
+	BackendResponsePath responsePath // Where the backend puts the generated text in a completion, BACKEND_RESPONSE_PATH like "choices.0.message.content"
+	BackendStreamPath responsePath // Same for the chunks of a streamed completion, BACKEND_STREAM_PATH
+	BackendWarmupPrompt string // Sent once to every fresh instance before it accepts inference, empty skips the warmup
+	BackendWarmupTimeout time.Duration
+	InferenceMaxTokens int // Defaults of the generation parameters clients leave unset
+	InferenceTemperature float64
+	InferenceTopP float64
+	InferenceMaxTokensLimit int // Largest max_tokens a client may ask for
+	InferenceMaxAttempts int // Forwarding attempts per prompt, transient backend errors are retried
+	InferenceTryTimeout time.Duration // Bound of a single forwarding attempt
+	InferenceQueueMaxAge time.Duration // How long a request may wait for a warming instance, 0 fails it right away
+	InferenceDeadline time.Duration // Bound of all attempts together, a shorter request timeout wins. Requests may ask for another with "timeout"
+	InferenceTimeoutMax time.Duration // Longest "timeout" a request may ask for
+	StreamMaxConcurrent int // Concurrent generations allowed on one inference websocket
+	MockProvider bool // Use the in memory provider and echo backend instead of VastAI
+	MockBootDelay time.Duration // How long mock instances take to come up
+	MockEndpointDelay time.Duration // How long booted mock instances report running without an endpoint
+	MockLatency time.Duration // Simulated latency of a mock completion
+	TracingEnabled bool // Export spans over OTLP, configured through the standard OTEL_EXPORTER_OTLP_* variables
+	TracingServiceName string
+	StateFile string // Where state that survives restarts is kept, in memory only when empty
+	security *securityConfig
+}
+
+// Collects the first parsing error so LoadConfig can read every variable in one pass
+type envParser struct {
+	values map[string]string // Read from .env on a reload, they win over the process environment
+	err error
+}
+
+//// Functionality
+
+// Value of the variable, os.Getenv unless values holds it
+func (p *envParser) lookup(key string) string {
+	if value, ok := p.values[key]; ok {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+func (p *envParser) fail(key string, value string, err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+}
+
+func (p *envParser) string(key string, fallback string) string {
+	if value := p.lookup(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (p *envParser) bool(key string, fallback bool) bool {
+	value := p.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+func (p *envParser) positiveInt(key string, fallback int) int {
+	value := p.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err == nil && parsed < 1 {
+		err = errors.New("must be at least 1")
+	}
+	if err != nil {
+		p.fail(key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+func (p *envParser) intBetween(key string, fallback int, min int, max int) int {
+	value := p.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err == nil && (parsed < min || parsed > max) {
+		err = fmt.Errorf("must be between %d and %d", min, max)
+	}
+	if err != nil {
+		p.fail(key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+func (p *envParser) float(key string, fallback float64) float64 {
+	value := p.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.fail(key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+func (p *envParser) duration(key string, fallback time.Duration) time.Duration {
+	value := p.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		p.fail(key, value, err)
+		return fallback
+	}
+	return parsed
+}
+
+// Period of a ticker, which panics on anything but a positive duration
+func (p *envParser) interval(key string, fallback time.Duration) time.Duration {
+	parsed := p.duration(key, fallback)
+	if parsed <= 0 {
+		p.fail(key, p.lookup(key), errors.New("must be positive"))
+		return fallback
+	}
+	return parsed
+}
+
+func (p *envParser) choice(key string, fallback string, options ...string) string {
+	value := p.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	if !slices.Contains(options, value) {
+		p.fail(key, value, fmt.Errorf("must be one of %v", options))
+		return fallback
+	}
+	return value
+}
+
+func LoadConfig() (*Config, error) {
+	if err := godotenv.Load(".env"); err != nil {
+		return nil, err
+	}
+	return loadConfig(nil)
+}
+
+// Parses the config from values, falling back to the process environment for the variables missing from it
+func loadConfig(values map[string]string) (*Config, error) {
+	env := &envParser{values: values}
+	security, err := LoadSecurityConfig(env)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{
+		TLSCertFile: env.lookup("TLS_CERT_FILE"),
+		TLSKeyFile: env.lookup("TLS_KEY_FILE"),
+		H2C: env.bool("H2C", false),
+		ProviderWarmup: env.bool("PROVIDER_WARMUP", false),
+		ProviderWarmupTimeout: env.duration("PROVIDER_WARMUP_TIMEOUT", 10*time.Second),
+		ProvisionTimeout: env.duration("PROVISION_TIMEOUT", 15*time.Minute),
+		SpecMismatchPolicy: env.choice("SPEC_MISMATCH_POLICY", "reprovision", "reprovision", "mark"),
+		ProvisionWorkers: env.positiveInt("PROVISION_WORKERS", 16),
+		ProvisionQueue: env.positiveInt("PROVISION_QUEUE", 64),
+		AllowEmptyOrigin: env.bool("ALLOW_EMPTY_ORIGIN", false),
+		MaxConnections: env.intBetween("MAX_CONNECTIONS", 0, 0, math.MaxInt32),
+		MaxWSConnections: env.positiveInt("MAX_WS_CONNECTIONS", 1024),
+		WSDisconnectGrace: env.duration("WS_DISCONNECT_GRACE", 0),
+		WSCompression: env.bool("WS_COMPRESSION", false),
+		WSCompressionLevel: env.intBetween("WS_COMPRESSION_LEVEL", 1, -2, 9),
+		WSSendBuffer: env.positiveInt("WS_SEND_BUFFER", 16),
+		WSDuplicatePolicy: env.choice("WS_DUPLICATE_POLICY", "replace", "replace", "reject"),
+		MaxCost: env.float("MAX_COST", 0),
+		CostCeiling: env.float("COST_CEILING", 0),
+		CostCheckInterval: env.interval("COST_CHECK_INTERVAL", time.Minute),
+		IdleTimeout: env.duration("IDLE_TIMEOUT", 0),
+		IdleCheckInterval: env.interval("IDLE_CHECK_INTERVAL", time.Minute),
+		InferenceDrainTimeout: env.duration("INFERENCE_DRAIN_TIMEOUT", 30*time.Second),
+		MinUptime: env.duration("MIN_UPTIME", 0),
+		IdleReapConcurrency: env.positiveInt("IDLE_REAP_CONCURRENCY", 4),
+		StopAllConcurrency: env.positiveInt("STOP_ALL_CONCURRENCY", 8),
+		DefaultGPUType: env.string("DEFAULT_GPU_TYPE", DefaultInstanceSpec().GPUType),
+		DefaultRegion: env.string("DEFAULT_REGION", ""),
+		OfferStrategy: env.choice("OFFER_STRATEGY", offerCheapest, offerCheapest, offerFastest, offerMostReliable),
+		WarmPoolMaxLifetime: env.duration("WARM_POOL_MAX_LIFETIME", time.Hour),
+		WarmPoolCheckInterval: env.interval("WARM_POOL_CHECK_INTERVAL", 30*time.Second),
+		WarmPoolScaleDownInterval: env.duration("WARM_POOL_SCALE_DOWN_INTERVAL", 0),
+		InstanceTag: env.string("INSTANCE_TAG", "gorasp"),
+		InstanceNameTemplate: env.string("INSTANCE_NAME_TEMPLATE", "{env}-{device_id}-{short_uuid}"),
+		OrphanCleanup: env.bool("ORPHAN_CLEANUP", false),
+		OrphanCleanupDryRun: env.bool("ORPHAN_CLEANUP_DRY_RUN", false),
+		OrphanScanInterval: env.interval("ORPHAN_SCAN_INTERVAL", 10*time.Minute),
+		InterruptionCheckInterval: env.interval("INTERRUPTION_CHECK_INTERVAL", 30*time.Second),
+		InterruptionReprovision: env.bool("INTERRUPTION_REPROVISION", false),
+		LogSampleRate: env.positiveInt("LOG_SAMPLE_RATE", 1),
+		LogDebug: env.bool("LOG_DEBUG", false),
+		SecurityHeaders: env.bool("SECURITY_HEADERS", true),
+		ReferrerPolicy: env.string("REFERRER_POLICY", "no-referrer"),
+		HSTSMaxAge: env.duration("HSTS_MAX_AGE", 180*24*time.Hour),
+		SlowRequestThreshold: time.Duration(env.intBetween("SLOW_REQUEST_MS", 2000, 0, math.MaxInt32)) * time.Millisecond,
+		MaintenanceMode: env.bool("MAINTENANCE_MODE", false),
+		ShutdownTimeout: env.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		ShutdownDestroyInstances: env.bool("SHUTDOWN_DESTROY_INSTANCES", false),
+		MaxRequestTimeout: env.duration("MAX_REQUEST_TIMEOUT", 15*time.Minute),
+		AttachmentMaxBytes: int64(env.positiveInt("ATTACHMENT_MAX_BYTES", 10<<20)),
+		AttachmentMaxTotalBytes: int64(env.positiveInt("ATTACHMENT_MAX_TOTAL_BYTES", 20<<20)),
+		ControlLenientRun: env.bool("CONTROL_LENIENT_RUN", false),
+		GenerateDeviceID: env.bool("GENERATE_DEVICE_ID", false),
+		PromptSanitize: env.choice("PROMPT_SANITIZE", "strip", "strip", "reject", "off"),
+		ProviderMinCredit: env.float("PROVIDER_MIN_CREDIT", 0),
+		ProviderCreditCache: env.duration("PROVIDER_CREDIT_CACHE", 30*time.Second),
+		ProviderBaseURL: env.string("PROVIDER_BASE_URL", vastAIBaseURL),
+		BackendModel: env.lookup("BACKEND_MODEL"),
+		BackendHealthPath: env.string("BACKEND_HEALTH_PATH", "/health"),
+		BackendHealthTimeout: env.duration("BACKEND_HEALTH_TIMEOUT", 5*time.Second),
+		BackendAuthHeader: env.string("BACKEND_AUTH_HEADER", "Authorization"),
+		BackendAuthToken: env.lookup("BACKEND_AUTH_TOKEN"),
+		BackendWarmupPrompt: env.lookup("BACKEND_WARMUP_PROMPT"),
+		BackendWarmupTimeout: env.duration("BACKEND_WARMUP_TIMEOUT", 2*time.Minute),
+		InferenceMaxTokens: env.positiveInt("INFERENCE_MAX_TOKENS", 256),
+		InferenceTemperature: env.float("INFERENCE_TEMPERATURE", 1),
+		InferenceTopP: env.float("INFERENCE_TOP_P", 1),
+		InferenceMaxTokensLimit: env.positiveInt("INFERENCE_MAX_TOKENS_LIMIT", 4096),
+		InferenceMaxAttempts: env.positiveInt("INFERENCE_MAX_ATTEMPTS", 3),
+		InferenceTryTimeout: env.duration("INFERENCE_TRY_TIMEOUT", time.Minute),
+		InferenceQueueMaxAge: env.duration("INFERENCE_QUEUE_MAX_AGE", 0),
+		InferenceDeadline: env.duration("INFERENCE_DEADLINE", 2*time.Minute),
+		InferenceTimeoutMax: env.duration("INFERENCE_TIMEOUT_MAX", 10*time.Minute),
+		StreamMaxConcurrent: env.positiveInt("STREAM_MAX_CONCURRENT", 4),
+		MockProvider: env.bool("MOCK_PROVIDER", false),
+		MockBootDelay: env.duration("MOCK_BOOT_DELAY", 3*time.Second),
+		MockEndpointDelay: env.duration("MOCK_ENDPOINT_DELAY", 0),
+		MockLatency: env.duration("MOCK_LATENCY", 200*time.Millisecond),
+		TracingEnabled: env.bool("TRACING_ENABLED", false),
+		TracingServiceName: env.string("OTEL_SERVICE_NAME", "gorasp-api"),
+		StateFile: env.lookup("STATE_FILE"),
+		security: security,
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	if err := validateNameTemplate(config.InstanceNameTemplate); err != nil {
+		return nil, err
+	}
+	if base_url, err := url.Parse(config.ProviderBaseURL); err != nil || (base_url.Scheme != "http" && base_url.Scheme != "https") || base_url.Host == "" {
+		return nil, fmt.Errorf("invalid PROVIDER_BASE_URL %q: must be an absolute http or https url", config.ProviderBaseURL)
+	}
+	if invalidNameChars.MatchString(config.InstanceTag) {
+		return nil, fmt.Errorf("invalid INSTANCE_TAG %q: only letters, digits, '.', '_' and '-' are allowed", config.InstanceTag)
+	}
+	if !validGPUType.MatchString(config.DefaultGPUType) {
+		return nil, fmt.Errorf("invalid DEFAULT_GPU_TYPE %q: only letters, digits, '_' and spaces are allowed", config.DefaultGPUType)
+	}
+	if config.DefaultRegion != "" && !validRegion.MatchString(config.DefaultRegion) {
+		return nil, fmt.Errorf("invalid DEFAULT_REGION %q: must be an uppercase two letter country code", config.DefaultRegion)
+	}
+	if config.WarmPool, err = parseWarmPool(env.lookup("WARM_POOL")); err != nil {
+		return nil, err
+	}
+	if config.BackendResponsePath, err = parseResponsePath(env.string("BACKEND_RESPONSE_PATH", "choices.0.text")); err != nil {
+		return nil, fmt.Errorf("invalid BACKEND_RESPONSE_PATH: %w", err)
+	}
+	if config.BackendStreamPath, err = parseResponsePath(env.string("BACKEND_STREAM_PATH", "choices.0.text")); err != nil {
+		return nil, fmt.Errorf("invalid BACKEND_STREAM_PATH: %w", err)
+	}
+	defaults := InferenceParameters{MaxTokens: &config.InferenceMaxTokens, Temperature: &config.InferenceTemperature, TopP: &config.InferenceTopP}
+	if errs := defaults.validate(&config); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid inference defaults: %s", errs)
+	}
+	config.PromptBlocklist, err = loadPromptBlocklist(env.lookup("PROMPT_BLOCKLIST_FILE"),
+		env.bool("PROMPT_BLOCKLIST_CASE_INSENSITIVE", true), env.positiveInt("PROMPT_BLOCKLIST_MAX", 100))
+	if env.err != nil {
+		return nil, env.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if config.H2C && config.TLSEnabled() {
+		return nil, errors.New("H2C can not be combined with TLS, TLS already negotiates HTTP/2")
+	}
+
+	return &config, nil
+}
+
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != ""
+}
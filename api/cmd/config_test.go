@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIntervalsMustBePositive(t *testing.T) {
+	settings := []string{"COST_CHECK_INTERVAL", "IDLE_CHECK_INTERVAL", "INTERRUPTION_CHECK_INTERVAL", "ORPHAN_SCAN_INTERVAL", "WARM_POOL_CHECK_INTERVAL"}
+	values := []struct {
+		value string
+		valid bool
+	}{
+		{"30s", true},
+		{"0s", false},
+		{"-1m", false},
+		{"soon", false},
+	}
+	for _, key := range settings {
+		for _, value := range values {
+			t.Run(key+"="+value.value, func(t *testing.T) {
+				t.Setenv("API_KEY", testAPIKey)
+				t.Setenv(key, value.value)
+				_, err := LoadConfig()
+				if value.valid && err != nil {
+					t.Fatal(err)
+				}
+				if !value.valid && (err == nil || !strings.Contains(err.Error(), key)) {
+					t.Fatalf("got %v, want an error naming %s", err, key)
+				}
+			})
+		}
+	}
+}
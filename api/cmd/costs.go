@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+//// Structure
+
+type CostsResponse struct {
+	ActiveInstances int `json:"active_instances"`
+	ActiveCost float64 `json:"active_cost"` // Accrued by instances that are still running
+	HistoricalCost float64 `json:"historical_cost"` // Accrued by destroyed instances, kept across restarts
+	TotalCost float64 `json:"total_cost"`
+	ByGPUType map[string]float64 `json:"by_gpu_type"`
+}
+
+//// Functionality
+
+// Effective cost cap of a device, the lower of the requested and the global cap (0 means no cap)
+func costCap(requested float64, global float64) float64 {
+	if requested <= 0 || (global > 0 && global < requested) {
+		return global
+	}
+	return requested
+}
+
+// Periodically checks the cost every running instance accrued and stops the ones over their cap
+func (api *APIServer) watchCosts(ctx context.Context) {
+	ticker := time.NewTicker(api.Config().CostCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			api.enforceCostCaps()
+		}
+	}
+}
+
+func (api *APIServer) enforceCostCaps() {
+	now := api.Clock.Now()
+
+	// The stops publish status frames, which must not happen under ComputesMu
+	api.ComputesMu.Lock()
+	compute_states := make([]*ComputeState, 0, len(api.Computes))
+	for _, compute_state := range api.Computes {
+		compute_states = append(compute_states, compute_state)
+	}
+	api.ComputesMu.Unlock()
+
+	for _, compute_state := range compute_states {
+		device_id := compute_state.DeviceID
+		if api.enforceCostCeiling(compute_state, now) {
+			continue
+		}
+
+		compute_state.Mu.Lock()
+		max_cost := costCap(compute_state.MaxCost, api.Config().MaxCost)
+		accrued := compute_state.accruedCost(now)
+		over_cap := compute_state.IsRunning && max_cost > 0 && accrued >= max_cost && compute_state.Status != "cost_cap_reached"
+		if !over_cap {
+			compute_state.Mu.Unlock()
+			continue
+		}
+
+		// Marking the state first keeps the next tick from stopping it twice
+		log.Println("compute reached its cost cap", device_id, accrued, max_cost)
+		compute_state.Status = "cost_cap_reached"
+		frame := compute_state.statusResponse()
+		cancel_provision := compute_state.CancelProvision
+		compute_state.Mu.Unlock()
+
+		api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+		if cancel_provision != nil {
+			cancel_provision()
+		} else {
+			go api.stopMarkedDevice(device_id, "cost_cap_reached")
+		}
+	}
+}
+
+// Force-stops the instance once it accrued its cost ceiling, the lower of the requested and COST_CEILING.
+// Checked on the cost ticker and before every inference, returns true while the ceiling is reached.
+// Caller must not hold state.Mu
+func (api *APIServer) enforceCostCeiling(compute_state *ComputeState, now time.Time) bool {
+	compute_state.Mu.Lock()
+	if compute_state.Status == "cost_ceiling_reached" {
+		compute_state.Mu.Unlock()
+		return true
+	}
+	ceiling := costCap(compute_state.CostCeiling, api.Config().CostCeiling)
+	accrued := compute_state.accruedCost(now)
+	if !compute_state.IsRunning || ceiling <= 0 || accrued < ceiling {
+		compute_state.Mu.Unlock()
+		return false
+	}
+
+	// Marking the state first keeps the ticker and concurrent inference from stopping it twice
+	device_id := compute_state.DeviceID
+	compute_state.Status = "cost_ceiling_reached"
+	frame := compute_state.statusResponse()
+	cancel_provision := compute_state.CancelProvision
+	record := AuditRecord{
+		Action: "cost_ceiling_stop",
+		DeviceID: device_id,
+		Tenant: compute_state.Tenant,
+		InstanceID: compute_state.ID,
+		Detail: map[string]any{"accrued": accrued, "ceiling": ceiling},
+	}
+	compute_state.Mu.Unlock()
+
+	api.audit(record)
+	api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+	if cancel_provision != nil {
+		cancel_provision()
+	} else {
+		go api.stopMarkedDevice(device_id, "cost_ceiling_reached")
+	}
+	return true
+}
+
+// Event bus handler booking the cost of a destroyed instance on its tenant and the history
+func (api *APIServer) settleInstanceCost(event Event) {
+	if stopped, ok := event.(InstanceStopped); ok {
+		api.Usage.AddSpend(stopped.Tenant, usageMonth(api.Clock.Now()), stopped.Cost)
+		api.recordHistoricalCost(stopped.GPUType, stopped.Cost)
+	}
+}
+
+// Adds the cost of a destroyed instance to the persisted history
+func (api *APIServer) recordHistoricalCost(gpu_type string, amount float64) {
+	api.StateMu.Lock()
+	defer api.StateMu.Unlock()
+
+	api.State.HistoricalCost += amount
+	api.State.HistoricalCostByGPU[gpu_type] += amount
+	if err := api.StateStore.Save(api.State); err != nil {
+		log.Println("state store save error", err)
+	}
+}
+
+func (api *APIServer) handleCosts(w http.ResponseWriter, r *http.Request) {
+	response := CostsResponse{ByGPUType: make(map[string]float64)}
+
+	api.StateMu.Lock()
+	response.HistoricalCost = api.State.HistoricalCost
+	for gpu_type, cost := range api.State.HistoricalCostByGPU {
+		response.ByGPUType[gpu_type] += cost
+	}
+	api.StateMu.Unlock()
+
+	now := api.Clock.Now()
+	api.ComputesMu.Lock()
+	for _, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.ID != "" && !compute_state.Attached {
+			accrued := compute_state.accruedCost(now)
+			response.ActiveInstances++
+			response.ActiveCost += accrued
+			response.ByGPUType[compute_state.Spec.GPUType] += accrued
+		}
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	response.TotalCost = response.ActiveCost + response.HistoricalCost
+
+	if err := encodeResponse(w, r, response); err != nil {
+		logWriteError("costs response encoding error", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Makes the device look like it has been running for two hours at a dollar an hour
+func accrueCost(api *APIServer, device_id string) {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	compute_state.CostPerHour = 1
+	compute_state.StartedAt = api.Clock.Now().Add(-2 * time.Hour)
+	compute_state.Mu.Unlock()
+}
+
+func TestCostLimitsStopTheDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		max_cost float64
+		cost_ceiling float64
+		stopped bool
+	}{
+		{"cost cap", 1, 0, true},
+		{"cost ceiling", 0, 1, true},
+		{"under both", 5, 5, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{
+				"device_id": "pi", "run": true, "max_cost": test.max_cost, "cost_ceiling": test.cost_ceiling,
+			}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "ready", func() bool { return deviceStatus(api, "pi") == "ready" })
+			accrueCost(api, "pi")
+
+			api.enforceCostCaps()
+			if !test.stopped {
+				if status := deviceStatus(api, "pi"); status != "ready" {
+					t.Fatalf("device under its limits got %s", status)
+				}
+				return
+			}
+			waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+			if instances, _ := mockProvider(api).ListInstances(context.Background()); len(instances) != 0 {
+				t.Fatalf("%d instances left", len(instances))
+			}
+		})
+	}
+}
+
+// A device a user restarted after the cost check marked it keeps running
+func TestStopMarkedDeviceSkipsChangedDevice(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	api.setStatus("pi", "cost_cap_reached")
+	api.setStatus("pi", "ready")
+	if err := api.stopMarkedDevice("pi", "cost_cap_reached"); err != nil {
+		t.Fatal(err)
+	}
+	if status := deviceStatus(api, "pi"); status != "ready" {
+		t.Fatalf("changed device got %s", status)
+	}
+}
+
+// Within a cent, cost accrues while the test runs
+func closeTo(got float64, want float64) bool {
+	return math.Abs(got-want) < 0.01
+}
+
+func TestCostsAggregate(t *testing.T) {
+	state_file := filepath.Join(t.TempDir(), "state.json")
+	api, server := newTestServer(t, map[string]string{"STATE_FILE": state_file})
+	for device_id, gpu_type := range map[string]string{"pi-1": "RTX_4090", "pi-2": "A100"} {
+		if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": device_id, "run": true, "gpu_type": gpu_type}); status != http.StatusOK {
+			t.Fatalf("start %s: %d %s", device_id, status, body)
+		}
+		waitFor(t, device_id+" ready", func() bool { return deviceStatus(api, device_id) == "ready" })
+		accrueCost(api, device_id)
+	}
+	api.recordHistoricalCost("A100", 3)
+
+	tests := []struct {
+		name string
+		got func(CostsResponse) float64
+		want float64
+	}{
+		{"active", func(costs CostsResponse) float64 { return costs.ActiveCost }, 4},
+		{"historical", func(costs CostsResponse) float64 { return costs.HistoricalCost }, 3},
+		{"total", func(costs CostsResponse) float64 { return costs.TotalCost }, 7},
+		{"RTX_4090", func(costs CostsResponse) float64 { return costs.ByGPUType["RTX_4090"] }, 2},
+		{"A100", func(costs CostsResponse) float64 { return costs.ByGPUType["A100"] }, 5},
+	}
+	status, body := doRequest(t, server, "GET", "/costs", testAPIKey, nil)
+	var costs CostsResponse
+	if err := json.Unmarshal(body, &costs); status != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s", status, body)
+	}
+	if costs.ActiveInstances != 2 {
+		t.Fatalf("%d active instances, want 2", costs.ActiveInstances)
+	}
+	for _, test := range tests {
+		if got := test.got(costs); !closeTo(got, test.want) {
+			t.Errorf("%s cost %.2f, want %.2f", test.name, got, test.want)
+		}
+	}
+
+	// The historical total outlives the server
+	restarted, err := NewStateStore(state_file).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closeTo(restarted.HistoricalCost, 3) {
+		t.Fatalf("persisted historical cost %.2f, want 3", restarted.HistoricalCost)
+	}
+}
+
+// A fake clock drives the accrued cost to the ceiling, the cost ticker or the next inference stops the device
+func TestCostCeilingAutoStop(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		cost_ceiling float64
+		hours time.Duration
+		check string // "ticker" or "inference"
+		stopped bool
+	}{
+		{"ticker", nil, 2, 3, "ticker", true},
+		{"inference", nil, 2, 3, "inference", true},
+		{"configured ceiling below the requested", map[string]string{"COST_CEILING": "2"}, 5, 3, "ticker", true},
+		{"under the ceiling", nil, 2, 1, "inference", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			clock := useFakeClock(t, api)
+			statuses := recordStatuses(api, "pi")
+			logs := captureLog(t)
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true, "cost_ceiling": test.cost_ceiling}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "ready", func() bool { return deviceStatus(api, "pi") == "ready" })
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			compute_state.CostPerHour = 1
+			compute_state.Mu.Unlock()
+			clock.Advance(test.hours * time.Hour)
+
+			switch test.check {
+			case "ticker":
+				api.enforceCostCaps()
+			case "inference":
+				status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+				want := http.StatusOK
+				if test.stopped {
+					want = http.StatusConflict
+				}
+				if status != want {
+					t.Fatalf("inference: %d %s, want %d", status, body, want)
+				}
+			}
+			if !test.stopped {
+				if status := deviceStatus(api, "pi"); status != "ready" {
+					t.Fatalf("device under its ceiling got %s", status)
+				}
+				return
+			}
+			waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+			if ids := instanceIDs(t, api); len(ids) != 0 {
+				t.Fatalf("instances %v left", ids)
+			}
+			if !slices.Contains(statuses(), "cost_ceiling_reached") {
+				t.Fatalf("no cost_ceiling_reached frame in %v", statuses())
+			}
+			if !strings.Contains(logs.String(), `"cost_ceiling_stop"`) {
+				t.Fatalf("no audit record:\n%s", logs)
+			}
+		})
+	}
+}
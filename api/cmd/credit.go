@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+//// Structure
+
+// Implemented by providers that can report the credit left on the account, lets the server refuse
+// provisionings the provider would reject for lack of funds anyway
+type CreditProvider interface {
+	Credit(ctx context.Context) (float64, error)
+}
+
+// Last credit reading, reused for PROVIDER_CREDIT_CACHE so every start doesn't cost a provider call
+type creditCache struct {
+	credit float64
+	read_at time.Time
+}
+
+//// Functionality
+
+var ErrCreditUnsupported = errors.New("provider can't report credit")
+
+func providerCredit(ctx context.Context, provider ComputeProvider) (float64, error) {
+	reporting, ok := provider.(CreditProvider)
+	if !ok {
+		return 0, ErrCreditUnsupported
+	}
+	return reporting.Credit(ctx)
+}
+
+// Credit of the provider account, cached for PROVIDER_CREDIT_CACHE
+func (api *APIServer) cachedCredit(ctx context.Context) (float64, error) {
+	now := api.Clock.Now()
+	api.credit_mu.Lock()
+	defer api.credit_mu.Unlock()
+
+	if !api.credit.read_at.IsZero() && now.Sub(api.credit.read_at) < api.Config().ProviderCreditCache {
+		return api.credit.credit, nil
+	}
+	credit, err := providerCredit(ctx, api.Provider)
+	if err != nil {
+		return 0, err
+	}
+	api.credit = creditCache{credit: credit, read_at: now}
+	return credit, nil
+}
+
+// Answers 402 insufficient_quota and returns true if the provider account holds less than
+// PROVIDER_MIN_CREDIT. Providers that can't report credit, and failed readings, let the start
+// through, the provider still refuses it if it really can't be paid for
+func (api *APIServer) rejectWithoutCredit(w http.ResponseWriter, r *http.Request) bool {
+	min_credit := api.Config().ProviderMinCredit
+	if min_credit <= 0 {
+		return false
+	}
+
+	credit, err := api.cachedCredit(r.Context())
+	if err != nil {
+		if !errors.Is(err, ErrCreditUnsupported) {
+			log.Println("provider credit check error", err)
+		}
+		return false
+	}
+	if credit >= min_credit {
+		return false
+	}
+	log.Println("rejecting start, provider credit too low", credit, min_credit)
+	writeError(w, r, http.StatusPaymentRequired, "insufficient_quota", fmt.Sprintf("provider credit %.2f is below %.2f", credit, min_credit))
+	return true
+}
+
+// Credit of the account VastAI reports for the api key
+func (p *VastAIProvider) Credit(ctx context.Context) (float64, error) {
+	var user struct {
+		Credit float64 `json:"credit"`
+	}
+	if err := p.do(ctx, "GET", "/users/current/", nil, &user); err != nil {
+		return 0, err
+	}
+	return user.Credit, nil
+}
+
+// The richest account, MultiProvider fails a start over to the next account so one that can pay is enough
+func (p *MultiProvider) Credit(ctx context.Context) (float64, error) {
+	p.mu.Lock()
+	accounts := append([]*providerAccount(nil), p.accounts...)
+	p.mu.Unlock()
+
+	best := math.Inf(-1)
+	var last_err error
+	for _, account := range accounts {
+		credit, err := providerCredit(ctx, account.provider)
+		if err != nil {
+			last_err = err
+			continue
+		}
+		best = max(best, credit)
+	}
+	if math.IsInf(best, -1) {
+		return 0, last_err
+	}
+	return best, nil
+}
+
+// Credit support is checked on the wrapped provider, so wrapping never hides or adds it
+func (p tracedProvider) Credit(ctx context.Context) (credit float64, err error) {
+	ctx, span := tracer.Start(ctx, "provider.credit")
+	defer func() { endSpan(span, err) }()
+	return providerCredit(ctx, p.ComputeProvider)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProviderCreditCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		credit float64
+		status int
+	}{
+		{"no credit", map[string]string{"PROVIDER_MIN_CREDIT": "5"}, 0, http.StatusPaymentRequired},
+		{"below the minimum", map[string]string{"PROVIDER_MIN_CREDIT": "5"}, 4.99, http.StatusPaymentRequired},
+		{"enough credit", map[string]string{"PROVIDER_MIN_CREDIT": "5"}, 5, http.StatusOK},
+		{"check disabled", nil, 0, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			mock := mockProvider(api)
+			mock.SetCredit(test.credit)
+
+			status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true})
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status != http.StatusPaymentRequired {
+				return
+			}
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); err != nil || response.Error != "insufficient_quota" {
+				t.Fatalf("got %s, want insufficient_quota", body)
+			}
+			// Refused before the provider was asked for an instance
+			if ids := instanceIDs(t, api); len(ids) != 0 {
+				t.Fatalf("instances %v rented", ids)
+			}
+		})
+	}
+}
+
+// A reading is reused for PROVIDER_CREDIT_CACHE
+func TestProviderCreditCache(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"PROVIDER_MIN_CREDIT": "5", "PROVIDER_CREDIT_CACHE": "1m"})
+	clock := useFakeClock(t, api)
+	mock := mockProvider(api)
+	tests := []struct {
+		name string
+		credit float64
+		advance bool // Past the cache lifetime before the start
+		status int
+	}{
+		{"first reading", 10, false, http.StatusOK},
+		{"cached", 0, false, http.StatusOK},
+		{"expired", 0, true, http.StatusPaymentRequired},
+		{"cached refusal", 10, false, http.StatusPaymentRequired},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock.SetCredit(test.credit)
+			if test.advance {
+				clock.Advance(api.Config().ProviderCreditCache)
+			}
+			device_id := string(rune('a' + i))
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": device_id, "run": true}); status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+//// Structure
+
+// Friendly name of a device, kept in the persisted state with the tenant that set it
+type DeviceLabel struct {
+	Label string `json:"label"`
+	Tenant string `json:"tenant"`
+}
+
+type DeviceLabelRequest struct {
+	Label *string `json:"label"` // Empty removes the label
+}
+
+type DeviceResponse struct {
+	DeviceID string `json:"device_id"`
+	Label string `json:"label,omitempty"`
+	Status string `json:"status"`
+}
+
+//// Functionality
+
+const maxDeviceLabelLength = 64
+
+// Trimmed label, false if it's too long or holds control characters
+func normalizeDeviceLabel(label string) (string, bool) {
+	label = strings.TrimSpace(label)
+	if utf8.RuneCountInString(label) > maxDeviceLabelLength {
+		return "", false
+	}
+	return label, strings.IndexFunc(label, unicode.IsControl) == -1
+}
+
+// Label of the device, empty if it has none
+func (api *APIServer) deviceLabel(device_id string) string {
+	api.StateMu.Lock()
+	defer api.StateMu.Unlock()
+	return api.State.DeviceLabels[device_id].Label
+}
+
+// POST {"label": "..."} names the device, the tenant labelling a device first owns its label and
+// other tenants can't change it. An empty label removes it
+func (api *APIServer) handleDeviceLabel(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+	tenant := tenantFromContext(r.Context())
+
+	var request DeviceLabelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Label == nil {
+		http.Error(w, "invalid label request body", http.StatusBadRequest)
+		return
+	}
+	label, ok := normalizeDeviceLabel(*request.Label)
+	if !ok {
+		http.Error(w, "label must be at most 64 printable characters", http.StatusBadRequest)
+		return
+	}
+
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	owner := compute_state.Tenant
+	compute_state.Mu.Unlock()
+
+	api.StateMu.Lock()
+	if owner == "" {
+		owner = api.State.DeviceLabels[device_id].Tenant
+	}
+	if owner != "" && owner != tenant.Name && tenant.Role != roleAdmin {
+		api.StateMu.Unlock()
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+	if owner == "" {
+		owner = tenant.Name
+	}
+	if label == "" {
+		delete(api.State.DeviceLabels, device_id)
+	} else {
+		api.State.DeviceLabels[device_id] = DeviceLabel{Label: label, Tenant: owner}
+	}
+	if err := api.StateStore.Save(api.State); err != nil {
+		log.Println("state store save error", err)
+	}
+	api.StateMu.Unlock()
+
+	compute_state.Mu.Lock()
+	compute_state.Label = label
+	status := compute_state.Status
+	frame := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+	api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+	api.audit(AuditRecord{Action: "device_label", DeviceID: device_id, Tenant: tenant.Name, Detail: map[string]any{"label": label}})
+
+	if err := encodeResponse(w, r, DeviceResponse{DeviceID: device_id, Label: label, Status: status}); err != nil {
+		logWriteError("device response encoding error", err)
+	}
+}
+
+// Devices of the tenant with their labels and status, admins see every device. Labelled devices
+// without a compute since the last restart are listed as idle
+func (api *APIServer) handleDevices(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	visible := func(owner string) bool {
+		return tenant.Role == roleAdmin || owner == tenant.Name
+	}
+
+	devices := []DeviceResponse{}
+	listed := make(map[string]bool)
+	api.ComputesMu.Lock()
+	for device_id, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		owner, label, status := compute_state.Tenant, compute_state.Label, compute_state.Status
+		compute_state.Mu.Unlock()
+		if owner == "" && label != "" {
+			owner = api.deviceLabelOwner(device_id)
+		}
+		if visible(owner) {
+			devices = append(devices, DeviceResponse{DeviceID: device_id, Label: label, Status: status})
+		}
+		listed[device_id] = true
+	}
+	api.ComputesMu.Unlock()
+
+	api.StateMu.Lock()
+	for device_id, label := range api.State.DeviceLabels {
+		if !listed[device_id] && visible(label.Tenant) {
+			devices = append(devices, DeviceResponse{DeviceID: device_id, Label: label.Label, Status: "idle"})
+		}
+	}
+	api.StateMu.Unlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+
+	if err := encodeResponse(w, r, devices); err != nil {
+		logWriteError("devices response encoding error", err)
+	}
+}
+
+// Tenant that labelled the device, empty if it has no label
+func (api *APIServer) deviceLabelOwner(device_id string) string {
+	api.StateMu.Lock()
+	defer api.StateMu.Unlock()
+	return api.State.DeviceLabels[device_id].Tenant
+}
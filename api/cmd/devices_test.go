@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDeviceLabels(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+	tests := []struct {
+		name string
+		device_id string
+		label any
+		status int
+		want string // Label of the device afterwards
+	}{
+		{"set", "pi", "Kitchen Pi", http.StatusOK, "Kitchen Pi"},
+		{"overwritten", "pi", "  Garage Pi ", http.StatusOK, "Garage Pi"},
+		{"device that never ran", "spare", "Spare", http.StatusOK, "Spare"},
+		{"too long", "pi", strings.Repeat("a", maxDeviceLabelLength+1), http.StatusBadRequest, "Garage Pi"},
+		{"control characters", "pi", "Garage\nPi", http.StatusBadRequest, "Garage Pi"},
+		{"missing", "pi", nil, http.StatusBadRequest, "Garage Pi"},
+		{"removed", "spare", "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := map[string]any{}
+			if test.label != nil {
+				body["label"] = test.label
+			}
+			status, response := doRequest(t, server, "POST", "/devices/"+test.device_id+"/label", testAPIKey, body)
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, response, test.status)
+			}
+			if label := api.deviceLabel(test.device_id); label != test.want {
+				t.Fatalf("label %q, want %q", label, test.want)
+			}
+		})
+	}
+
+	t.Run("listed", func(t *testing.T) {
+		doRequest(t, server, "POST", "/devices/spare/label", testAPIKey, map[string]any{"label": "Spare"})
+		status, body := doRequest(t, server, "GET", "/devices", testAPIKey, nil)
+		var devices []DeviceResponse
+		if err := json.Unmarshal(body, &devices); status != http.StatusOK || err != nil {
+			t.Fatalf("got %d %s", status, body)
+		}
+		want := []DeviceResponse{{DeviceID: "pi", Label: "Garage Pi", Status: "ready"}, {DeviceID: "spare", Label: "Spare", Status: "idle"}}
+		if !slices.Equal(devices, want) {
+			t.Fatalf("devices %+v, want %+v", devices, want)
+		}
+	})
+
+	t.Run("in the status", func(t *testing.T) {
+		status, body := doRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+		var response StatusResponse
+		if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || response.Label != "Garage Pi" {
+			t.Fatalf("got %d %s, want the label", status, body)
+		}
+	})
+}
+
+// Labels survive a restart through the state store
+func TestDeviceLabelsPersisted(t *testing.T) {
+	state_file := filepath.Join(t.TempDir(), "state.json")
+	api, server := newTestServer(t, map[string]string{"STATE_FILE": state_file})
+	if status, body := doRequest(t, server, "POST", "/devices/pi/label", testAPIKey, map[string]any{"label": "Kitchen Pi"}); status != http.StatusOK {
+		t.Fatalf("label: %d %s", status, body)
+	}
+	if label := api.deviceLabel("pi"); label != "Kitchen Pi" {
+		t.Fatalf("label %q before the restart", label)
+	}
+
+	restarted, _ := newTestServer(t, map[string]string{"STATE_FILE": state_file})
+	if label := restarted.deviceLabel("pi"); label != "Kitchen Pi" {
+		t.Fatalf("label %q after the restart", label)
+	}
+}
+
+// The tenant labelling a device first owns the label
+func TestDeviceLabelOwnership(t *testing.T) {
+	_, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "admin", APIKey: testAPIKey, Role: roleAdmin},
+		Tenant{Name: "alice", APIKey: "alice-key"},
+		Tenant{Name: "bob", APIKey: "bob-key"},
+	)})
+	tests := []struct {
+		name string
+		key string
+		status int
+	}{
+		{"first label", "alice-key", http.StatusOK},
+		{"owner relabels", "alice-key", http.StatusOK},
+		{"other tenant", "bob-key", http.StatusNotFound},
+		{"admin", testAPIKey, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := doRequest(t, server, "POST", "/devices/pi/label", test.key, map[string]any{"label": test.name}); status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+		})
+	}
+
+	for key, want := range map[string]int{"alice-key": 1, "bob-key": 0, testAPIKey: 1} {
+		status, body := doRequest(t, server, "GET", "/devices", key, nil)
+		var devices []DeviceResponse
+		if err := json.Unmarshal(body, &devices); status != http.StatusOK || err != nil || len(devices) != want {
+			t.Fatalf("%s listed %d %s, want %d devices", key, status, body, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+//// Functionality
+
+// Counts an inference against the instance of the device if it still takes inference, caller must
+// hold Mu. A reaper that decided to stop the instance changed its status first, so every inference
+// it has to wait for is counted once it takes Mu
+func (state *ComputeState) beginInference() bool {
+	if state.Status != "ready" || !state.AcceptingInference {
+		return false
+	}
+	state.Inferences++
+	return true
+}
+
+// Releases an inference counted by beginInference, waking a reaper waiting for the last one
+func (api *APIServer) endInference(device_id string) {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	defer compute_state.Mu.Unlock()
+
+	compute_state.Inferences--
+	if compute_state.Inferences == 0 && compute_state.inferences_done != nil {
+		close(compute_state.inferences_done)
+		compute_state.inferences_done = nil
+	}
+}
+
+// Waits for the in-flight inferences of a device that no longer takes new ones, at most timeout.
+// Past the timeout the instance is stopped regardless and the remaining inferences fail
+func (api *APIServer) awaitInferences(device_id string, timeout time.Duration) {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	in_flight := compute_state.Inferences
+	if in_flight == 0 || timeout <= 0 {
+		compute_state.Mu.Unlock()
+		return
+	}
+	if compute_state.inferences_done == nil {
+		compute_state.inferences_done = make(chan struct{})
+	}
+	done := compute_state.inferences_done
+	compute_state.Mu.Unlock()
+
+	log.Println("waiting for in-flight inferences before stopping", device_id, in_flight)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		compute_state.Mu.Lock()
+		in_flight = compute_state.Inferences
+		compute_state.Mu.Unlock()
+		log.Println("inference drain timed out, stopping anyway", device_id, in_flight)
+	}
+}
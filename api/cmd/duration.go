@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+//// Structure
+
+// Duration of a response field, encoded as seconds like "1.234s" from a second on and as
+// milliseconds like "12.345ms" below, so clients can parse it with any Go style duration parser.
+// Decoding accepts any time.ParseDuration string
+type Duration time.Duration
+
+//// Functionality
+
+func (d Duration) String() string {
+	if duration := time.Duration(d); duration.Abs() < time.Second {
+		return strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', 3, 64) + "ms"
+	}
+	return strconv.FormatFloat(time.Duration(d).Seconds(), 'f', 3, 64) + "s"
+}
+
+// Used for json and msgpack alike
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestDurationEncoding(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		encoded string
+		decoded time.Duration // What a client reads back, cut to the encoded precision
+	}{
+		{0, "0.000ms", 0},
+		{12345678 * time.Nanosecond, "12.346ms", 12346 * time.Microsecond},
+		{999 * time.Millisecond, "999.000ms", 999 * time.Millisecond},
+		{time.Second, "1.000s", time.Second},
+		{1234567 * time.Microsecond, "1.235s", 1235 * time.Millisecond},
+		{90 * time.Minute, "5400.000s", 90 * time.Minute},
+		{-250 * time.Millisecond, "-250.000ms", -250 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.encoded, func(t *testing.T) {
+			if got := Duration(test.duration).String(); got != test.encoded {
+				t.Fatalf("encoded as %q, want %q", got, test.encoded)
+			}
+
+			response := InferenceResponse{Latency: Duration(test.duration)}
+			data, err := json.Marshal(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded InferenceResponse
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if time.Duration(decoded.Latency) != test.decoded {
+				t.Fatalf("json round trip %s gave %s, want %s", data, time.Duration(decoded.Latency), test.decoded)
+			}
+
+			data, err = msgpack.Marshal(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded = InferenceResponse{}
+			if err := msgpack.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if time.Duration(decoded.Latency) != test.decoded {
+				t.Fatalf("msgpack round trip gave %s, want %s", time.Duration(decoded.Latency), test.decoded)
+			}
+		})
+	}
+}
+
+func TestDurationDecoding(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+		valid bool
+	}{
+		{`"1.5s"`, 1500 * time.Millisecond, true},
+		{`"2m"`, 2 * time.Minute, true},
+		{`"750us"`, 750 * time.Microsecond, true},
+		{`"soon"`, 0, false},
+		{`1.5`, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			var d Duration
+			err := json.Unmarshal([]byte(test.text), &d)
+			if (err == nil) != test.valid {
+				t.Fatalf("error %v, want valid %v", err, test.valid)
+			}
+			if time.Duration(d) != test.want {
+				t.Fatalf("decoded %s, want %s", time.Duration(d), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+//// Structure
+
+// State transition published on the event bus, handlers switch on the concrete type
+type Event interface {
+	eventType() string
+}
+
+// Every status change of a device, with the frame the websocket and SSE subscribers get
+type StatusChanged struct {
+	DeviceID string
+	Frame StatusResponse
+}
+
+// A new instance is being rented for the device
+type InstanceStarting struct {
+	DeviceID string
+	Spec InstanceSpec
+}
+
+// The instance of the device came up and its inference server answers
+type InstanceReady struct {
+	DeviceID string
+	InstanceID string
+	Reused bool // A resumed paused instance or a warm pool claim rather than a freshly rented one
+}
+
+// The instance of the device was destroyed, Cost is what it accrued over its lifetime
+type InstanceStopped struct {
+	DeviceID string
+	InstanceID string
+	Tenant string
+	GPUType string
+	Cost float64
+}
+
+// The provider reclaimed the interruptible instance of the device
+type InstanceInterrupted struct {
+	DeviceID string
+	InstanceID string
+}
+
+// An inference request finished, Err is nil when it succeeded
+type InferenceCompleted struct {
+	DeviceID string
+	Latency time.Duration
+	Err error
+}
+
+// In process pub/sub for state transitions. Handlers run synchronously on the publishing
+// goroutine in subscription order, so they see events in the order they happened and must not block
+type EventBus struct {
+	handlers []func(Event)
+	mu sync.RWMutex
+}
+
+//// Functionality
+
+func (StatusChanged) eventType() string { return "status_changed" }
+func (InstanceStarting) eventType() string { return "instance_starting" }
+func (InstanceReady) eventType() string { return "instance_ready" }
+func (InstanceStopped) eventType() string { return "instance_stopped" }
+func (InstanceInterrupted) eventType() string { return "instance_interrupted" }
+func (InferenceCompleted) eventType() string { return "inference_completed" }
+
+func (bus *EventBus) Subscribe(handler func(Event)) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.handlers = append(bus.handlers, handler)
+}
+
+func (bus *EventBus) Publish(event Event) {
+	bus.mu.RLock()
+	handlers := bus.handlers
+	bus.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// Wires the features that react to state transitions, run once at startup
+func (api *APIServer) subscribeEventHandlers() {
+	api.Events.Subscribe(api.fanOutStatus)
+	api.Events.Subscribe(api.settleInstanceCost)
+	api.Events.Subscribe(recordEventMetrics)
+	api.Events.Subscribe(api.wakeInferenceQueue)
+	api.Events.Subscribe(api.recordEventStats)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestEventBusFanOut(t *testing.T) {
+	tests := []struct {
+		name string
+		subscribers int
+		event Event
+	}{
+		{"no subscribers", 0, InstanceReady{DeviceID: "pi"}},
+		{"one subscriber", 1, InstanceStarting{DeviceID: "pi"}},
+		{"several subscribers", 3, InstanceStopped{DeviceID: "pi", Cost: 0.5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bus EventBus
+			var order []int
+			received := make([]Event, test.subscribers)
+			for i := range test.subscribers {
+				bus.Subscribe(func(event Event) {
+					received[i] = event
+					order = append(order, i)
+				})
+			}
+			bus.Publish(test.event)
+			for i, event := range received {
+				if event != test.event {
+					t.Fatalf("subscriber %d got %#v, want %#v", i, event, test.event)
+				}
+			}
+			if !slices.IsSorted(order) || len(order) != test.subscribers {
+				t.Fatalf("handlers ran in order %v", order)
+			}
+		})
+	}
+}
+
+// Starting and stopping a device publishes its transitions in the order they happened
+func TestLifecycleEvents(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	var mu sync.Mutex
+	var events []string
+	api.Events.Subscribe(func(event Event) {
+		if _, ok := event.(StatusChanged); ok {
+			return
+		}
+		mu.Lock()
+		events = append(events, event.eventType())
+		mu.Unlock()
+	})
+
+	startDevice(t, api, server, testAPIKey, "pi")
+	if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"}); status != http.StatusOK {
+		t.Fatalf("inference: %d %s", status, body)
+	}
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+	want := []string{"instance_starting", "instance_ready", "inference_completed", "instance_stopped"}
+	waitFor(t, "the stop event", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Equal(events, want)
+	})
+}
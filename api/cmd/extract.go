@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//// Structure
+
+// Location of the generated text in a backend response, e.g. choices.0.text for OpenAI completions,
+// choices.0.message.content for chat completions or 0.generated_text for TGI
+type responsePath []string
+
+//// Functionality
+
+// Parses a dotted path, JSONPath style "$.choices[0].text" is accepted too
+func parseResponsePath(path string) (responsePath, error) {
+	trimmed := strings.ReplaceAll(strings.ReplaceAll(strings.TrimPrefix(path, "$"), "[", "."), "]", "")
+	trimmed = strings.TrimPrefix(trimmed, ".")
+	segments := strings.Split(trimmed, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid response path %q", path)
+		}
+	}
+	return segments, nil
+}
+
+func (path responsePath) String() string {
+	return strings.Join(path, ".")
+}
+
+// Value at the path, false if the document doesn't have it. Numeric segments index arrays
+func (path responsePath) lookup(document any) (any, bool) {
+	current := document
+	for _, segment := range path {
+		switch node := current.(type) {
+		case map[string]any:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Decodes the json response and returns the text at the path, false if the response has none
+func (path responsePath) extract(body io.Reader) (string, bool, error) {
+	var document any
+	if err := json.NewDecoder(body).Decode(&document); err != nil {
+		return "", false, err
+	}
+	value, ok := path.lookup(document)
+	if !ok || value == nil {
+		return "", false, nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", false, fmt.Errorf("backend: %s is a %T, not text", path, value)
+	}
+	return text, true, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseResponsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want responsePath // nil when the path is rejected
+	}{
+		{"choices.0.text", responsePath{"choices", "0", "text"}},
+		{"$.choices[0].message.content", responsePath{"choices", "0", "message", "content"}},
+		{".output.text", responsePath{"output", "text"}},
+		{"$[0].generated_text", responsePath{"0", "generated_text"}},
+		{"", nil},
+		{"choices..text", nil},
+		{"choices.", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			path, err := parseResponsePath(test.path)
+			if (err != nil) != (test.want == nil) {
+				t.Fatalf("error %v, want rejected %v", err, test.want == nil)
+			}
+			if !slices.Equal(path, test.want) {
+				t.Fatalf("parsed %q, want %q", path, test.want)
+			}
+		})
+	}
+}
+
+// The same backend client maps differently shaped responses through the configured path
+func TestResponsePathMapping(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		want string
+		ok bool
+		valid bool
+	}{
+		{"openai completions", "choices.0.text", `{"choices":[{"text":"hello"}]}`, "hello", true, true},
+		{"chat completions", "$.choices[0].message.content", `{"choices":[{"message":{"role":"assistant","content":"hi there"}}]}`, "hi there", true, true},
+		{"tgi", "0.generated_text", `[{"generated_text":"from tgi"}]`, "from tgi", true, true},
+		{"missing field", "choices.0.text", `{"choices":[{"message":{"content":"chat"}}]}`, "", false, true},
+		{"index out of range", "choices.1.text", `{"choices":[{"text":"only one"}]}`, "", false, true},
+		{"null text", "output.text", `{"output":{"text":null}}`, "", false, true},
+		{"not text", "usage.total_tokens", `{"usage":{"total_tokens":12}}`, "", false, false},
+		{"not json", "choices.0.text", `<html></html>`, "", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := parseResponsePath(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, ok, err := path.extract(strings.NewReader(test.body))
+			if (err == nil) != test.valid {
+				t.Fatalf("error %v, want valid %v", err, test.valid)
+			}
+			if text != test.want || ok != test.ok {
+				t.Fatalf("got %q %v, want %q %v", text, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+// Completions from two backends answering in different formats come back as the same text
+func TestBackendResponseFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"completions", "choices.0.text", `{"id":"cmpl-1","choices":[{"index":0,"text":"mapped"}]}`},
+		{"custom server", "result.outputs[0].text", `{"result":{"outputs":[{"text":"mapped","tokens":1}]}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(test.body))
+			}))
+			defer instance.Close()
+			path, err := parseResponsePath(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			backend := NewOpenAIBackend("model", "/health", 0, "Authorization", "", path, nil)
+			text, err := backend.Complete(context.Background(), strings.TrimPrefix(instance.URL, "http://"), InferenceRequest{Prompt: "hi"})
+			if err != nil || text != "mapped" {
+				t.Fatalf("got %q %v, want mapped", text, err)
+			}
+
+			// The other format's path finds nothing in this response
+			other := responsePath{"choices", "0", "text"}
+			if slices.Equal(path, other) {
+				other = responsePath{"result", "outputs", "0", "text"}
+			}
+			backend = NewOpenAIBackend("model", "/health", 0, "Authorization", "", other, nil)
+			if _, err := backend.Complete(context.Background(), strings.TrimPrefix(instance.URL, "http://"), InferenceRequest{Prompt: "hi"}); err == nil || !strings.Contains(err.Error(), "completion without text") {
+				t.Fatalf("error %v, want a completion without text", err)
+			}
+		})
+	}
+}
+
+// Streamed chunks without text at the path, like the role and finish chunks of a chat stream, are skipped
+func TestBackendStreamPath(t *testing.T) {
+	chunks := []string{
+		`{"choices":[{"delta":{"role":"assistant"}}]}`,
+		`{"choices":[{"delta":{"content":"hel"}}]}`,
+		`{"choices":[{"delta":{"content":"lo"}}]}`,
+		`{"choices":[{"delta":{},"finish_reason":"stop"}]}`,
+	}
+	instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer instance.Close()
+	path, err := parseResponsePath("$.choices[0].delta.content")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewOpenAIBackend("model", "/health", 0, "Authorization", "", nil, path)
+	var tokens []string
+	err = backend.Stream(context.Background(), strings.TrimPrefix(instance.URL, "http://"), InferenceRequest{Prompt: "hi"}, func(token string) error {
+		tokens = append(tokens, token)
+		return nil
+	})
+	if err != nil || !slices.Equal(tokens, []string{"hel", "lo"}) {
+		t.Fatalf("got %q %v, want the two content tokens", tokens, err)
+	}
+}
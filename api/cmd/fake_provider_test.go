@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"RASBERRY_api/testsupport/providertest"
+)
+
+// The exported fake drives the server like any provider
+func TestFakeProviderServer(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	fake := providertest.NewFakeProvider()
+	api.Provider = tracedProvider{fake}
+
+	startDevice(t, api, server, testAPIKey, "pi")
+	instance_id := instanceID(api, "pi")
+	if info, ok := fake.Instance(instance_id); !ok || info.Status != "running" {
+		t.Fatalf("fake instance %s: %+v", instance_id, info)
+	}
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+	waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+	if _, ok := fake.Instance(instance_id); ok {
+		t.Fatal("instance still rented after the stop")
+	}
+	if fake.Calls("create") != 1 || fake.Calls("destroy") != 1 {
+		t.Fatalf("%d creates and %d destroys", fake.Calls("create"), fake.Calls("destroy"))
+	}
+}
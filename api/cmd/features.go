@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+//// Structure
+
+// Experimental behaviours a client opted into for a single request through X-Features
+type featureSet map[string]bool
+
+//// Functionality
+
+const featuresContextKey contextKey = "features"
+
+// Flags clients may send, the rest are ignored
+var knownFeatures = map[string]bool{
+	"skip_warmup": true, // /control provisions without sending BACKEND_WARMUP_PROMPT, inference is accepted once ready
+}
+
+func (features featureSet) enabled(name string) bool {
+	return features[name]
+}
+
+func requestFeatures(ctx context.Context) featureSet {
+	features, _ := ctx.Value(featuresContextKey).(featureSet)
+	return features
+}
+
+// Parses the comma separated X-Features header into the feature set of the request, flags are case
+// insensitive so clients don't break on capitalization
+func (api *APIServer) featuresMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Features")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		features := featureSet{}
+		for _, flag := range strings.Split(header, ",") {
+			flag = strings.ToLower(strings.TrimSpace(flag))
+			if flag == "" {
+				continue
+			}
+			if !knownFeatures[flag] {
+				api.debugLog("ignoring unknown feature flag", flag, r.Method, r.URL.Path)
+				continue
+			}
+			features[flag] = true
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), featuresContextKey, features)))
+	})
+}
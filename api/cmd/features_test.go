@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// skip_warmup lets inference in as soon as the instance is ready, without waiting on the warmup prompt
+func TestFeatureHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		header string
+		skipped bool
+		ignored string // Flag logged as unknown
+	}{
+		{"no header", "", false, ""},
+		{"skip_warmup", "skip_warmup", true, ""},
+		{"case insensitive", " Skip_Warmup ", true, ""},
+		{"among unknown flags", "turbo,skip_warmup,", true, "turbo"},
+		{"only unknown flags", "turbo", false, "turbo"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"BACKEND_WARMUP_PROMPT": testWarmupPrompt, "LOG_DEBUG": "true"})
+			backend := &warmupBackend{InferenceBackend: api.Backend, release: make(chan struct{})}
+			api.Backend = backend
+			defer close(backend.release)
+			logs := captureLog(t)
+
+			request := newRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true})
+			if test.header != "" {
+				request.Header.Set("X-Features", test.header)
+			}
+			if response, body := sendRequest(t, request); response.StatusCode != http.StatusOK {
+				t.Fatalf("start: %d %s", response.StatusCode, body)
+			}
+			waitFor(t, "the instance to be ready", func() bool { return deviceStatus(api, "pi") == "ready" })
+
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hello"})
+			if test.skipped {
+				if status != http.StatusOK {
+					t.Fatalf("got %d %s, want 200 without the warmup", status, body)
+				}
+			} else {
+				var response ErrorResponse
+				if err := json.Unmarshal(body, &response); status != http.StatusServiceUnavailable || err != nil || response.Error != "compute_warming_up" {
+					t.Fatalf("got %d %s, want 503 compute_warming_up", status, body)
+				}
+			}
+			if logged := strings.Contains(logs.String(), "ignoring unknown feature flag "+test.ignored); test.ignored != "" && !logged {
+				t.Fatalf("unknown flag %s not logged:\n%s", test.ignored, logs.String())
+			}
+		})
+	}
+}
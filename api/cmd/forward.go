@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//// Structure
+
+// Returned by the backend for a non 200 answer, Body is the start of what it sent along
+type BackendStatusError struct {
+	Status int
+	Body string
+}
+
+// Returned when the backend answered 200 with something other than a completion, e.g. the html
+// page of a proxy in front of the model server
+type BackendBodyError struct {
+	ContentType string
+	Body string // Truncated to backendBodySnippet bytes
+}
+
+//// Functionality
+
+func (e *BackendStatusError) Error() string {
+	return fmt.Sprintf("backend: unexpected status %d", e.Status)
+}
+
+func (e *BackendBodyError) Error() string {
+	return fmt.Sprintf("backend: unexpected %s response: %s", e.ContentType, e.Body)
+}
+
+// How much of an unexpected backend body is kept for logs and clients
+const backendBodySnippet = 512
+
+// Start of the body, cut to backendBodySnippet bytes without splitting a character
+func readBodySnippet(body io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(body, backendBodySnippet))
+	return strings.ToValidUTF8(strings.TrimSpace(string(data)), "")
+}
+
+// First wait between forwarding attempts, doubled after every attempt
+const inferenceRetryBackoff = 100 * time.Millisecond
+
+// Reports whether another attempt may succeed: the backend being briefly unavailable, a dropped
+// connection or a single attempt running out of time. parent is the context of the whole forwarding
+func isTransientBackendError(parent context.Context, err error) bool {
+	if parent.Err() != nil {
+		return false
+	}
+	var status_err *BackendStatusError
+	if errors.As(err, &status_err) {
+		return status_err.Status == http.StatusBadGateway || status_err.Status == http.StatusServiceUnavailable || status_err.Status == http.StatusGatewayTimeout
+	}
+	var net_err net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &net_err)
+}
+
+// Forwards the request to the backend, retrying transient errors up to INFERENCE_MAX_ATTEMPTS times.
+// Each attempt is bounded by INFERENCE_TRY_TIMEOUT and all of them together by the timeout of the
+// request, INFERENCE_DEADLINE without one, or the deadline of ctx, whichever comes first
+func (api *APIServer) forwardInference(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	config := api.Config()
+	ctx, cancel := context.WithTimeout(ctx, request.timeout(config.InferenceDeadline))
+	defer cancel()
+
+	backoff := inferenceRetryBackoff
+	for attempt := 1; ; attempt++ {
+		try_ctx, cancel_try := context.WithTimeout(ctx, config.InferenceTryTimeout)
+		completion, err := api.Backend.Complete(try_ctx, endpoint, request)
+		cancel_try()
+		if err == nil || attempt == config.InferenceMaxAttempts || !isTransientBackendError(ctx, err) {
+			return completion, err
+		}
+
+		if deadline, _ := ctx.Deadline(); time.Now().Add(backoff).After(deadline) {
+			return "", err
+		}
+		log.Println("retrying inference after transient error", request.DeviceID, attempt, err)
+		inferenceRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
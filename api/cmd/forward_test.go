@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInferenceRetryBudget(t *testing.T) {
+	unavailable := &BackendStatusError{Status: http.StatusServiceUnavailable}
+	tests := []struct {
+		name string
+		env map[string]string
+		failures []error
+		status int
+		code string
+		retries float64
+	}{
+		{"fails once", nil, []error{unavailable}, http.StatusOK, "", 1},
+		{"attempts exhausted", map[string]string{"INFERENCE_MAX_ATTEMPTS": "2"}, []error{unavailable, unavailable, unavailable}, http.StatusBadGateway, "inference_failed", 1},
+		{"not transient", nil, []error{&BackendStatusError{Status: http.StatusBadRequest}}, http.StatusBadGateway, "inference_failed", 0},
+		// The second backoff of 200ms would end past the deadline
+		{"deadline exhausted", map[string]string{"INFERENCE_DEADLINE": "250ms"}, []error{unavailable, unavailable, unavailable}, http.StatusBadGateway, "inference_failed", 1},
+		{"every try times out", map[string]string{"MOCK_LATENCY": "300ms", "INFERENCE_TRY_TIMEOUT": "50ms", "INFERENCE_MAX_ATTEMPTS": "2"}, nil, http.StatusGatewayTimeout, "inference_timeout", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			startDevice(t, api, server, testAPIKey, "pi")
+			backend := api.Backend.(tracedBackend).InferenceBackend.(*MockBackend)
+			for _, err := range test.failures {
+				backend.FailNext(err)
+			}
+			retries := testutil.ToFloat64(inferenceRetries)
+
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hello"})
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if test.code != "" {
+				var response ErrorResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Error != test.code {
+					t.Fatalf("got %s, want %s", body, test.code)
+				}
+			}
+			if got := testutil.ToFloat64(inferenceRetries) - retries; got != test.retries {
+				t.Fatalf("%g retries recorded, want %g", got, test.retries)
+			}
+		})
+	}
+}
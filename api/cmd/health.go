@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+//// Structure
+
+type ReadinessResponse struct {
+	Status string `json:"status"`
+	Provider string `json:"provider"`
+}
+
+type PingResponse struct {
+	Pong bool `json:"pong"`
+	Tenant string `json:"tenant"`
+	ServerTime string `json:"server_time"`
+}
+
+//// Functionality
+
+// Pings the provider within the configured timeout and records the result for readiness,
+// a failure leaves the server running in a degraded state
+func (api *APIServer) warmupProvider(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := api.Provider.Ping(ctx); err != nil {
+		log.Println("provider warmup failed, starting degraded", err)
+		api.ProviderStatus = err.Error()
+		return
+	}
+	api.ProviderStatus = "ok"
+}
+
+// Liveness, serves as long as the process is up
+func (api *APIServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := encodeResponse(w, r, map[string]string{"status": "ok"}); err != nil {
+		logWriteError("health response encoding error", err)
+	}
+}
+
+// Authenticated echo so clients can check their key and reachability before starting compute,
+// touches no provider
+func (api *APIServer) handlePing(w http.ResponseWriter, r *http.Request) {
+	if err := encodeResponse(w, r, PingResponse{
+		Pong: true,
+		Tenant: tenantFromContext(r.Context()).Name,
+		ServerTime: api.servedAt(),
+	}); err != nil {
+		logWriteError("ping response encoding error", err)
+	}
+}
+
+func (api *APIServer) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	response := ReadinessResponse{Status: "ready", Provider: api.ProviderStatus}
+	status := http.StatusOK
+	if api.ProviderStatus != "ok" && api.ProviderStatus != "unchecked" {
+		response.Status = "degraded"
+		status = http.StatusServiceUnavailable
+	}
+
+	if err := encodeResponseStatus(w, r, status, response); err != nil {
+		logWriteError("readiness response encoding error", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"RASBERRY_api/testsupport/providertest"
+)
+
+func TestProviderWarmup(t *testing.T) {
+	// A VastAI that rejects the api key
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid api key", http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+
+	tests := []struct {
+		name string
+		env map[string]string
+		ready int
+		provider string
+	}{
+		{"disabled", map[string]string{"PROVIDER_WARMUP": "false"}, http.StatusOK, "unchecked"},
+		{"provider reachable", map[string]string{"PROVIDER_WARMUP": "true"}, http.StatusOK, "ok"},
+		{"provider rejects the key", map[string]string{
+			"PROVIDER_WARMUP": "true", "MOCK_PROVIDER": "false", "VAST_API_KEY": "bad", "PROVIDER_BASE_URL": unauthorized.URL,
+		}, http.StatusServiceUnavailable, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, server := newTestServer(t, test.env)
+
+			status, body := doRequest(t, server, "GET", "/ready", "", nil)
+			var readiness ReadinessResponse
+			if err := json.Unmarshal(body, &readiness); status != test.ready || err != nil {
+				t.Fatalf("readiness %d %s, want %d", status, body, test.ready)
+			}
+			if test.provider != "" && readiness.Provider != test.provider {
+				t.Fatalf("provider %q, want %q", readiness.Provider, test.provider)
+			}
+			if test.ready != http.StatusOK && readiness.Status != "degraded" {
+				t.Fatalf("status %q of a failed warmup", readiness.Status)
+			}
+
+			// Degraded or not, liveness keeps serving
+			if status, body := doRequest(t, server, "GET", "/health", "", nil); status != http.StatusOK {
+				t.Fatalf("health %d %s", status, body)
+			}
+		})
+	}
+}
+
+func TestPing(t *testing.T) {
+	tests := []struct {
+		name string
+		key string
+		status int
+		tenant string
+	}{
+		{"alice", "alice-key", http.StatusOK, "alice"},
+		{"bob", "bob-key", http.StatusOK, "bob"},
+		{"wrong key", "nope", http.StatusUnauthorized, ""},
+		{"no key", "", http.StatusUnauthorized, ""},
+	}
+	api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "alice", APIKey: "alice-key"},
+		Tenant{Name: "bob", APIKey: "bob-key"},
+	)})
+	fake := providertest.NewFakeProvider()
+	api.Provider = tracedProvider{fake}
+	operations := []string{"create", "destroy", "status", "ping"}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := doRequest(t, server, "GET", "/ping", test.key, nil)
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var pong PingResponse
+			if err := json.Unmarshal(body, &pong); err != nil || !pong.Pong || pong.Tenant != test.tenant {
+				t.Fatalf("got %s, want pong for %s", body, test.tenant)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, pong.ServerTime); err != nil {
+				t.Fatalf("server_time %q: %v", pong.ServerTime, err)
+			}
+		})
+	}
+	for _, operation := range operations {
+		if calls := fake.Calls(operation); calls != 0 {
+			t.Errorf("ping made %d %s calls to the provider", calls, operation)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+//// Functionality
+
+// Periodically stops instances that served nothing for IDLE_TIMEOUT, the timeout is read on
+// every sweep so a config reload applies right away
+func (api *APIServer) watchIdle(ctx context.Context) {
+	ticker := time.NewTicker(api.Config().IdleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			api.reapIdle(api.Clock.Now())
+		}
+	}
+}
+
+// Stops every idle instance through a pool of IDLE_REAP_CONCURRENCY workers and waits for them,
+// so sweeps never overlap. Instances up for less than MIN_UPTIME are kept even when idle, a burst
+// that ended right after the boot is likely followed by another before a new instance would be up
+func (api *APIServer) reapIdle(now time.Time) {
+	config := api.Config()
+	if config.IdleTimeout <= 0 {
+		return
+	}
+
+	api.ComputesMu.Lock()
+	var idle_devices []string
+	var frames []StatusChanged
+	for _, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		young := now.Sub(compute_state.StartedAt) < config.MinUptime
+		if compute_state.IsRunning && compute_state.Status == "ready" && now.Sub(compute_state.LastActive) >= config.IdleTimeout && !young {
+			// Marking the state first keeps it from being stopped twice
+			log.Println("stopping idle compute", compute_state.DeviceID, now.Sub(compute_state.LastActive))
+			compute_state.Status = "idle_timeout"
+			frames = append(frames, StatusChanged{DeviceID: compute_state.DeviceID, Frame: compute_state.statusResponse()})
+			idle_devices = append(idle_devices, compute_state.DeviceID)
+		}
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	// Published outside ComputesMu so slow subscribers don't hold up every other request
+	for _, frame := range frames {
+		api.Events.Publish(frame)
+	}
+
+	slots := make(chan struct{}, config.IdleReapConcurrency)
+	var wg sync.WaitGroup
+	for _, device_id := range idle_devices {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			api.awaitInferences(device_id, config.InferenceDrainTimeout)
+			api.stopMarkedDevice(device_id, "idle_timeout")
+		}()
+	}
+	wg.Wait()
+}
+
+// Marks the device as in use, pushing back its idle stop
+func (api *APIServer) touchCompute(compute_state *ComputeState) {
+	compute_state.Mu.Lock()
+	compute_state.LastActive = api.Clock.Now()
+	compute_state.Mu.Unlock()
+}
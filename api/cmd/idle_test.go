@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReapIdle(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		idle time.Duration // Time since the last activity at the sweep
+		stopped bool
+	}{
+		{"idle", map[string]string{"IDLE_TIMEOUT": "1h"}, 2 * time.Hour, true},
+		{"active", map[string]string{"IDLE_TIMEOUT": "1h"}, 30 * time.Minute, false},
+		{"disabled", nil, 2 * time.Hour, false},
+		{"young", map[string]string{"IDLE_TIMEOUT": "1h", "MIN_UPTIME": "3h"}, 2 * time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			startDevice(t, api, server, testAPIKey, "pi")
+			statuses := recordStatuses(api, "pi")
+
+			api.reapIdle(api.Clock.Now().Add(test.idle))
+			if stopped := deviceStatus(api, "pi") == "stopped"; stopped != test.stopped {
+				t.Fatalf("device %s, want stopped %v", deviceStatus(api, "pi"), test.stopped)
+			}
+			if test.stopped && !slices.Equal(statuses(), []string{"idle_timeout", "stopped"}) {
+				t.Fatalf("status transitions %v", statuses())
+			}
+		})
+	}
+}
+
+// A device restarted while the reaper drained its inferences stays up
+func TestReapIdleSkipsRestartedDevice(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"IDLE_TIMEOUT": "1h"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	compute_state := api.getComputeState("pi")
+	compute_state.Mu.Lock()
+	compute_state.beginInference()
+	compute_state.Mu.Unlock()
+
+	reaped := make(chan struct{})
+	go func() {
+		api.reapIdle(api.Clock.Now().Add(2 * time.Hour))
+		close(reaped)
+	}()
+	waitFor(t, "the idle mark", func() bool { return deviceStatus(api, "pi") == "idle_timeout" })
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+	waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+	startDevice(t, api, server, testAPIKey, "pi")
+	restarted := instanceID(api, "pi")
+
+	api.endInference("pi")
+	<-reaped
+	if status := deviceStatus(api, "pi"); status != "ready" || instanceID(api, "pi") != restarted {
+		t.Fatalf("reaper stopped the restarted device, now %s", status)
+	}
+}
+
+// Provider whose destroys take a while, recording how many overlap
+type slowDestroyProvider struct {
+	ComputeProvider
+	delay time.Duration
+	running atomic.Int32
+	peak atomic.Int32
+}
+
+func (p *slowDestroyProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	running := p.running.Add(1)
+	defer p.running.Add(-1)
+	for peak := p.peak.Load(); running > peak && !p.peak.CompareAndSwap(peak, running); peak = p.peak.Load() {
+	}
+	time.Sleep(p.delay)
+	return p.ComputeProvider.DestroyInstance(ctx, instance_id)
+}
+
+// Provider recording how many inferences the device had in flight when its instance was destroyed
+type drainCheckProvider struct {
+	ComputeProvider
+	api *APIServer
+	device_id string
+	in_flight atomic.Int64
+	destroyed atomic.Bool
+}
+
+func (p *drainCheckProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	compute_state := p.api.getComputeState(p.device_id)
+	compute_state.Mu.Lock()
+	p.in_flight.Store(int64(compute_state.Inferences))
+	compute_state.Mu.Unlock()
+	p.destroyed.Store(true)
+	return p.ComputeProvider.DestroyInstance(ctx, instance_id)
+}
+
+// The reaper waits for the inference in flight when it decided to stop, later ones are refused
+func TestReapIdleDrainsInferences(t *testing.T) {
+	tests := []struct {
+		name string
+		latency string
+		drain string
+		in_flight int64 // Inferences still running at the destroy
+	}{
+		{"drained", "300ms", "5s", 0},
+		{"drain timeout", "1s", "50ms", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"IDLE_TIMEOUT": "1h", "MOCK_LATENCY": test.latency, "INFERENCE_DRAIN_TIMEOUT": test.drain})
+			startDevice(t, api, server, testAPIKey, "pi")
+			provider := &drainCheckProvider{ComputeProvider: api.Provider, api: api, device_id: "pi"}
+			api.Provider = provider
+
+			inference := make(chan int, 1)
+			go func() {
+				status, _ := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+				inference <- status
+			}()
+			waitFor(t, "the inference to be counted", func() bool {
+				compute_state := api.getComputeState("pi")
+				compute_state.Mu.Lock()
+				defer compute_state.Mu.Unlock()
+				return compute_state.Inferences == 1
+			})
+			reaped := make(chan struct{})
+			go func() {
+				api.reapIdle(api.Clock.Now().Add(2 * time.Hour))
+				close(reaped)
+			}()
+			waitFor(t, "the idle mark", func() bool { return deviceStatus(api, "pi") == "idle_timeout" })
+
+			if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "late"}); status != http.StatusConflict {
+				t.Fatalf("inference after the stop decision got %d %s, want 409", status, body)
+			}
+			<-reaped
+			if got := provider.in_flight.Load(); !provider.destroyed.Load() || got != test.in_flight {
+				t.Fatalf("destroyed %v with %d inferences in flight, want %d", provider.destroyed.Load(), got, test.in_flight)
+			}
+			status := <-inference
+			if test.in_flight == 0 && status != http.StatusOK {
+				t.Fatalf("drained inference got %d, want 200", status)
+			}
+			if status := deviceStatus(api, "pi"); status != "stopped" {
+				t.Fatalf("device %s after the reap", status)
+			}
+		})
+	}
+}
+
+// Inferences racing the reap either finish before the destroy or are refused, run with -race
+func TestReapIdleInferenceRace(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"IDLE_TIMEOUT": "1h", "MOCK_LATENCY": "20ms", "INFERENCE_DRAIN_TIMEOUT": "5s"})
+	tests := []struct {
+		name string
+		clients int
+	}{
+		{"one inference", 1},
+		{"several inferences", 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for round := range 10 {
+				startDevice(t, api, server, testAPIKey, "pi")
+				provider := &drainCheckProvider{ComputeProvider: api.Provider, api: api, device_id: "pi"}
+				api.Provider = provider
+
+				start := make(chan struct{})
+				statuses := make(chan int, test.clients)
+				var wg sync.WaitGroup
+				for range test.clients {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						<-start
+						status, _ := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+						statuses <- status
+					}()
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					api.reapIdle(api.Clock.Now().Add(2 * time.Hour))
+				}()
+				close(start)
+				wg.Wait()
+				close(statuses)
+				api.Provider = provider.ComputeProvider
+
+				for status := range statuses {
+					if status != http.StatusOK && status != http.StatusConflict {
+						t.Fatalf("round %d: inference got %d, want 200 or 409", round, status)
+					}
+				}
+				if got := provider.in_flight.Load(); !provider.destroyed.Load() || got != 0 {
+					t.Fatalf("round %d: destroyed %v with %d inferences in flight", round, provider.destroyed.Load(), got)
+				}
+				if status := deviceStatus(api, "pi"); status != "stopped" {
+					t.Fatalf("round %d: device %s after the reap", round, status)
+				}
+			}
+		})
+	}
+}
+
+func TestReapIdleConcurrency(t *testing.T) {
+	const devices, concurrency, delay = 8, 4, 100 * time.Millisecond
+	api, server := newTestServer(t, map[string]string{"IDLE_TIMEOUT": "1h", "IDLE_REAP_CONCURRENCY": fmt.Sprint(concurrency)})
+	for i := range devices {
+		startDevice(t, api, server, testAPIKey, fmt.Sprint("pi-", i))
+	}
+	slow := &slowDestroyProvider{ComputeProvider: api.Provider, delay: delay}
+	api.Provider = slow
+
+	start := time.Now()
+	api.reapIdle(api.Clock.Now().Add(2 * time.Hour))
+	elapsed := time.Since(start)
+
+	for i := range devices {
+		if status := deviceStatus(api, fmt.Sprint("pi-", i)); status != "stopped" {
+			t.Fatalf("pi-%d %s after the sweep", i, status)
+		}
+	}
+	if peak := slow.peak.Load(); peak != concurrency {
+		t.Fatalf("%d destroys at once, want %d", peak, concurrency)
+	}
+	// One after the other would take devices*delay
+	if elapsed >= delay*devices/2+delay {
+		t.Fatalf("sweep took %s", elapsed)
+	}
+}
+
+// The idle watcher on a fake clock, the sweeps tick in real time but idleness is measured on the clock
+func TestIdleWatcherClock(t *testing.T) {
+	tests := []struct {
+		name string
+		advance []time.Duration // Clock moves, with an inference after each
+		idle time.Duration // Final move with no activity after it
+		stopped bool
+	}{
+		{"idle past the timeout", nil, 2 * time.Hour, true},
+		{"activity pushes the stop back", []time.Duration{40 * time.Minute, 40 * time.Minute}, 40 * time.Minute, false},
+		{"idle after the activity", []time.Duration{40 * time.Minute}, time.Hour, true},
+		{"clock moved backwards", nil, -2 * time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"IDLE_TIMEOUT": "1h"})
+			clock := useFakeClock(t, api)
+			// The server's watcher ticks every minute, so a second one on a short interval
+			// starts after the clock swap instead of racing it
+			config := *api.Config()
+			config.IdleCheckInterval = 10 * time.Millisecond
+			api.config.Store(&config)
+			api.startWatcher(api.watchIdle)
+			startDevice(t, api, server, testAPIKey, "pi")
+			for _, advance := range test.advance {
+				clock.Advance(advance)
+				if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"}); status != http.StatusOK {
+					t.Fatalf("inference: %d %s", status, body)
+				}
+			}
+			clock.Advance(test.idle)
+
+			if test.stopped {
+				waitFor(t, "the idle stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+				return
+			}
+			// Several sweeps come and go
+			time.Sleep(100 * time.Millisecond)
+			if status := deviceStatus(api, "pi"); status != "ready" {
+				t.Fatalf("device %s, want ready", status)
+			}
+		})
+	}
+}
+
+// An idle instance younger than MIN_UPTIME is kept, a burst often comes back before a new one would boot
+func TestMinUptime(t *testing.T) {
+	tests := []struct {
+		name string
+		min_uptime string
+		uptime time.Duration // Age of the instance at the sweep, idle the whole time
+		stopped bool
+	}{
+		{"younger than the min uptime", "3h", 2 * time.Hour, false},
+		{"reached the min uptime", "3h", 3 * time.Hour, true},
+		{"no min uptime", "0s", 2 * time.Hour, true},
+		{"old but not idle long enough", "10m", 30 * time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"IDLE_TIMEOUT": "1h", "MIN_UPTIME": test.min_uptime})
+			startDevice(t, api, server, testAPIKey, "pi")
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			started_at := compute_state.StartedAt
+			compute_state.LastActive = started_at
+			compute_state.Mu.Unlock()
+
+			api.reapIdle(started_at.Add(test.uptime))
+			if stopped := deviceStatus(api, "pi") == "stopped"; stopped != test.stopped {
+				t.Fatalf("device %s, want stopped %v", deviceStatus(api, "pi"), test.stopped)
+			}
+		})
+	}
+}
+
+// Sweeps publish their stop frames after releasing ComputesMu, a subscriber looking up devices doesn't deadlock them
+func TestSweepsPublishUnlocked(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		status string
+		sweep func(api *APIServer)
+	}{
+		{"idle reaper", map[string]string{"IDLE_TIMEOUT": "1h"}, "idle_timeout", func(api *APIServer) { api.reapIdle(api.Clock.Now().Add(2 * time.Hour)) }},
+		{"cost cap", nil, "cost_cap_reached", func(api *APIServer) {
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			compute_state.MaxCost = 1
+			compute_state.Mu.Unlock()
+			accrueCost(api, "pi")
+			api.enforceCostCaps()
+		}},
+		{"cost ceiling", nil, "cost_ceiling_reached", func(api *APIServer) {
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			compute_state.CostCeiling = 1
+			compute_state.Mu.Unlock()
+			accrueCost(api, "pi")
+			api.enforceCostCaps()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			startDevice(t, api, server, testAPIKey, "pi")
+			api.Events.Subscribe(func(event Event) {
+				if changed, ok := event.(StatusChanged); ok && changed.Frame.Status == test.status {
+					api.findComputeState(changed.DeviceID)
+				}
+			})
+
+			swept := make(chan struct{})
+			go func() {
+				defer close(swept)
+				test.sweep(api)
+			}()
+			select {
+			case <-swept:
+			case <-time.After(5 * time.Second):
+				t.Fatal("sweep deadlocked publishing under ComputesMu")
+			}
+			waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+		})
+	}
+}
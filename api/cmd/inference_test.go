@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMultipartPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		files map[string][2]string
+		want int
+		response string
+	}{
+		{"prompt only", nil, http.StatusOK, "echo: summarize"},
+		{"with file", map[string][2]string{"file": {"notes.txt", "the notes"}}, http.StatusOK, "echo: the notes\n\nsummarize"},
+		{"file over the limit", map[string][2]string{"file": {"big.txt", strings.Repeat("x", maxPromptBytes)}}, http.StatusRequestEntityTooLarge, ""},
+	}
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := doMultipart(t, server, "/respond", testAPIKey, map[string]string{"device_id": "pi", "prompt": "summarize"}, test.files)
+			if status != test.want {
+				t.Fatalf("got %d %s, want %d", status, body, test.want)
+			}
+			if test.want != http.StatusOK {
+				return
+			}
+			var response InferenceResponse
+			if err := json.Unmarshal(body, &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Response != test.response {
+				t.Fatalf("response %q, want %q", response.Response, test.response)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//// Structure
+
+type watchedInstance struct {
+	device_id string
+	instance_id string
+}
+
+//// Functionality
+
+// Periodically checks the instances of ready interruptible devices, the provider reclaims those
+// without notice once outbid
+func (api *APIServer) watchInterruptions(ctx context.Context) {
+	ticker := time.NewTicker(api.Config().InterruptionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			api.checkInterruptions(ctx)
+		}
+	}
+}
+
+// Asks the provider once per instance, devices sharing an interrupted instance are all handled
+func (api *APIServer) checkInterruptions(ctx context.Context) {
+	var watched []watchedInstance
+	api.ComputesMu.Lock()
+	for device_id, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.IsRunning && compute_state.Status == "ready" && compute_state.Spec.Interruptible && compute_state.ID != "" {
+			watched = append(watched, watchedInstance{device_id, compute_state.ID})
+		}
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	interrupted := make(map[string]bool)
+	for _, instance := range watched {
+		is_interrupted, checked := interrupted[instance.instance_id]
+		if !checked {
+			info, err := api.Provider.InstanceStatus(ctx, instance.instance_id)
+			if err != nil {
+				log.Println("interruption check error", instance.device_id, instance.instance_id, err)
+				continue
+			}
+			// Reclaimed instances stay rented but stopped until the bid wins again
+			is_interrupted = info.Status != "running"
+			interrupted[instance.instance_id] = is_interrupted
+		}
+		if is_interrupted {
+			api.handleInterruption(instance.device_id, instance.instance_id)
+		}
+	}
+}
+
+// Broadcasts "interrupted" for the device, then with INTERRUPTION_REPROVISION rents a fresh
+// instance in place of the reclaimed one. Otherwise, or while in maintenance, the reclaimed
+// instance is released and the device stopped until the client starts it again
+func (api *APIServer) handleInterruption(device_id string, instance_id string) {
+	config := api.Config()
+	compute_state := api.getComputeState(device_id)
+	reprovision := config.InterruptionReprovision && !api.maintenance.Load()
+
+	compute_state.Mu.Lock()
+	// Stopped, paused or reprovisioned since the check
+	if compute_state.ID != instance_id || compute_state.Status != "ready" {
+		compute_state.Mu.Unlock()
+		return
+	}
+	compute_state.Status = "interrupted"
+	compute_state.AcceptingInference = false
+	var provision_ctx context.Context
+	var cancel_provision context.CancelFunc
+	if reprovision {
+		provision_ctx, cancel_provision = context.WithTimeout(api.lifecycle_ctx, config.ProvisionTimeout)
+		compute_state.CancelProvision = cancel_provision
+	}
+	tenant := compute_state.Tenant
+	frame := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+
+	log.Println("instance interrupted by the provider", device_id, instance_id, reprovision)
+	api.audit(AuditRecord{Action: "instance_interrupted", DeviceID: device_id, Tenant: tenant, InstanceID: instance_id, Detail: map[string]any{"reprovision": reprovision}})
+	api.Events.Publish(InstanceInterrupted{DeviceID: device_id, InstanceID: instance_id})
+	api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+
+	if reprovision {
+		if api.submitProvision(func() { api.reprovisionVastAICompute(provision_ctx, device_id) }) {
+			return
+		}
+		log.Println("provisioning queue full, releasing interrupted instance", device_id)
+		cancel_provision()
+		compute_state.Mu.Lock()
+		compute_state.CancelProvision = nil
+		compute_state.Mu.Unlock()
+	}
+
+	// Serialized with the start and stop operations of the device, a client that restarted it since
+	// keeps its new instance
+	if err := api.stopMarkedDevice(device_id, "interrupted"); err != nil {
+		log.Println("interrupted instance teardown error", device_id, err)
+	}
+}
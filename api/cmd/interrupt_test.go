@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstanceInterruption(t *testing.T) {
+	tests := []struct {
+		name string
+		reprovision bool
+		maintenance bool
+		statuses []string // Transitions after the interruption
+	}{
+		{"released", false, false, []string{"interrupted", "stopped"}},
+		{"reprovisioned", true, false, []string{"interrupted", "reprovisioning", "ready"}},
+		{"released in maintenance", true, true, []string{"interrupted", "stopped"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"INTERRUPTION_CHECK_INTERVAL": "20ms"}
+			if test.reprovision {
+				env["INTERRUPTION_REPROVISION"] = "true"
+			}
+			api, server := newTestServer(t, env)
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true, "interruptible": true}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "the instance to be ready", func() bool { return deviceStatus(api, "pi") == "ready" })
+			if test.maintenance {
+				if status, body := doRequest(t, server, "PUT", "/admin/maintenance", testAPIKey, map[string]any{"enabled": true}); status != http.StatusOK {
+					t.Fatalf("enable maintenance: %d %s", status, body)
+				}
+			}
+			conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readStatusFrame(t, conn)
+			statuses := recordStatuses(api, "pi")
+			interruptions := testutil.ToFloat64(instanceEvents.WithLabelValues("instance_interrupted"))
+			instance_id := instanceID(api, "pi")
+
+			if !mockProvider(api).Interrupt(instance_id) {
+				t.Fatalf("instance %s not found", instance_id)
+			}
+			if frame := readStatusFrame(t, conn); frame.Status != "interrupted" {
+				t.Fatalf("frame %+v, want interrupted", frame)
+			}
+			final := test.statuses[len(test.statuses)-1]
+			// Repeated frames of one status are left out
+			waitFor(t, "the device to be "+final, func() bool { return slices.Equal(slices.Compact(statuses()), test.statuses) })
+			if got := testutil.ToFloat64(instanceEvents.WithLabelValues("instance_interrupted")) - interruptions; got != 1 {
+				t.Fatalf("%g interruptions counted", got)
+			}
+
+			ids := instanceIDs(t, api)
+			if !test.reprovision || test.maintenance {
+				if len(ids) != 0 {
+					t.Fatalf("instances %v left after the release", ids)
+				}
+				return
+			}
+			if len(ids) != 1 || ids[0] == instance_id || instanceID(api, "pi") != ids[0] {
+				t.Fatalf("device on %q with instances %v, want a fresh one in place of %s", instanceID(api, "pi"), ids, instance_id)
+			}
+		})
+	}
+}
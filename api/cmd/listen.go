@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/netutil"
+)
+
+//// Structure
+
+// Counts the connections accepted through it, so reaching the limit of the LimitListener around it
+// can be logged
+type countingListener struct {
+	net.Listener
+	limit int64
+	open atomic.Int64
+}
+
+type countedConn struct {
+	net.Conn
+	listener *countingListener
+	close_once sync.Once
+}
+
+//// Functionality
+
+// Listens on the address, with MAX_CONNECTIONS set at most that many connections are served at
+// once and the rest wait in the accept backlog until one closes
+func listen(addr string, max_connections int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if max_connections <= 0 {
+		return listener, nil
+	}
+	counting := &countingListener{Listener: listener, limit: int64(max_connections)}
+	return netutil.LimitListener(counting, max_connections), nil
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.open.Add(1) == l.limit {
+		log.Println("connection limit reached, new connections wait until one closes", l.limit)
+	}
+	return &countedConn{Conn: conn, listener: l}, nil
+}
+
+func (c *countedConn) Close() error {
+	c.close_once.Do(func() { c.listener.open.Add(-1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Writes a self-signed certificate for 127.0.0.1, returns the cert and key file paths
+func selfSignedCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "gorasp test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cert_file, key_file := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert_file, key_file
+}
+
+func TestHTTP2(t *testing.T) {
+	cert_file, key_file := selfSignedCert(t)
+	tests := []struct {
+		name string
+		env map[string]string
+		scheme string
+		client *http.Client
+	}{
+		{"TLS negotiates h2", map[string]string{"TLS_CERT_FILE": cert_file, "TLS_KEY_FILE": key_file}, "https", &http.Client{
+			Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}},
+		{"h2c", map[string]string{"H2C": "true"}, "http", &http.Client{
+			Transport: &http2.Transport{AllowHTTP: true, DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, _ := newTestServer(t, test.env)
+			listener, err := listen("127.0.0.1:0", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := api.newHTTPServer(listener.Addr().String())
+			go api.serve(server, listener)
+			defer server.Close()
+
+			response, err := test.client.Get(test.scheme + "://" + listener.Addr().String() + "/health")
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.ProtoMajor != 2 || response.StatusCode != http.StatusOK {
+				t.Fatalf("got %s %d, want HTTP/2 200", response.Proto, response.StatusCode)
+			}
+		})
+	}
+}
+
+// Sends a keep-alive GET /health on a fresh connection, the answer is read with readHealth
+func openHealthConn(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte("GET /health HTTP/1.1\r\nHost: " + addr + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Reports whether the health answer arrived within wait
+func readHealth(conn net.Conn, wait time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK
+}
+
+func TestConnectionLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		limit int
+		delayed bool // Whether the connection past the limit waits
+	}{
+		{"at the limit", 2, true},
+		{"unlimited", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, _ := newTestServer(t, nil)
+			logs := captureLog(t)
+			listener, err := listen("127.0.0.1:0", test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := api.newHTTPServer(listener.Addr().String())
+			go api.serve(server, listener)
+			defer server.Close()
+			addr := listener.Addr().String()
+
+			// Kept open by keep-alive, each holds a slot
+			held := []net.Conn{openHealthConn(t, addr), openHealthConn(t, addr)}
+			for _, conn := range held {
+				if !readHealth(conn, 5*time.Second) {
+					t.Fatal("connection within the limit not served")
+				}
+			}
+
+			extra := openHealthConn(t, addr)
+			if served := readHealth(extra, 200*time.Millisecond); served == test.delayed {
+				t.Fatalf("connection past the limit served %v, want delayed %v", served, test.delayed)
+			}
+			if !test.delayed {
+				return
+			}
+			if !strings.Contains(logs.String(), "connection limit reached") {
+				t.Fatalf("limit not logged:\n%s", logs.String())
+			}
+			// Freeing a slot lets the waiting connection in
+			held[0].Close()
+			if !readHealth(extra, 5*time.Second) {
+				t.Fatal("waiting connection not served after a slot freed up")
+			}
+		})
+	}
+}
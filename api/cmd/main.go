@@ -1,202 +1,931 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 //// Structure
 
 // Meta Structures
 type ComputeState struct {
-	ID string
+	ID string // Provider instance ID, empty while nothing is allocated
+	Name string // Label of the instance on the provider, rendered from INSTANCE_NAME_TEMPLATE
+	DeviceID string
+	Label string // Friendly name of the device, see handleDeviceLabel
 	IsRunning bool
+	Status string // Last broadcast status (init, provisioning, ready, reprovisioning, paused, stopped, error)
+	Spec InstanceSpec // Spec the instance was provisioned with, reused on reprovision
+	Endpoint string
+	CostPerHour float64
+	Metadata map[string]any // Offer details passed through to clients, already redacted
+	Account string // Provider account of the instance, empty with a single account
+	BackendToken string // Per-instance backend token, never part of a status frame
+	StartedAt time.Time // When the current instance was created, used to accrue cost
+	PausedAt time.Time // When the instance was paused, zero while it runs
+	AcceptingInference bool // The instance finished its warmup, inference is refused before
+	SkipWarmup bool // Started with the skip_warmup feature, the instance accepts inference once ready
+	Tenant string // Tenant that started the compute
+	MaxCost float64 // Requested cost cap, 0 when the client set none
+	CostCeiling float64 // Requested cost ceiling, 0 when the client set none
+	Attached bool // Shares the instance of another device and accrues no cost of its own
+	CancelProvision context.CancelFunc // Set while a provisioning is underway so a stop can abort it
 	LastActive time.Time
+	Inferences int // In-flight inferences on the instance, see beginInference
+	inferences_done chan struct{} // Closed by the last inference while a reaper waits for them to drain
 	Mu sync.Mutex // Lock or unlock mutual exclusivity (whether one OR more threads can access)
+	OpMu sync.Mutex // Serializes start and stop of the device, held across provider calls unlike Mu. Taken before Mu
 }
 
 type securityConfig struct {
 	api_key string
+	api_key_previous string // Still accepted while clients migrate to api_key
 	accepted_origin string
+	vast_api_key string
+	vast_accounts []vastAccount // Spread instances across these accounts instead of vast_api_key alone
+	tenants map[string]*Tenant // Tenants by api key
 }
 
 type APIServer struct {
 	Router *mux.Router
-	ComputeState *ComputeState
-	securityConfig *securityConfig
+	HTTPServer *http.Server
+	config atomic.Pointer[Config] // Swapped as a whole on reload, read through Config()
+	reload_mu sync.Mutex
+	Computes map[string]*ComputeState // Compute state per device ID
+	InstanceRefs map[string]int // Devices attached per instance ID, guarded by ComputesMu
+	ComputesMu sync.Mutex
+	Provider ComputeProvider
+	Backend InferenceBackend
+	Usage UsageStore
+	Clock Clock
+	Events EventBus // State transitions, consumed by the status fan-out, cost accounting and metrics
+	StateStore StateStore
+	State *PersistedState
+	StateMu sync.Mutex
+	ProviderStatus string // Result of the startup provider check, "ok", "unchecked" or the error
+	Subscribers map[string]map[*wsConn]*Tenant // Status websocket connections per device ID, with the tenant of each, nil when anonymous
+	EventSubscribers map[string]map[chan StatusResponse]*Tenant // Status SSE streams per device ID, also guarded by SubscribersMu
+	SubscribersMu sync.Mutex
+	ws_connections atomic.Int64 // Open status and inference websockets, bounded by MAX_WS_CONNECTIONS
+	Streams map[*inferenceStream]bool // Open inference websockets
+	StreamsMu sync.Mutex
 	Upgrader websocket.Upgrader
+	lifecycle_ctx context.Context // Parent of every provisioning context, cancelled on shutdown
+	cancel_lifecycle context.CancelFunc
+	provisioning sync.WaitGroup // In-flight provisioning goroutines
+	provision_queue chan func() // Provisionings waiting for one of the PROVISION_WORKERS
+	watchers sync.WaitGroup // Background loops and provision workers, all return once the lifecycle context is cancelled
+	RequestShutdown func() // Starts the graceful shutdown, replaceable for tests
+	shutdown_tracing func(context.Context) error // Flushes buffered spans
+	shutdown_requested chan struct{}
+	disconnected map[string]*disconnectedDevice // Devices in their WS_DISCONNECT_GRACE window, guarded by affinity_mu
+	affinity_mu sync.Mutex
+	inference_queue map[string]map[chan struct{}]bool // Requests waiting for a warming instance per device ID
+	inference_queue_mu sync.Mutex
+	maintenance atomic.Bool // New provisioning is refused while set, seeded from MAINTENANCE_MODE
+	credit creditCache // Last provider credit reading, guarded by credit_mu
+	credit_mu sync.Mutex
+	stats statsRecorder // Rolling aggregates served by /stats
+	warm_pool warmPool // Pre-provisioned instances of WARM_POOL, no device owns them until claimed
+	shutdown_once sync.Once
 }
 
 // Request Structures
 type ControlRequest struct {
 	DeviceID string `json:"device_id"` // Identify specific client machine
 	Timestamp string `json:"timestamp"` // Log time
-	Run bool `json:"run"`
+	Run *bool `json:"run"` // Required, nil when the client left it out
+	MaxCost float64 `json:"max_cost"` // Stop the instance once it accrued this much, optional
+	CostCeiling float64 `json:"cost_ceiling"` // Lowers the COST_CEILING of this device, optional
+	ReuseExisting bool `json:"reuse_existing"` // Attach to a warm compatible instance instead of provisioning
+	Interruptible bool `json:"interruptible"` // Rent a cheaper instance the provider may reclaim, optional
+	GPUType string `json:"gpu_type"` // Optional, defaults to the tenant's and then DEFAULT_GPU_TYPE
+	Region string `json:"region"` // Country code like "US", optional, defaults to the tenant's and then DEFAULT_REGION
 }
 
 type InferenceRequest struct {
 	DeviceID string `json:"device_id"` // Identify specific client machine
 	Timestamp string `json:"timestamp"` // Log time
 	Prompt string `json:"prompt"` // Prompt that we want to respond to
+	InferenceParameters
+	Attachments []Attachment `json:"-"` // Binary parts of a multipart request, forwarded to the backend as is
+}
+
+// File part of a multipart inference request, e.g. an image for a multimodal model
+type Attachment struct {
+	Filename string
+	ContentType string
+	Data []byte
 }
 
 // Response Structures
 type StatusResponse struct {
+	DeviceID string `json:"device_id,omitempty"`
+	Label string `json:"label,omitempty"` // Friendly name of the device
 	WebSocketURL string `json:"websocket_url"`
 	ComputeInstance string `json:"compute_instance"`
+	Endpoint string `json:"endpoint,omitempty"` // Connection details of the inference server
 	Status string `json:"status"`
 	Ready bool `json:"ready"`
+	AcceptingInference bool `json:"accepting_inference"` // Ready and done warming up the model
 	CostPerHour float64 `json:"cost_per_hour"`
 	IdleAfterMin float64 `json:"idle_after_min"`
+	Metadata map[string]any `json:"metadata,omitempty"` // Provider details of the instance, e.g. geolocation and reliability
+	Account string `json:"account,omitempty"` // Provider account the instance is rented on, set with VAST_ACCOUNTS
+	Version string `json:"version,omitempty"` // Frame format version, set on websocket frames
+	ServedAt string `json:"served_at,omitempty"` // Server time the response was encoded at, RFC3339
+	tenant string // Tenant that started the device, decides how much of the frame subscribers see
 }
 
 type InferenceResponse struct {
 	Status string `json:"status"`
 	Response string `json:"response"`
-	Latency string `json:"latency"`
+	Latency Duration `json:"latency"`
+	ServedAt string `json:"served_at,omitempty"` // Server time the response was encoded at, RFC3339
 }
 
 //// Functionality
 
+// Max size of a prompt including any uploaded file context
+const maxPromptBytes = 1 << 20
+
+var errPromptTooLarge = errors.New("prompt exceeds max size")
+
 // Server
-func LoadSecurityConfig() (*securityConfig, error){
-	err := godotenv.Load(".env") 
+func LoadSecurityConfig(env *envParser) (*securityConfig, error){
+	var err error
+
+	security_config := securityConfig{
+		api_key: env.lookup("API_KEY"),
+		api_key_previous: env.lookup("API_KEY_PREVIOUS"),
+		accepted_origin: env.lookup("ACCEPTED_ORIGIN"),
+		vast_api_key: env.lookup("VAST_API_KEY"),
+	}
+
+	security_config.tenants, err = loadTenants(env, security_config.api_key, security_config.api_key_previous)
 	if err != nil {
 		return nil, err
 	}
 
-	security_config := securityConfig{
-		api_key: os.Getenv("API_KEY"),
-		accepted_origin: os.Getenv("ACCEPTED_ORIGIN"),
+	security_config.vast_accounts, err = parseVastAccounts(env.lookup("VAST_ACCOUNTS"))
+	if err != nil {
+		return nil, err
 	}
 
-	return &security_config
+	return &security_config, nil
 }
 
 func NewAPIServer() (*APIServer, error) {
 
-	// Initialize Compute State
-	compute_state := ComputeState{
-		ID: "",
-		IsRunning: false,
-		LastActive: time.Now(),
-		Mu: sync.Mutex{},
+	// Load and Initialize the Config
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
 	}
+	security := config.security
 
-	// Load and Initialize the Security Config
-	security, err := LoadSecurityConfig()
+	// Restore the state kept across restarts
+	state_store := NewStateStore(config.StateFile)
+	state, err := state_store.Load()
 	if err != nil {
 		return nil, err
 	}
 
+	shutdown_tracing, err := setupTracing(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	lifecycle_ctx, cancel_lifecycle := context.WithCancel(context.Background())
+
+	// Create the API Server
+	api_server := APIServer{
+		Router: mux.NewRouter(),
+		Computes: make(map[string]*ComputeState),
+		InstanceRefs: make(map[string]int),
+		Usage: NewMemoryUsageStore(),
+		Clock: systemClock{},
+		StateStore: state_store,
+		State: state,
+		Subscribers: make(map[string]map[*wsConn]*Tenant),
+		EventSubscribers: make(map[string]map[chan StatusResponse]*Tenant),
+		Streams: make(map[*inferenceStream]bool),
+		ProviderStatus: "unchecked",
+		lifecycle_ctx: lifecycle_ctx,
+		cancel_lifecycle: cancel_lifecycle,
+		shutdown_requested: make(chan struct{}),
+		disconnected: make(map[string]*disconnectedDevice),
+		inference_queue: make(map[string]map[chan struct{}]bool),
+		provision_queue: make(chan func(), config.ProvisionQueue),
+		warm_pool: warmPool{refill: make(chan struct{}, 1)},
+		shutdown_tracing: shutdown_tracing,
+	}
+	api_server.config.Store(config)
+	api_server.maintenance.Store(config.MaintenanceMode)
+	api_server.RequestShutdown = api_server.requestShutdown
+
 	// Initialize Websocket Upgrader
-	var upgrader = websocket.Upgrader{
+	api_server.Upgrader = websocket.Upgrader{
 		ReadBufferSize: 1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			if origin == "" {
-				return False
+		Subprotocols: []string{statusSubprotocol},
+		CheckOrigin: api_server.checkOrigin,
+		EnableCompression: config.WSCompression,
+	}
+
+	// Mock mode runs the whole lifecycle offline
+	if config.MockProvider {
+		log.Println("running with the mock provider, no real instances are created")
+		mock_provider := NewMockProvider(config.MockBootDelay)
+		mock_provider.SetEndpointDelay(config.MockEndpointDelay)
+		api_server.Provider = mock_provider
+		api_server.Backend = NewMockBackend(config.MockLatency)
+	} else {
+		api_server.Provider = NewVastAIProvider(security.vast_api_key, config.ProviderBaseURL, http.DefaultClient, config.OfferStrategy, api_server.Clock)
+		if len(security.vast_accounts) > 0 {
+			multi_provider := NewMultiProvider()
+			for _, account := range security.vast_accounts {
+				multi_provider.AddAccount(account.name, NewVastAIProvider(account.api_key, config.ProviderBaseURL, http.DefaultClient, config.OfferStrategy, api_server.Clock), account.weight)
 			}
-			return (origin == security.accepted_origin)
-		},
+			api_server.Provider = multi_provider
+		}
+		api_server.Backend = NewOpenAIBackend(config.BackendModel, config.BackendHealthPath, config.BackendHealthTimeout, config.BackendAuthHeader, config.BackendAuthToken,
+			config.BackendResponsePath, config.BackendStreamPath)
 	}
+	api_server.Provider = tracedProvider{api_server.Provider}
+	api_server.Backend = tracedBackend{api_server.Backend}
 
-	// Create the API Server
-	api_server := APIServer{
-		Router: mux.NewRouter(),
-		ComputeState: &compute_state,
+	// Optionally validate provider connectivity before serving
+	if config.ProviderWarmup {
+		api_server.warmupProvider(config.ProviderWarmupTimeout)
+	}
+
+	api_server.subscribeEventHandlers()
+	api_server.startProvisionWorkers(config.ProvisionWorkers)
+	api_server.startWatcher(api_server.watchCosts)
+	api_server.startWatcher(api_server.watchIdle)
+	api_server.startWatcher(api_server.watchInterruptions)
+	api_server.startWatcher(api_server.watchWarmPool)
+	api_server.startWatcher(api_server.watchReloadSignal)
+	if config.OrphanCleanup {
+		api_server.startWatcher(api_server.watchOrphans)
 	}
-	
+
 	return &api_server, nil
 }
 
+// Current configuration, replaced as a whole when the config is reloaded
+func (api *APIServer) Config() *Config {
+	return api.config.Load()
+}
+
+// Runs a background loop until the lifecycle context is cancelled, Shutdown waits for it to return
+func (api *APIServer) startWatcher(watch func(ctx context.Context)) {
+	api.watchers.Add(1)
+	go func() {
+		defer api.watchers.Done()
+		watch(api.lifecycle_ctx)
+	}()
+}
 
-func (api *APIServer) handleControlRequest(w http.ResponseWriter, r *http.Request) {
+// Cancels all in-flight provisioning and waits for their partial instances to be torn down
+func (api *APIServer) stopProvisioning() {
+	// Cancelled under the warm pool lock, a pool check that saw the lifecycle running has added its fills before the wait
+	api.warm_pool.mu.Lock()
+	api.cancel_lifecycle()
+	api.warm_pool.mu.Unlock()
+	api.provisioning.Wait()
+}
+
+// Returns the compute state of a device without creating one, for routes anyone can reach
+func (api *APIServer) findComputeState(device_id string) (*ComputeState, bool) {
+	api.ComputesMu.Lock()
+	defer api.ComputesMu.Unlock()
 
-	var control_request ControlRequest
+	compute_state, ok := api.Computes[device_id]
+	return compute_state, ok
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&control_request); err != {
+// Returns the compute state of a device, creating an idle one if the device is new
+func (api *APIServer) getComputeState(device_id string) *ComputeState {
+	api.ComputesMu.Lock()
+	defer api.ComputesMu.Unlock()
+
+	compute_state, ok := api.Computes[device_id]
+	if !ok {
+		compute_state = &ComputeState{
+			DeviceID: device_id,
+			Label: api.deviceLabel(device_id),
+			IsRunning: false,
+			Status: "idle",
+			LastActive: api.Clock.Now(),
+		}
+		api.Computes[device_id] = compute_state
+	}
+	return compute_state
+}
+
+
+func (api *APIServer) handleControlRequest(w http.ResponseWriter, r *http.Request) {
+
+	control_request, err := decodeControlRequest(r.Body, api.Config().ControlLenientRun)
+	if err != nil {
 		log.Println("control request json decoding error", err)
 		http.Error(w, "invalid control request body", http.StatusBadRequest)
-		return 
+		return
+	}
+	if control_request.Run == nil {
+		// Treating a missing run as false answered "already idle" to clients that meant to start
+		writeError(w, r, http.StatusUnprocessableEntity, "run field required", "")
+		return
 	}
 
-	api.ComputeState.Mu.Lock()
-	is_running := api.ComputeState.IsRunning
-	api.ComputeState.Mu.Unlock()
+	if control_request.DeviceID == "" && *control_request.Run && api.Config().GenerateDeviceID {
+		// For clients that don't manage device IDs, they use the one returned from here on
+		control_request.DeviceID = uuid.NewString()
+		log.Println("generated device id", control_request.DeviceID)
+	}
 
-	
-	if !is_running && control_request.Run {
-		//
-		go s.initVastAICompute(control_request.DeviceID) // Start a concurrent thread that initializes the VastAI compute
+	noteRequestDevice(r, control_request.DeviceID)
+	if writeValidationErrors(w, r, http.StatusUnprocessableEntity, control_request.validate()) {
+		return
+	}
+
+	provision_timeout, err := api.requestTimeout(r, api.Config().ProvisionTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tenant := tenantFromContext(r.Context())
+
+	if *control_request.Run && api.rejectInMaintenance(w, r) {
+		return
+	}
 
-		wsURL := fmt.Sprintf("ws://%s/status/%s", control_request.Host, control_request.DeviceID) // Create URL for websocket channel
-		json.NewEncoder(w).Encode(StatusResponse{
+	spec := api.controlSpec(control_request, tenant)
+
+	// Attaching to a shared instance counts against the quota like renting one
+	if *control_request.Run {
+		if quota := api.checkInstanceQuota(tenant); quota != "" {
+			log.Println("tenant exceeded instance quota", tenant.Name, quota)
+			writeQuotaExceeded(w, r, quota)
+			return
+		}
+	}
+
+	if *control_request.Run && control_request.ReuseExisting {
+		if api.attachExistingInstance(control_request.DeviceID, tenant.Name, spec) {
+			compute_state := api.getComputeState(control_request.DeviceID)
+			compute_state.Mu.Lock()
+			frame := compute_state.statusResponse()
+			compute_state.Mu.Unlock()
+
+			frame.WebSocketURL = statusURL(r, control_request.DeviceID)
+			frame.ServedAt = api.servedAt()
+			if err := encodeResponse(w, r, redactStatus(frame, tenantRole(tenant))); err != nil {
+				logWriteError("status response encoding error", err)
+			}
+			return
+		}
+		// Nothing warm to attach to, provision as usual
+	}
+
+	if *control_request.Run && api.rejectWithoutCredit(w, r) {
+		return
+	}
+
+	compute_state := api.getComputeState(control_request.DeviceID)
+	if !*control_request.Run && rejectForeignDevice(w, r, compute_state) {
+		return
+	}
+
+	// Serialized with the stops and other operations of the device for the state transition only. A
+	// start waiting in the provision queue holds no lock, a stop cancels it through CancelProvision
+	compute_state.OpMu.Lock()
+
+	var provision_ctx context.Context
+	var cancel_provision context.CancelFunc
+
+	compute_state.Mu.Lock()
+	is_running := compute_state.IsRunning
+	previous_status := compute_state.Status
+	if !is_running && *control_request.Run {
+		// Claim the device before releasing the lock so concurrent requests don't double provision
+		provision_ctx, cancel_provision = context.WithTimeout(withRequestTrace(api.lifecycle_ctx, r), provision_timeout)
+		compute_state.IsRunning = true
+		compute_state.Status = "init"
+		compute_state.Spec = spec
+		compute_state.Name = api.instanceName(control_request.DeviceID, tenant.Name)
+		compute_state.Spec.Label = compute_state.Name
+		compute_state.Tenant = tenant.Name
+		compute_state.MaxCost = control_request.MaxCost
+		compute_state.CostCeiling = control_request.CostCeiling
+		compute_state.SkipWarmup = requestFeatures(r.Context()).enabled("skip_warmup")
+		compute_state.CancelProvision = cancel_provision
+	}
+	compute_state.Mu.Unlock()
+
+	// A ready instance from the warm pool skips the boot entirely
+	claimed := !is_running && *control_request.Run && api.claimPooledInstance(control_request.DeviceID, spec)
+	// A stop keeps OpMu until the teardown is through, so it can't act on a start that comes after it
+	if !is_running || *control_request.Run {
+		compute_state.OpMu.Unlock()
+	}
+
+	if !is_running && *control_request.Run {
+		if claimed {
+			cancel_provision()
+			compute_state.Mu.Lock()
+			frame := compute_state.statusResponse()
+			compute_state.Mu.Unlock()
+			frame.WebSocketURL = statusURL(r, control_request.DeviceID)
+			frame.ServedAt = api.servedAt()
+			if err := encodeResponse(w, r, redactStatus(frame, tenantRole(tenant))); err != nil {
+				logWriteError("status response encoding error", err)
+			}
+			return
+		}
+
+		//
+		created := make(chan error, 1)
+		if !api.submitProvision(func() { api.initVastAICompute(provision_ctx, control_request.DeviceID, created) }) {
+			api.rejectProvision(w, r, compute_state, cancel_provision, previous_status, false)
+			return
+		}
+
+		// Wait for the provider to accept the instance so its errors reach the client, the boot itself is streamed
+		if err := <-created; err != nil {
+			log.Println("compute creation error", control_request.DeviceID, err)
+			writeProviderError(w, r, err)
+			return
+		}
+
+		wsURL := statusURL(r, control_request.DeviceID) // Create URL for websocket channel
+		if err := encodeResponse(w, r, StatusResponse{
+			DeviceID: control_request.DeviceID,
 			Status: "init",
 			WebSocketURL: wsURL,
-		})
+			ServedAt: api.servedAt(),
+		}); err != nil {
+			logWriteError("status response encoding error", err)
+		}
 
 		return
 		//
-	} else if is_running && control_request.Run {
+	} else if is_running && *control_request.Run {
 		log.Println("trying to RUN an already RUNNING compute error")
-		return 
+		http.Error(w, "compute already running", http.StatusConflict)
+		return
 
-	} else if !is_running && !control_request.Run {
+	} else if !is_running && !*control_request.Run {
 		log.Println("trying to STOP an already IDLE compute error")
-		return 
-		
-	} else if is_running && !control_request.Run {
+		http.Error(w, "compute already idle", http.StatusConflict)
+		return
+
+	} else if is_running && !*control_request.Run {
 		//
-		go s.stopVastAICompute(control_request.DeviceID)
+		compute_state.Mu.Lock()
+		cancel_provision = compute_state.CancelProvision
+		compute_state.Mu.Unlock()
+
+		if cancel_provision != nil {
+			// Provisioning is still underway, the init goroutine tears down the partial instance
+			cancel_provision()
+			compute_state.OpMu.Unlock()
+		} else {
+			go func() {
+				defer compute_state.OpMu.Unlock()
+				api.stopVastAICompute(control_request.DeviceID)
+			}()
+		}
+		w.WriteHeader(http.StatusAccepted)
 		return
 		//
 	}
 }
 
+// Stops the current instance of a device and starts a fresh one with the same spec
+func (api *APIServer) handleReprovisionRequest(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+	if api.rejectInMaintenance(w, r) {
+		return
+	}
+
+	provision_timeout, err := api.requestTimeout(r, api.Config().ProvisionTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+	if rejectForeignDevice(w, r, compute_state) {
+		return
+	}
+
+	var provision_ctx context.Context
+	var cancel_provision context.CancelFunc
+
+	compute_state.Mu.Lock()
+	can_reprovision := compute_state.IsRunning && compute_state.Status == "ready"
+	if can_reprovision {
+		// IsRunning stays true for the whole operation, the device never appears idle
+		provision_ctx, cancel_provision = context.WithTimeout(withRequestTrace(api.lifecycle_ctx, r), provision_timeout)
+		compute_state.Status = "reprovisioning"
+		compute_state.CancelProvision = cancel_provision
+	}
+	compute_state.Mu.Unlock()
+
+	if !can_reprovision {
+		log.Println("trying to REPROVISION a compute that is not READY error")
+		http.Error(w, "compute not ready", http.StatusConflict)
+		return
+	}
+
+	if !api.submitProvision(func() { api.reprovisionVastAICompute(provision_ctx, device_id) }) {
+		api.rejectProvision(w, r, compute_state, cancel_provision, "ready", true)
+		return
+	}
+
+	wsURL := statusURL(r, device_id)
+	if err := encodeResponseStatus(w, r, http.StatusAccepted, StatusResponse{
+		Status: "reprovisioning",
+		WebSocketURL: wsURL,
+		ServedAt: api.servedAt(),
+	}); err != nil {
+		logWriteError("status response encoding error", err)
+	}
+}
+
 func (api *APIServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader
+	device_id := mux.Vars(r)["deviceID"]
+
+	// Clients that ask for a subprotocol must ask for one we speak, the upgrader would silently pick none
+	if requested := websocket.Subprotocols(r); len(requested) > 0 && !slices.Contains(requested, statusSubprotocol) {
+		log.Println("websocket unsupported subprotocol", requested)
+		http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	// Subscribing to an unknown device must not create it
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+
+	if !api.acquireWebSocket() {
+		http.Error(w, "too many websocket connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer api.releaseWebSocket()
+
+	conn, err := api.upgradeWebSocket(w, r)
+	if err != nil {
+		log.Println("websocket upgrade error", err)
+		return
+	}
+
+	if !api.addSubscriber(device_id, conn, api.requestTenant(r)) {
+		return
+	}
+	api.noteReconnect(device_id)
+	defer api.noteDisconnect(device_id)
+	defer api.removeSubscriber(device_id, conn)
+
+	// Send the current state so late subscribers know where provisioning is at
+	compute_state.Mu.Lock()
+	current_status := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+	api.sendStatus(device_id, conn, current_status)
+
+	// The channel is server to client only, read until the client goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
 }
 
-func respondHandler(w http.ResponseWriter, r *http.Request) {
-	var prompt PromptRequest
+// Decodes an inference request from either a json body or a multipart form with a prompt
+// field, an optional file part that is prepended to the prompt as context, and any number
+// of attachment parts that are forwarded to the backend
+func (api *APIServer) readInferenceRequest(w http.ResponseWriter, r *http.Request) (*InferenceRequest, error) {
+	var prompt InferenceRequest
+
+	media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if media_type != "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPromptBytes)
+		if err := json.NewDecoder(r.Body).Decode(&prompt); err != nil {
+			return nil, err
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPromptBytes+api.Config().AttachmentMaxTotalBytes)
+		if err := r.ParseMultipartForm(maxPromptBytes); err != nil {
+			return nil, err
+		}
+		prompt.DeviceID = r.FormValue("device_id")
+		prompt.Timestamp = r.FormValue("timestamp")
+		prompt.Prompt = r.FormValue("prompt")
+		params, err := readFormParameters(r)
+		if err != nil {
+			return nil, err
+		}
+		prompt.InferenceParameters = params
+
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			defer file.Close()
+			contents, err := io.ReadAll(io.LimitReader(file, maxPromptBytes+1))
+			if err != nil {
+				return nil, err
+			}
+			prompt.Prompt = string(contents) + "\n\n" + prompt.Prompt
+		} else if !errors.Is(err, http.ErrMissingFile) {
+			return nil, err
+		}
+
+		if prompt.Attachments, err = api.readAttachments(r.MultipartForm.File["attachment"]); err != nil {
+			return nil, err
+		}
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&prompt); err != nil {
-		log.Println("Request Json Decoding Error: ", err)
+	if len(prompt.Prompt) > maxPromptBytes {
+		return nil, errPromptTooLarge
+	}
+	return &prompt, nil
+}
+
+// Resolves the inference endpoint of a device the tenant may use, writes the error response if there is none.
+// A resolved endpoint counts as an in-flight inference until the caller calls endInference.
+// With INFERENCE_QUEUE_MAX_AGE a request for a warming instance waits for it that long instead of failing right away
+func (api *APIServer) inferenceEndpoint(w http.ResponseWriter, r *http.Request, device_id string) (string, string, bool) {
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return "", "", false
+	}
+	var wake chan struct{}
+	var evict <-chan time.Time
+
+	for {
+		compute_state.Mu.Lock()
+		owner, status, endpoint := compute_state.Tenant, compute_state.Status, compute_state.Endpoint
+		backend_token := compute_state.BackendToken
+		accepting, running := compute_state.AcceptingInference, compute_state.IsRunning
+		compute_state.Mu.Unlock()
+		if owner != "" && owner != tenantFromContext(r.Context()).Name {
+			http.Error(w, "device belongs to another tenant", http.StatusForbidden)
+			return "", "", false
+		}
+		if api.enforceCostCeiling(compute_state, api.Clock.Now()) {
+			writeError(w, r, http.StatusConflict, "cost_ceiling_reached", "")
+			return "", "", false
+		}
+		if status == "ready" && accepting {
+			compute_state.Mu.Lock()
+			counted := compute_state.beginInference()
+			compute_state.Mu.Unlock()
+			if !counted {
+				continue // Stopped since it was read, answer with the new status
+			}
+			api.touchCompute(compute_state)
+			return endpoint, backend_token, true
+		}
+
+		if max_age := api.Config().InferenceQueueMaxAge; max_age > 0 && running && isWarmingStatus(status) {
+			if wake == nil {
+				// Queued before the status is read again, so a change in between still wakes the request
+				wake = api.enqueueInference(device_id)
+				defer api.dequeueInference(device_id, wake)
+				timer := time.NewTimer(max_age)
+				defer timer.Stop()
+				evict = timer.C
+				continue
+			}
+			select {
+			case <-wake:
+				continue
+			case <-evict:
+			case <-r.Context().Done():
+			}
+			inferenceQueueEvictions.Inc()
+			writeError(w, r, http.StatusGatewayTimeout, "queued_too_long", "")
+			return "", "", false
+		}
+
+		if isPausedStatus(status) {
+			// Apart from not ready so clients know a resume is needed or underway
+			writeError(w, r, http.StatusConflict, "compute_paused", status)
+			return "", "", false
+		}
+		if status != "ready" {
+			writeError(w, r, http.StatusConflict, "compute_not_ready", "")
+			return "", "", false
+		}
+		writeError(w, r, http.StatusServiceUnavailable, "compute_warming_up", "")
+		return "", "", false
+	}
+}
+
+func (api *APIServer) respondHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	// Inference is bounded by the client timeout when one was sent
+	timeout, err := api.requestTimeout(r, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	prompt, err := api.readInferenceRequest(w, r)
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if err != nil {
+		log.Println("Request Decoding Error: ", err)
+		var max_bytes_err *http.MaxBytesError
+		if errors.Is(err, errAttachmentTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errPromptTooLarge) || errors.As(err, &max_bytes_err) {
+			http.Error(w, "Prompt too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	log.Println(prompt)
 
-	response := map[string]string{"prompt": "Prompt recieved succesfully"}
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Println("Request Json Encoding Error:", err)
-		http.Error(w, "Invalid request body", http.StatusInternalServerError)
+	if prompt.Prompt, err = sanitizePrompt(prompt.Prompt, api.Config().PromptSanitize); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	noteRequestDevice(r, prompt.DeviceID)
+	if !api.allowPrompt(prompt.DeviceID, tenantFromContext(r.Context()).Name, prompt.Prompt) {
+		writeError(w, r, http.StatusUnprocessableEntity, "prompt_blocked", "")
 		return
 	}
+	// Out of range parameters alone keep their 400, together with other problems all go out as one 422
+	param_errors := prompt.InferenceParameters.validate(api.Config())
+	if errs := prompt.validate(); len(errs) > 0 {
+		writeValidationErrors(w, r, http.StatusUnprocessableEntity, errs.merge(param_errors))
+		return
+	}
+	if writeValidationErrors(w, r, http.StatusBadRequest, param_errors) {
+		return
+	}
+	prompt.InferenceParameters = prompt.InferenceParameters.withDefaults(api.Config())
+
+	endpoint, backend_token, ok := api.inferenceEndpoint(w, r, prompt.DeviceID)
+	if !ok {
+		return
+	}
+	defer api.endInference(prompt.DeviceID)
+
+	completion, err := api.forwardInference(withBackendToken(r.Context(), backend_token), endpoint, *prompt)
+	api.Events.Publish(InferenceCompleted{DeviceID: prompt.DeviceID, Latency: time.Since(start), Err: err})
+	if err != nil && errors.Is(r.Context().Err(), context.Canceled) {
+		// The client went away mid inference, nobody is left to answer
+		return
+	}
+	if err != nil {
+		log.Println("inference error", prompt.DeviceID, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeError(w, r, http.StatusGatewayTimeout, "inference_timeout", "")
+			return
+		}
+		var body_err *BackendBodyError
+		if errors.As(err, &body_err) {
+			writeError(w, r, http.StatusBadGateway, "backend_invalid_response", body_err.Body)
+			return
+		}
+		var status_err *BackendStatusError
+		if errors.As(err, &status_err) {
+			writeError(w, r, http.StatusBadGateway, "inference_failed", status_err.Body)
+			return
+		}
+		writeError(w, r, http.StatusBadGateway, "inference_failed", "")
+		return
+	}
+
+	response := InferenceResponse{
+		Status: "completed",
+		Response: completion,
+		Latency: Duration(time.Since(start)),
+		ServedAt: api.servedAt(),
+	}
+	if err := encodeResponse(w, r, response); err != nil {
+		logWriteError("inference response encoding error", err)
+	}
+}
+
+// Mounts every endpoint on the router, also used to serve the API from httptest
+func (api *APIServer) registerRoutes() {
+	api.Router.Use(api.recoveryMiddleware, api.tracingMiddleware, api.loggingMiddleware, api.metricsMiddleware, api.slowRequestMiddleware, api.featuresMiddleware)
+	api.Router.HandleFunc("/health", api.handleHealth).Methods("GET")
+	api.Router.HandleFunc("/version", api.handleVersion).Methods("GET")
+	api.Router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	api.Router.HandleFunc("/ready", api.handleReadiness).Methods("GET")
+
+	for version := range apiVersions {
+		api.RegisterRoutes(api.Router.PathPrefix("/"+version).Subrouter(), version)
+	}
+	// Registered last so a versioned path never falls through to it
+	api.RegisterRoutes(api.Router, legacyAPIVersion)
+}
+
+// HTTP server of the api. TLS negotiates HTTP/2 through ALPN on its own, H2C wraps the handler
+// to speak it over cleartext
+func (api *APIServer) newHTTPServer(addr string) *http.Server {
+	// Outside the router so unmatched routes get the security headers too
+	var handler http.Handler = api.securityHeadersMiddleware(api.Router)
+	if api.Config().H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server := &http.Server{Addr: addr, Handler: handler}
+	// Event streams never go idle on their own, end them so draining doesn't wait on them
+	server.RegisterOnShutdown(api.closeEventStreams)
+	return server
+}
+
+// Serves on the listener until the server is shut down, over TLS when a certificate is configured
+func (api *APIServer) serve(server *http.Server, listener net.Listener) error {
+	if api.Config().TLSEnabled() {
+		return server.ServeTLS(listener, api.Config().TLSCertFile, api.Config().TLSKeyFile)
+	}
+	return server.Serve(listener)
 }
 
 func main() {
 	port := ":8000"
 
-	api, err = NewAPIServer()
+	api, err := NewAPIServer()
 	if err != nil {
-		log.Println("Starting Server Error: ", err)
+		log.Fatal("Starting Server Error: ", err)
 	}
 
-	api.r.HandleFunc("/control", respondHandler).Methods("POST")
+	api.registerRoutes()
+
+	server := api.newHTTPServer(port)
+	api.HTTPServer = server
+
+	logStartupBanner(port, api.Config())
+
+	go func() {
+		log.Printf("Server started succesfully at port: %s", port)
+		log.Printf("Ready to recieve requests!")
+		listener, err := listen(port, api.Config().MaxConnections)
+		if err != nil {
+			log.Fatal("Server failed to start at port: ", port)
+		}
+		if err := api.serve(server, listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Server failed to start at port: ", port)
+		}
+	}()
+
+	// Wait for a shutdown signal or request
+	signal_ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-signal_ctx.Done():
+	case <-api.shutdown_requested:
+	}
 
-	log.Printf("Server started succesfully at port: %s", port)
-	log.Printf("Ready to recieve requests!")
-	if err := http.ListenAndServe(port, r); err != nil {
-		log.Fatal("Server failed to start at port: ", port)
+	log.Println("Shutting down server")
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), api.Config().ShutdownTimeout)
+	defer cancel()
+	if err := api.Shutdown(shutdown_ctx); err != nil {
+		log.Println("server shutdown error", err)
 	}
 }
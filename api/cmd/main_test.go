@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testAPIKey = "test-key"
+
+const testOrigin = "http://pi.test"
+
+// LoadConfig requires a .env next to the binary, the tests run in a scratch directory holding an empty one
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gorasp-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".env"), nil, 0o600); err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Server on the mock provider with instant boots and an instant backend, env overrides the defaults.
+// It is shut down when the test ends
+func newTestServer(t *testing.T, env map[string]string) (*APIServer, *httptest.Server) {
+	t.Helper()
+	defaults := map[string]string{"API_KEY": testAPIKey, "MOCK_PROVIDER": "true", "MOCK_BOOT_DELAY": "0s", "MOCK_LATENCY": "0s", "ACCEPTED_ORIGIN": testOrigin}
+	for key, value := range defaults {
+		if _, ok := env[key]; !ok {
+			t.Setenv(key, value)
+		}
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	api, err := NewAPIServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.registerRoutes()
+	server := httptest.NewServer(api.Router)
+	t.Cleanup(func() {
+		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := api.Shutdown(ctx); err != nil {
+			t.Error("shutdown:", err)
+		}
+	})
+	return api, server
+}
+
+// Writes the tenants to a TENANTS_FILE and returns its path
+func tenantsFile(t *testing.T, tenants ...Tenant) string {
+	t.Helper()
+	data, err := json.Marshal(tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The mock provider behind the tracing wrapper
+func mockProvider(api *APIServer) *MockProvider {
+	return api.Provider.(tracedProvider).ComputeProvider.(*MockProvider)
+}
+
+// Sends body as json (as is when it's a string) with the api key, returns the status and the body
+func doRequest(t *testing.T, server *httptest.Server, method string, path string, key string, body any) (int, []byte) {
+	t.Helper()
+	response, data := sendRequest(t, newRequest(t, server, method, path, key, body))
+	return response.StatusCode, data
+}
+
+// Request doRequest sends, for tests that need to set more headers
+func newRequest(t *testing.T, server *httptest.Server, method string, path string, key string, body any) *http.Request {
+	t.Helper()
+	var payload io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		payload = bytes.NewBufferString(body)
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, server.URL+path, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		request.Header.Set("X-API-Key", key)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+// Returns the response with its body read
+func sendRequest(t *testing.T, request *http.Request) (*http.Response, []byte) {
+	t.Helper()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, data
+}
+
+// Polls until ok holds, fails the test after 5s
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func deviceStatus(api *APIServer, device_id string) string {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	defer compute_state.Mu.Unlock()
+	return compute_state.Status
+}
+
+// Makes the devices known without starting them, routes other than /control answer 404 for unknown devices
+func knownDevices(api *APIServer, device_ids ...string) {
+	for _, device_id := range device_ids {
+		api.getComputeState(device_id)
+	}
+}
+
+// Starts the device through /control and waits until it takes inference
+func startDevice(t *testing.T, api *APIServer, server *httptest.Server, key string, device_id string) {
+	t.Helper()
+	if status, body := doRequest(t, server, "POST", "/control", key, map[string]any{"device_id": device_id, "run": true}); status != http.StatusOK {
+		t.Fatalf("start %s: %d %s", device_id, status, body)
+	}
+	waitFor(t, device_id+" to accept inference", func() bool {
+		compute_state := api.getComputeState(device_id)
+		compute_state.Mu.Lock()
+		defer compute_state.Mu.Unlock()
+		return compute_state.Status == "ready" && compute_state.AcceptingInference
+	})
+}
+
+// Records the status frames published for the device from now on
+func recordStatuses(api *APIServer, device_id string) func() []string {
+	var mu sync.Mutex
+	var statuses []string
+	api.Events.Subscribe(func(event Event) {
+		if changed, ok := event.(StatusChanged); ok && changed.DeviceID == device_id {
+			mu.Lock()
+			statuses = append(statuses, changed.Frame.Status)
+			mu.Unlock()
+		}
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(statuses)
+	}
+}
+
+// IDs of the instances the mock provider still has
+func instanceIDs(t *testing.T, api *APIServer) []string {
+	t.Helper()
+	instances, err := mockProvider(api).ListInstances(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func instanceID(api *APIServer, device_id string) string {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	defer compute_state.Mu.Unlock()
+	return compute_state.ID
+}
+
+// Posts a multipart form, files maps a part name to its filename and contents
+func doMultipart(t *testing.T, server *httptest.Server, path string, key string, fields map[string]string, files map[string][2]string) (int, []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	for name, file := range files {
+		part, err := form.CreateFormFile(name, file[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file[1]))
+	}
+	form.Close()
+
+	request, err := http.NewRequest("POST", server.URL+path, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-API-Key", key)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	response, data := sendRequest(t, request)
+	return response.StatusCode, data
+}
+
+// Opens a websocket on the path from the accepted origin, with the api key unless it's empty.
+// The connection is closed when the test ends
+func dialWebSocket(t *testing.T, server *httptest.Server, path string, key string, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	return dialWebSocketFrom(t, server, path, key, testOrigin, subprotocols...)
+}
+
+// Dials like a client on origin, an empty origin sends no Origin header
+func dialWebSocketFrom(t *testing.T, server *httptest.Server, path string, key string, origin string, subprotocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	if key != "" {
+		header.Set("X-API-Key", key)
+	}
+	dialer := websocket.Dialer{Subprotocols: subprotocols, HandshakeTimeout: 5 * time.Second}
+	conn, response, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, response, err
+}
+
+// Reads the next status frame, failing the test after 5s
+func readStatusFrame(t *testing.T, conn *websocket.Conn) StatusResponse {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame StatusResponse
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal("reading status frame:", err)
+	}
+	return frame
+}
+
+// Reads the next status event of an SSE stream
+func readStatusEvent(t *testing.T, stream *bufio.Reader) StatusResponse {
+	t.Helper()
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal("reading status event:", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var frame StatusResponse
+			if err := json.Unmarshal([]byte(data), &frame); err != nil {
+				t.Fatal(err)
+			}
+			return frame
+		}
+	}
+}
+
+// Clock the test moves forward by hand
+type fakeClock struct {
+	now time.Time
+	mu sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Puts the server on a fake clock. The warm pool reads the clock as soon as it starts, the swap
+// waits for that first pass so it doesn't race it. The other watchers only read it on their ticks
+func useFakeClock(t *testing.T, api *APIServer) *fakeClock {
+	t.Helper()
+	waitFor(t, "the first warm pool pass", func() bool {
+		api.warm_pool.mu.Lock()
+		defer api.warm_pool.mu.Unlock()
+		return api.warm_pool.instances != nil
+	})
+	clock := newFakeClock()
+	api.Clock = clock
+	return clock
+}
+
+// Buffer safe for the concurrent writes of background loops
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// Captures the standard logger until the test ends
+func captureLog(t *testing.T) *syncBuffer {
+	var buffer syncBuffer
+	log.SetOutput(&buffer)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buffer
+}
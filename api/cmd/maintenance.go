@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+//// Structure
+
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type MaintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+//// Functionality
+
+// Answers 503 maintenance and returns true while maintenance mode holds back new provisioning.
+// Stops, inference and status queries keep working so running work is left alone
+func (api *APIServer) rejectInMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	if !api.maintenance.Load() {
+		return false
+	}
+	writeError(w, r, http.StatusServiceUnavailable, "maintenance", "")
+	return true
+}
+
+func (api *APIServer) setMaintenance(enabled bool, by string) {
+	if api.maintenance.Swap(enabled) == enabled {
+		return
+	}
+	action := "maintenance_off"
+	if enabled {
+		action = "maintenance_on"
+	}
+	log.Println("maintenance mode", enabled, by)
+	api.audit(AuditRecord{Action: action, Tenant: by})
+}
+
+// GET reports the mode, PUT {"enabled": bool} flips it until the next restart or a reload that changes MAINTENANCE_MODE
+func (api *APIServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var request MaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Enabled == nil {
+			http.Error(w, "invalid maintenance request body", http.StatusBadRequest)
+			return
+		}
+		api.setMaintenance(*request.Enabled, tenantFromContext(r.Context()).Name)
+	}
+
+	if err := encodeResponse(w, r, MaintenanceResponse{Enabled: api.maintenance.Load()}); err != nil {
+		logWriteError("maintenance response encoding error", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Starts are held back while stops, inference and status queries keep working
+func TestMaintenanceMode(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "running")
+	if status, body := doRequest(t, server, "PUT", "/admin/maintenance", testAPIKey, map[string]any{"enabled": true}); status != http.StatusOK {
+		t.Fatalf("enable: %d %s", status, body)
+	}
+
+	tests := []struct {
+		name string
+		method string
+		path string
+		body any
+		status int
+	}{
+		{"start", "POST", "/control", map[string]any{"device_id": "new", "run": true}, http.StatusServiceUnavailable},
+		{"status", "GET", "/status/running/snapshot", nil, http.StatusOK},
+		{"inference", "POST", "/respond", map[string]any{"device_id": "running", "prompt": "hi"}, http.StatusOK},
+		{"stop", "POST", "/control", map[string]any{"device_id": "running", "run": false}, http.StatusAccepted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := doRequest(t, server, test.method, test.path, testAPIKey, test.body)
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status == http.StatusServiceUnavailable && string(body) != `{"error":"maintenance"}`+"\n" {
+				t.Fatalf("body %q", body)
+			}
+		})
+	}
+
+	if status, body := doRequest(t, server, "PUT", "/admin/maintenance", testAPIKey, map[string]any{"enabled": false}); status != http.StatusOK {
+		t.Fatalf("disable: %d %s", status, body)
+	}
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "new", "run": true}); status != http.StatusOK {
+		t.Fatalf("start after maintenance: %d %s", status, body)
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		key string
+		method string
+		body any
+		status int
+		enabled bool
+	}{
+		{"MAINTENANCE_MODE", map[string]string{"MAINTENANCE_MODE": "true"}, testAPIKey, "GET", nil, http.StatusOK, true},
+		{"off by default", nil, testAPIKey, "GET", nil, http.StatusOK, false},
+		{"turned on", nil, testAPIKey, "PUT", map[string]any{"enabled": true}, http.StatusOK, true},
+		{"turned off", map[string]string{"MAINTENANCE_MODE": "true"}, testAPIKey, "PUT", map[string]any{"enabled": false}, http.StatusOK, false},
+		{"enabled missing", nil, testAPIKey, "PUT", map[string]any{}, http.StatusBadRequest, false},
+		{"not an admin", nil, "owner-key", "PUT", map[string]any{"enabled": true}, http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"TENANTS_FILE": tenantsFile(t,
+				Tenant{Name: "admin", APIKey: testAPIKey, Role: roleAdmin},
+				Tenant{Name: "owner", APIKey: "owner-key"},
+			)}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			api, server := newTestServer(t, env)
+
+			status, body := doRequest(t, server, test.method, "/admin/maintenance", test.key, test.body)
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status == http.StatusOK {
+				var response MaintenanceResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Enabled != test.enabled {
+					t.Fatalf("got %s, want enabled %t", body, test.enabled)
+				}
+			}
+			if api.maintenance.Load() != test.enabled {
+				t.Fatalf("maintenance %t, want %t", api.maintenance.Load(), test.enabled)
+			}
+		})
+	}
+}
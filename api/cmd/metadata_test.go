@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedactMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		metadata map[string]any
+		want map[string]any
+	}{
+		{"nil", nil, nil},
+		{"only sensitive", map[string]any{"ssh_host": "10.0.0.1", "jupyter_token": "t"}, nil},
+		{
+			"mixed",
+			map[string]any{"datacenter": true, "reliability": 0.99, "public-ip": "1.2.3.4", "api.key": "k", "SSH_Port": 22, "machine_id": 7},
+			map[string]any{"datacenter": true, "reliability": 0.99, "machine_id": 7},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := redactMetadata(test.metadata); !maps.Equal(got, test.want) || (got == nil) != (test.want == nil) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVastAIOfferMetadata(t *testing.T) {
+	vastai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			fmt.Fprint(w, `{"offers":[{"id":3,"gpu_name":"RTX_4090","dph_total":0.4,"geolocation":"Ontario, CA","hosting_type_datacenter":true,"reliability2":0.98,"inet_down":900,"inet_up":500,"machine_id":42,"dlperf":80}]}`)
+		case "PUT":
+			fmt.Fprint(w, `{"success":true,"new_contract":11}`)
+		}
+	}))
+	defer vastai.Close()
+
+	provider := NewVastAIProvider("key", vastai.URL, vastai.Client(), "cheapest", systemClock{})
+	info, err := provider.CreateInstance(context.Background(), DefaultInstanceSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"offer_strategy": "cheapest",
+		"offer_price": 0.4,
+		"dlperf": 80.0,
+		"gpu_name": "RTX_4090",
+		"geolocation": "Ontario, CA",
+		"datacenter": true,
+		"reliability": 0.98,
+		"inet_down_mbps": 900.0,
+		"inet_up_mbps": 500.0,
+		"machine_id": 42,
+	}
+	if !maps.Equal(info.Metadata, want) {
+		t.Fatalf("metadata %v, want %v", info.Metadata, want)
+	}
+}
+
+func TestReadyStatusMetadata(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	status, body := doRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+	var ready StatusResponse
+	if err := json.Unmarshal(body, &ready); status != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s", status, body)
+	}
+	if ready.Metadata["gpu_name"] != DefaultInstanceSpec().GPUType || ready.Metadata["geolocation"] == nil {
+		t.Fatalf("ready status metadata %v", ready.Metadata)
+	}
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+	waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+	_, body = doRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+	var raw map[string]any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["metadata"]; ok {
+		t.Fatalf("stopped status still carries metadata: %s", body)
+	}
+}
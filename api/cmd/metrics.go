@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+//// Structure
+
+// Served on /metrics in the Prometheus text format
+var (
+	websocketOriginRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_origin_rejections_total",
+		Help: "Websocket upgrades rejected by the origin check, by reason.",
+	}, []string{"reason"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests currently being served, by route and method.",
+	}, []string{"route", "method"})
+
+	httpRequestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_request_size_bytes",
+		Help: "Size of HTTP request bodies, by route and method.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"route", "method"})
+
+	httpResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "http_response_size_bytes",
+		Help: "Size of HTTP response bodies, by route and method.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"route", "method"})
+
+	// Upgrades live as long as the connection, so they would skew the request metrics
+	websocketUpgrades = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_upgrades_total",
+		Help: "Websocket upgrade requests, by route and whether the upgrade succeeded.",
+	}, []string{"route", "upgraded"})
+
+	instanceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "instance_events_total",
+		Help: "Instance lifecycle transitions, by event.",
+	}, []string{"event"})
+
+	inferenceRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "inference_retries_total",
+		Help: "Inference forwarding attempts retried after a transient backend error.",
+	})
+
+	inferenceQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "inference_queue_depth",
+		Help: "Inference requests waiting for a warming instance.",
+	})
+
+	inferenceQueueEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "inference_queue_evictions_total",
+		Help: "Queued inference requests answered 504 after waiting INFERENCE_QUEUE_MAX_AGE.",
+	})
+
+	websocketSlowClientDrops = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "websocket_slow_client_drops_total",
+		Help: "Status websockets closed because their send buffer filled up.",
+	})
+
+	websocketConnectionsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "websocket_connections_active",
+		Help: "Websockets currently open, by route.",
+	}, []string{"route"})
+
+	websocketConnectionsOpened = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_connections_opened_total",
+		Help: "Websockets opened, by route.",
+	}, []string{"route"})
+
+	websocketConnectionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_connections_closed_total",
+		Help: "Websockets closed, by route.",
+	}, []string{"route"})
+
+	websocketConnectionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "websocket_connection_duration_seconds",
+		Help: "How long websockets stayed open, by route.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+	}, []string{"route"})
+
+	websocketMessagesSent = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "websocket_messages_sent",
+		Help: "Messages sent over a websocket during its lifetime, by route.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"route"})
+
+	handlerPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_handler_panics_total",
+		Help: "Handler panics recovered into a 500.",
+	}, []string{"route"})
+
+	inferenceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "inference_duration_seconds",
+		Help: "Duration of inference requests, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"outcome"})
+)
+
+//// Functionality
+
+// Route template of the request so the labels don't grow with device IDs, runs after route matching
+func routeLabel(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// Event bus handler counting lifecycle transitions and timing inference
+func recordEventMetrics(event Event) {
+	switch event := event.(type) {
+	case InstanceStarting, InstanceReady, InstanceStopped, InstanceInterrupted:
+		instanceEvents.WithLabelValues(event.eventType()).Inc()
+	case InferenceCompleted:
+		outcome := "completed"
+		if event.Err != nil {
+			outcome = "error"
+		}
+		inferenceDuration.WithLabelValues(outcome).Observe(event.Latency.Seconds())
+	}
+}
+
+// Counts requests and their sizes per route, websocket upgrades are counted on their own
+func (api *APIServer) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeLabel(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		if websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(rec, r)
+			websocketUpgrades.WithLabelValues(route, strconv.FormatBool(rec.status == http.StatusSwitchingProtocols)).Inc()
+			return
+		}
+
+		in_flight := httpRequestsInFlight.WithLabelValues(route, r.Method)
+		in_flight.Inc()
+		defer in_flight.Dec()
+
+		next.ServeHTTP(rec, r)
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestSize.WithLabelValues(route, r.Method).Observe(float64(max(r.ContentLength, 0)))
+		httpResponseSize.WithLabelValues(route, r.Method).Observe(float64(rec.bytes))
+	})
+}
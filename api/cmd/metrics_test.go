@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOriginRejectionMetrics(t *testing.T) {
+	tests := []struct {
+		name string
+		origin string
+		reason string
+	}{
+		{"mismatch", "http://evil.test", "mismatch"},
+		{"missing", "", "missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			knownDevices(api, "pi")
+			logs := captureLog(t)
+			before := testutil.ToFloat64(websocketOriginRejections.WithLabelValues(test.reason))
+
+			if _, response, err := dialWebSocketFrom(t, server, "/status/pi", testAPIKey, test.origin); err == nil {
+				t.Fatal("upgrade with a bad origin was accepted")
+			} else if response == nil || response.StatusCode != http.StatusForbidden {
+				t.Fatalf("handshake response %v, want 403", response)
+			}
+
+			if got := testutil.ToFloat64(websocketOriginRejections.WithLabelValues(test.reason)) - before; got != 1 {
+				t.Fatalf("%s rejections grew by %v, want 1", test.reason, got)
+			}
+			if !strings.Contains(logs.String(), "websocket origin rejected") {
+				t.Fatalf("no rejection logged: %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "300ms"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	in_flight := httpRequestsInFlight.WithLabelValues("/respond", "POST")
+	requests := httpRequests.WithLabelValues("/respond", "POST", "200")
+	requests_before := testutil.ToFloat64(requests)
+	sizes_before := testutil.CollectAndCount(httpResponseSize)
+
+	done := make(chan int)
+	go func() {
+		status, _ := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+		done <- status
+	}()
+	waitFor(t, "the request to be in flight", func() bool { return testutil.ToFloat64(in_flight) == 1 })
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("inference: %d", status)
+	}
+
+	if got := testutil.ToFloat64(in_flight); got != 0 {
+		t.Fatalf("in flight %v after the request finished", got)
+	}
+	if got := testutil.ToFloat64(requests) - requests_before; got != 1 {
+		t.Fatalf("request count grew by %v, want 1", got)
+	}
+	if testutil.CollectAndCount(httpResponseSize) < max(sizes_before, 1) {
+		t.Fatal("response size not observed")
+	}
+
+	// Upgrades stay out of the request metrics
+	upgrades := websocketUpgrades.WithLabelValues("/status/{deviceID}", "true")
+	upgrades_before := testutil.ToFloat64(upgrades)
+	status_requests_before := testutil.CollectAndCount(httpRequests)
+	conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// Counted once the connection is over
+	waitFor(t, "the upgrade to be counted", func() bool { return testutil.ToFloat64(upgrades)-upgrades_before == 1 })
+	if got := testutil.CollectAndCount(httpRequests); got != status_requests_before {
+		t.Fatalf("the upgrade was counted as a request, %d series became %d", status_requests_before, got)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+//// Structure
+
+// Records the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes int
+}
+
+// Warn entry of a request slower than SLOW_REQUEST_MS, json so log pipelines can index it
+type slowRequestLog struct {
+	Level string `json:"level"`
+	Msg string `json:"msg"`
+	Method string `json:"method"`
+	Route string `json:"route"`
+	DeviceID string `json:"device_id,omitempty"`
+	Status int `json:"status"`
+	DurationMS int64 `json:"duration_ms"`
+}
+
+//// Functionality
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Needed by the websocket upgrader
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Turns a handler panic into a 500 instead of a dropped connection and logs the stack under the request ID,
+// which is the X-Request-ID the client sent or a generated one echoed back in that header
+func (api *APIServer) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request_id := r.Header.Get("X-Request-ID")
+		if request_id == "" {
+			request_id = shortUUID()
+		}
+		w.Header().Set("X-Request-ID", request_id)
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate abort, the server closes the connection quietly
+				panic(recovered)
+			}
+			handlerPanics.WithLabelValues(routeLabel(r)).Inc()
+			log.Printf("handler panic %s %s %s: %v\n%s", request_id, r.Method, r.URL.Path, recovered, debug.Stack())
+			if rec.status != 0 || rec.bytes > 0 {
+				// Part of the response is already out, it can only be cut short
+				return
+			}
+			writeError(rec, r, http.StatusInternalServerError, "internal", "")
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// Sets the SECURITY_HEADERS on every response except websocket upgrades, whose handshake is no
+// document a browser could sniff or frame. HSTS is only sent over TLS, browsers ignore it otherwise
+func (api *APIServer) securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := api.Config()
+		if !config.SecurityHeaders || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", config.ReferrerPolicy)
+		if r.TLS != nil && config.HSTSMaxAge > 0 {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(config.HSTSMaxAge.Seconds())))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Logs only with LOG_DEBUG enabled
+func (api *APIServer) debugLog(v ...any) {
+	if api.Config().LogDebug {
+		log.Println(append([]any{"debug:"}, v...)...)
+	}
+}
+
+// Logs one line per request, successful requests are sampled 1 in LOG_SAMPLE_RATE while failures always log
+func (api *APIServer) loggingMiddleware(next http.Handler) http.Handler {
+	var successes atomic.Uint64
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status < 400 {
+			if successes.Add(1)%uint64(api.Config().LogSampleRate) != 0 {
+				return
+			}
+		}
+		log.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+const requestDeviceContextKey contextKey = "request_device"
+
+// Tags the request with its device for the slow request log, for handlers that only learn it from the body
+func noteRequestDevice(r *http.Request, device_id string) {
+	if device, ok := r.Context().Value(requestDeviceContextKey).(*string); ok {
+		*device = device_id
+	}
+}
+
+// Logs a warn entry for requests slower than SLOW_REQUEST_MS to help spot degraded instances,
+// fast requests don't log. Websockets and event streams stay open by design and are left out
+func (api *APIServer) slowRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		threshold := api.Config().SlowRequestThreshold
+		if threshold <= 0 || websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		device_id := mux.Vars(r)["deviceID"]
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestDeviceContextKey, &device_id)))
+
+		duration := time.Since(start)
+		if duration < threshold || rec.Header().Get("Content-Type") == "text/event-stream" {
+			return
+		}
+		entry, err := json.Marshal(slowRequestLog{
+			Level: "warn",
+			Msg: "slow request",
+			Method: r.Method,
+			Route: routeLabel(r),
+			DeviceID: device_id,
+			Status: rec.status,
+			DurationMS: duration.Milliseconds(),
+		})
+		if err != nil {
+			log.Println("slow request log encoding error", err)
+			return
+		}
+		log.Println(string(entry))
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLogSampling(t *testing.T) {
+	tests := []struct {
+		rate string
+		successes int
+		failures int
+		want_successes int
+	}{
+		{"1", 50, 10, 50},
+		{"10", 200, 10, 20},
+		{"100", 50, 10, 0},
+	}
+	for _, test := range tests {
+		t.Run("LOG_SAMPLE_RATE="+test.rate, func(t *testing.T) {
+			api, _ := newTestServer(t, map[string]string{"LOG_SAMPLE_RATE": test.rate})
+			handler := api.loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/fail" {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			logs := captureLog(t)
+
+			for i := range test.successes {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ok", nil))
+				if i < test.failures {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+				}
+			}
+
+			output := logs.String()
+			if got := strings.Count(output, "GET /ok 200"); got != test.want_successes {
+				t.Errorf("%d successes logged, want %d", got, test.want_successes)
+			}
+			if got := strings.Count(output, "GET /fail 500"); got != test.failures {
+				t.Errorf("%d failures logged, want all %d", got, test.failures)
+			}
+		})
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	tests := []struct {
+		name string
+		threshold string
+		path string
+		delay time.Duration
+		want *slowRequestLog
+	}{
+		{"slow", "20", "/work/pi", 50 * time.Millisecond, &slowRequestLog{Level: "warn", Msg: "slow request", Method: "GET", Route: "/work/{deviceID}", DeviceID: "pi", Status: http.StatusAccepted}},
+		{"device from the body", "20", "/work", 50 * time.Millisecond, &slowRequestLog{Level: "warn", Msg: "slow request", Method: "GET", Route: "/work", DeviceID: "noted", Status: http.StatusAccepted}},
+		{"fast", "1000", "/work/pi", 0, nil},
+		{"disabled", "0", "/work/pi", 50 * time.Millisecond, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, _ := newTestServer(t, map[string]string{"SLOW_REQUEST_MS": test.threshold})
+			work := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := mux.Vars(r)["deviceID"]; !ok {
+					noteRequestDevice(r, "noted")
+				}
+				time.Sleep(test.delay)
+				w.WriteHeader(http.StatusAccepted)
+			})
+			router := mux.NewRouter()
+			router.Use(api.slowRequestMiddleware)
+			router.Handle("/work/{deviceID}", work)
+			router.Handle("/work", work)
+			logs := captureLog(t)
+
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+
+			output := strings.TrimSpace(logs.String())
+			if test.want == nil {
+				if strings.Contains(output, "slow request") {
+					t.Fatalf("logged %s", output)
+				}
+				return
+			}
+			var entry slowRequestLog
+			if err := json.Unmarshal([]byte(output[strings.Index(output, "{"):]), &entry); err != nil {
+				t.Fatalf("log %q: %v", output, err)
+			}
+			if entry.DurationMS < test.delay.Milliseconds() {
+				t.Fatalf("duration %dms, slept %s", entry.DurationMS, test.delay)
+			}
+			entry.DurationMS = 0
+			if entry != *test.want {
+				t.Fatalf("got %+v, want %+v", entry, *test.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		handler http.HandlerFunc
+		status int
+		body string
+	}{
+		{"panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, http.StatusInternalServerError, `{"error":"internal"}`},
+		{"nil map write", func(w http.ResponseWriter, r *http.Request) {
+			var counts map[string]int
+			counts["x"]++
+		}, http.StatusInternalServerError, `{"error":"internal"}`},
+		{"panic after the header", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("late")
+		}, http.StatusAccepted, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, _ := newTestServer(t, nil)
+			router := mux.NewRouter()
+			router.Use(api.recoveryMiddleware)
+			router.Handle("/panic", test.handler)
+			logs := captureLog(t)
+
+			request := httptest.NewRequest("GET", "/panic", nil)
+			request.Header.Set("X-Request-ID", "req-42")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d", recorder.Code, test.status)
+			}
+			if test.body != "" && strings.TrimSpace(recorder.Body.String()) != test.body {
+				t.Fatalf("body %q, want %s", recorder.Body.String(), test.body)
+			}
+			output := logs.String()
+			if !strings.Contains(output, "handler panic req-42") || !strings.Contains(output, "goroutine ") {
+				t.Fatalf("no stack logged with the request id:\n%s", output)
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		tls bool
+		want map[string]string // Empty values must be absent
+	}{
+		{"plain http", nil, false, map[string]string{"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY", "Referrer-Policy": "no-referrer", "Strict-Transport-Security": ""}},
+		{"tls", nil, true, map[string]string{"X-Content-Type-Options": "nosniff", "Strict-Transport-Security": "max-age=15552000; includeSubDomains"}},
+		{"configured", map[string]string{"REFERRER_POLICY": "strict-origin-when-cross-origin", "HSTS_MAX_AGE": "1h"}, true, map[string]string{"Referrer-Policy": "strict-origin-when-cross-origin", "Strict-Transport-Security": "max-age=3600; includeSubDomains"}},
+		{"hsts off", map[string]string{"HSTS_MAX_AGE": "0s"}, true, map[string]string{"X-Frame-Options": "DENY", "Strict-Transport-Security": ""}},
+		{"disabled", map[string]string{"SECURITY_HEADERS": "false"}, true, map[string]string{"X-Content-Type-Options": "", "X-Frame-Options": "", "Referrer-Policy": "", "Strict-Transport-Security": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, _ := newTestServer(t, test.env)
+			// Served like in main, the headers are set outside the router
+			server := httptest.NewUnstartedServer(api.newHTTPServer("").Handler)
+			if test.tls {
+				server.StartTLS()
+			} else {
+				server.Start()
+			}
+			t.Cleanup(server.Close)
+			response, err := server.Client().Get(server.URL + "/health")
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			for header, want := range test.want {
+				if got := response.Header.Get(header); got != want {
+					t.Errorf("%s is %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Upgrade responses are left alone, the headers mean nothing to a websocket client
+func TestSecurityHeadersSkipWebSocket(t *testing.T) {
+	api, _ := newTestServer(t, nil)
+	knownDevices(api, "pi")
+	server := httptest.NewServer(api.newHTTPServer("").Handler)
+	t.Cleanup(server.Close)
+	_, response, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy"} {
+		if got := response.Header.Get(header); got != "" {
+			t.Errorf("upgrade sent %s: %s", header, got)
+		}
+	}
+}
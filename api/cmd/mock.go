@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// Structure
+
+// In memory provider for local development and tests, instances boot after a delay and cost nothing
+type MockProvider struct {
+	boot_delay time.Duration
+	endpoint_delay time.Duration // How long instances report running before their endpoint is assigned
+	reported_gpu string // GPU instances report instead of the requested one, empty reports the requested one
+	instances map[string]*mockInstance
+	failures map[string][]error // Injected errors per operation, returned before the operation runs
+	credit float64 // Reported account credit
+	next_id int
+	mu sync.Mutex
+}
+
+type mockInstance struct {
+	info InstanceInfo
+	ready_at time.Time
+	endpoint_at time.Time
+	paused bool
+	interrupted bool // Reclaimed by the simulated provider, see Interrupt
+}
+
+// Echoes prompts back after a simulated latency
+type MockBackend struct {
+	latency time.Duration
+	failures []error // Injected errors, returned by the next completions before they run
+	mu sync.Mutex
+}
+
+//// Functionality
+
+const mockEndpoint = "mock:8080"
+
+// Credit mock accounts start with, plenty for any PROVIDER_MIN_CREDIT
+const mockCredit = 1000.0
+
+func NewMockProvider(boot_delay time.Duration) *MockProvider {
+	return &MockProvider{boot_delay: boot_delay, instances: make(map[string]*mockInstance), failures: make(map[string][]error), credit: mockCredit}
+}
+
+// Makes the next call of the operation ("create", "destroy", "status", "list", "ping", "pause", "resume" or "credit")
+// fail with err, repeated calls queue up failures for the calls after it. Failing a pause with
+// ErrPauseUnsupported simulates a provider that can't pause
+func (p *MockProvider) FailNext(operation string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[operation] = append(p.failures[operation], err)
+}
+
+// Credit the account reports from now on
+func (p *MockProvider) SetCredit(credit float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.credit = credit
+}
+
+// Reclaims the instance like a provider whose interruptible rental was outbid, it reports
+// exited from now on
+func (p *MockProvider) Interrupt(instance_id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instance, ok := p.instances[instance_id]
+	if ok {
+		instance.interrupted = true
+	}
+	return ok
+}
+
+// Boot delay of instances created from now on
+func (p *MockProvider) SetBootDelay(boot_delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.boot_delay = boot_delay
+}
+
+// Makes instances created or resumed from now on report running without an endpoint for the delay,
+// like providers that mark the machine up before its ports are mapped
+func (p *MockProvider) SetEndpointDelay(endpoint_delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endpoint_delay = endpoint_delay
+}
+
+// Makes instances created from now on report the GPU instead of the requested one, like a recycled
+// machine, empty restores the requested one
+func (p *MockProvider) SetReportedGPU(gpu_type string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reported_gpu = gpu_type
+}
+
+// Pops the next injected failure of the operation, caller must hold mu
+func (p *MockProvider) injected(operation string) error {
+	queued := p.failures[operation]
+	if len(queued) == 0 {
+		return nil
+	}
+	p.failures[operation] = queued[1:]
+	return queued[0]
+}
+
+func (p *MockProvider) CreateInstance(ctx context.Context, spec InstanceSpec) (*InstanceInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("create"); err != nil {
+		return nil, err
+	}
+
+	p.next_id++
+	gpu_type := spec.GPUType
+	if p.reported_gpu != "" {
+		gpu_type = p.reported_gpu
+	}
+	geolocation := "mock"
+	if spec.Region != "" {
+		geolocation = "mock, " + spec.Region
+	}
+	instance := &mockInstance{
+		info: InstanceInfo{ID: fmt.Sprint(p.next_id), Status: "created", Label: spec.Label, GPUType: gpu_type, Image: spec.Image, BackendToken: shortUUID(), Metadata: map[string]any{
+			"gpu_name": gpu_type,
+			"geolocation": geolocation,
+		}},
+		ready_at: time.Now().Add(p.boot_delay),
+	}
+	instance.endpoint_at = instance.ready_at.Add(p.endpoint_delay)
+	p.instances[instance.info.ID] = instance
+
+	info := instance.info
+	return &info, nil
+}
+
+func (p *MockProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("destroy"); err != nil {
+		return err
+	}
+
+	if _, ok := p.instances[instance_id]; !ok {
+		return fmt.Errorf("%w: mock: unknown instance %s", ErrInstanceNotFound, instance_id)
+	}
+	delete(p.instances, instance_id)
+	return nil
+}
+
+func (p *MockProvider) PauseInstance(ctx context.Context, instance_id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("pause"); err != nil {
+		return err
+	}
+
+	instance, ok := p.instances[instance_id]
+	if !ok {
+		return fmt.Errorf("%w: mock: unknown instance %s", ErrInstanceNotFound, instance_id)
+	}
+	instance.paused = true
+	return nil
+}
+
+// Resumed instances skip the image pull and come back in a fraction of the boot delay
+func (p *MockProvider) ResumeInstance(ctx context.Context, instance_id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("resume"); err != nil {
+		return err
+	}
+
+	instance, ok := p.instances[instance_id]
+	if !ok {
+		return fmt.Errorf("%w: mock: unknown instance %s", ErrInstanceNotFound, instance_id)
+	}
+	instance.paused = false
+	instance.ready_at = time.Now().Add(p.boot_delay / 4)
+	instance.endpoint_at = instance.ready_at.Add(p.endpoint_delay)
+	return nil
+}
+
+func (p *MockProvider) InstanceStatus(ctx context.Context, instance_id string) (*InstanceInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("status"); err != nil {
+		return nil, err
+	}
+
+	instance, ok := p.instances[instance_id]
+	if !ok {
+		return nil, fmt.Errorf("%w: mock: unknown instance %s", ErrInstanceNotFound, instance_id)
+	}
+	info := instance.current()
+	return &info, nil
+}
+
+func (p *MockProvider) ListInstances(ctx context.Context) ([]InstanceInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("list"); err != nil {
+		return nil, err
+	}
+
+	instances := make([]InstanceInfo, 0, len(p.instances))
+	for _, instance := range p.instances {
+		instances = append(instances, instance.current())
+	}
+	return instances, nil
+}
+
+func (p *MockProvider) Credit(ctx context.Context) (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.injected("credit"); err != nil {
+		return 0, err
+	}
+	return p.credit, nil
+}
+
+func (p *MockProvider) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.injected("ping")
+}
+
+// Status of the instance, running once the boot delay has passed unless paused, with an endpoint
+// once the endpoint delay passed too
+func (instance *mockInstance) current() InstanceInfo {
+	info := instance.info
+	if instance.interrupted {
+		info.Status = "exited"
+	} else if instance.paused {
+		info.Status = "stopped"
+	} else if now := time.Now(); !now.Before(instance.ready_at) {
+		info.Status = "running"
+		if !now.Before(instance.endpoint_at) {
+			info.Endpoint = mockEndpoint
+		}
+	} else {
+		info.Status = "loading"
+	}
+	return info
+}
+
+func NewMockBackend(latency time.Duration) *MockBackend {
+	return &MockBackend{latency: latency}
+}
+
+// Makes the next completion fail with err, repeated calls queue up failures for the completions after it
+func (b *MockBackend) FailNext(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = append(b.failures, err)
+}
+
+func (b *MockBackend) injected() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.failures) == 0 {
+		return nil
+	}
+	err := b.failures[0]
+	b.failures = b.failures[1:]
+	return err
+}
+
+func (b *MockBackend) wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Words of the echo, cut at the first stop sequence and at max_tokens words like a real model would
+func mockTokens(request InferenceRequest) []string {
+	echo := "echo: " + request.Prompt
+	for _, stop := range request.Stop {
+		echo, _, _ = strings.Cut(echo, stop)
+	}
+	tokens := strings.SplitAfter(echo, " ")
+	if request.MaxTokens != nil && len(tokens) > *request.MaxTokens {
+		tokens = tokens[:*request.MaxTokens]
+	}
+	return tokens
+}
+
+func (b *MockBackend) Ready(ctx context.Context, endpoint string) error {
+	return nil
+}
+
+func (b *MockBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	if err := b.injected(); err != nil {
+		return "", err
+	}
+	if err := b.wait(ctx, b.latency); err != nil {
+		return "", err
+	}
+	echo := strings.Join(mockTokens(request), "")
+	for _, attachment := range request.Attachments {
+		echo += fmt.Sprintf(" [%s %s %d bytes]", attachment.Filename, attachment.ContentType, len(attachment.Data))
+	}
+	return echo, nil
+}
+
+// Streams the echo word by word, spreading the latency across the tokens
+func (b *MockBackend) Stream(ctx context.Context, endpoint string, request InferenceRequest, on_token func(token string) error) error {
+	tokens := mockTokens(request)
+	for _, token := range tokens {
+		if err := b.wait(ctx, b.latency/time.Duration(len(tokens))); err != nil {
+			return err
+		}
+		if err := on_token(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// The whole control, ready, infer, stop flow offline
+func TestMockModeLifecycle(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "10ms"})
+	if _, ok := api.Provider.(tracedProvider).ComputeProvider.(*MockProvider); !ok {
+		t.Fatalf("MOCK_PROVIDER wired %T", api.Provider)
+	}
+
+	statuses := recordStatuses(api, "pi")
+	status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true})
+	var started StatusResponse
+	if err := json.Unmarshal(body, &started); status != http.StatusOK || err != nil || started.Status != "init" {
+		t.Fatalf("start: %d %s", status, body)
+	}
+	conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for frame := readStatusFrame(t, conn); !frame.AcceptingInference; frame = readStatusFrame(t, conn) {
+	}
+
+	status, body = doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hello pi"})
+	var inference InferenceResponse
+	if err := json.Unmarshal(body, &inference); status != http.StatusOK || err != nil || inference.Response != "echo: hello pi" {
+		t.Fatalf("inference: %d %s", status, body)
+	}
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+	for frame := readStatusFrame(t, conn); frame.Status != "stopped"; frame = readStatusFrame(t, conn) {
+	}
+	if recorded := statuses(); !slices.Contains(recorded, "provisioning") || !slices.Contains(recorded, "ready") {
+		t.Fatalf("status transitions %v", recorded)
+	}
+	if ids := instanceIDs(t, api); len(ids) != 0 {
+		t.Fatalf("instances %v left after the stop", ids)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//// Functionality
+
+// Longest label the provider console accepts
+const maxInstanceNameLength = 64
+
+var nameVariablePattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+var nameVariables = map[string]bool{"env": true, "device_id": true, "tenant": true, "short_uuid": true}
+
+// Checks that the template only references known variables and renders to a valid name.
+// It has to start with "{env}-" since the orphan cleanup recognizes our instances by that prefix
+func validateNameTemplate(template string) error {
+	if !strings.HasPrefix(template, "{env}-") {
+		return fmt.Errorf("instance name template %q must start with {env}-", template)
+	}
+	for _, match := range nameVariablePattern.FindAllStringSubmatch(template, -1) {
+		if !nameVariables[match[1]] {
+			return fmt.Errorf("instance name template %q references unknown variable {%s}", template, match[1])
+		}
+	}
+
+	literal := nameVariablePattern.ReplaceAllString(template, "")
+	if strings.ContainsAny(literal, "{}") || invalidNameChars.MatchString(literal) {
+		return fmt.Errorf("instance name template %q contains characters not allowed in instance names", template)
+	}
+	if sample := substituteNameVariables(template, map[string]string{"env": "env", "device_id": "device", "tenant": "tenant", "short_uuid": "abcdef12"}); len(sample) > maxInstanceNameLength {
+		return fmt.Errorf("instance name template %q renders names longer than %d characters", template, maxInstanceNameLength)
+	}
+	return nil
+}
+
+// Substitutes the variables, their values are made name safe so a device ID can't produce an invalid name
+func substituteNameVariables(template string, values map[string]string) string {
+	return nameVariablePattern.ReplaceAllStringFunc(template, func(variable string) string {
+		return invalidNameChars.ReplaceAllString(values[strings.Trim(variable, "{}")], "-")
+	})
+}
+
+// Renders the template, cut to the longest name the provider accepts when long values overflow it
+func renderNameTemplate(template string, values map[string]string) string {
+	name := substituteNameVariables(template, values)
+	if len(name) > maxInstanceNameLength {
+		name = name[:maxInstanceNameLength]
+	}
+	return name
+}
+
+func shortUUID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Renders the name the next instance of the device is labeled with on the provider
+func (api *APIServer) instanceName(device_id string, tenant string) string {
+	return renderNameTemplate(api.Config().InstanceNameTemplate, map[string]string{
+		"env": api.Config().InstanceTag,
+		"device_id": device_id,
+		"tenant": tenant,
+		"short_uuid": shortUUID(),
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateNameTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		valid bool
+	}{
+		{"{env}-{device_id}-{short_uuid}", true},
+		{"{env}-{tenant}-{device_id}", true},
+		{"{env}-pi.{device_id}_x", true},
+		{"{device_id}-{env}", false},
+		{"{env}-{hostname}", false},
+		{"{env}-{device_id}/{short_uuid}", false},
+		{"{env}-{device_id", false},
+		{"{env}-" + strings.Repeat("x", maxInstanceNameLength), false},
+	}
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			if err := validateNameTemplate(test.template); (err == nil) != test.valid {
+				t.Fatalf("got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestRenderNameTemplate(t *testing.T) {
+	values := map[string]string{"env": "prod", "device_id": "kitchen pi/2", "tenant": "alice", "short_uuid": "abcdef12"}
+	tests := []struct {
+		template string
+		want string
+	}{
+		{"{env}-{device_id}-{short_uuid}", "prod-kitchen-pi-2-abcdef12"},
+		{"{env}-{tenant}", "prod-alice"},
+		{"{env}-" + strings.Repeat("x", 100), "prod-" + strings.Repeat("x", maxInstanceNameLength-5)},
+	}
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			if got := renderNameTemplate(test.template, values); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// The rendered name is recorded on the device and is the label the provider gets
+func TestInstanceNamedAtProvisioning(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"INSTANCE_TAG": "staging", "INSTANCE_NAME_TEMPLATE": "{env}-{device_id}-{short_uuid}"})
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	compute_state := api.getComputeState("pi")
+	compute_state.Mu.Lock()
+	name := compute_state.Name
+	compute_state.Mu.Unlock()
+	if !regexp.MustCompile(`^staging-pi-[0-9a-f]{8}$`).MatchString(name) {
+		t.Fatalf("device name %q", name)
+	}
+	instances, err := mockProvider(api).ListInstances(context.Background())
+	if err != nil || len(instances) != 1 || instances[0].Label != name {
+		t.Fatalf("provider instances %+v, want one labeled %s", instances, name)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+//// Functionality
+
+// OFFER_STRATEGY values, how CreateInstance picks among the offers matching a spec
+const (
+	offerCheapest = "cheapest"
+	offerFastest = "fastest" // Highest DLPerf score
+	offerMostReliable = "most-reliable"
+)
+
+// Hourly price the offer would be rented at
+func (offer vastOffer) price(interruptible bool) float64 {
+	if interruptible {
+		return offer.MinBid
+	}
+	return offer.DphTotal
+}
+
+// Best offer by the strategy, the cheaper one wins a tie and the first listed after that.
+// offers must not be empty
+func pickOffer(offers []vastOffer, strategy string, interruptible bool) vastOffer {
+	better := func(a, b vastOffer) bool {
+		switch strategy {
+		case offerFastest:
+			if a.DLPerf != b.DLPerf {
+				return a.DLPerf > b.DLPerf
+			}
+		case offerMostReliable:
+			if a.Reliability != b.Reliability {
+				return a.Reliability > b.Reliability
+			}
+		}
+		return a.price(interruptible) < b.price(interruptible)
+	}
+
+	best := offers[0]
+	for _, offer := range offers[1:] {
+		if better(offer, best) {
+			best = offer
+		}
+	}
+	return best
+}
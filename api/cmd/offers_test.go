@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Offers of a marketplace search, each one best by some measure
+var testOffers = []vastOffer{
+	{ID: 1, DphTotal: 0.50, MinBid: 0.20, Reliability: 0.95, DLPerf: 40},
+	{ID: 2, DphTotal: 0.35, MinBid: 0.30, Reliability: 0.90, DLPerf: 30},
+	{ID: 3, DphTotal: 0.80, MinBid: 0.40, Reliability: 0.99, DLPerf: 90},
+	{ID: 4, DphTotal: 0.60, MinBid: 0.35, Reliability: 0.99, DLPerf: 50},
+}
+
+func TestPickOffer(t *testing.T) {
+	tests := []struct {
+		name string
+		offers []vastOffer
+		strategy string
+		interruptible bool
+		want int
+	}{
+		{"cheapest", testOffers, offerCheapest, false, 2},
+		{"cheapest bid", testOffers, offerCheapest, true, 1},
+		{"fastest", testOffers, offerFastest, false, 3},
+		{"most reliable, tie broken by price", testOffers, offerMostReliable, false, 4},
+		{"single offer", testOffers[:1], offerFastest, false, 1},
+		{"equal offers keep the first listed", []vastOffer{{ID: 5, DphTotal: 0.4}, {ID: 6, DphTotal: 0.4}}, offerCheapest, false, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pickOffer(test.offers, test.strategy, test.interruptible); got.ID != test.want {
+				t.Fatalf("picked offer %d, want %d", got.ID, test.want)
+			}
+		})
+	}
+}
+
+// Stand-in of the VastAI api listing several offers and recording the ask that rents one
+type offersVastAI struct {
+	mu sync.Mutex
+	asked string // Path of the ask
+	ask map[string]any
+}
+
+func (f *offersVastAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/bundles/":
+		json.NewEncoder(w).Encode(map[string]any{"offers": testOffers})
+	case r.Method == "PUT":
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.asked = r.URL.Path
+		json.Unmarshal(body, &f.ask)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "new_contract": 42})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// The provider rents the offer the strategy picks and reports it in the instance metadata
+func TestVastAIOfferStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		interruptible bool
+		asked string
+		cost float64
+		offer vastOffer
+	}{
+		{offerCheapest, false, "/asks/2/", 0.35, testOffers[1]},
+		{offerCheapest, true, "/asks/1/", 0.20, testOffers[0]},
+		{offerFastest, false, "/asks/3/", 0.80, testOffers[2]},
+		{offerMostReliable, false, "/asks/4/", 0.60, testOffers[3]},
+	}
+	for _, test := range tests {
+		name := test.strategy
+		if test.interruptible {
+			name += " interruptible"
+		}
+		t.Run(name, func(t *testing.T) {
+			vast := &offersVastAI{}
+			vastai := httptest.NewServer(vast)
+			defer vastai.Close()
+			provider := NewVastAIProvider("key", vastai.URL, vastai.Client(), test.strategy, systemClock{})
+
+			spec := DefaultInstanceSpec()
+			spec.Interruptible = test.interruptible
+			info, err := provider.CreateInstance(context.Background(), spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vast.mu.Lock()
+			asked, price := vast.asked, vast.ask["price"]
+			vast.mu.Unlock()
+			if asked != test.asked {
+				t.Fatalf("rented %s, want %s", asked, test.asked)
+			}
+			if test.interruptible && price != test.cost {
+				t.Fatalf("bid %v, want %g", price, test.cost)
+			}
+			if info.CostPerHour != test.cost {
+				t.Fatalf("cost per hour %g, want %g", info.CostPerHour, test.cost)
+			}
+			for key, want := range map[string]any{
+				"offer_strategy": test.strategy,
+				"offer_price": test.offer.DphTotal,
+				"reliability": test.offer.Reliability,
+				"dlperf": test.offer.DLPerf,
+			} {
+				if got := info.Metadata[key]; got != want {
+					t.Fatalf("metadata %s is %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
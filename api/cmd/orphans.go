@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+//// Functionality
+
+// Periodically destroys provider instances bearing our tag that no device tracks, e.g. left over from a crash
+func (api *APIServer) watchOrphans(ctx context.Context) {
+	api.cleanupOrphans(ctx)
+
+	ticker := time.NewTicker(api.Config().OrphanScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			api.cleanupOrphans(ctx)
+		}
+	}
+}
+
+// Reports whether the provider instance is unknown to us, caller must hold ComputesMu
+func (api *APIServer) isOrphan(instance InstanceInfo) bool {
+	prefix := api.Config().InstanceTag + "-"
+	if !strings.HasPrefix(instance.Label, prefix) {
+		return false // Not ours, never touch it
+	}
+	if api.inWarmPool(instance) {
+		return false
+	}
+
+	for _, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		// A device that is provisioning may not have recorded the instance ID yet, but knows its name
+		tracked := compute_state.ID == instance.ID || (compute_state.IsRunning && compute_state.Name == instance.Label)
+		compute_state.Mu.Unlock()
+		if tracked {
+			return false
+		}
+	}
+	return true
+}
+
+func (api *APIServer) cleanupOrphans(ctx context.Context) {
+	instances, err := api.Provider.ListInstances(ctx)
+	if err != nil {
+		log.Println("orphan scan list instances error", err)
+		return
+	}
+
+	var orphans []InstanceInfo
+	api.ComputesMu.Lock()
+	for _, instance := range instances {
+		if api.isOrphan(instance) {
+			orphans = append(orphans, instance)
+		}
+	}
+	api.ComputesMu.Unlock()
+
+	for _, orphan := range orphans {
+		if api.Config().OrphanCleanupDryRun {
+			log.Println("orphan scan would destroy instance (dry run)", orphan.ID, orphan.Label)
+			continue
+		}
+		log.Println("orphan scan destroying instance", orphan.ID, orphan.Label)
+		if err := api.Provider.DestroyInstance(ctx, orphan.ID); err != nil {
+			log.Println("orphan instance destroy error", orphan.ID, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestCleanupOrphans(t *testing.T) {
+	tests := []struct {
+		name string
+		dry_run string
+		want []string // Labels left on the provider
+	}{
+		{"destroys orphans", "false", []string{"someone-elses", "tracked"}},
+		{"dry run", "true", []string{"someone-elses", "tracked", "orphan"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"ORPHAN_CLEANUP_DRY_RUN": test.dry_run})
+			startDevice(t, api, server, testAPIKey, "pi")
+			provider := mockProvider(api)
+			ctx := context.Background()
+			labels := map[string]string{api.getComputeState("pi").Name: "tracked"}
+			for label, name := range map[string]string{"someone-elses": "someone-elses", "gorasp-orphan": "orphan"} {
+				if _, err := provider.CreateInstance(ctx, InstanceSpec{Label: label}); err != nil {
+					t.Fatal(err)
+				}
+				labels[label] = name
+			}
+
+			api.cleanupOrphans(ctx)
+			instances, err := provider.ListInstances(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var left []string
+			for _, instance := range instances {
+				left = append(left, labels[instance.Label])
+			}
+			slices.Sort(left)
+			want := slices.Sorted(slices.Values(test.want))
+			if !slices.Equal(left, want) {
+				t.Fatalf("left %v, want %v", left, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//// Structure
+
+// Optional generation settings of an inference request, unset ones fall back to the INFERENCE_* defaults
+type InferenceParameters struct {
+	MaxTokens *int `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP *float64 `json:"top_p,omitempty"`
+	Stop []string `json:"stop,omitempty"` // Generation ends before any of these
+	Timeout string `json:"timeout,omitempty"` // Bound of the whole generation, e.g. "30s", overrides INFERENCE_DEADLINE up to INFERENCE_TIMEOUT_MAX
+}
+
+//// Functionality
+
+// Most stop sequences the OpenAI completions API takes
+const maxStopSequences = 4
+
+func (params InferenceParameters) validate(config *Config) fieldErrors {
+	max_tokens_limit := config.InferenceMaxTokensLimit
+	errs := fieldErrors{}
+	if params.MaxTokens != nil {
+		errs.check(*params.MaxTokens >= 1 && *params.MaxTokens <= max_tokens_limit, "max_tokens", fmt.Sprintf("must be between 1 and %d", max_tokens_limit))
+	}
+	if params.Temperature != nil {
+		errs.check(*params.Temperature >= 0 && *params.Temperature <= 2, "temperature", "must be between 0 and 2")
+	}
+	if params.TopP != nil {
+		errs.check(*params.TopP > 0 && *params.TopP <= 1, "top_p", "must be above 0 and at most 1")
+	}
+	errs.check(len(params.Stop) <= maxStopSequences, "stop", fmt.Sprintf("at most %d sequences", maxStopSequences))
+	for _, stop := range params.Stop {
+		errs.check(stop != "", "stop", "must not contain empty sequences")
+	}
+	if params.Timeout != "" {
+		timeout, err := time.ParseDuration(params.Timeout)
+		errs.check(err == nil && timeout > 0 && timeout <= config.InferenceTimeoutMax, "timeout", fmt.Sprintf("must be a duration above 0 and at most %s", config.InferenceTimeoutMax))
+	}
+	return errs
+}
+
+// Bound of the generation, the requested timeout or the fallback when none was asked for.
+// Only meaningful after validate
+func (params InferenceParameters) timeout(fallback time.Duration) time.Duration {
+	if timeout, err := time.ParseDuration(params.Timeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return fallback
+}
+
+// Fills the unset parameters from the configured defaults
+func (params InferenceParameters) withDefaults(config *Config) InferenceParameters {
+	max_tokens, temperature, top_p := config.InferenceMaxTokens, config.InferenceTemperature, config.InferenceTopP
+	if params.MaxTokens == nil {
+		params.MaxTokens = &max_tokens
+	}
+	if params.Temperature == nil {
+		params.Temperature = &temperature
+	}
+	if params.TopP == nil {
+		params.TopP = &top_p
+	}
+	return params
+}
+
+// Reads the parameters of a multipart inference request, every stop field adds a sequence
+func readFormParameters(r *http.Request) (InferenceParameters, error) {
+	var params InferenceParameters
+	if value := r.FormValue("max_tokens"); value != "" {
+		max_tokens, err := strconv.Atoi(value)
+		if err != nil {
+			return params, fmt.Errorf("invalid max_tokens: %w", err)
+		}
+		params.MaxTokens = &max_tokens
+	}
+	for field, target := range map[string]**float64{"temperature": &params.Temperature, "top_p": &params.TopP} {
+		if value := r.FormValue(field); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return params, fmt.Errorf("invalid %s: %w", field, err)
+			}
+			*target = &parsed
+		}
+	}
+	params.Stop = r.MultipartForm.Value["stop"]
+	params.Timeout = r.FormValue("timeout")
+	return params, nil
+}
+
+// One line summary of the problems, for channels without a structured error like websocket frames
+func (errs fieldErrors) String() string {
+	problems := make([]string, 0, len(errs))
+	for field, problem := range errs {
+		problems = append(problems, field+" "+problem)
+	}
+	sort.Strings(problems)
+	return strings.Join(problems, ", ")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Wraps the mock backend keeping the last request it was asked to complete
+type recordingBackend struct {
+	InferenceBackend
+	request InferenceRequest
+	mu sync.Mutex
+}
+
+func (b *recordingBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	b.mu.Lock()
+	b.request = request
+	b.mu.Unlock()
+	return b.InferenceBackend.Complete(ctx, endpoint, request)
+}
+
+func (b *recordingBackend) last() InferenceRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.request
+}
+
+func TestInferenceParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		params map[string]any
+		max_tokens int
+		temperature float64
+		top_p float64
+		stop []string
+	}{
+		{"defaults", nil, 32, 0.7, 0.9, nil},
+		{"forwarded", map[string]any{"max_tokens": 8, "temperature": 0, "top_p": 0.5, "stop": []string{"\n", "END"}}, 8, 0, 0.5, []string{"\n", "END"}},
+		{"partly set", map[string]any{"temperature": 1.5}, 32, 1.5, 0.9, nil},
+	}
+	api, server := newTestServer(t, map[string]string{"INFERENCE_MAX_TOKENS": "32", "INFERENCE_TEMPERATURE": "0.7", "INFERENCE_TOP_P": "0.9"})
+	backend := &recordingBackend{InferenceBackend: api.Backend}
+	api.Backend = backend
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := map[string]any{"device_id": "pi", "prompt": "hello"}
+			for key, value := range test.params {
+				body[key] = value
+			}
+			if status, response := doRequest(t, server, "POST", "/respond", testAPIKey, body); status != http.StatusOK {
+				t.Fatalf("inference: %d %s", status, response)
+			}
+			request := backend.last()
+			if request.MaxTokens == nil || request.Temperature == nil || request.TopP == nil {
+				t.Fatalf("backend got unset parameters %+v", request.InferenceParameters)
+			}
+			if *request.MaxTokens != test.max_tokens || *request.Temperature != test.temperature || *request.TopP != test.top_p || !slices.Equal(request.Stop, test.stop) {
+				t.Fatalf("backend got max_tokens %d temperature %g top_p %g stop %q", *request.MaxTokens, *request.Temperature, *request.TopP, request.Stop)
+			}
+		})
+	}
+}
+
+func TestInferenceParameterRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		params map[string]any
+		field string
+	}{
+		{"no tokens", map[string]any{"max_tokens": 0}, "max_tokens"},
+		{"tokens over the limit", map[string]any{"max_tokens": 65}, "max_tokens"},
+		{"negative temperature", map[string]any{"temperature": -0.1}, "temperature"},
+		{"temperature above 2", map[string]any{"temperature": 2.1}, "temperature"},
+		{"zero top_p", map[string]any{"top_p": 0}, "top_p"},
+		{"top_p above 1", map[string]any{"top_p": 1.1}, "top_p"},
+		{"too many stops", map[string]any{"stop": []string{"a", "b", "c", "d", "e"}}, "stop"},
+		{"empty stop", map[string]any{"stop": []string{""}}, "stop"},
+	}
+	api, server := newTestServer(t, map[string]string{"INFERENCE_MAX_TOKENS": "32", "INFERENCE_MAX_TOKENS_LIMIT": "64"})
+	backend := &recordingBackend{InferenceBackend: api.Backend}
+	api.Backend = backend
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := map[string]any{"device_id": "pi", "prompt": "rejected"}
+			for key, value := range test.params {
+				body[key] = value
+			}
+			status, response := doRequest(t, server, "POST", "/respond", testAPIKey, body)
+			var errors ValidationErrorResponse
+			if err := json.Unmarshal(response, &errors); status != http.StatusBadRequest || err != nil {
+				t.Fatalf("got %d %s, want 400", status, response)
+			}
+			if _, ok := errors.Fields[test.field]; !ok || len(errors.Fields) != 1 {
+				t.Fatalf("errors %v, want one on %s", errors.Fields, test.field)
+			}
+			if backend.last().Prompt == "rejected" {
+				t.Fatal("rejected request reached the backend")
+			}
+		})
+	}
+}
+
+// The OpenAI backend maps the parameters onto the completions fields, unset ones stay out
+func TestOpenAIParameterMapping(t *testing.T) {
+	max_tokens, temperature, top_p := 16, 0.2, 0.8
+	tests := []struct {
+		name string
+		params InferenceParameters
+		want map[string]any
+	}{
+		{"all set", InferenceParameters{MaxTokens: &max_tokens, Temperature: &temperature, TopP: &top_p, Stop: []string{"END"}},
+			map[string]any{"max_tokens": 16.0, "temperature": 0.2, "top_p": 0.8, "stop": []any{"END"}}},
+		{"unset", InferenceParameters{}, map[string]any{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var received map[string]any
+			instance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				json.Unmarshal(data, &received)
+				json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"text": "ok"}}})
+			}))
+			defer instance.Close()
+
+			backend := NewOpenAIBackend("model", "/health", 0, "Authorization", "", []string{"choices", "0", "text"}, nil)
+			if _, err := backend.Complete(context.Background(), strings.TrimPrefix(instance.URL, "http://"), InferenceRequest{Prompt: "hi", InferenceParameters: test.params}); err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range []string{"max_tokens", "temperature", "top_p", "stop"} {
+				got, ok := received[field]
+				want, wanted := test.want[field]
+				if ok != wanted || (ok && !jsonEqual(got, want)) {
+					t.Fatalf("%s sent as %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func jsonEqual(a any, b any) bool {
+	encoded_a, _ := json.Marshal(a)
+	encoded_b, _ := json.Marshal(b)
+	return string(encoded_a) == string(encoded_b)
+}
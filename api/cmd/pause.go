@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//// Structure
+
+// Implemented by providers that can stop an instance while keeping it allocated. A stopped
+// instance only bills its storage and resumes faster than a fresh provision
+type PausableProvider interface {
+	PauseInstance(ctx context.Context, instance_id string) error
+	ResumeInstance(ctx context.Context, instance_id string) error
+}
+
+//// Functionality
+
+// Returned when the provider can't pause, the device is paused by destroying the instance instead
+var ErrPauseUnsupported = errors.New("provider can't pause instances")
+
+// Whether the device is paused or on its way in or out of it
+func isPausedStatus(status string) bool {
+	return status == "pausing" || status == "paused" || status == "resuming"
+}
+
+func pauseInstance(ctx context.Context, provider ComputeProvider, instance_id string) error {
+	pausable, ok := provider.(PausableProvider)
+	if !ok {
+		return ErrPauseUnsupported
+	}
+	return pausable.PauseInstance(ctx, instance_id)
+}
+
+func resumeInstance(ctx context.Context, provider ComputeProvider, instance_id string) error {
+	pausable, ok := provider.(PausableProvider)
+	if !ok {
+		return ErrPauseUnsupported
+	}
+	return pausable.ResumeInstance(ctx, instance_id)
+}
+
+// Stops the instance of a ready device without giving it up, inference answers 409 until it is resumed
+func (api *APIServer) handlePauseRequest(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+
+	provision_timeout, err := api.requestTimeout(r, api.Config().ProvisionTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+	if rejectForeignDevice(w, r, compute_state) {
+		return
+	}
+
+	api.ComputesMu.Lock()
+	compute_state.Mu.Lock()
+	// Shared instances keep serving the other devices, they can't be paused from under them
+	can_pause := compute_state.IsRunning && compute_state.Status == "ready" &&
+		!compute_state.Attached && api.InstanceRefs[compute_state.ID] <= 1
+	if can_pause {
+		compute_state.Status = "pausing"
+	}
+	compute_state.Mu.Unlock()
+	api.ComputesMu.Unlock()
+
+	if !can_pause {
+		log.Println("trying to PAUSE a compute that is not READY error")
+		http.Error(w, "compute not ready", http.StatusConflict)
+		return
+	}
+
+	pause_ctx, cancel_pause := context.WithTimeout(withRequestTrace(api.lifecycle_ctx, r), provision_timeout)
+	if !api.submitProvision(func() {
+		defer cancel_pause()
+		api.pauseCompute(pause_ctx, device_id)
+	}) {
+		api.rejectProvision(w, r, compute_state, cancel_pause, "ready", true)
+		return
+	}
+
+	if err := encodeResponseStatus(w, r, http.StatusAccepted, StatusResponse{
+		Status: "pausing",
+		WebSocketURL: statusURL(r, device_id),
+		ServedAt: api.servedAt(),
+	}); err != nil {
+		logWriteError("status response encoding error", err)
+	}
+}
+
+// Brings a paused device back, a stop while resuming aborts it like a stop while provisioning
+func (api *APIServer) handleResumeRequest(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+	if api.rejectInMaintenance(w, r) {
+		return
+	}
+
+	provision_timeout, err := api.requestTimeout(r, api.Config().ProvisionTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+	if rejectForeignDevice(w, r, compute_state) {
+		return
+	}
+
+	var provision_ctx context.Context
+	var cancel_provision context.CancelFunc
+
+	compute_state.Mu.Lock()
+	can_resume := compute_state.IsRunning && compute_state.Status == "paused"
+	if can_resume {
+		provision_ctx, cancel_provision = context.WithTimeout(withRequestTrace(api.lifecycle_ctx, r), provision_timeout)
+		compute_state.Status = "resuming"
+		compute_state.CancelProvision = cancel_provision
+	}
+	compute_state.Mu.Unlock()
+
+	if !can_resume {
+		log.Println("trying to RESUME a compute that is not PAUSED error")
+		http.Error(w, "compute not paused", http.StatusConflict)
+		return
+	}
+
+	if !api.submitProvision(func() { api.resumeCompute(provision_ctx, device_id) }) {
+		api.rejectProvision(w, r, compute_state, cancel_provision, "paused", true)
+		return
+	}
+
+	if err := encodeResponseStatus(w, r, http.StatusAccepted, StatusResponse{
+		Status: "resuming",
+		WebSocketURL: statusURL(r, device_id),
+		ServedAt: api.servedAt(),
+	}); err != nil {
+		logWriteError("status response encoding error", err)
+	}
+}
+
+// Stops the instance keeping it allocated, or destroys it when the provider can't pause.
+// Either way the spec is kept so the resume comes back with the same machine type
+func (api *APIServer) pauseCompute(ctx context.Context, device_id string) {
+	defer api.provisioning.Done()
+
+	compute_state := api.getComputeState(device_id)
+	// A stop waits for the pause to be through with the provider
+	compute_state.OpMu.Lock()
+	defer compute_state.OpMu.Unlock()
+
+	compute_state.Mu.Lock()
+	instance_id := compute_state.ID
+	compute_state.Mu.Unlock()
+
+	err := api.retryRateLimited(ctx, device_id, nil, func() error {
+		return pauseInstance(ctx, api.Provider, instance_id)
+	})
+	if errors.Is(err, ErrPauseUnsupported) {
+		log.Println("provider can't pause, destroying the instance instead", device_id)
+		err = api.destroyInstance(ctx, device_id)
+	}
+
+	// A stop while pausing tore the device down, it must not come back as paused or ready
+	compute_state.Mu.Lock()
+	changed := !compute_state.IsRunning || compute_state.Status != "pausing"
+	if !changed && err == nil && compute_state.ID == instance_id {
+		// The endpoint may change once the instance is started again
+		compute_state.Endpoint = ""
+		compute_state.PausedAt = api.Clock.Now()
+		compute_state.AcceptingInference = false
+	}
+	compute_state.Mu.Unlock()
+	if changed {
+		log.Println("device changed while pausing, leaving it", device_id, instance_id)
+		return
+	}
+	if err != nil {
+		// The instance is still up, keep serving from it
+		log.Println("compute pause error", device_id, err)
+		api.setStatus(device_id, "ready")
+		return
+	}
+
+	log.Println("compute paused", device_id, instance_id)
+	api.setStatus(device_id, "paused")
+}
+
+// Starts the stopped instance again, or provisions a fresh one if the pause destroyed it
+func (api *APIServer) resumeCompute(ctx context.Context, device_id string) {
+	defer api.provisioning.Done()
+
+	compute_state := api.getComputeState(device_id)
+
+	compute_state.Mu.Lock()
+	instance_id := compute_state.ID
+	spec := compute_state.Spec
+	compute_state.Mu.Unlock()
+
+	api.setStatus(device_id, "resuming")
+
+	var err error
+	if instance_id == "" {
+		// Like a start, stops wait for the provider to accept the fresh instance
+		created := make(chan error, 1)
+		compute_state.OpMu.Lock()
+		go func() {
+			<-created
+			compute_state.OpMu.Unlock()
+		}()
+		err = api.provisionInstance(ctx, device_id, spec, "resuming", created)
+	} else {
+		compute_state.OpMu.Lock()
+		err = api.retryRateLimited(ctx, device_id, nil, func() error {
+			return resumeInstance(ctx, api.Provider, instance_id)
+		})
+		compute_state.OpMu.Unlock()
+		if err == nil {
+			// The paused time accrued no compute cost
+			compute_state.Mu.Lock()
+			compute_state.StartedAt = compute_state.StartedAt.Add(api.Clock.Now().Sub(compute_state.PausedAt))
+			compute_state.PausedAt = time.Time{}
+			compute_state.Mu.Unlock()
+
+			err = api.waitForInstance(ctx, device_id, instance_id, spec)
+		}
+	}
+	// Settled under OpMu like a start
+	compute_state.OpMu.Lock()
+	defer compute_state.OpMu.Unlock()
+	if !api.finishProvisioning(ctx, device_id) {
+		api.cancelCompute(device_id)
+		return
+	}
+	if err != nil {
+		api.failCompute(device_id, fmt.Errorf("resume failed: %w", err))
+		return
+	}
+	// A pause that had to destroy the instance resumed on a freshly rented one
+	api.instanceReady(device_id, instance_id != "")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	tests := []struct {
+		name string
+		pausable bool
+	}{
+		{"pausable provider", true},
+		{"provider without pause", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			startDevice(t, api, server, testAPIKey, "pi")
+			paused_id := instanceID(api, "pi")
+			if !test.pausable {
+				mockProvider(api).FailNext("pause", ErrPauseUnsupported)
+			}
+
+			if status, body := doRequest(t, server, "POST", "/pause/pi", testAPIKey, nil); status != http.StatusAccepted {
+				t.Fatalf("pause: %d %s", status, body)
+			}
+			waitFor(t, "the pause", func() bool { return deviceStatus(api, "pi") == "paused" })
+			if kept := slices.Contains(instanceIDs(t, api), paused_id); kept != test.pausable {
+				t.Fatalf("instance kept %v while paused, want %v", kept, test.pausable)
+			}
+			if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"}); status != http.StatusConflict {
+				t.Fatalf("inference while paused: %d %s", status, body)
+			}
+
+			if status, body := doRequest(t, server, "POST", "/resume/pi", testAPIKey, nil); status != http.StatusAccepted {
+				t.Fatalf("resume: %d %s", status, body)
+			}
+			waitFor(t, "the resume", func() bool { return deviceStatus(api, "pi") == "ready" })
+			if same := instanceID(api, "pi") == paused_id; same != test.pausable {
+				t.Fatalf("resumed on the paused instance %v, want %v", same, test.pausable)
+			}
+			if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"}); status != http.StatusOK {
+				t.Fatalf("inference after the resume: %d %s", status, body)
+			}
+		})
+	}
+}
+
+func TestPauseResumeConflicts(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	knownDevices(api, "pi")
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"pause stopped device", "/pause/pi"},
+		{"resume running device", "/resume/pi"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.path == "/resume/pi" {
+				startDevice(t, api, server, testAPIKey, "pi")
+			}
+			if status, body := doRequest(t, server, "POST", test.path, testAPIKey, nil); status != http.StatusConflict {
+				t.Fatalf("got %d %s, want 409", status, body)
+			}
+		})
+	}
+}
+
+// The compute routes pause and resume like the short ones, inference in between is refused
+func TestComputePauseRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		pause string
+		resume string
+	}{
+		{"compute routes", "/compute/pi/pause", "/compute/pi/resume"},
+		{"versioned compute routes", "/v1/compute/pi/pause", "/v1/compute/pi/resume"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			if status, body := doRequest(t, server, "POST", test.pause, testAPIKey, nil); status != http.StatusAccepted {
+				t.Fatalf("pause: %d %s", status, body)
+			}
+			waitFor(t, "the pause", func() bool { return deviceStatus(api, "pi") == "paused" })
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusConflict || err != nil || response.Error != "compute_paused" {
+				t.Fatalf("inference while paused: %d %s, want 409 compute_paused", status, body)
+			}
+
+			if status, body := doRequest(t, server, "POST", test.resume, testAPIKey, nil); status != http.StatusAccepted {
+				t.Fatalf("resume: %d %s", status, body)
+			}
+			waitFor(t, "the resume", func() bool { return deviceStatus(api, "pi") == "ready" })
+		})
+	}
+}
+
+// Provider whose pauses wait for release, so a test can act while one is in flight
+type blockingPauseProvider struct {
+	ComputeProvider
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPauseProvider) PauseInstance(ctx context.Context, instance_id string) error {
+	close(p.entered)
+	<-p.release
+	return pauseInstance(ctx, p.ComputeProvider, instance_id)
+}
+
+func (p *blockingPauseProvider) ResumeInstance(ctx context.Context, instance_id string) error {
+	return resumeInstance(ctx, p.ComputeProvider, instance_id)
+}
+
+// A stop that comes in while the pause is in flight leaves the device stopped, not paused on a destroyed instance
+func TestStopWhilePausing(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	mock := mockProvider(api)
+	startDevice(t, api, server, testAPIKey, "pi")
+	provider := &blockingPauseProvider{ComputeProvider: api.Provider, entered: make(chan struct{}), release: make(chan struct{})}
+	api.Provider = provider
+
+	if status, body := doRequest(t, server, "POST", "/pause/pi", testAPIKey, nil); status != http.StatusAccepted {
+		t.Fatalf("pause: %d %s", status, body)
+	}
+	<-provider.entered
+	// The stop waits for the pause to be through with the provider
+	stopped := make(chan int, 1)
+	go func() {
+		status, _ := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false})
+		stopped <- status
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case status := <-stopped:
+		t.Fatalf("stop answered %d while the pause was in flight", status)
+	default:
+	}
+	close(provider.release)
+	if status := <-stopped; status != http.StatusAccepted {
+		t.Fatalf("stop: %d", status)
+	}
+
+	waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+	// Past the end of the pause
+	time.Sleep(20 * time.Millisecond)
+	if status, id := deviceStatus(api, "pi"), instanceID(api, "pi"); status != "stopped" || id != "" {
+		t.Fatalf("device %s on %q after the stop", status, id)
+	}
+	if instances, _ := mock.ListInstances(context.Background()); len(instances) != 0 {
+		t.Fatalf("instances %v left after the stop", instances)
+	}
+	if status, body := doRequest(t, server, "POST", "/resume/pi", testAPIKey, nil); status != http.StatusConflict {
+		t.Fatalf("resume of the stopped device: %d %s, want 409", status, body)
+	}
+}
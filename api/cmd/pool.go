@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+//// Functionality
+
+// Runs queued provisionings on a fixed number of goroutines, so a burst of control requests can't
+// spawn unbounded provisioning goroutines. A shutdown cancels the queued jobs, the workers run them
+// so they drain right away and return once the queue is empty
+func (api *APIServer) startProvisionWorkers(workers int) {
+	for range workers {
+		api.startWatcher(func(ctx context.Context) {
+			for {
+				select {
+				case job := <-api.provision_queue:
+					job()
+				case <-ctx.Done():
+					for {
+						select {
+						case job := <-api.provision_queue:
+							job()
+						default:
+							return
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// Queues a provisioning job, returns false if the queue is full. The job must call
+// api.provisioning.Done when it finishes
+func (api *APIServer) submitProvision(job func()) bool {
+	api.provisioning.Add(1)
+	select {
+	case api.provision_queue <- job:
+		return true
+	default:
+		api.provisioning.Done()
+		return false
+	}
+}
+
+// Undoes the claim of a device whose provisioning was rejected by a full queue, then answers 503
+func (api *APIServer) rejectProvision(w http.ResponseWriter, r *http.Request, compute_state *ComputeState, cancel context.CancelFunc, status string, is_running bool) {
+	cancel()
+
+	compute_state.Mu.Lock()
+	compute_state.Status = status
+	compute_state.IsRunning = is_running
+	compute_state.CancelProvision = nil
+	compute_state.Mu.Unlock()
+
+	log.Println("provisioning queue full", compute_state.DeviceID)
+	writeError(w, r, http.StatusServiceUnavailable, "provisioning_busy", "")
+}
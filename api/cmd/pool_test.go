@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Occupies the single provisioning worker and fills the one queue slot behind it. A queued start
+// waits for a worker before it answers, so the busy device is stopped at the end to let it through
+func saturateProvisioning(t *testing.T, api *APIServer, server *httptest.Server) {
+	t.Helper()
+	mockProvider(api).SetBootDelay(time.Hour)
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "busy", "run": true}); status != http.StatusOK {
+		t.Fatalf("start busy: %d %s", status, body)
+	}
+
+	queued := newRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "queued", "run": true})
+	answered := make(chan struct{})
+	go func() {
+		defer close(answered)
+		if response, err := http.DefaultClient.Do(queued); err == nil {
+			response.Body.Close()
+		}
+	}()
+	waitFor(t, "the start to be queued", func() bool { return len(api.provision_queue) == 1 })
+
+	t.Cleanup(func() {
+		doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "busy", "run": false})
+		<-answered
+	})
+}
+
+func TestProvisioningBackpressure(t *testing.T) {
+	tests := []struct {
+		name string
+		setup func(t *testing.T, api *APIServer, server *httptest.Server)
+		path string
+		body any
+		kept string // Status the device keeps after the rejection
+	}{
+		{
+			name: "start",
+			setup: func(t *testing.T, api *APIServer, server *httptest.Server) {},
+			path: "/control",
+			body: map[string]any{"device_id": "pi", "run": true},
+			kept: "idle",
+		},
+		{
+			name: "pause",
+			setup: func(t *testing.T, api *APIServer, server *httptest.Server) {
+				startDevice(t, api, server, testAPIKey, "pi")
+			},
+			path: "/pause/pi",
+			kept: "ready",
+		},
+		{
+			name: "resume",
+			setup: func(t *testing.T, api *APIServer, server *httptest.Server) {
+				startDevice(t, api, server, testAPIKey, "pi")
+				if status, body := doRequest(t, server, "POST", "/pause/pi", testAPIKey, nil); status != http.StatusAccepted {
+					t.Fatalf("pause: %d %s", status, body)
+				}
+				waitFor(t, "the pause", func() bool { return deviceStatus(api, "pi") == "paused" })
+			},
+			path: "/resume/pi",
+			kept: "paused",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"PROVISION_WORKERS": "1", "PROVISION_QUEUE": "1"})
+			test.setup(t, api, server)
+			saturateProvisioning(t, api, server)
+
+			status, body := doRequest(t, server, "POST", test.path, testAPIKey, test.body)
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusServiceUnavailable || err != nil || response.Error != "provisioning_busy" {
+				t.Fatalf("got %d %s, want 503 provisioning_busy", status, body)
+			}
+			if status := deviceStatus(api, "pi"); status != test.kept {
+				t.Fatalf("device %s after the rejection, want %s", status, test.kept)
+			}
+		})
+	}
+}
+
+// A stop reaches a start waiting in the provision queue right away and cancels it before anything is rented
+func TestStopQueuedStart(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"PROVISION_WORKERS": "1", "PROVISION_QUEUE": "1"})
+	mockProvider(api).SetBootDelay(time.Hour)
+	var rented atomic.Bool
+	api.Events.Subscribe(func(event Event) {
+		if starting, ok := event.(InstanceStarting); ok && starting.DeviceID == "queued" {
+			rented.Store(true)
+		}
+	})
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "busy", "run": true}); status != http.StatusOK {
+		t.Fatalf("start busy: %d %s", status, body)
+	}
+
+	started := make(chan int, 1)
+	start := newRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "queued", "run": true})
+	go func() {
+		response, err := http.DefaultClient.Do(start)
+		if err != nil {
+			started <- 0
+			return
+		}
+		response.Body.Close()
+		started <- response.StatusCode
+	}()
+	waitFor(t, "the start to be queued", func() bool { return len(api.provision_queue) == 1 })
+
+	stopped := make(chan int, 1)
+	stop := newRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "queued", "run": false})
+	go func() {
+		response, err := http.DefaultClient.Do(stop)
+		if err != nil {
+			stopped <- 0
+			return
+		}
+		response.Body.Close()
+		stopped <- response.StatusCode
+	}()
+	select {
+	case status := <-stopped:
+		if status != http.StatusAccepted {
+			t.Fatalf("stop of the queued start: %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop waited for the queued start")
+	}
+
+	// Frees the worker, the cancelled job runs next
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "busy", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop busy: %d %s", status, body)
+	}
+	if status := <-started; status != http.StatusConflict {
+		t.Fatalf("cancelled start answered %d, want 409", status)
+	}
+	waitFor(t, "the queued device to stop", func() bool { return deviceStatus(api, "queued") == "stopped" })
+	if rented.Load() {
+		t.Fatal("the cancelled start rented an instance")
+	}
+}
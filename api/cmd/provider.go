@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"RASBERRY_api/provider"
+)
+
+//// Structure
+
+// Provider Structures, declared in the provider package so fakes outside the server can implement them
+type ComputeProvider = provider.ComputeProvider
+type InstanceSpec = provider.InstanceSpec
+type InstanceInfo = provider.InstanceInfo
+type RateLimitError = provider.RateLimitError
+
+type VastAIProvider struct {
+	api_key string
+	base_url string // PROVIDER_BASE_URL, points at a stand-in of the api in tests and staging
+	client *http.Client
+	offer_strategy string // OFFER_STRATEGY
+	clock Clock // Resolves Retry-After dates
+}
+
+// VastAI Response Structures
+type vastOffer struct {
+	ID int `json:"id"`
+	GPUName string `json:"gpu_name"`
+	DphTotal float64 `json:"dph_total"`
+	Geolocation string `json:"geolocation"`
+	Datacenter bool `json:"hosting_type_datacenter"`
+	Reliability float64 `json:"reliability2"`
+	InetDown float64 `json:"inet_down"` // Mbps
+	InetUp float64 `json:"inet_up"`
+	MachineID int `json:"machine_id"`
+	MinBid float64 `json:"min_bid"` // Lowest price an interruptible rental is accepted at
+	DLPerf float64 `json:"dlperf"` // VastAI deep learning performance score, higher is faster
+}
+
+type vastInstance struct {
+	ID int `json:"id"`
+	ActualStatus string `json:"actual_status"`
+	PublicIP string `json:"public_ipaddr"`
+	Ports map[string][]struct {
+		HostPort string `json:"HostPort"`
+	} `json:"ports"`
+	DphTotal float64 `json:"dph_total"`
+	Label string `json:"label"`
+	GPUName string `json:"gpu_name"`
+	Image string `json:"image_uuid"`
+}
+
+//// Functionality
+
+// Provider failures callers can act on, wrapped with the provider detail
+var (
+	ErrProviderNoCapacity = provider.ErrProviderNoCapacity
+	ErrProviderQuota = provider.ErrProviderQuota
+	ErrProviderAuth = provider.ErrProviderAuth
+	ErrInstanceNotFound = provider.ErrInstanceNotFound
+)
+
+const vastAIBaseURL = "https://console.vast.ai/api/v0"
+
+// Port the inference server listens on inside the instance
+const backendPort = "8080/tcp"
+
+// Parses a Retry-After header given either in seconds or as an HTTP date, 0 if absent or invalid
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
+
+func DefaultInstanceSpec() InstanceSpec {
+	return InstanceSpec{
+		GPUType: "RTX_4090",
+		Image: "vllm/vllm-openai:latest",
+		DiskGB: 40,
+	}
+}
+
+func NewVastAIProvider(api_key string, base_url string, client *http.Client, offer_strategy string, clock Clock) *VastAIProvider {
+	return &VastAIProvider{api_key: api_key, base_url: strings.TrimSuffix(base_url, "/"), client: client, offer_strategy: offer_strategy, clock: clock}
+}
+
+// Sends an authenticated request to VastAI and decodes the json response into out
+func (p *VastAIProvider) do(ctx context.Context, method string, path string, body any, out any) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.base_url+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.api_key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: vastai %s %s: status %d", ErrProviderAuth, method, path, resp.StatusCode)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err := fmt.Errorf("%w: vastai %s %s: status %d", ErrProviderQuota, method, path, resp.StatusCode)
+		if retry_after := parseRetryAfter(resp.Header.Get("Retry-After"), p.clock.Now()); retry_after > 0 {
+			return &RateLimitError{RetryAfter: retry_after, Err: err}
+		}
+		return err
+	case resp.StatusCode == http.StatusPaymentRequired:
+		return fmt.Errorf("%w: vastai %s %s: status %d", ErrProviderQuota, method, path, resp.StatusCode)
+	case resp.StatusCode == http.StatusNotFound && isInstancePath(path):
+		return fmt.Errorf("%w: vastai %s %s: status %d", ErrInstanceNotFound, method, path, resp.StatusCode)
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: vastai %s %s: status %d", ErrProviderNoCapacity, method, path, resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("vastai %s %s: unexpected status %d", method, path, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Reports whether the path addresses a single instance, only there a 404 means the instance is gone.
+// Anywhere else it is a moved or misconfigured endpoint
+func isInstancePath(path string) bool {
+	instance_id, ok := strings.CutPrefix(path, "/instances/")
+	return ok && strings.Trim(instance_id, "/") != ""
+}
+
+// Rents the offer matching the spec that OFFER_STRATEGY picks, interruptible instances are bid on at the minimum bid
+func (p *VastAIProvider) CreateInstance(ctx context.Context, spec InstanceSpec) (*InstanceInfo, error) {
+	rental_type := "on-demand"
+	if spec.Interruptible {
+		rental_type = "bid"
+	}
+	location := ""
+	if spec.Region != "" {
+		location = fmt.Sprintf(`"geolocation":{"eq":"%s"},`, spec.Region)
+	}
+	query := fmt.Sprintf(`{"gpu_name":{"eq":"%s"},%s"rentable":{"eq":true},"type":"%s","order":[["dph_total","asc"]]}`, spec.GPUType, location, rental_type)
+
+	var offers struct {
+		Offers []vastOffer `json:"offers"`
+	}
+	if err := p.do(ctx, "GET", "/bundles/?q="+url.QueryEscape(query), nil, &offers); err != nil {
+		return nil, err
+	}
+	if len(offers.Offers) == 0 {
+		return nil, fmt.Errorf("%w: vastai: no offers for gpu %s", ErrProviderNoCapacity, spec.GPUType)
+	}
+	offer := pickOffer(offers.Offers, p.offer_strategy, spec.Interruptible)
+
+	var created struct {
+		Success bool `json:"success"`
+		NewContract int `json:"new_contract"`
+	}
+	ask := map[string]any{
+		"client_id": "me",
+		"image": spec.Image,
+		"disk": spec.DiskGB,
+		"label": spec.Label,
+	}
+	cost := offer.price(spec.Interruptible)
+	if spec.Interruptible {
+		ask["price"] = cost
+	}
+	if err := p.do(ctx, "PUT", fmt.Sprintf("/asks/%d/", offer.ID), ask, &created); err != nil {
+		return nil, err
+	}
+	if !created.Success {
+		return nil, fmt.Errorf("vastai: renting offer %d failed", offer.ID)
+	}
+
+	return &InstanceInfo{
+		ID: fmt.Sprint(created.NewContract),
+		Status: "created",
+		CostPerHour: cost,
+		Label: spec.Label,
+		Metadata: offer.metadata(p.offer_strategy),
+	}, nil
+}
+
+func (offer vastOffer) metadata(strategy string) map[string]any {
+	return map[string]any{
+		"offer_strategy": strategy,
+		"offer_price": offer.DphTotal,
+		"dlperf": offer.DLPerf,
+		"gpu_name": offer.GPUName,
+		"geolocation": offer.Geolocation,
+		"datacenter": offer.Datacenter,
+		"reliability": offer.Reliability,
+		"inet_down_mbps": offer.InetDown,
+		"inet_up_mbps": offer.InetUp,
+		"machine_id": offer.MachineID,
+	}
+}
+
+func (p *VastAIProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	return p.do(ctx, "DELETE", "/instances/"+instance_id+"/", nil, nil)
+}
+
+// Stops the container, the instance stays rented and only its disk is billed
+func (p *VastAIProvider) PauseInstance(ctx context.Context, instance_id string) error {
+	return p.do(ctx, "PUT", "/instances/"+instance_id+"/", map[string]string{"state": "stopped"}, nil)
+}
+
+func (p *VastAIProvider) ResumeInstance(ctx context.Context, instance_id string) error {
+	return p.do(ctx, "PUT", "/instances/"+instance_id+"/", map[string]string{"state": "running"}, nil)
+}
+
+func (p *VastAIProvider) InstanceStatus(ctx context.Context, instance_id string) (*InstanceInfo, error) {
+	var status struct {
+		Instances vastInstance `json:"instances"`
+	}
+	if err := p.do(ctx, "GET", "/instances/"+instance_id+"/", nil, &status); err != nil {
+		return nil, err
+	}
+
+	info := status.Instances.info()
+	return &info, nil
+}
+
+func (instance vastInstance) info() InstanceInfo {
+	info := InstanceInfo{
+		ID: fmt.Sprint(instance.ID),
+		Status: instance.ActualStatus,
+		CostPerHour: instance.DphTotal,
+		Label: instance.Label,
+		GPUType: instance.GPUName,
+		Image: instance.Image,
+	}
+	// VastAI reports running before the ip and port mapping are assigned, the endpoint stays empty until both are
+	if ports := instance.Ports[backendPort]; instance.PublicIP != "" && len(ports) > 0 && ports[0].HostPort != "" {
+		info.Endpoint = instance.PublicIP + ":" + ports[0].HostPort
+	}
+	return info
+}
+
+func (p *VastAIProvider) ListInstances(ctx context.Context) ([]InstanceInfo, error) {
+	var list struct {
+		Instances []vastInstance `json:"instances"`
+	}
+	if err := p.do(ctx, "GET", "/instances/", nil, &list); err != nil {
+		return nil, err
+	}
+
+	instances := make([]InstanceInfo, 0, len(list.Instances))
+	for _, instance := range list.Instances {
+		instances = append(instances, instance.info())
+	}
+	return instances, nil
+}
+
+func (p *VastAIProvider) Ping(ctx context.Context) error {
+	return p.do(ctx, "GET", "/users/current/", nil, nil)
+}
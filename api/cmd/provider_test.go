@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestVastAIErrorStatuses(t *testing.T) {
+	tests := []struct {
+		status int
+		want error
+	}{
+		{http.StatusUnauthorized, ErrProviderAuth},
+		{http.StatusForbidden, ErrProviderAuth},
+		{http.StatusTooManyRequests, ErrProviderQuota},
+		{http.StatusPaymentRequired, ErrProviderQuota},
+		{http.StatusNotFound, ErrInstanceNotFound},
+		{http.StatusServiceUnavailable, ErrProviderNoCapacity},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			vastai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer vastai.Close()
+
+			provider := NewVastAIProvider("key", vastai.URL, vastai.Client(), "cheapest", systemClock{})
+			if _, err := provider.InstanceStatus(context.Background(), "1"); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestProviderErrorResponses(t *testing.T) {
+	tests := []struct {
+		err error
+		status int
+		code string
+	}{
+		{fmt.Errorf("%w: no offers", ErrProviderNoCapacity), http.StatusServiceUnavailable, "provider_no_capacity"},
+		{fmt.Errorf("%w: status 402", ErrProviderQuota), http.StatusTooManyRequests, "provider_quota"},
+		{fmt.Errorf("%w: key sk-secret rejected", ErrProviderAuth), http.StatusInternalServerError, "provider_auth"},
+		{errors.New("connection reset"), http.StatusBadGateway, "provider_error"},
+	}
+	api, server := newTestServer(t, nil)
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			mockProvider(api).FailNext("create", test.err)
+			status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true})
+			var response ErrorResponse
+			if err := json.Unmarshal(body, &response); err != nil || status != test.status || response.Error != test.code {
+				t.Fatalf("got %d %s, want %d %s", status, body, test.status, test.code)
+			}
+			if test.code == "provider_auth" && strings.Contains(string(body), "sk-secret") {
+				t.Fatalf("auth failure detail leaked: %s", body)
+			}
+			waitFor(t, "the failed start to settle", func() bool {
+				compute_state := api.getComputeState("pi")
+				compute_state.Mu.Lock()
+				defer compute_state.Mu.Unlock()
+				return !compute_state.IsRunning
+			})
+		})
+	}
+}
+
+// Stand-in of the VastAI api renting one offer, its instance serves the model from model_addr
+type fakeVastAI struct {
+	model_addr string
+	mu sync.Mutex
+	rented map[string]bool
+	destroyed []string
+	unauthorized int
+}
+
+func (f *fakeVastAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer vast-key" {
+		f.unauthorized++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	host, port, _ := strings.Cut(f.model_addr, ":")
+	instance := func(id string) map[string]any {
+		return map[string]any{"id": json.Number(id), "actual_status": "running", "public_ipaddr": host, "gpu_name": "RTX 4090",
+			"image_uuid": "vllm/vllm-openai:latest", "dph_total": 0.4, "ports": map[string]any{backendPort: []any{map[string]any{"HostPort": port}}}}
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/bundles/":
+		json.NewEncoder(w).Encode(map[string]any{"offers": []any{map[string]any{"id": 7, "gpu_name": "RTX 4090", "dph_total": 0.4}}})
+	case r.Method == "PUT" && r.URL.Path == "/asks/7/":
+		f.rented["42"] = true
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "new_contract": 42})
+	case r.Method == "GET" && r.URL.Path == "/instances/":
+		var instances []any
+		for id := range f.rented {
+			instances = append(instances, instance(id))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"instances": instances})
+	case strings.HasPrefix(r.URL.Path, "/instances/"):
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+		if !f.rented[id] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.rented, id)
+			f.destroyed = append(f.destroyed, id)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"instances": instance(id)})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Only a 404 on a single instance means the instance is gone, elsewhere it is a plain provider error
+func TestVastAINotFound(t *testing.T) {
+	vastai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer vastai.Close()
+	provider := NewVastAIProvider("key", vastai.URL, vastai.Client(), "cheapest", systemClock{})
+
+	tests := []struct {
+		name string
+		call func() error
+		not_found bool
+	}{
+		{"instance status", func() error { _, err := provider.InstanceStatus(context.Background(), "1"); return err }, true},
+		{"destroy", func() error { return provider.DestroyInstance(context.Background(), "1") }, true},
+		{"pause", func() error { return provider.PauseInstance(context.Background(), "1") }, true},
+		{"list", func() error { _, err := provider.ListInstances(context.Background()); return err }, false},
+		{"offer search", func() error { _, err := provider.CreateInstance(context.Background(), DefaultInstanceSpec()); return err }, false},
+		{"ping", func() error { return provider.Ping(context.Background()) }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if err == nil {
+				t.Fatal("404 succeeded")
+			}
+			if not_found := errors.Is(err, ErrInstanceNotFound); not_found != test.not_found {
+				t.Fatalf("got %v, want instance not found %v", err, test.not_found)
+			}
+		})
+	}
+}
+
+// Start, inference and stop against stand-ins of the VastAI api and the model server
+func TestVastAIProvisionFlow(t *testing.T) {
+	model := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"choices": []any{map[string]any{"text": "hello from vast"}}})
+		}
+	}))
+	defer model.Close()
+	vast := &fakeVastAI{model_addr: strings.TrimPrefix(model.URL, "http://"), rented: make(map[string]bool)}
+	vastai := httptest.NewServer(vast)
+	defer vastai.Close()
+
+	api, server := newTestServer(t, map[string]string{"MOCK_PROVIDER": "false", "VAST_API_KEY": "vast-key", "PROVIDER_BASE_URL": vastai.URL + "/"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	if id := instanceID(api, "pi"); id != "42" {
+		t.Fatalf("device on instance %q, want the rented 42", id)
+	}
+
+	status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+	var inference InferenceResponse
+	if err := json.Unmarshal(body, &inference); status != http.StatusOK || err != nil || inference.Response != "hello from vast" {
+		t.Fatalf("inference: %d %s", status, body)
+	}
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+	waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+	vast.mu.Lock()
+	defer vast.mu.Unlock()
+	if len(vast.destroyed) != 1 || vast.destroyed[0] != "42" || vast.unauthorized != 0 {
+		t.Fatalf("destroyed %v, %d unauthorized calls", vast.destroyed, vast.unauthorized)
+	}
+}
+
+func TestProviderBaseURLValidation(t *testing.T) {
+	tests := []struct {
+		url string
+		valid bool
+	}{
+		{"https://console.vast.ai/api/v0", true},
+		{"http://127.0.0.1:9000", true},
+		{"console.vast.ai/api/v0", false},
+		{"ftp://console.vast.ai", false},
+		{"https://", false},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			t.Setenv("API_KEY", testAPIKey)
+			t.Setenv("PROVIDER_BASE_URL", test.url)
+			_, err := LoadConfig()
+			if (err == nil) != test.valid {
+				t.Fatalf("got %v, want valid %t", err, test.valid)
+			}
+			if err != nil && !strings.Contains(err.Error(), "PROVIDER_BASE_URL") {
+				t.Fatalf("error %q doesn't name PROVIDER_BASE_URL", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stop while the device is still provisioning cancels the provisioning and tears down the partial instance
+func TestStopCancelsProvisioning(t *testing.T) {
+	tests := []struct {
+		name string
+		boot_delay time.Duration
+		endpoint_delay time.Duration
+	}{
+		{"while booting", time.Hour, 0},
+		{"while the endpoint comes up", 0, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			mockProvider(api).SetBootDelay(test.boot_delay)
+			mockProvider(api).SetEndpointDelay(test.endpoint_delay)
+
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "the instance to be created", func() bool { return len(instanceIDs(t, api)) == 1 })
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			cancel_provision := compute_state.CancelProvision
+			compute_state.Mu.Unlock()
+			if cancel_provision == nil {
+				t.Fatal("provisioning has no cancel function")
+			}
+
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+				t.Fatalf("stop: %d %s", status, body)
+			}
+			waitFor(t, "the partial instance to be destroyed", func() bool { return len(instanceIDs(t, api)) == 0 })
+			waitFor(t, "the device to go idle", func() bool {
+				compute_state.Mu.Lock()
+				defer compute_state.Mu.Unlock()
+				return !compute_state.IsRunning && compute_state.CancelProvision == nil
+			})
+		})
+	}
+}
+
+// Provisioning ends and cleans up when its context does, whether the server shuts down or the timeout hits
+func TestProvisioningHonorsItsContext(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		cancel func(api *APIServer)
+	}{
+		{"server shutdown", nil, func(api *APIServer) { api.stopProvisioning() }},
+		{"provision timeout", map[string]string{"PROVISION_TIMEOUT": "50ms"}, func(api *APIServer) {}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			mockProvider(api).SetBootDelay(time.Hour)
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+
+			test.cancel(api)
+			done := make(chan struct{})
+			go func() {
+				api.provisioning.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("provisioning goroutine did not exit")
+			}
+			if ids := instanceIDs(t, api); len(ids) != 0 {
+				t.Fatalf("instances %v left behind", ids)
+			}
+			compute_state := api.getComputeState("pi")
+			compute_state.Mu.Lock()
+			defer compute_state.Mu.Unlock()
+			if compute_state.IsRunning {
+				t.Fatalf("device still running with status %s", compute_state.Status)
+			}
+		})
+	}
+}
+
+// A provider that reports running before the ports are mapped must not make the device ready
+func TestReadyWaitsForEndpoint(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"MOCK_ENDPOINT_DELAY": "100ms"})
+	logs := captureLog(t)
+	var mu sync.Mutex
+	var frames []StatusResponse
+	api.Events.Subscribe(func(event Event) {
+		if changed, ok := event.(StatusChanged); ok && changed.DeviceID == "pi" {
+			mu.Lock()
+			frames = append(frames, changed.Frame)
+			mu.Unlock()
+		}
+	})
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true}); status != http.StatusOK {
+		t.Fatalf("start: %d %s", status, body)
+	}
+	// The endpoint shows up by the second poll, pollInterval after the first
+	deadline := time.Now().Add(pollInterval + 5*time.Second)
+	for deviceStatus(api, "pi") != "ready" {
+		if time.Now().After(deadline) {
+			t.Fatal("device never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !strings.Contains(logs.String(), "instance running without an endpoint yet") {
+		t.Fatal("the first poll already saw an endpoint")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, frame := range frames {
+		if frame.Status == "ready" && frame.Endpoint == "" {
+			t.Fatalf("ready broadcast without an endpoint: %+v", frame)
+		}
+	}
+}
+
+// Run with -race: starts and stops of one device fired at once end in a state matching the provider
+func TestControlOperationsSerialized(t *testing.T) {
+	tests := []struct {
+		name string
+		clients int
+	}{
+		{"a few clients", 8},
+		{"many clients", 32},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			var wg sync.WaitGroup
+			for range test.clients {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for _, run := range []bool{true, false, true} {
+						status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": run})
+						if status != http.StatusOK && status != http.StatusAccepted && status != http.StatusConflict {
+							t.Errorf("run %v: %d %s", run, status, body)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			// Running on exactly the instance the provider has, or stopped with none left
+			consistent := func() bool {
+				compute_state := api.getComputeState("pi")
+				compute_state.Mu.Lock()
+				is_running, status, id := compute_state.IsRunning, compute_state.Status, compute_state.ID
+				compute_state.Mu.Unlock()
+				ids := instanceIDs(t, api)
+				if is_running {
+					return status == "ready" && len(ids) == 1 && ids[0] == id
+				}
+				return len(ids) == 0
+			}
+			waitFor(t, "a consistent state", consistent)
+			// No stop or provisioning left behind to undo it
+			time.Sleep(100 * time.Millisecond)
+			if !consistent() {
+				t.Fatalf("device %s on %q with instances %v", deviceStatus(api, "pi"), instanceID(api, "pi"), instanceIDs(t, api))
+			}
+		})
+	}
+}
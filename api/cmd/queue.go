@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+)
+
+//// Functionality
+
+// Statuses of a device whose instance is on its way to taking inference
+var warmingStatuses = []string{"init", "provisioning", "rate_limited", "reprovisioning", "resuming", "ready"}
+
+// Adds a waiter for the device, it is signalled on every status change of the device
+func (api *APIServer) enqueueInference(device_id string) chan struct{} {
+	api.inference_queue_mu.Lock()
+	defer api.inference_queue_mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	if api.inference_queue[device_id] == nil {
+		api.inference_queue[device_id] = make(map[chan struct{}]bool)
+	}
+	api.inference_queue[device_id][wake] = true
+	inferenceQueueDepth.Inc()
+	return wake
+}
+
+func (api *APIServer) dequeueInference(device_id string, wake chan struct{}) {
+	api.inference_queue_mu.Lock()
+	defer api.inference_queue_mu.Unlock()
+
+	if !api.inference_queue[device_id][wake] {
+		return
+	}
+	delete(api.inference_queue[device_id], wake)
+	if len(api.inference_queue[device_id]) == 0 {
+		delete(api.inference_queue, device_id)
+	}
+	inferenceQueueDepth.Dec()
+}
+
+// Event bus handler waking the queued requests of the device so they check its new status
+func (api *APIServer) wakeInferenceQueue(event Event) {
+	changed, ok := event.(StatusChanged)
+	if !ok {
+		return
+	}
+
+	api.inference_queue_mu.Lock()
+	defer api.inference_queue_mu.Unlock()
+	for wake := range api.inference_queue[changed.DeviceID] {
+		select {
+		case wake <- struct{}{}:
+		default:
+			// A wakeup is already pending, the waiter reads the latest status anyway
+		}
+	}
+}
+
+func isWarmingStatus(status string) bool {
+	return slices.Contains(warmingStatuses, status)
+}
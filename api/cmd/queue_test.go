@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Requests for a warming instance wait for it up to INFERENCE_QUEUE_MAX_AGE
+func TestInferenceQueueMaxAge(t *testing.T) {
+	tests := []struct {
+		name string
+		max_age time.Duration
+		warmup time.Duration // How long the warmup holds the instance back
+		status int
+	}{
+		{"served once warm", 2 * time.Second, 100 * time.Millisecond, http.StatusOK},
+		{"evicted past the max age", 100 * time.Millisecond, time.Hour, http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"INFERENCE_QUEUE_MAX_AGE": test.max_age.String(), "BACKEND_WARMUP_PROMPT": testWarmupPrompt})
+			backend := &warmupBackend{InferenceBackend: api.Backend, release: make(chan struct{})}
+			api.Backend = backend
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "the warmup to start", func() bool { return deviceStatus(api, "pi") == "ready" })
+			release := time.AfterFunc(test.warmup, func() { close(backend.release) })
+			defer release.Stop()
+			evictions := testutil.ToFloat64(inferenceQueueEvictions)
+
+			start := time.Now()
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+			waited := time.Since(start)
+			if status != test.status {
+				t.Fatalf("got %d %s after %s, want %d", status, body, waited, test.status)
+			}
+			if test.status == http.StatusGatewayTimeout {
+				var response ErrorResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Error != "queued_too_long" {
+					t.Fatalf("got %s, want queued_too_long", body)
+				}
+				if waited < test.max_age {
+					t.Fatalf("evicted after %s, before the max age %s", waited, test.max_age)
+				}
+				if got := testutil.ToFloat64(inferenceQueueEvictions) - evictions; got != 1 {
+					t.Fatalf("%g evictions recorded", got)
+				}
+			}
+
+			api.inference_queue_mu.Lock()
+			defer api.inference_queue_mu.Unlock()
+			if len(api.inference_queue) != 0 {
+				t.Fatalf("requests left queued: %v", api.inference_queue)
+			}
+		})
+	}
+}
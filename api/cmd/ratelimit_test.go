@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedProviderIsRetried(t *testing.T) {
+	const retry_after = 200 * time.Millisecond
+	tests := []struct {
+		name string
+		operation string
+		done string
+	}{
+		{"create", "create", "ready"},
+		{"destroy", "destroy", "stopped"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			if test.operation == "destroy" {
+				startDevice(t, api, server, testAPIKey, "pi")
+			}
+			statuses := recordStatuses(api, "pi")
+			mockProvider(api).FailNext(test.operation, &RateLimitError{RetryAfter: retry_after, Err: ErrProviderQuota})
+
+			start := time.Now()
+			run := test.operation == "create"
+			want := http.StatusOK
+			if !run {
+				want = http.StatusAccepted
+			}
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": run}); status != want {
+				t.Fatalf("got %d %s, want %d", status, body, want)
+			}
+			waitFor(t, "the retried "+test.operation, func() bool { return deviceStatus(api, "pi") == test.done })
+
+			if elapsed := time.Since(start); elapsed < retry_after {
+				t.Fatalf("retried after %s, before Retry-After %s", elapsed, retry_after)
+			}
+			if !slices.Contains(statuses(), "rate_limited") {
+				t.Fatalf("status transitions %v never showed rate_limited", statuses())
+			}
+		})
+	}
+}
+
+// A Retry-After past the provisioning timeout fails right away
+func TestRateLimitBeyondProvisionTimeout(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"PROVISION_TIMEOUT": "1s"})
+	mockProvider(api).FailNext("create", &RateLimitError{RetryAfter: time.Minute, Err: ErrProviderQuota})
+
+	status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true})
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("got %d %s, want 429", status, body)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-5", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.header, now); got != test.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//// Functionality
+
+// Tenant roles, each sees strictly more of the status than the one before
+const (
+	roleViewer = "viewer" // Status only
+	roleOwner = "owner" // Plus connection details
+	roleAdmin = "admin" // Everything, including provider instance IDs
+)
+
+// Metadata keys containing any of these never leave the server, they identify or grant access to the host
+var sensitiveMetadataKeys = []string{"ip", "host", "ssh", "token", "key", "password", "secret"}
+
+// Copies the provider metadata without its sensitive keys, nil if nothing is left
+func redactMetadata(metadata map[string]any) map[string]any {
+	redacted := make(map[string]any)
+	for key, value := range metadata {
+		sensitive := false
+		for _, part := range strings.FieldsFunc(strings.ToLower(key), func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+			for _, word := range sensitiveMetadataKeys {
+				sensitive = sensitive || part == word
+			}
+		}
+		if !sensitive {
+			redacted[key] = value
+		}
+	}
+	if len(redacted) == 0 {
+		return nil
+	}
+	return redacted
+}
+
+// Strips the status fields the role may not see
+func redactStatus(frame StatusResponse, role string) StatusResponse {
+	switch role {
+	case roleAdmin:
+		return frame
+	case roleOwner:
+		frame.ComputeInstance = ""
+		return frame
+	default:
+		frame.ComputeInstance = ""
+		frame.Endpoint = ""
+		frame.CostPerHour = 0
+		frame.Metadata = nil
+		frame.Account = ""
+		return frame
+	}
+}
+
+func tenantRole(tenant *Tenant) string {
+	if tenant == nil {
+		return roleViewer
+	}
+	return tenant.Role
+}
+
+// Role of the tenant on the device of the frame, only admins and the tenant that started the
+// device see more than its status. Anonymous callers are viewers
+func deviceRole(tenant *Tenant, frame StatusResponse) string {
+	if tenant == nil {
+		return roleViewer
+	}
+	if tenant.Role == roleAdmin || (frame.tenant != "" && frame.tenant == tenant.Name) {
+		return tenantRole(tenant)
+	}
+	return roleViewer
+}
+
+// Strips the status fields the tenant may not see on the device of the frame
+func redactStatusFor(frame StatusResponse, tenant *Tenant) StatusResponse {
+	return redactStatus(frame, deviceRole(tenant, frame))
+}
+
+// Resolves the tenant of an optionally authenticated request, nil for anonymous callers.
+// Browsers can't set headers on websockets so the key may also come as the api_key query param
+func (api *APIServer) requestTenant(r *http.Request) *Tenant {
+	key := requestAPIKey(r)
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if tenant, ok := api.Config().security.tenants[key]; ok && key != "" {
+		return tenant
+	}
+	return nil
+}
+
+// Lists the devices of the tenant, admins see every device
+func (api *APIServer) handleInstances(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	role := tenantRole(tenant)
+
+	instances := []StatusResponse{}
+	api.ComputesMu.Lock()
+	for _, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if role == roleAdmin || compute_state.Tenant == tenant.Name {
+			instances = append(instances, redactStatus(compute_state.statusResponse(), role))
+		}
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	served_at := api.servedAt()
+	for i := range instances {
+		instances[i].ServedAt = served_at
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].DeviceID < instances[j].DeviceID })
+
+	if err := encodeResponse(w, r, instances); err != nil {
+		logWriteError("instances response encoding error", err)
+	}
+}
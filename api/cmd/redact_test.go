@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestStatusRedactionByRole(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "alice", APIKey: "alice-key"},
+		Tenant{Name: "alice-viewer", APIKey: "alice-viewer-key", Role: roleViewer},
+		Tenant{Name: "bob", APIKey: "bob-key"},
+		Tenant{Name: "ops", APIKey: "ops-key", Role: roleAdmin},
+	)})
+	startDevice(t, api, server, "alice-key", "pi")
+
+	tests := []struct {
+		name string
+		key string
+		instance bool // Sees the provider instance ID
+		endpoint bool // Sees the connection details
+	}{
+		{"anonymous", "", false, false},
+		{"viewer", "alice-viewer-key", false, false},
+		{"owner", "alice-key", false, true},
+		{"owner of another device", "bob-key", false, false},
+		{"admin", "ops-key", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := func(how string, frame StatusResponse) {
+				t.Helper()
+				if frame.Status != "ready" {
+					t.Fatalf("%s: status %q, every role sees it", how, frame.Status)
+				}
+				if (frame.ComputeInstance != "") != test.instance || (frame.Endpoint != "") != test.endpoint {
+					t.Fatalf("%s: instance %q endpoint %q", how, frame.ComputeInstance, frame.Endpoint)
+				}
+			}
+
+			snapshots := map[string]*http.Request{
+				"snapshot": newRequest(t, server, "GET", "/status/pi/snapshot", test.key, nil),
+				"snapshot with the key as query param": newRequest(t, server, "GET", "/status/pi/snapshot?api_key="+test.key, "", nil),
+			}
+			for how, request := range snapshots {
+				response, body := sendRequest(t, request)
+				var frame StatusResponse
+				if err := json.Unmarshal(body, &frame); response.StatusCode != http.StatusOK || err != nil {
+					t.Fatalf("%s: %d %s", how, response.StatusCode, body)
+				}
+				check(how, frame)
+			}
+
+			conn, _, err := dialWebSocket(t, server, "/status/pi?api_key="+test.key, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("websocket", readStatusFrame(t, conn))
+
+			response, err := http.DefaultClient.Do(newRequest(t, server, "GET", "/status/pi/sse", test.key, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			check("sse", readStatusEvent(t, bufio.NewReader(response.Body)))
+		})
+	}
+}
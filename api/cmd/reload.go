@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+//// Structure
+
+type ReloadResponse struct {
+	Status string `json:"status"`
+	Ignored []string `json:"ignored,omitempty"` // Changed settings that only apply after a restart
+}
+
+//// Functionality
+
+// Keeps the current value of a setting that can't change while running, recording it if the reload changed it
+func keepSetting[T comparable](ignored *[]string, name string, current T, next *T) {
+	if *next != current {
+		*ignored = append(*ignored, name)
+		*next = current
+	}
+}
+
+// Carries over everything wired up at startup (listener, provider, backend, background loops)
+func keepImmutableSettings(current *Config, next *Config) []string {
+	var ignored []string
+	keepSetting(&ignored, "TLS_CERT_FILE", current.TLSCertFile, &next.TLSCertFile)
+	keepSetting(&ignored, "TLS_KEY_FILE", current.TLSKeyFile, &next.TLSKeyFile)
+	keepSetting(&ignored, "H2C", current.H2C, &next.H2C)
+	keepSetting(&ignored, "MAX_CONNECTIONS", current.MaxConnections, &next.MaxConnections)
+	keepSetting(&ignored, "WS_COMPRESSION", current.WSCompression, &next.WSCompression)
+	keepSetting(&ignored, "PROVIDER_WARMUP", current.ProviderWarmup, &next.ProviderWarmup)
+	keepSetting(&ignored, "PROVIDER_WARMUP_TIMEOUT", current.ProviderWarmupTimeout, &next.ProviderWarmupTimeout)
+	keepSetting(&ignored, "PROVISION_WORKERS", current.ProvisionWorkers, &next.ProvisionWorkers)
+	keepSetting(&ignored, "PROVISION_QUEUE", current.ProvisionQueue, &next.ProvisionQueue)
+	keepSetting(&ignored, "COST_CHECK_INTERVAL", current.CostCheckInterval, &next.CostCheckInterval)
+	keepSetting(&ignored, "IDLE_CHECK_INTERVAL", current.IdleCheckInterval, &next.IdleCheckInterval)
+	keepSetting(&ignored, "INSTANCE_TAG", current.InstanceTag, &next.InstanceTag)
+	keepSetting(&ignored, "ORPHAN_CLEANUP", current.OrphanCleanup, &next.OrphanCleanup)
+	keepSetting(&ignored, "ORPHAN_SCAN_INTERVAL", current.OrphanScanInterval, &next.OrphanScanInterval)
+	keepSetting(&ignored, "WARM_POOL_CHECK_INTERVAL", current.WarmPoolCheckInterval, &next.WarmPoolCheckInterval)
+	keepSetting(&ignored, "INTERRUPTION_CHECK_INTERVAL", current.InterruptionCheckInterval, &next.InterruptionCheckInterval)
+	keepSetting(&ignored, "PROVIDER_BASE_URL", current.ProviderBaseURL, &next.ProviderBaseURL)
+	keepSetting(&ignored, "OFFER_STRATEGY", current.OfferStrategy, &next.OfferStrategy)
+	keepSetting(&ignored, "BACKEND_MODEL", current.BackendModel, &next.BackendModel)
+	keepSetting(&ignored, "BACKEND_HEALTH_PATH", current.BackendHealthPath, &next.BackendHealthPath)
+	keepSetting(&ignored, "BACKEND_HEALTH_TIMEOUT", current.BackendHealthTimeout, &next.BackendHealthTimeout)
+	keepSetting(&ignored, "BACKEND_AUTH_HEADER", current.BackendAuthHeader, &next.BackendAuthHeader)
+	keepSetting(&ignored, "BACKEND_AUTH_TOKEN", current.BackendAuthToken, &next.BackendAuthToken)
+	keepSetting(&ignored, "MOCK_PROVIDER", current.MockProvider, &next.MockProvider)
+	keepSetting(&ignored, "MOCK_BOOT_DELAY", current.MockBootDelay, &next.MockBootDelay)
+	keepSetting(&ignored, "MOCK_ENDPOINT_DELAY", current.MockEndpointDelay, &next.MockEndpointDelay)
+	keepSetting(&ignored, "MOCK_LATENCY", current.MockLatency, &next.MockLatency)
+	keepSetting(&ignored, "TRACING_ENABLED", current.TracingEnabled, &next.TracingEnabled)
+	keepSetting(&ignored, "OTEL_SERVICE_NAME", current.TracingServiceName, &next.TracingServiceName)
+	keepSetting(&ignored, "STATE_FILE", current.StateFile, &next.StateFile)
+	keepSetting(&ignored, "VAST_API_KEY", current.security.vast_api_key, &next.security.vast_api_key)
+	if !slices.Equal(current.BackendResponsePath, next.BackendResponsePath) {
+		ignored = append(ignored, "BACKEND_RESPONSE_PATH")
+		next.BackendResponsePath = current.BackendResponsePath
+	}
+	if !slices.Equal(current.BackendStreamPath, next.BackendStreamPath) {
+		ignored = append(ignored, "BACKEND_STREAM_PATH")
+		next.BackendStreamPath = current.BackendStreamPath
+	}
+	if !slices.Equal(current.security.vast_accounts, next.security.vast_accounts) {
+		ignored = append(ignored, "VAST_ACCOUNTS")
+		next.security.vast_accounts = current.security.vast_accounts
+	}
+	return ignored
+}
+
+// Names of the settings that differ between the configs, without their values since some are secrets
+func changedSettings(current *Config, next *Config) []string {
+	var changed []string
+	before, after := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < before.NumField(); i++ {
+		field := before.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if patterns, ok := before.Field(i).Interface().([]blockedPattern); ok {
+			// Compiled patterns don't compare, their sources do
+			if !slices.EqualFunc(patterns, after.Field(i).Interface().([]blockedPattern), func(a, b blockedPattern) bool {
+				return a.pattern.String() == b.pattern.String()
+			}) {
+				changed = append(changed, field.Name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(before.Field(i).Interface(), after.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+
+	if current.security.api_key != next.security.api_key {
+		changed = append(changed, "APIKey")
+	}
+	if current.security.api_key_previous != next.security.api_key_previous {
+		changed = append(changed, "APIKeyPrevious")
+	}
+	if current.security.accepted_origin != next.security.accepted_origin {
+		changed = append(changed, "AcceptedOrigin")
+	}
+	if !reflect.DeepEqual(current.security.tenants, next.security.tenants) {
+		changed = append(changed, "Tenants")
+	}
+	return changed
+}
+
+// Re-reads .env and the environment and swaps in the new config. Settings that need a restart keep
+// their current value. On error the running config and the environment stay untouched
+func (api *APIServer) reloadConfig() ([]string, error) {
+	api.reload_mu.Lock()
+	defer api.reload_mu.Unlock()
+
+	// The process environment can't change after start, so values edited in .env win on reload
+	values, err := godotenv.Read(".env")
+	if err != nil {
+		return nil, err
+	}
+	next, err := loadConfig(values)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		os.Setenv(key, value)
+	}
+
+	current := api.Config()
+	ignored := keepImmutableSettings(current, next)
+	changed := changedSettings(current, next)
+	api.config.Store(next)
+	// Only an edited MAINTENANCE_MODE applies, a reload must not undo a flip through /admin/maintenance
+	if next.MaintenanceMode != current.MaintenanceMode {
+		api.setMaintenance(next.MaintenanceMode, "reload")
+	}
+
+	log.Println("config reloaded, changed", changed)
+	if len(ignored) > 0 {
+		log.Println("restart required to apply", ignored)
+	}
+	return ignored, nil
+}
+
+// Reloads the config on every SIGHUP until the lifecycle ends
+func (api *APIServer) watchReloadSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if _, err := api.reloadConfig(); err != nil {
+				log.Println("config reload error, keeping the current config", err)
+			}
+		}
+	}
+}
+
+func (api *APIServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	ignored, err := api.reloadConfig()
+	if err != nil {
+		log.Println("config reload error, keeping the current config", err)
+		writeError(w, r, http.StatusUnprocessableEntity, "invalid_config", err.Error())
+		return
+	}
+
+	if err := encodeResponse(w, r, ReloadResponse{Status: "reloaded", Ignored: ignored}); err != nil {
+		logWriteError("reload response encoding error", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs the test from a directory whose .env holds the settings. The process environment the reload
+// writes them to is restored afterwards
+func writeDotEnv(t *testing.T, settings map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	var contents string
+	for key, value := range settings {
+		t.Setenv(key, os.Getenv(key))
+		contents += key + "=" + value + "\n"
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+func TestReloadAppliesIdleTimeout(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+	later := api.Clock.Now().Add(2 * time.Hour)
+
+	api.reapIdle(later)
+	if status := deviceStatus(api, "pi"); status != "ready" {
+		t.Fatalf("device %s without an IDLE_TIMEOUT", status)
+	}
+
+	writeDotEnv(t, map[string]string{"IDLE_TIMEOUT": "1h"})
+	status, body := doRequest(t, server, "POST", "/admin/reload", testAPIKey, nil)
+	var response ReloadResponse
+	if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || response.Status != "reloaded" {
+		t.Fatalf("reload: %d %s", status, body)
+	}
+	if timeout := api.Config().IdleTimeout; timeout != time.Hour {
+		t.Fatalf("IdleTimeout %s after the reload", timeout)
+	}
+
+	api.reapIdle(later)
+	waitFor(t, "the idle stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+}
+
+// Secrets are named only, their values stay out of the log. The default tenant follows API_KEY
+func TestReloadLogsChangedSettings(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	logs := captureLog(t)
+	writeDotEnv(t, map[string]string{"IDLE_TIMEOUT": "10m", "API_KEY": "rotated-key"})
+
+	if status, body := doRequest(t, server, "POST", "/admin/reload", testAPIKey, nil); status != http.StatusOK {
+		t.Fatalf("reload: %d %s", status, body)
+	}
+	if !strings.Contains(logs.String(), "config reloaded, changed [IdleTimeout APIKey Tenants]") {
+		t.Fatalf("changed settings not logged:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "rotated-key") {
+		t.Fatal("reload logged the new api key")
+	}
+	if status, _ := doRequest(t, server, "GET", "/ping", "rotated-key", nil); status != http.StatusOK {
+		t.Fatalf("rotated key got %d", status)
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	duplicate_keys := tenantsFile(t, Tenant{Name: "alice", APIKey: "shared"}, Tenant{Name: "bob", APIKey: "shared"})
+	tests := []struct {
+		name string
+		settings map[string]string
+		status int
+		ignored []string
+	}{
+		{"mutable", map[string]string{"IDLE_TIMEOUT": "10m", "MIN_UPTIME": "5m"}, http.StatusOK, nil},
+		{"needs a restart", map[string]string{"PROVISION_WORKERS": "9", "IDLE_TIMEOUT": "10m"}, http.StatusOK, []string{"PROVISION_WORKERS"}},
+		{"invalid", map[string]string{"IDLE_CHECK_INTERVAL": "0s", "IDLE_TIMEOUT": "10m"}, http.StatusUnprocessableEntity, nil},
+		{"duplicate api keys", map[string]string{"TENANTS_FILE": duplicate_keys, "IDLE_TIMEOUT": "10m"}, http.StatusUnprocessableEntity, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			before := *api.Config()
+			writeDotEnv(t, test.settings)
+
+			status, body := doRequest(t, server, "POST", "/admin/reload", testAPIKey, nil)
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status != http.StatusOK {
+				if api.Config().IdleTimeout != before.IdleTimeout {
+					t.Fatal("a rejected reload changed the config")
+				}
+				// Nothing of the rejected file leaks into the environment a later reload falls back to
+				for key := range test.settings {
+					if value, ok := os.LookupEnv(key); ok && value != "" {
+						t.Fatalf("rejected reload set %s=%s", key, value)
+					}
+				}
+				return
+			}
+			if value := os.Getenv("IDLE_TIMEOUT"); value != "10m" {
+				t.Fatalf("IDLE_TIMEOUT=%q in the environment after the reload", value)
+			}
+			var response ReloadResponse
+			if err := json.Unmarshal(body, &response); err != nil || !slices.Equal(response.Ignored, test.ignored) {
+				t.Fatalf("ignored %v, want %v", response.Ignored, test.ignored)
+			}
+			if api.Config().IdleTimeout != 10*time.Minute || api.Config().ProvisionWorkers != before.ProvisionWorkers {
+				t.Fatalf("config after the reload %+v", api.Config())
+			}
+		})
+	}
+}
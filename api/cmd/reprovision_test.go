@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestReprovision(t *testing.T) {
+	tests := []struct {
+		name string
+		started bool
+		want int
+	}{
+		{"ready device", true, http.StatusAccepted},
+		{"stopped device", false, http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			if test.started {
+				startDevice(t, api, server, testAPIKey, "pi")
+			}
+			old_id := instanceID(api, "pi")
+			statuses := recordStatuses(api, "pi")
+
+			status, body := doRequest(t, server, "POST", "/reprovision/pi", testAPIKey, nil)
+			if status != test.want {
+				t.Fatalf("got %d %s, want %d", status, body, test.want)
+			}
+			if !test.started {
+				return
+			}
+
+			// IsRunning must hold at every step, sample it until the new instance is up
+			waitFor(t, "the new instance", func() bool {
+				compute_state := api.getComputeState("pi")
+				compute_state.Mu.Lock()
+				defer compute_state.Mu.Unlock()
+				if !compute_state.IsRunning {
+					t.Fatal("device appeared idle during the reprovision")
+				}
+				return compute_state.Status == "ready"
+			})
+			new_id := instanceID(api, "pi")
+			if new_id == old_id {
+				t.Fatal("instance was not replaced")
+			}
+			if ids := instanceIDs(t, api); !slices.Equal(ids, []string{new_id}) {
+				t.Fatalf("provider instances %v, want only %s", ids, new_id)
+			}
+			if recorded := statuses(); len(recorded) == 0 || recorded[0] != "reprovisioning" || slices.Contains(recorded, "stopped") {
+				t.Fatalf("status transitions %v", recorded)
+			}
+		})
+	}
+}
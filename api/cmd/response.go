@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//// Structure
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+//// Functionality
+
+const msgpackContentType = "application/msgpack"
+
+// Reports whether the client asked for msgpack, the Raspberry Pi clients use it to save bandwidth
+func wantsMsgpack(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		media_type := strings.TrimSpace(strings.Split(accepted, ";")[0])
+		if media_type == msgpackContentType || media_type == "application/x-msgpack" {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes v as msgpack or json depending on the Accept header of the request
+func encodeResponse(w http.ResponseWriter, r *http.Request, v any) error {
+	return encodeResponseStatus(w, r, http.StatusOK, v)
+}
+
+// Marshals v before anything is written, so an encoding failure still gets a clean 500
+// instead of a committed status with a truncated body
+func encodeResponseStatus(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	w.Header().Add("Vary", "Accept")
+
+	content_type := "application/json"
+	var body bytes.Buffer
+	v, err := shapeResponse(r, v)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return err
+	}
+	if wantsMsgpack(r) {
+		content_type = msgpackContentType
+		encoder := msgpack.NewEncoder(&body)
+		encoder.SetCustomStructTag("json") // Keep the same field names as the json responses
+		err = encoder.Encode(v)
+	} else {
+		err = json.NewEncoder(&body).Encode(v)
+	}
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", content_type)
+	w.WriteHeader(status)
+	_, err = w.Write(body.Bytes())
+	return err
+}
+
+// Reports whether a write failed because the client went away, which is a normal event
+// rather than a server error
+func isClientGone(err error) bool {
+	return errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, websocket.ErrCloseSent) ||
+		websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived)
+}
+
+// Logs a failed response write unless the client simply disconnected mid-response
+func logWriteError(what string, err error) {
+	if isClientGone(err) {
+		return
+	}
+	log.Println(what, err)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	if err := encodeResponseStatus(w, r, status, ErrorResponse{Error: code, Detail: detail}); err != nil {
+		logWriteError("error response encoding error", err)
+	}
+}
+
+// Maps a provider error to an http status and error code, auth failures are redacted
+// since their detail is about our credentials, not the client's request
+func writeProviderError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrProviderNoCapacity):
+		writeError(w, r, http.StatusServiceUnavailable, "provider_no_capacity", err.Error())
+	case errors.Is(err, ErrProviderQuota):
+		writeError(w, r, http.StatusTooManyRequests, "provider_quota", err.Error())
+	case errors.Is(err, ErrProviderAuth):
+		writeError(w, r, http.StatusInternalServerError, "provider_auth", "")
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, r, http.StatusGatewayTimeout, "provider_timeout", "")
+	case errors.Is(err, context.Canceled):
+		writeError(w, r, http.StatusConflict, "provisioning_cancelled", "")
+	default:
+		writeError(w, r, http.StatusBadGateway, "provider_error", "")
+	}
+}
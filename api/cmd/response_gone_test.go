@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIsClientGone(t *testing.T) {
+	tests := []struct {
+		err error
+		gone bool
+	}{
+		{net.ErrClosed, true},
+		{fmt.Errorf("write tcp: %w", syscall.EPIPE), true},
+		{fmt.Errorf("read tcp: %w", syscall.ECONNRESET), true},
+		{websocket.ErrCloseSent, true},
+		{&websocket.CloseError{Code: websocket.CloseGoingAway}, true},
+		{&websocket.CloseError{Code: websocket.CloseInternalServerErr}, false},
+		{errors.New("json: unsupported value"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.err), func(t *testing.T) {
+			if got := isClientGone(test.err); got != test.gone {
+				t.Fatalf("got %v, want %v", got, test.gone)
+			}
+		})
+	}
+}
+
+// A client that goes away mid-response releases its inference and websocket slot without error logs
+func TestClientGoneMidResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		leave func(t *testing.T, api *APIServer, server string)
+	}{
+		{"stream websocket closed after the first token", func(t *testing.T, api *APIServer, server string) {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server, "http")+"/stream/pi", http.Header{"X-API-Key": {testAPIKey}, "Origin": {testOrigin}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.WriteJSON(StreamMessage{Action: "infer", RequestID: "a", Prompt: "one two three four five six"})
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.Fatal(err)
+			}
+			conn.UnderlyingConn().Close()
+		}},
+		{"http request abandoned mid inference", func(t *testing.T, api *APIServer, server string) {
+			ctx, cancel := context.WithCancel(context.Background())
+			request, _ := http.NewRequestWithContext(ctx, "POST", server+"/respond", strings.NewReader(`{"device_id": "pi", "prompt": "hi"}`))
+			request.Header.Set("X-API-Key", testAPIKey)
+			go func() {
+				waitFor(t, "the inference to start", func() bool { return inferences(api, "pi") > 0 })
+				cancel()
+			}()
+			if _, err := http.DefaultClient.Do(request); !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want the request cancelled", err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "500ms"})
+			startDevice(t, api, server, testAPIKey, "pi")
+			logs := captureLog(t)
+
+			test.leave(t, api, server.URL)
+			waitFor(t, "the inference to be released", func() bool { return inferences(api, "pi") == 0 })
+			waitFor(t, "the websocket slot to be released", func() bool { return api.ws_connections.Load() == 0 })
+			if output := logs.String(); strings.Contains(strings.ToLower(output), "error") {
+				t.Fatalf("client going away logged an error:\n%s", output)
+			}
+		})
+	}
+}
+
+func inferences(api *APIServer, device_id string) int {
+	compute_state := api.getComputeState(device_id)
+	compute_state.Mu.Lock()
+	defer compute_state.Mu.Unlock()
+	return compute_state.Inferences
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestResponseFormatNegotiation(t *testing.T) {
+	tests := []struct {
+		accept string
+		content_type string
+	}{
+		{"", "application/json"},
+		{"application/json", "application/json"},
+		{"application/msgpack", msgpackContentType},
+		{"application/x-msgpack;q=0.9, application/json;q=0.5", msgpackContentType},
+	}
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			for path, body := range map[string]any{
+				"/respond": map[string]any{"device_id": "pi", "prompt": "hi"},
+				"/status/pi/snapshot": nil,
+			} {
+				method := "POST"
+				if body == nil {
+					method = "GET"
+				}
+				request := newRequest(t, server, method, path, testAPIKey, body)
+				request.Header.Set("Accept", test.accept)
+				response, data := sendRequest(t, request)
+				if got := response.Header.Get("Content-Type"); got != test.content_type {
+					t.Fatalf("%s: content type %s, want %s", path, got, test.content_type)
+				}
+
+				var decoded map[string]any
+				var err error
+				if test.content_type == msgpackContentType {
+					err = msgpack.Unmarshal(data, &decoded)
+				} else {
+					err = json.Unmarshal(data, &decoded)
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				if decoded["status"] == nil {
+					t.Fatalf("%s: no status field in %v", path, decoded)
+				}
+			}
+		})
+	}
+}
+
+// Values json can't encode get a clean 500, never a committed 200 with half a body
+func TestUnencodableResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		value any
+	}{
+		{"nan", map[string]any{"cost": math.NaN()}},
+		{"infinity", map[string]any{"response": "partial", "latency": math.Inf(1)}},
+		{"channel", map[string]any{"response": "partial", "stream": make(chan int)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := encodeResponse(w, httptest.NewRequest("GET", "/", nil), test.value); err == nil {
+				t.Fatal("encoding succeeded")
+			}
+			if w.Code != http.StatusInternalServerError || w.Body.String() != "internal server error\n" {
+				t.Fatalf("got %d %q, want a clean 500", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// Every format and status goes through the same buffered encoder
+func TestUnencodableResponseFormats(t *testing.T) {
+	tests := []struct {
+		accept string
+		status int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json", http.StatusAccepted},
+		{msgpackContentType, http.StatusOK},
+		{msgpackContentType, http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		t.Run(test.accept+" "+http.StatusText(test.status), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", test.accept)
+			if err := encodeResponseStatus(w, r, test.status, map[string]any{"stream": func() {}}); err == nil {
+				t.Fatal("encoding succeeded")
+			}
+			if w.Code != http.StatusInternalServerError || w.Body.String() != "internal server error\n" || w.Header().Get("Content-Type") == test.accept {
+				t.Fatalf("got %d %s %q, want a clean 500", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+)
+
+//// Functionality
+
+// Attaches an idle device to a ready instance of the same tenant and spec, returns false if none is warm.
+// Instances are reference counted so the last device to detach tears them down
+func (api *APIServer) attachExistingInstance(device_id string, tenant string, spec InstanceSpec) bool {
+	api.ComputesMu.Lock()
+	defer api.ComputesMu.Unlock()
+
+	compute_state, ok := api.Computes[device_id]
+	if !ok {
+		compute_state = &ComputeState{DeviceID: device_id, Label: api.deviceLabel(device_id), Status: "idle"}
+		api.Computes[device_id] = compute_state
+	}
+
+	for host_id, host := range api.Computes {
+		if host_id == device_id {
+			continue
+		}
+
+		host.Mu.Lock()
+		compatible := host.Status == "ready" && host.Tenant == tenant &&
+			host.Spec.GPUType == spec.GPUType && host.Spec.Region == spec.Region && host.Spec.Image == spec.Image &&
+			host.Spec.Interruptible == spec.Interruptible
+		if !compatible {
+			host.Mu.Unlock()
+			continue
+		}
+		instance_id, endpoint, cost, host_spec, metadata := host.ID, host.Endpoint, host.CostPerHour, host.Spec, host.Metadata
+		accepting, account, backend_token := host.AcceptingInference, host.Account, host.BackendToken
+		host.Mu.Unlock()
+
+		compute_state.Mu.Lock()
+		defer compute_state.Mu.Unlock()
+		if compute_state.IsRunning {
+			return false
+		}
+		compute_state.IsRunning = true
+		compute_state.Attached = true
+		compute_state.Status = "ready"
+		compute_state.ID = instance_id
+		compute_state.Endpoint = endpoint
+		compute_state.CostPerHour = cost
+		compute_state.Metadata = metadata
+		compute_state.AcceptingInference = accepting
+		compute_state.Account = account
+		compute_state.BackendToken = backend_token
+		compute_state.Spec = host_spec
+		compute_state.Tenant = tenant
+		compute_state.LastActive = api.Clock.Now()
+
+		api.InstanceRefs[instance_id]++
+		log.Println("device attached to existing instance", device_id, instance_id, api.InstanceRefs[instance_id])
+		return true
+	}
+	return false
+}
+
+// Detaches the device from its instance if other devices still share it, returns false if the
+// device is the last one and the instance has to be destroyed. When the cost bearing device
+// detaches, its accrued cost is settled and another device takes over accruing it
+func (api *APIServer) detachSharedInstance(compute_state *ComputeState) bool {
+	api.ComputesMu.Lock()
+
+	compute_state.Mu.Lock()
+	instance_id := compute_state.ID
+	if instance_id == "" || api.InstanceRefs[instance_id] <= 1 {
+		compute_state.Mu.Unlock()
+		api.ComputesMu.Unlock()
+		return false
+	}
+
+	api.InstanceRefs[instance_id]--
+	now := api.Clock.Now()
+	was_owner := !compute_state.Attached
+	accrued := compute_state.accruedCost(now)
+	tenant, gpu_type := compute_state.Tenant, compute_state.Spec.GPUType
+
+	compute_state.ID = ""
+	compute_state.Endpoint = ""
+	compute_state.CostPerHour = 0
+	compute_state.Metadata = nil
+	compute_state.Account = ""
+	compute_state.BackendToken = ""
+	compute_state.Attached = false
+	compute_state.Mu.Unlock()
+
+	if was_owner {
+		for _, other := range api.Computes {
+			other.Mu.Lock()
+			if other.ID == instance_id && other.Attached {
+				other.Attached = false
+				other.StartedAt = now
+				other.Mu.Unlock()
+				break
+			}
+			other.Mu.Unlock()
+		}
+	}
+	log.Println("device detached from shared instance", compute_state.DeviceID, instance_id, api.InstanceRefs[instance_id])
+	api.ComputesMu.Unlock()
+
+	if was_owner {
+		api.Usage.AddSpend(tenant, usageMonth(now), accrued)
+		api.recordHistoricalCost(gpu_type, accrued)
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestReuseExistingInstance(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "host")
+	host_instance := instanceID(api, "host")
+
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "guest", "run": true, "reuse_existing": true}); status != http.StatusOK {
+		t.Fatalf("attach: %d %s", status, body)
+	}
+	if got := instanceID(api, "guest"); got != host_instance {
+		t.Fatalf("guest on instance %s, want the host's %s", got, host_instance)
+	}
+	if ids := instanceIDs(t, api); len(ids) != 1 {
+		t.Fatalf("provider instances %v, want the one shared", ids)
+	}
+
+	// Both devices get answers from the shared instance
+	for _, device_id := range []string{"host", "guest"} {
+		status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": device_id, "prompt": "hi"})
+		var response InferenceResponse
+		if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil || response.Response != "echo: hi" {
+			t.Fatalf("%s inference: %d %s", device_id, status, body)
+		}
+	}
+
+	// Stopping in either order, the instance goes with the last device
+	steps := []struct {
+		device_id string
+		instances []string
+	}{
+		{"host", []string{host_instance}},
+		{"guest", nil},
+	}
+	for _, step := range steps {
+		if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": step.device_id, "run": false}); status != http.StatusAccepted {
+			t.Fatalf("stop %s: %d %s", step.device_id, status, body)
+		}
+		waitFor(t, step.device_id+" to stop", func() bool { return deviceStatus(api, step.device_id) == "stopped" })
+		if ids := instanceIDs(t, api); !slices.Equal(ids, step.instances) {
+			t.Fatalf("after stopping %s instances %v, want %v", step.device_id, ids, step.instances)
+		}
+	}
+}
+
+// An attach takes an instance slot of the tenant like a rental
+func TestReuseExistingCountsAgainstQuota(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "alice", APIKey: "alice-key", MaxInstances: 1},
+	)})
+	startDevice(t, api, server, "alice-key", "host")
+
+	status, body := doRequest(t, server, "POST", "/control", "alice-key", map[string]any{"device_id": "guest", "run": true, "reuse_existing": true})
+	if status != http.StatusForbidden {
+		t.Fatalf("got %d %s, want 403", status, body)
+	}
+	if deviceStatus(api, "guest") == "ready" {
+		t.Fatal("guest attached past the quota")
+	}
+}
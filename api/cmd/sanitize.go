@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//// Functionality
+
+var errPromptInvalidUTF8 = errors.New("prompt is not valid utf-8")
+var errPromptControlChars = errors.New("prompt contains control characters")
+
+// Control characters other than the usual whitespace
+func isDisallowedControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t'
+}
+
+// Checks a prompt before it is forwarded to the backend. Invalid utf-8 is always rejected,
+// control characters are stripped or rejected depending on the mode ("strip", "reject", "off")
+func sanitizePrompt(prompt string, mode string) (string, error) {
+	if mode == "off" {
+		return prompt, nil
+	}
+	if !utf8.ValidString(prompt) {
+		return "", errPromptInvalidUTF8
+	}
+	if strings.IndexFunc(prompt, isDisallowedControl) < 0 {
+		return prompt, nil
+	}
+	if mode == "reject" {
+		return "", errPromptControlChars
+	}
+	return strings.Map(func(r rune) rune {
+		if isDisallowedControl(r) {
+			return -1
+		}
+		return r
+	}, prompt), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSanitizePrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		prompt string
+		mode string
+		want string
+		err error
+	}{
+		{"clean", "hello\n\tworld", "strip", "hello\n\tworld", nil},
+		{"strip control characters", "he\x07llo\x00\x1b[31m", "strip", "hello[31m", nil},
+		{"reject control characters", "he\x07llo", "reject", "", errPromptControlChars},
+		{"invalid utf-8 stripping", "caf\xe9", "strip", "", errPromptInvalidUTF8},
+		{"invalid utf-8 rejecting", "caf\xe9", "reject", "", errPromptInvalidUTF8},
+		{"off", "caf\xe9\x07", "off", "caf\xe9\x07", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := sanitizePrompt(test.prompt, test.mode)
+			if got != test.want || err != test.err {
+				t.Fatalf("got %q %v, want %q %v", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestPromptSanitizationResponses(t *testing.T) {
+	tests := []struct {
+		mode string
+		prompt string
+		want int
+		response string
+	}{
+		{"strip", "he\x07llo", http.StatusOK, "echo: hello"},
+		{"reject", "he\x07llo", http.StatusUnprocessableEntity, ""},
+		{"strip", "caf\xe9", http.StatusUnprocessableEntity, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.mode+" "+test.prompt, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"PROMPT_SANITIZE": test.mode})
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			// Multipart, a json body can't carry invalid utf-8
+			status, body := doMultipart(t, server, "/respond", testAPIKey, map[string]string{"device_id": "pi", "prompt": test.prompt}, nil)
+			if status != test.want {
+				t.Fatalf("got %d %s, want %d", status, body, test.want)
+			}
+			if test.want != http.StatusOK {
+				return
+			}
+			var response InferenceResponse
+			if err := json.Unmarshal(body, &response); err != nil || response.Response != test.response {
+				t.Fatalf("response %s, want %q", body, test.response)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServedAt(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	before := time.Now()
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	tests := []struct {
+		name string
+		served_at func(t *testing.T) string
+	}{
+		{"control", func(t *testing.T) string {
+			status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "other", "run": true})
+			var response StatusResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("got %d %s", status, body)
+			}
+			return response.ServedAt
+		}},
+		{"inference", func(t *testing.T) string {
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+			var response InferenceResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("got %d %s", status, body)
+			}
+			return response.ServedAt
+		}},
+		{"snapshot", func(t *testing.T) string {
+			status, body := doRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+			var response StatusResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("got %d %s", status, body)
+			}
+			return response.ServedAt
+		}},
+		{"websocket", func(t *testing.T) string {
+			conn, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return readStatusFrame(t, conn).ServedAt
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			served_at, err := time.Parse(time.RFC3339, test.served_at(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if served_at.Before(before) || served_at.After(time.Now()) {
+				t.Fatalf("served_at %s outside the test", served_at)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+//// Functionality
+
+// Closes the shutdown channel main waits on, safe to call more than once
+func (api *APIServer) requestShutdown() {
+	api.shutdown_once.Do(func() {
+		close(api.shutdown_requested)
+	})
+}
+
+// Triggers the same graceful shutdown as SIGTERM, for orchestrators where signals are awkward
+func (api *APIServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	log.Println("shutdown requested by", tenantFromContext(r.Context()).Name)
+
+	if err := encodeResponseStatus(w, r, http.StatusAccepted, map[string]string{"status": "shutting_down"}); err != nil {
+		logWriteError("shutdown response encoding error", err)
+	}
+	// The server drains this request before exiting, so the 202 still reaches the client
+	api.RequestShutdown()
+}
+
+// Waits for fn to return, giving up when ctx expires
+func waitOrDone(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Closes every status and inference websocket with a going away close frame
+func (api *APIServer) closeWebSockets() {
+	api.SubscribersMu.Lock()
+	for device_id, conns := range api.Subscribers {
+		for conn := range conns {
+			closeWithCode(conn, websocket.CloseGoingAway, "server shutting down")
+		}
+		delete(api.Subscribers, device_id)
+	}
+	api.SubscribersMu.Unlock()
+
+	api.StreamsMu.Lock()
+	for stream := range api.Streams {
+		closeWithCode(stream.conn, websocket.CloseGoingAway, "server shutting down")
+	}
+	api.StreamsMu.Unlock()
+}
+
+// Shuts the server down in order: stop accepting connections, drain in-flight requests,
+// close websockets, then tear down compute and wait for the background loops to return. Stops early
+// with the ctx error once ctx expires
+func (api *APIServer) Shutdown(ctx context.Context) error {
+	log.Println("shutdown: stop accepting and drain in-flight requests")
+	if api.HTTPServer != nil {
+		if err := api.HTTPServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	log.Println("shutdown: close websockets")
+	api.closeWebSockets()
+
+	log.Println("shutdown: tear down compute")
+	if err := waitOrDone(ctx, api.stopProvisioning); err != nil {
+		return err
+	}
+	if err := waitOrDone(ctx, api.watchers.Wait); err != nil {
+		return err
+	}
+	// Nothing claims pooled instances after a restart, so they go regardless of SHUTDOWN_DESTROY_INSTANCES
+	if err := waitOrDone(ctx, api.drainWarmPool); err != nil {
+		return err
+	}
+	if api.Config().ShutdownDestroyInstances {
+		if err := waitOrDone(ctx, api.teardownInstances); err != nil {
+			return err
+		}
+	} else {
+		api.logPreservedInstances()
+	}
+
+	if api.shutdown_tracing != nil {
+		return api.shutdown_tracing(ctx)
+	}
+	return nil
+}
+
+// Destroys every allocated instance in parallel, used on shutdown when instances are not preserved.
+// Runs after stopProvisioning, so the stops only wait for operations already talking to the provider
+func (api *APIServer) teardownInstances() {
+	var device_ids []string
+	api.ComputesMu.Lock()
+	for device_id, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.IsRunning && compute_state.ID != "" {
+			device_ids = append(device_ids, device_id)
+		}
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, device_id := range device_ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := api.stopDevice(device_id); err != nil {
+				log.Println("shutdown teardown error", device_id, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Logs every instance left running on shutdown, nothing tracks them once the process is gone so
+// the orphan scan of the next run finds them by their tag
+func (api *APIServer) logPreservedInstances() {
+	api.ComputesMu.Lock()
+	defer api.ComputesMu.Unlock()
+
+	for device_id, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.ID != "" {
+			log.Println("shutdown: preserving instance, it is an orphan after the restart", device_id, compute_state.ID, compute_state.Name)
+		}
+		compute_state.Mu.Unlock()
+	}
+}
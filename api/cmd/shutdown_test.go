@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownEndpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		key string
+		want int
+		requested bool
+	}{
+		{"admin", "ops-key", http.StatusAccepted, true},
+		{"owner", "alice-key", http.StatusForbidden, false},
+		{"anonymous", "", http.StatusUnauthorized, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+				Tenant{Name: "alice", APIKey: "alice-key"},
+				Tenant{Name: "ops", APIKey: "ops-key", Role: roleAdmin},
+			)})
+			requested := false
+			api.RequestShutdown = func() { requested = true }
+
+			if status, body := doRequest(t, server, "POST", "/admin/shutdown", test.key, nil); status != test.want {
+				t.Fatalf("got %d %s, want %d", status, body, test.want)
+			}
+			if requested != test.requested {
+				t.Fatalf("shutdown requested %v, want %v", requested, test.requested)
+			}
+		})
+	}
+}
+
+// The shutdown tears running instances down only with SHUTDOWN_DESTROY_INSTANCES, preserved ones are logged as orphans
+func TestShutdownInstanceTeardown(t *testing.T) {
+	tests := []struct {
+		destroy string
+		left int
+		status string
+	}{
+		{"false", 1, "ready"},
+		{"true", 0, "stopped"},
+	}
+	for _, test := range tests {
+		t.Run("SHUTDOWN_DESTROY_INSTANCES="+test.destroy, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"SHUTDOWN_DESTROY_INSTANCES": test.destroy})
+			startDevice(t, api, server, testAPIKey, "pi")
+			instance_id := instanceID(api, "pi")
+			logs := captureLog(t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := api.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if ids := instanceIDs(t, api); len(ids) != test.left {
+				t.Fatalf("instances %v after the shutdown, want %d", ids, test.left)
+			}
+			if status := deviceStatus(api, "pi"); status != test.status {
+				t.Fatalf("device %s after the shutdown, want %s", status, test.status)
+			}
+			preserved := strings.Contains(logs.String(), "preserving instance, it is an orphan after the restart pi "+instance_id)
+			if preserved != (test.left > 0) {
+				t.Fatalf("preserved instance logged %v, want %v:\n%s", preserved, test.left > 0, logs.String())
+			}
+		})
+	}
+}
+
+// Requests in flight finish before the websockets close, and compute goes last
+func TestShutdownOrdering(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"SHUTDOWN_DESTROY_INSTANCES": "true", "MOCK_LATENCY": "300ms"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	status_conn, _, err := dialWebSocket(t, server, "/status/pi", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readStatusFrame(t, status_conn)
+
+	listener, err := listen("127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.HTTPServer = api.newHTTPServer(listener.Addr().String())
+	go api.serve(api.HTTPServer, listener)
+
+	logs := captureLog(t)
+	api.Events.Subscribe(func(event Event) {
+		if _, ok := event.(InstanceStopped); ok {
+			log.Println("test: instance stopped")
+		}
+	})
+	responded := make(chan int, 1)
+	go func() {
+		body := strings.NewReader(`{"device_id": "pi", "prompt": "hi"}`)
+		request, _ := http.NewRequest("POST", "http://"+listener.Addr().String()+"/respond", body)
+		request.Header.Set("X-API-Key", testAPIKey)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			responded <- 0
+			return
+		}
+		response.Body.Close()
+		responded <- response.StatusCode
+	}()
+	waitFor(t, "the inference to start", func() bool {
+		compute_state := api.getComputeState("pi")
+		compute_state.Mu.Lock()
+		defer compute_state.Mu.Unlock()
+		return compute_state.Inferences > 0
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := api.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-responded; status != http.StatusOK {
+		t.Fatalf("in-flight inference got %d, want it drained with 200", status)
+	}
+
+	status_conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := status_conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("status websocket got %v, want a going away close", err)
+	}
+
+	order := []string{"POST /respond 200", "shutdown: close websockets", "shutdown: tear down compute", "test: instance stopped"}
+	output := logs.String()
+	last := -1
+	for _, line := range order {
+		index := strings.Index(output, line)
+		if index == -1 || index < last {
+			t.Fatalf("%q logged out of order:\n%s", line, output)
+		}
+		last = index
+	}
+}
+
+// Every background loop has returned once the shutdown does, nothing outlives the server
+func TestShutdownGoroutineLeak(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		device bool // Start a device before the shutdown
+	}{
+		{"idle server", nil, false},
+		{"running device", map[string]string{"IDLE_TIMEOUT": "10m", "IDLE_CHECK_INTERVAL": "10ms"}, true},
+		{"warm pool and orphan scan", map[string]string{"WARM_POOL": "RTX_4090:1", "ORPHAN_CLEANUP": "true", "ORPHAN_SCAN_INTERVAL": "10ms"}, false},
+	}
+	// The first signal.Notify starts the signal dispatcher of the runtime for good, the SIGHUP reload
+	// watcher would otherwise leave it behind in the first case
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	signal.Stop(hup)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			http.DefaultClient.CloseIdleConnections()
+			before := runtime.NumGoroutine()
+
+			api, server := newTestServer(t, test.env)
+			if test.device {
+				startDevice(t, api, server, testAPIKey, "pi")
+			}
+			if running := runtime.NumGoroutine(); running <= before {
+				t.Fatalf("%d goroutines running, the server started none over %d", running, before)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := api.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+			http.DefaultClient.CloseIdleConnections()
+
+			// Goroutines finishing their last step after Shutdown returned get a moment to exit
+			deadline := time.Now().Add(2 * time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if running := runtime.NumGoroutine(); running > before {
+				stacks := make([]byte, 1<<20)
+				t.Fatalf("%d goroutines left over %d after the shutdown:\n%s", running, before, stacks[:runtime.Stack(stacks, true)])
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//// Functionality
+
+// Entity tag of the status as the caller sees it, served_at is left out so an unchanged state keeps
+// its tag. msgpack and json bodies of the same state get different tags
+func statusETag(frame StatusResponse, msgpack bool) (string, error) {
+	frame.ServedAt = ""
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return "", err
+	}
+	if msgpack {
+		data = append(data, msgpackContentType...)
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// Reports whether the If-None-Match header lists the tag, weak tags compare equal to strong ones
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Current status of the device for polling clients, answers 304 while the state is unchanged
+func (api *APIServer) handleStatusSnapshot(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+
+	// Polling an unknown device must not create it
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+	compute_state.Mu.Lock()
+	frame := redactStatusFor(compute_state.statusResponse(), api.requestTenant(r))
+	compute_state.Mu.Unlock()
+
+	etag, err := statusETag(frame, wantsMsgpack(r))
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Add("Vary", "Accept") // Set by encodeResponse otherwise
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	frame.ServedAt = api.servedAt()
+	if err := encodeResponse(w, r, frame); err != nil {
+		logWriteError("status snapshot encoding error", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStatusSnapshotETag(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	response, body := sendRequest(t, newRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil))
+	etag := response.Header.Get("ETag")
+	if response.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("fresh snapshot: %d etag %q %s", response.StatusCode, etag, body)
+	}
+
+	tests := []struct {
+		name string
+		if_none_match string
+		want int
+	}{
+		{"matching tag", etag, http.StatusNotModified},
+		{"weak tag", "W/" + etag, http.StatusNotModified},
+		{"among others", `"stale", ` + etag, http.StatusNotModified},
+		{"wildcard", "*", http.StatusNotModified},
+		{"stale tag", `"stale"`, http.StatusOK},
+		{"no header", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+			if test.if_none_match != "" {
+				request.Header.Set("If-None-Match", test.if_none_match)
+			}
+			response, body := sendRequest(t, request)
+			if response.StatusCode != test.want || response.Header.Get("ETag") != etag {
+				t.Fatalf("got %d etag %q, want %d %q", response.StatusCode, response.Header.Get("ETag"), test.want, etag)
+			}
+			if test.want == http.StatusNotModified && len(body) != 0 {
+				t.Fatalf("304 with body %s", body)
+			}
+		})
+	}
+
+	t.Run("changed state", func(t *testing.T) {
+		if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+			t.Fatalf("stop: %d %s", status, body)
+		}
+		waitFor(t, "the stop", func() bool { return deviceStatus(api, "pi") == "stopped" })
+		request := newRequest(t, server, "GET", "/status/pi/snapshot", testAPIKey, nil)
+		request.Header.Set("If-None-Match", etag)
+		response, body := sendRequest(t, request)
+		if response.StatusCode != http.StatusOK || response.Header.Get("ETag") == etag {
+			t.Fatalf("got %d etag %q after the stop %s", response.StatusCode, response.Header.Get("ETag"), body)
+		}
+	})
+}
+
+// Polling a device nobody started answers 404 and leaves no state behind
+func TestStatusSnapshotUnknownDevice(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	status, body := doRequest(t, server, "GET", "/status/ghost/snapshot", testAPIKey, nil)
+	if status != http.StatusNotFound {
+		t.Fatalf("got %d %s, want 404", status, body)
+	}
+	if _, ok := api.findComputeState("ghost"); ok {
+		t.Fatal("snapshot created the unknown device")
+	}
+}
+
+// Device routes other than /control answer 404 for a device nobody started and leave no state behind
+func TestUnknownDeviceRoutes(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	tests := []struct {
+		name string
+		method string
+		path string
+		body any
+	}{
+		{"reprovision", "POST", "/reprovision/ghost", nil},
+		{"pause", "POST", "/pause/ghost", nil},
+		{"resume", "POST", "/resume/ghost", nil},
+		{"respond", "POST", "/respond", map[string]any{"device_id": "ghost", "prompt": "hi"}},
+		{"status websocket", "GET", "/status/ghost", nil},
+		{"stream websocket", "GET", "/stream/ghost", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := 0
+			if test.method == "GET" {
+				if _, response, err := dialWebSocket(t, server, test.path, testAPIKey); err == nil {
+					t.Fatal("upgrade for the unknown device was accepted")
+				} else if response != nil {
+					status = response.StatusCode
+				}
+			} else {
+				status, _ = doRequest(t, server, test.method, test.path, testAPIKey, test.body)
+			}
+			if status != http.StatusNotFound {
+				t.Fatalf("got %d, want 404", status)
+			}
+			if _, ok := api.findComputeState("ghost"); ok {
+				t.Fatal("the route created the unknown device")
+			}
+		})
+	}
+}
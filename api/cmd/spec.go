@@ -0,0 +1,50 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//// Functionality
+
+// Returned when the provider runs something else than what was rented, e.g. a recycled machine
+var errSpecMismatch = errors.New("instance does not match the requested spec")
+
+// Attempts at getting a matching instance before provisioning fails, with SPEC_MISMATCH_POLICY=reprovision
+const maxSpecMismatchAttempts = 3
+
+// GPU names and regions end up in the provider's offer query, so only plain names are accepted
+var (
+	validGPUType = regexp.MustCompile(`^[A-Za-z0-9_ ]{1,64}$`)
+	validRegion = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// Spec of a control request, the GPU and region it left out come from the tenant defaults and then
+// from DEFAULT_GPU_TYPE and DEFAULT_REGION
+func (api *APIServer) controlSpec(request ControlRequest, tenant *Tenant) InstanceSpec {
+	config := api.Config()
+	spec := DefaultInstanceSpec()
+	spec.GPUType = cmp.Or(request.GPUType, tenant.GPUType, config.DefaultGPUType, spec.GPUType)
+	spec.Region = cmp.Or(request.Region, tenant.Region, config.DefaultRegion)
+	spec.Interruptible = request.Interruptible
+	return spec
+}
+
+// GPU names are searched with underscores but reported with spaces
+func sameGPUType(a string, b string) bool {
+	return strings.EqualFold(strings.ReplaceAll(a, " ", "_"), strings.ReplaceAll(b, " ", "_"))
+}
+
+// Compares what the provider reports against the spec, attributes it doesn't report are trusted
+func verifyInstanceSpec(spec InstanceSpec, info *InstanceInfo) error {
+	if info.GPUType != "" && spec.GPUType != "" && !sameGPUType(info.GPUType, spec.GPUType) {
+		return fmt.Errorf("%w: gpu %s instead of %s", errSpecMismatch, info.GPUType, spec.GPUType)
+	}
+	if info.Image != "" && spec.Image != "" && info.Image != spec.Image {
+		return fmt.Errorf("%w: image %s instead of %s", errSpecMismatch, info.Image, spec.Image)
+	}
+	return nil
+}
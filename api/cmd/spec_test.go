@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVerifyInstanceSpec(t *testing.T) {
+	tests := []struct {
+		name string
+		spec InstanceSpec
+		info InstanceInfo
+		mismatch bool
+	}{
+		{"matching", InstanceSpec{GPUType: "RTX_4090", Image: "vllm"}, InstanceInfo{GPUType: "RTX_4090", Image: "vllm"}, false},
+		{"gpu reported with spaces", InstanceSpec{GPUType: "RTX_4090"}, InstanceInfo{GPUType: "rtx 4090"}, false},
+		{"unreported attributes", InstanceSpec{GPUType: "RTX_4090", Image: "vllm"}, InstanceInfo{}, false},
+		{"other gpu", InstanceSpec{GPUType: "RTX_4090"}, InstanceInfo{GPUType: "H100"}, true},
+		{"other image", InstanceSpec{Image: "vllm"}, InstanceInfo{Image: "tgi"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := test.info
+			if err := verifyInstanceSpec(test.spec, &info); errors.Is(err, errSpecMismatch) != test.mismatch {
+				t.Fatalf("got %v, want mismatch %t", err, test.mismatch)
+			}
+		})
+	}
+}
+
+// The mock hands out instances with the wrong GPU for the first mismatched creates
+func TestSpecMismatchPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		policy string
+		mismatched int32
+		status string
+		starts int32
+		instances int
+	}{
+		{"reprovisioned", "reprovision", 1, "ready", 2, 1},
+		{"never matching", "reprovision", maxSpecMismatchAttempts, "error", maxSpecMismatchAttempts, 0},
+		{"marked", "mark", 1, "spec_mismatch", 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"SPEC_MISMATCH_POLICY": test.policy})
+			mock := mockProvider(api)
+			var starts atomic.Int32
+			api.Events.Subscribe(func(event Event) {
+				if _, ok := event.(InstanceStarting); !ok {
+					return
+				}
+				// Runs before the create it announces
+				if starts.Add(1) > test.mismatched {
+					mock.SetReportedGPU("")
+				} else {
+					mock.SetReportedGPU("H100")
+				}
+			})
+			logs := captureLog(t)
+
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true, "gpu_type": "RTX_4090"}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "the device to settle on "+test.status, func() bool { return deviceStatus(api, "pi") == test.status })
+			if starts.Load() != test.starts {
+				t.Fatalf("%d instances rented, want %d", starts.Load(), test.starts)
+			}
+			waitFor(t, "the mismatched instances to go", func() bool { return len(instanceIDs(t, api)) == test.instances })
+			if test.instances == 1 && !slices.Contains(instanceIDs(t, api), instanceID(api, "pi")) {
+				t.Fatalf("device points at %q, provider has %v", instanceID(api, "pi"), instanceIDs(t, api))
+			}
+			if !strings.Contains(logs.String(), "provider instance does not match the spec") {
+				t.Fatalf("mismatch not logged:\n%s", logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//// Functionality
+
+// Status frames buffered per event stream before a slow client is dropped
+const eventStreamBuffer = 16
+
+// Comment line sent while idle so proxies don't time the stream out
+const eventStreamKeepalive = 15 * time.Second
+
+func (api *APIServer) addEventSubscriber(device_id string, tenant *Tenant) chan StatusResponse {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	events := make(chan StatusResponse, eventStreamBuffer)
+	if api.EventSubscribers[device_id] == nil {
+		api.EventSubscribers[device_id] = make(map[chan StatusResponse]*Tenant)
+	}
+	api.EventSubscribers[device_id][events] = tenant
+	return events
+}
+
+func (api *APIServer) removeEventSubscriber(device_id string, events chan StatusResponse) {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	if _, ok := api.EventSubscribers[device_id][events]; !ok {
+		// Already dropped and closed
+		return
+	}
+	delete(api.EventSubscribers[device_id], events)
+	if len(api.EventSubscribers[device_id]) == 0 {
+		delete(api.EventSubscribers, device_id)
+	}
+	close(events)
+}
+
+// Queues the frame on every event stream of the device, a stream that fell too far behind is
+// closed rather than blocking the broadcast. Caller must hold SubscribersMu
+func (api *APIServer) publishStatusEvent(device_id string, frame StatusResponse) {
+	for events, tenant := range api.EventSubscribers[device_id] {
+		select {
+		case events <- redactStatusFor(frame, tenant):
+		default:
+			log.Println("dropping slow status event stream", device_id)
+			delete(api.EventSubscribers[device_id], events)
+			close(events)
+		}
+	}
+	if len(api.EventSubscribers[device_id]) == 0 {
+		delete(api.EventSubscribers, device_id)
+	}
+}
+
+// Ends every event stream, run when the HTTP server starts shutting down
+func (api *APIServer) closeEventStreams() {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	for device_id, streams := range api.EventSubscribers {
+		for events := range streams {
+			close(events)
+		}
+		delete(api.EventSubscribers, device_id)
+	}
+}
+
+func (api *APIServer) writeStatusEvent(w http.ResponseWriter, frame StatusResponse) error {
+	frame.ServedAt = api.servedAt()
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+	return err
+}
+
+// Server sent events alternative to the status websocket, streams the same frames
+func (api *APIServer) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	// Unauthenticated, looking a device up must not create it
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+
+	// Subscribe before reading the current state so no transition falls in between
+	tenant := api.requestTenant(r)
+	events := api.addEventSubscriber(device_id, tenant)
+	defer api.removeEventSubscriber(device_id, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	compute_state.Mu.Lock()
+	current_status := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+	current_status.Version = statusFrameVersion
+
+	if err := api.writeStatusEvent(w, redactStatusFor(current_status, tenant)); err != nil {
+		logWriteError("status event write error "+device_id, err)
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := api.writeStatusEvent(w, frame); err != nil {
+				logWriteError("status event write error "+device_id, err)
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				logWriteError("status event write error "+device_id, err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"testing"
+)
+
+func TestStatusEvents(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	startDevice(t, api, server, testAPIKey, "pi")
+
+	response, err := http.DefaultClient.Do(newRequest(t, server, "GET", "/status/pi/sse", "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if content_type := response.Header.Get("Content-Type"); content_type != "text/event-stream" {
+		t.Fatalf("content type %s", content_type)
+	}
+	stream := bufio.NewReader(response.Body)
+
+	// The current state first, then every transition as it happens
+	tests := []struct {
+		transition func()
+		status string
+	}{
+		{func() {}, "ready"},
+		{func() { api.setStatus("pi", "reprovisioning") }, "reprovisioning"},
+		{func() { api.setStatus("pi", "ready") }, "ready"},
+	}
+	for _, test := range tests {
+		test.transition()
+		frame := readStatusEvent(t, stream)
+		if frame.Status != test.status || frame.Version != statusFrameVersion {
+			t.Fatalf("got %s frame version %q, want %s", frame.Status, frame.Version, test.status)
+		}
+	}
+}
+
+// Anyone can reach the event stream, an unknown device is not created by asking for it
+func TestStatusEventsUnknownDevice(t *testing.T) {
+	api, server := newTestServer(t, nil)
+
+	if status, body := doRequest(t, server, "GET", "/status/nobody/sse", "", nil); status != http.StatusNotFound {
+		t.Fatalf("got %d %s, want 404", status, body)
+	}
+	if _, ok := api.findComputeState("nobody"); ok {
+		t.Fatal("looking the device up created it")
+	}
+}
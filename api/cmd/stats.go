@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+//// Structure
+
+// Counts per minute over the last statsHorizon, a bucket is reused once its minute is out of range
+type rollingCounter struct {
+	buckets [statsBuckets]statsBucket
+}
+
+type statsBucket struct {
+	minute int64 // Unix minute the bucket counts, stale buckets are reset on the next add
+	count int64
+	sum float64 // Sum of the observed values, seconds for latencies
+}
+
+// Rolling aggregates of the lifecycle events, fed from the event bus
+type statsRecorder struct {
+	started rollingCounter
+	stopped rollingCounter
+	inferences rollingCounter
+	inference_errors rollingCounter
+	total_started int64
+	total_stopped int64
+	total_inferences int64
+	total_inference_errors int64
+	mu sync.Mutex
+}
+
+type StatsWindows struct {
+	LastHour int64 `json:"last_1h"`
+	LastDay int64 `json:"last_24h"`
+	Total int64 `json:"total"` // Since the server started
+}
+
+type LatencyWindows struct {
+	LastHour Duration `json:"last_1h"`
+	LastDay Duration `json:"last_24h"`
+}
+
+type StatsResponse struct {
+	InstancesStarted StatsWindows `json:"instances_started"` // Freshly rented instances that came up ready, resumes and warm pool claims aside
+	InstancesStopped StatsWindows `json:"instances_stopped"`
+	Inferences StatsWindows `json:"inferences"`
+	InferenceErrors StatsWindows `json:"inference_errors"`
+	AvgInferenceLatency LatencyWindows `json:"avg_inference_latency"` // Over every inference, failed ones included
+	RunningInstances int `json:"running_instances"`
+	TotalCost float64 `json:"total_cost"` // Historical cost plus what the running instances accrued so far
+	ServedAt string `json:"served_at"`
+}
+
+//// Functionality
+
+const (
+	statsHorizon = 24 * time.Hour
+	statsBuckets = int(statsHorizon / time.Minute)
+)
+
+func (c *rollingCounter) add(now time.Time, value float64) {
+	minute := now.Unix() / 60
+	bucket := &c.buckets[minute%int64(statsBuckets)]
+	if bucket.minute != minute {
+		*bucket = statsBucket{minute: minute}
+	}
+	bucket.count++
+	bucket.sum += value
+}
+
+// Count and sum over the window ending now, the current minute included
+func (c *rollingCounter) window(now time.Time, window time.Duration) (int64, float64) {
+	minute := now.Unix() / 60
+	oldest := minute - int64(window/time.Minute)
+	var count int64
+	var sum float64
+	for _, bucket := range c.buckets {
+		if bucket.minute > oldest && bucket.minute <= minute {
+			count += bucket.count
+			sum += bucket.sum
+		}
+	}
+	return count, sum
+}
+
+func (c *rollingCounter) windows(now time.Time, total int64) StatsWindows {
+	last_hour, _ := c.window(now, time.Hour)
+	last_day, _ := c.window(now, statsHorizon)
+	return StatsWindows{LastHour: last_hour, LastDay: last_day, Total: total}
+}
+
+func averageLatency(count int64, seconds float64) Duration {
+	if count == 0 {
+		return 0
+	}
+	return Duration(time.Duration(seconds / float64(count) * float64(time.Second)))
+}
+
+// Event bus handler feeding the rolling stats
+func (api *APIServer) recordEventStats(event Event) {
+	stats := &api.stats
+	now := api.Clock.Now()
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	switch event := event.(type) {
+	case InstanceReady:
+		if event.Reused {
+			break
+		}
+		stats.started.add(now, 1)
+		stats.total_started++
+	case InstanceStopped:
+		stats.stopped.add(now, 1)
+		stats.total_stopped++
+	case InferenceCompleted:
+		stats.inferences.add(now, event.Latency.Seconds())
+		stats.total_inferences++
+		if event.Err != nil {
+			stats.inference_errors.add(now, 1)
+			stats.total_inference_errors++
+		}
+	}
+}
+
+func (api *APIServer) statsSnapshot(now time.Time) StatsResponse {
+	stats := &api.stats
+	stats.mu.Lock()
+	hour_count, hour_seconds := stats.inferences.window(now, time.Hour)
+	day_count, day_seconds := stats.inferences.window(now, statsHorizon)
+	response := StatsResponse{
+		InstancesStarted: stats.started.windows(now, stats.total_started),
+		InstancesStopped: stats.stopped.windows(now, stats.total_stopped),
+		Inferences: stats.inferences.windows(now, stats.total_inferences),
+		InferenceErrors: stats.inference_errors.windows(now, stats.total_inference_errors),
+		AvgInferenceLatency: LatencyWindows{
+			LastHour: averageLatency(hour_count, hour_seconds),
+			LastDay: averageLatency(day_count, day_seconds),
+		},
+	}
+	stats.mu.Unlock()
+
+	api.ComputesMu.Lock()
+	for _, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.ID != "" && !compute_state.Attached {
+			response.RunningInstances++
+		}
+		response.TotalCost += compute_state.accruedCost(now)
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	api.StateMu.Lock()
+	response.TotalCost += api.State.HistoricalCost
+	api.StateMu.Unlock()
+	return response
+}
+
+func (api *APIServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	response := api.statsSnapshot(api.Clock.Now())
+	response.ServedAt = api.servedAt()
+	if err := encodeResponse(w, r, response); err != nil {
+		logWriteError("stats response encoding error", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRollingCounter(t *testing.T) {
+	start := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	var counter rollingCounter
+	for _, added := range []struct {
+		at time.Duration
+		value float64
+	}{{0, 2}, {30 * time.Minute, 4}, {2 * time.Hour, 6}, {25 * time.Hour, 8}} {
+		counter.add(start.Add(added.at), added.value)
+	}
+
+	tests := []struct {
+		name string
+		at time.Duration
+		window time.Duration
+		count int64
+		sum float64
+	}{
+		{"last hour", 25 * time.Hour, time.Hour, 1, 8},
+		{"last day", 25 * time.Hour, statsHorizon, 2, 14},
+		{"window ending in the past", 2*time.Hour + 30*time.Minute, time.Hour, 1, 6},
+		{"nothing yet", -time.Hour, statsHorizon, 0, 0},
+		{"everything expired", 50 * time.Hour, statsHorizon, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, sum := counter.window(start.Add(test.at), test.window)
+			if count != test.count || sum != test.sum {
+				t.Fatalf("count %d sum %g, want %d and %g", count, sum, test.count, test.sum)
+			}
+		})
+	}
+}
+
+// Aggregates simulated lifecycle events as the fake clock moves on
+func TestStats(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	clock := useFakeClock(t, api)
+	tests := []struct {
+		name string
+		advance time.Duration
+		events []Event
+		want StatsResponse
+	}{
+		{"first events", 0, []Event{
+			InstanceReady{DeviceID: "a"},
+			InstanceReady{DeviceID: "b"},
+			InferenceCompleted{DeviceID: "a", Latency: time.Second},
+			InferenceCompleted{DeviceID: "b", Latency: 3 * time.Second, Err: errors.New("backend down")},
+		}, StatsResponse{
+			InstancesStarted: StatsWindows{2, 2, 2},
+			Inferences: StatsWindows{2, 2, 2},
+			InferenceErrors: StatsWindows{1, 1, 1},
+			AvgInferenceLatency: LatencyWindows{Duration(2 * time.Second), Duration(2 * time.Second)},
+		}},
+		{"two hours later", 2 * time.Hour, []Event{
+			InstanceReady{DeviceID: "c"},
+			InstanceStopped{DeviceID: "a", GPUType: "RTX_4090", Cost: 1.5},
+			InferenceCompleted{DeviceID: "c", Latency: 5 * time.Second},
+		}, StatsResponse{
+			InstancesStarted: StatsWindows{1, 3, 3},
+			InstancesStopped: StatsWindows{1, 1, 1},
+			Inferences: StatsWindows{1, 3, 3},
+			InferenceErrors: StatsWindows{0, 1, 1},
+			AvgInferenceLatency: LatencyWindows{Duration(5 * time.Second), Duration(3 * time.Second)},
+			TotalCost: 1.5,
+		}},
+		{"first events out of the day", 23 * time.Hour, nil, StatsResponse{
+			InstancesStarted: StatsWindows{0, 1, 3},
+			InstancesStopped: StatsWindows{0, 1, 1},
+			Inferences: StatsWindows{0, 1, 3},
+			InferenceErrors: StatsWindows{0, 0, 1},
+			AvgInferenceLatency: LatencyWindows{0, Duration(5 * time.Second)},
+			TotalCost: 1.5,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock.Advance(test.advance)
+			for _, event := range test.events {
+				api.Events.Publish(event)
+			}
+
+			status, body := doRequest(t, server, "GET", "/stats", testAPIKey, nil)
+			var response StatsResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("got %d %s", status, body)
+			}
+			response.ServedAt, test.want.ServedAt = "", ""
+			if response != test.want {
+				t.Fatalf("got %+v\nwant %+v", response, test.want)
+			}
+		})
+	}
+}
+
+func TestStatsRunningInstances(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	for _, device_id := range []string{"a", "b"} {
+		startDevice(t, api, server, testAPIKey, device_id)
+	}
+	response := api.statsSnapshot(api.Clock.Now())
+	if response.RunningInstances != 2 || response.InstancesStarted.Total != 2 {
+		t.Fatalf("running %d started %+v, want 2 and 2", response.RunningInstances, response.InstancesStarted)
+	}
+}
+
+// A resume counts as a started instance only when it had to rent a fresh one
+func TestStatsPauseResume(t *testing.T) {
+	tests := []struct {
+		name string
+		pausable bool
+		started int64
+	}{
+		{"pausable provider", true, 1},
+		{"provider without pause", false, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			startDevice(t, api, server, testAPIKey, "pi")
+			if !test.pausable {
+				mockProvider(api).FailNext("pause", ErrPauseUnsupported)
+			}
+
+			if status, body := doRequest(t, server, "POST", "/pause/pi", testAPIKey, nil); status != http.StatusAccepted {
+				t.Fatalf("pause: %d %s", status, body)
+			}
+			waitFor(t, "the pause", func() bool { return deviceStatus(api, "pi") == "paused" })
+			if status, body := doRequest(t, server, "POST", "/resume/pi", testAPIKey, nil); status != http.StatusAccepted {
+				t.Fatalf("resume: %d %s", status, body)
+			}
+			waitFor(t, "the resume", func() bool { return deviceStatus(api, "pi") == "ready" })
+
+			if started := api.statsSnapshot(api.Clock.Now()).InstancesStarted; started.Total != test.started || started.LastHour != test.started {
+				t.Fatalf("started %+v, want %d", started, test.started)
+			}
+		})
+	}
+}
+
+func TestStatsRequiresAdmin(t *testing.T) {
+	_, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t, Tenant{Name: "owner", APIKey: "owner-key"})})
+	if status, body := doRequest(t, server, "GET", "/stats", "owner-key", nil); status != http.StatusForbidden {
+		t.Fatalf("got %d %s, want 403", status, body)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+//// Structure
+
+type StopAllResponse struct {
+	Stopped int `json:"stopped"`
+	Failed int `json:"failed"`
+	Devices []StopAllResult `json:"devices"`
+}
+
+type StopAllResult struct {
+	DeviceID string `json:"device_id"`
+	Status string `json:"status"` // stopped, cancelled (was still provisioning) or error
+	Error string `json:"error,omitempty"`
+}
+
+//// Functionality
+
+// Tears down every running device through STOP_ALL_CONCURRENCY workers and answers once all are done,
+// for emergencies and end of day cleanup. Provisionings underway are cancelled and clean up after themselves
+func (api *APIServer) handleStopAll(w http.ResponseWriter, r *http.Request) {
+	var device_ids []string
+	var cancelled []StopAllResult
+	api.ComputesMu.Lock()
+	for device_id, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.IsRunning {
+			if compute_state.CancelProvision != nil {
+				compute_state.CancelProvision()
+				cancelled = append(cancelled, StopAllResult{DeviceID: device_id, Status: "cancelled"})
+			} else {
+				device_ids = append(device_ids, device_id)
+			}
+		}
+		compute_state.Mu.Unlock()
+	}
+	api.ComputesMu.Unlock()
+
+	results := make([]StopAllResult, len(device_ids))
+	slots := make(chan struct{}, api.Config().StopAllConcurrency)
+	var wg sync.WaitGroup
+	for i, device_id := range device_ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = StopAllResult{DeviceID: device_id, Status: "stopped"}
+			if err := api.stopDevice(device_id); err != nil {
+				results[i].Status = "error"
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	response := StopAllResponse{Devices: append(results, cancelled...)}
+	sort.Slice(response.Devices, func(i, j int) bool { return response.Devices[i].DeviceID < response.Devices[j].DeviceID })
+	for _, result := range response.Devices {
+		if result.Status == "error" {
+			response.Failed++
+		} else {
+			response.Stopped++
+		}
+	}
+
+	tenant := tenantFromContext(r.Context()).Name
+	log.Println("stop all requested by", tenant, response.Stopped, response.Failed)
+	api.audit(AuditRecord{Action: "stop_all", Tenant: tenant, Detail: map[string]any{"stopped": response.Stopped, "failed": response.Failed}})
+
+	if err := encodeResponse(w, r, response); err != nil {
+		logWriteError("stop all response encoding error", err)
+	}
+}
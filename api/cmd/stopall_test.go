@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Wraps a provider failing the destroy of the instance set with fail
+type failingDestroyProvider struct {
+	ComputeProvider
+	instance_id string
+	mu sync.Mutex
+}
+
+func (p *failingDestroyProvider) fail(instance_id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.instance_id = instance_id
+}
+
+func (p *failingDestroyProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	p.mu.Lock()
+	failing := instance_id == p.instance_id
+	p.mu.Unlock()
+	if failing {
+		return errors.New("teardown refused")
+	}
+	return p.ComputeProvider.DestroyInstance(ctx, instance_id)
+}
+
+func TestStopAll(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"STOP_ALL_CONCURRENCY": "2"})
+	mock := mockProvider(api)
+	provider := &failingDestroyProvider{ComputeProvider: mock}
+	api.Provider = tracedProvider{provider}
+	for _, device_id := range []string{"a", "b", "c"} {
+		startDevice(t, api, server, testAPIKey, device_id)
+	}
+	mock.SetBootDelay(time.Hour)
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "booting", "run": true}); status != http.StatusOK {
+		t.Fatalf("start booting: %d %s", status, body)
+	}
+	waitFor(t, "the boot to start", func() bool { return deviceStatus(api, "booting") == "provisioning" })
+	failed_id := instanceID(api, "b")
+	provider.fail(failed_id)
+
+	status, body := doRequest(t, server, "POST", "/compute/stop-all", testAPIKey, nil)
+	var response StopAllResponse
+	if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+		t.Fatalf("stop all: %d %s", status, body)
+	}
+	if response.Stopped != 3 || response.Failed != 1 {
+		t.Fatalf("stopped %d failed %d, want 3 and 1: %s", response.Stopped, response.Failed, body)
+	}
+
+	want := map[string]string{"a": "stopped", "b": "error", "booting": "cancelled", "c": "stopped"}
+	var device_ids []string
+	for _, result := range response.Devices {
+		device_ids = append(device_ids, result.DeviceID)
+		if result.Status != want[result.DeviceID] {
+			t.Errorf("%s %s, want %s", result.DeviceID, result.Status, want[result.DeviceID])
+		}
+		if (result.Error != "") != (result.Status == "error") {
+			t.Errorf("%s error %q with status %s", result.DeviceID, result.Error, result.Status)
+		}
+	}
+	if !slices.Equal(device_ids, []string{"a", "b", "booting", "c"}) {
+		t.Fatalf("devices %v", device_ids)
+	}
+	instances, err := mock.ListInstances(context.Background())
+	if err != nil || len(instances) != 1 || instances[0].ID != failed_id {
+		t.Fatalf("instances %+v left, want only the failed %s", instances, failed_id)
+	}
+}
+
+func TestStopAllRequiresAdmin(t *testing.T) {
+	_, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t, Tenant{Name: "owner", APIKey: "owner-key"})})
+	if status, body := doRequest(t, server, "POST", "/compute/stop-all", "owner-key", nil); status != http.StatusForbidden {
+		t.Fatalf("got %d %s, want 403", status, body)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//// Structure
+
+// State that survives restarts
+type PersistedState struct {
+	HistoricalCost float64 `json:"historical_cost"`
+	HistoricalCostByGPU map[string]float64 `json:"historical_cost_by_gpu"`
+	DeviceLabels map[string]DeviceLabel `json:"device_labels,omitempty"`
+}
+
+type StateStore interface {
+	Load() (*PersistedState, error)
+	Save(state *PersistedState) error
+}
+
+// Keeps state in a json file, written through a temp file so a crash never leaves it half written
+type FileStateStore struct {
+	path string
+	mu sync.Mutex
+}
+
+// Used when no STATE_FILE is configured, state is lost on restart
+type MemoryStateStore struct{}
+
+//// Functionality
+
+func NewStateStore(path string) StateStore {
+	if path == "" {
+		return MemoryStateStore{}
+	}
+	return &FileStateStore{path: path}
+}
+
+func newPersistedState() *PersistedState {
+	return &PersistedState{HistoricalCostByGPU: make(map[string]float64), DeviceLabels: make(map[string]DeviceLabel)}
+}
+
+func (s *FileStateStore) Load() (*PersistedState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := newPersistedState()
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.HistoricalCostByGPU == nil {
+		state.HistoricalCostByGPU = make(map[string]float64)
+	}
+	if state.DeviceLabels == nil {
+		state.DeviceLabels = make(map[string]DeviceLabel)
+	}
+	return state, nil
+}
+
+func (s *FileStateStore) Save(state *PersistedState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (MemoryStateStore) Load() (*PersistedState, error) {
+	return newPersistedState(), nil
+}
+
+func (MemoryStateStore) Save(state *PersistedState) error {
+	return nil
+}
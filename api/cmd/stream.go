@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//// Structure
+
+// Client to server message on the inference stream
+type StreamMessage struct {
+	Action string `json:"action"` // "infer" starts a generation, "cancel" aborts one, or all of them without a request_id
+	RequestID string `json:"request_id"` // Chosen by the client, tags every frame of the generation
+	Prompt string `json:"prompt"`
+	InferenceParameters
+}
+
+// Server to client frame, token chunks of concurrent generations are interleaved
+type StreamFrame struct {
+	RequestID string `json:"request_id,omitempty"`
+	Type string `json:"type"` // token, done, cancelled or error
+	Data string `json:"data,omitempty"` // Token, or the output generated so far on an inference_timeout error
+	Error string `json:"error,omitempty"`
+}
+
+// One inference websocket carrying several generations at once
+type inferenceStream struct {
+	conn *wsConn
+	write_mu sync.Mutex // Gorilla connections support one concurrent writer
+	inflight map[string]context.CancelFunc
+	mu sync.Mutex
+	wg sync.WaitGroup
+}
+
+//// Functionality
+
+func (stream *inferenceStream) write(frame StreamFrame) error {
+	stream.write_mu.Lock()
+	defer stream.write_mu.Unlock()
+	return writeJSONMessage(stream.conn, frame)
+}
+
+// Cancels the generation, or every generation in flight when request_id is empty. Returns false
+// if there was nothing to cancel. Each cancelled generation ends with its own cancelled frame
+func (stream *inferenceStream) cancel(request_id string) bool {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if request_id == "" {
+		for _, cancel := range stream.inflight {
+			cancel()
+		}
+		return len(stream.inflight) > 0
+	}
+
+	cancel, ok := stream.inflight[request_id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Registers a generation, returns an error frame reason if it can't start
+func (stream *inferenceStream) start(ctx context.Context, request_id string, max_concurrent int) (context.Context, string) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if request_id == "" {
+		return nil, "request_id required"
+	}
+	if _, ok := stream.inflight[request_id]; ok {
+		return nil, "request_id already in flight"
+	}
+	if len(stream.inflight) >= max_concurrent {
+		return nil, "too many concurrent requests"
+	}
+
+	request_ctx, cancel := context.WithCancel(ctx)
+	stream.inflight[request_id] = cancel
+	return request_ctx, ""
+}
+
+func (stream *inferenceStream) finish(request_id string) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if cancel, ok := stream.inflight[request_id]; ok {
+		cancel()
+		delete(stream.inflight, request_id)
+	}
+}
+
+// Runs one generation and streams its tokens tagged with the request ID. The generation is bounded
+// by its timeout, INFERENCE_DEADLINE without one
+func (api *APIServer) runStreamInference(ctx context.Context, stream *inferenceStream, endpoint string, request InferenceRequest, request_id string) {
+	defer stream.wg.Done()
+	defer stream.finish(request_id)
+	defer api.endInference(request.DeviceID)
+
+	ctx, cancel := context.WithTimeout(ctx, request.timeout(api.Config().InferenceDeadline))
+	defer cancel()
+
+	start := time.Now()
+	var partial strings.Builder
+	err := api.Backend.Stream(ctx, endpoint, request, func(token string) error {
+		partial.WriteString(token)
+		return stream.write(StreamFrame{RequestID: request_id, Type: "token", Data: token})
+	})
+	api.Events.Publish(InferenceCompleted{DeviceID: request.DeviceID, Latency: time.Since(start), Err: err})
+
+	switch {
+	case isClientGone(err):
+		// Nobody is left to tell, the deferred finish releases the request
+		return
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		log.Println("stream inference timed out", request.DeviceID, request_id)
+		stream.write(StreamFrame{RequestID: request_id, Type: "error", Error: "inference_timeout", Data: partial.String()})
+	case errors.Is(ctx.Err(), context.Canceled):
+		stream.write(StreamFrame{RequestID: request_id, Type: "cancelled"})
+	case err != nil:
+		log.Println("stream inference error", request.DeviceID, request_id, err)
+		stream.write(StreamFrame{RequestID: request_id, Type: "error", Error: "inference failed"})
+	default:
+		stream.write(StreamFrame{RequestID: request_id, Type: "done"})
+	}
+}
+
+// Inference websocket of a device, carries concurrent generations distinguished by request_id
+func (api *APIServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	device_id := mux.Vars(r)["deviceID"]
+	tenant := tenantFromContext(r.Context())
+
+	compute_state, ok := api.findComputeState(device_id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_device", "")
+		return
+	}
+	if rejectForeignDevice(w, r, compute_state) {
+		return
+	}
+
+	if !api.acquireWebSocket() {
+		http.Error(w, "too many websocket connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer api.releaseWebSocket()
+
+	conn, err := api.upgradeWebSocket(w, r)
+	if err != nil {
+		log.Println("stream websocket upgrade error", err)
+		return
+	}
+
+	stream := &inferenceStream{conn: conn, inflight: make(map[string]context.CancelFunc)}
+	api.StreamsMu.Lock()
+	api.Streams[stream] = true
+	api.StreamsMu.Unlock()
+
+	ctx, cancel := context.WithCancel(api.lifecycle_ctx)
+	defer func() {
+		// Abort whatever is still generating once the client is gone
+		cancel()
+		stream.wg.Wait()
+		conn.Close()
+
+		api.StreamsMu.Lock()
+		delete(api.Streams, stream)
+		api.StreamsMu.Unlock()
+	}()
+
+	for {
+		var message StreamMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+
+		switch message.Action {
+		case "cancel":
+			if !stream.cancel(message.RequestID) {
+				reason := "unknown request_id"
+				if message.RequestID == "" {
+					reason = "nothing to cancel"
+				}
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: reason})
+			}
+
+		case "infer":
+			if api.enforceCostCeiling(compute_state, api.Clock.Now()) {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "cost ceiling reached"})
+				continue
+			}
+
+			compute_state.Mu.Lock()
+			status, endpoint := compute_state.Status, compute_state.Endpoint
+			accepting, backend_token := compute_state.AcceptingInference, compute_state.BackendToken
+			compute_state.Mu.Unlock()
+			if isPausedStatus(status) {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "compute paused"})
+				continue
+			}
+			if status != "ready" {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "compute not ready"})
+				continue
+			}
+			if !accepting {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "compute warming up"})
+				continue
+			}
+
+			prompt, err := sanitizePrompt(message.Prompt, api.Config().PromptSanitize)
+			if err != nil {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: err.Error()})
+				continue
+			}
+			if !api.allowPrompt(device_id, tenant.Name, prompt) {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: errPromptBlocked.Error()})
+				continue
+			}
+
+			if errs := message.InferenceParameters.validate(api.Config()); len(errs) > 0 {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "invalid parameters: " + errs.String()})
+				continue
+			}
+
+			request_ctx, reason := stream.start(ctx, message.RequestID, api.Config().StreamMaxConcurrent)
+			if reason != "" {
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: reason})
+				continue
+			}
+
+			compute_state.Mu.Lock()
+			counted := compute_state.beginInference()
+			compute_state.Mu.Unlock()
+			if !counted {
+				stream.finish(message.RequestID)
+				stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "compute not ready"})
+				continue
+			}
+			api.touchCompute(compute_state)
+			request := InferenceRequest{DeviceID: device_id, Prompt: prompt, InferenceParameters: message.InferenceParameters.withDefaults(api.Config())}
+			stream.wg.Add(1)
+			go api.runStreamInference(withBackendToken(request_ctx, backend_token), stream, endpoint, request, message.RequestID)
+
+		default:
+			stream.write(StreamFrame{RequestID: message.RequestID, Type: "error", Error: "unknown action"})
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func readStreamFrame(t *testing.T, conn *websocket.Conn) StreamFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame StreamFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal("reading stream frame:", err)
+	}
+	return frame
+}
+
+func TestStreamMultiplexing(t *testing.T) {
+	// Tokens trickle out over 400ms so the generations overlap
+	api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "400ms"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	conn, _, err := dialWebSocket(t, server, "/stream/pi", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prompt := "one two three four five six seven eight"
+	for _, request_id := range []string{"kept", "cancelled"} {
+		if err := conn.WriteJSON(StreamMessage{Action: "infer", RequestID: request_id, Prompt: prompt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := map[string]*strings.Builder{"kept": {}, "cancelled": {}}
+	ended := map[string]string{}
+	interleaved := false
+	for len(ended) < 2 {
+		frame := readStreamFrame(t, conn)
+		switch frame.Type {
+		case "token":
+			output[frame.RequestID].WriteString(frame.Data)
+			if frame.RequestID == "cancelled" && output["kept"].Len() > 0 && !interleaved {
+				interleaved = true
+				conn.WriteJSON(StreamMessage{Action: "cancel", RequestID: "cancelled"})
+			}
+		default:
+			ended[frame.RequestID] = frame.Type
+		}
+	}
+
+	if !interleaved {
+		t.Fatal("tokens of the two generations were not interleaved")
+	}
+	if ended["kept"] != "done" || output["kept"].String() != "echo: "+prompt {
+		t.Fatalf("kept generation ended %s with %q", ended["kept"], output["kept"].String())
+	}
+	if ended["cancelled"] != "cancelled" || output["cancelled"].String() == "echo: "+prompt {
+		t.Fatalf("cancelled generation ended %s with %q", ended["cancelled"], output["cancelled"].String())
+	}
+}
+
+func TestStreamRejections(t *testing.T) {
+	tests := []struct {
+		name string
+		messages []StreamMessage
+		error string
+	}{
+		{"missing request_id", []StreamMessage{{Action: "infer", Prompt: "hi"}}, "request_id required"},
+		{"request_id in flight", []StreamMessage{{Action: "infer", RequestID: "a", Prompt: "hi"}, {Action: "infer", RequestID: "a", Prompt: "hi"}}, "request_id already in flight"},
+		{"over STREAM_MAX_CONCURRENT", []StreamMessage{{Action: "infer", RequestID: "a", Prompt: "hi"}, {Action: "infer", RequestID: "b", Prompt: "hi"}}, "too many concurrent requests"},
+		{"unknown request_id", []StreamMessage{{Action: "cancel", RequestID: "nope"}}, "unknown request_id"},
+		{"nothing to cancel", []StreamMessage{{Action: "cancel"}}, "nothing to cancel"},
+		{"unknown action", []StreamMessage{{Action: "dance", RequestID: "a"}}, "unknown action"},
+	}
+	api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "1s", "STREAM_MAX_CONCURRENT": "1"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, _, err := dialWebSocket(t, server, "/stream/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range test.messages {
+				if err := conn.WriteJSON(message); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for {
+				frame := readStreamFrame(t, conn)
+				if frame.Type == "error" {
+					if frame.Error != test.error {
+						t.Fatalf("error %q, want %q", frame.Error, test.error)
+					}
+					return
+				}
+			}
+		})
+	}
+}
+
+// Wraps the mock backend reporting the context error each stream returned with
+type cancelRecordingBackend struct {
+	InferenceBackend
+	ended chan error
+}
+
+func (b *cancelRecordingBackend) Stream(ctx context.Context, endpoint string, request InferenceRequest, on_token func(token string) error) error {
+	err := b.InferenceBackend.Stream(ctx, endpoint, request, on_token)
+	b.ended <- ctx.Err()
+	return err
+}
+
+func TestStreamCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		cancel StreamMessage
+	}{
+		{"by request_id", StreamMessage{Action: "cancel", RequestID: "a"}},
+		{"every generation", StreamMessage{Action: "cancel"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "2s"})
+			backend := &cancelRecordingBackend{InferenceBackend: api.Backend, ended: make(chan error, 1)}
+			api.Backend = backend
+			startDevice(t, api, server, testAPIKey, "pi")
+			conn, _, err := dialWebSocket(t, server, "/stream/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := conn.WriteJSON(StreamMessage{Action: "infer", RequestID: "a", Prompt: "one two three four five six"}); err != nil {
+				t.Fatal(err)
+			}
+			if frame := readStreamFrame(t, conn); frame.Type != "token" {
+				t.Fatalf("first frame %+v, want a token", frame)
+			}
+			if err := conn.WriteJSON(test.cancel); err != nil {
+				t.Fatal(err)
+			}
+			for frame := readStreamFrame(t, conn); frame.Type != "cancelled"; frame = readStreamFrame(t, conn) {
+				if frame.Type != "token" || frame.RequestID != "a" {
+					t.Fatalf("frame %+v before the cancelled one", frame)
+				}
+			}
+			select {
+			case err := <-backend.ended:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("backend stream ended with %v, want cancelled", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("backend stream still running after the cancel")
+			}
+		})
+	}
+}
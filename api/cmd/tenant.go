@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// Structure
+
+// Tenant Structures
+type Tenant struct {
+	Name string `json:"name"`
+	APIKey string `json:"api_key"`
+	APIKeyPrevious string `json:"api_key_previous,omitempty"` // Accepted alongside APIKey during a rotation
+	Role string `json:"role"` // viewer, owner (default) or admin, admin unlocks the admin endpoints
+	MaxInstances int `json:"max_instances"` // Quotas of 0 mean unlimited
+	MaxMonthlySpend float64 `json:"max_monthly_spend"`
+	MaxRequestsPerDay int `json:"max_requests_per_day"`
+	GPUType string `json:"gpu_type,omitempty"` // Defaults of control requests leaving them out, empty falls back to DEFAULT_GPU_TYPE
+	Region string `json:"region,omitempty"` // and DEFAULT_REGION
+}
+
+// Usage is kept behind an interface so it can be moved to a persistent store
+type UsageStore interface {
+	IncrementRequests(tenant string, day string) int
+	Requests(tenant string, day string) int
+	AddSpend(tenant string, month string, amount float64)
+	Spend(tenant string, month string) float64
+}
+
+type MemoryUsageStore struct {
+	requests map[string]int
+	spend map[string]float64
+	mu sync.Mutex
+}
+
+type contextKey string
+
+const tenantContextKey contextKey = "tenant"
+
+// Response Structures
+type UsageResponse struct {
+	Tenant string `json:"tenant"`
+	RequestsToday int `json:"requests_today"`
+	MaxRequestsPerDay int `json:"max_requests_per_day"`
+	RunningInstances int `json:"running_instances"`
+	MaxInstances int `json:"max_instances"`
+	MonthlySpend float64 `json:"monthly_spend"`
+	MaxMonthlySpend float64 `json:"max_monthly_spend"`
+}
+
+type QuotaResponse struct {
+	Error string `json:"error"`
+	Quota string `json:"quota"`
+}
+
+//// Functionality
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{
+		requests: make(map[string]int),
+		spend: make(map[string]float64),
+	}
+}
+
+func (s *MemoryUsageStore) IncrementRequests(tenant string, day string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[tenant+"/"+day]++
+	return s.requests[tenant+"/"+day]
+}
+
+func (s *MemoryUsageStore) Requests(tenant string, day string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[tenant+"/"+day]
+}
+
+func (s *MemoryUsageStore) AddSpend(tenant string, month string, amount float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spend[tenant+"/"+month] += amount
+}
+
+func (s *MemoryUsageStore) Spend(tenant string, month string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spend[tenant+"/"+month]
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Loads tenants from the json file at TENANTS_FILE, without one the API_KEY is a single unlimited tenant.
+// A tenant is reachable through both its current and previous key while a rotation is in progress
+func loadTenants(env *envParser, api_key string, api_key_previous string) (map[string]*Tenant, error) {
+	tenants := make(map[string]*Tenant)
+
+	path := env.lookup("TENANTS_FILE")
+	if path == "" {
+		tenant := &Tenant{Name: "default", APIKey: api_key, APIKeyPrevious: api_key_previous, Role: roleAdmin}
+		tenants[api_key] = tenant
+		if api_key_previous != "" {
+			tenants[api_key_previous] = tenant
+		}
+		return tenants, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenant_list []Tenant
+	if err := json.Unmarshal(data, &tenant_list); err != nil {
+		return nil, err
+	}
+	for i := range tenant_list {
+		if tenant_list[i].Role == "" {
+			tenant_list[i].Role = roleOwner
+		}
+		if gpu_type := tenant_list[i].GPUType; gpu_type != "" && !validGPUType.MatchString(gpu_type) {
+			return nil, fmt.Errorf("tenant %s: invalid gpu_type %q", tenant_list[i].Name, gpu_type)
+		}
+		if region := tenant_list[i].Region; region != "" && !validRegion.MatchString(region) {
+			return nil, fmt.Errorf("tenant %s: invalid region %q, must be an uppercase two letter country code", tenant_list[i].Name, region)
+		}
+		// A key shared by two entries would authenticate as whichever came last
+		keys := []string{tenant_list[i].APIKey}
+		if tenant_list[i].APIKeyPrevious != "" {
+			keys = append(keys, tenant_list[i].APIKeyPrevious)
+		}
+		for _, key := range keys {
+			if other, duplicate := tenants[key]; duplicate {
+				return nil, fmt.Errorf("tenant %s: duplicate api key, already used by tenant %s", tenant_list[i].Name, other.Name)
+			}
+			tenants[key] = &tenant_list[i]
+		}
+	}
+	return tenants, nil
+}
+
+func tenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantContextKey).(*Tenant)
+	return tenant
+}
+
+// Reads the api key from the X-API-Key header or a bearer Authorization header
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request, quota string) {
+	if err := encodeResponseStatus(w, r, http.StatusForbidden, QuotaResponse{
+		Error: "quota_exceeded",
+		Quota: quota,
+	}); err != nil {
+		logWriteError("quota response encoding error", err)
+	}
+}
+
+// Answers 403 and returns true if the device was started by another tenant than the one of the request
+func rejectForeignDevice(w http.ResponseWriter, r *http.Request, compute_state *ComputeState) bool {
+	compute_state.Mu.Lock()
+	owner := compute_state.Tenant
+	compute_state.Mu.Unlock()
+	if owner != "" && owner != tenantFromContext(r.Context()).Name {
+		http.Error(w, "device belongs to another tenant", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// Resolves the tenant of the request from its api key and enforces the daily request quota
+func (api *APIServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		tenant, ok := api.Config().security.tenants[key]
+		if key == "" || !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if key == tenant.APIKeyPrevious {
+			// Helps track down the clients that still need to move to the new key
+			api.debugLog("request authenticated with the previous api key", tenant.Name, r.Method, r.URL.Path, r.RemoteAddr)
+		}
+
+		requests := api.Usage.IncrementRequests(tenant.Name, usageDay(api.Clock.Now()))
+		if tenant.MaxRequestsPerDay > 0 && requests > tenant.MaxRequestsPerDay {
+			log.Println("tenant exceeded daily request quota", tenant.Name)
+			writeQuotaExceeded(w, r, "max_requests_per_day")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey, tenant)))
+	})
+}
+
+// Restricts a route to admin tenants, must run after authMiddleware
+func (api *APIServer) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := tenantFromContext(r.Context()); tenant == nil || tenant.Role != roleAdmin {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Counts running instances of the tenant and the cost they accrued so far
+func (api *APIServer) tenantRunning(tenant string) (int, float64) {
+	api.ComputesMu.Lock()
+	defer api.ComputesMu.Unlock()
+
+	running := 0
+	accrued := 0.0
+	for _, compute_state := range api.Computes {
+		compute_state.Mu.Lock()
+		if compute_state.IsRunning && compute_state.Tenant == tenant {
+			running++
+			accrued += compute_state.accruedCost(api.Clock.Now())
+		}
+		compute_state.Mu.Unlock()
+	}
+	return running, accrued
+}
+
+// Returns the name of the quota a new instance for the tenant would exceed, or "" if it fits
+func (api *APIServer) checkInstanceQuota(tenant *Tenant) string {
+	running, accrued := api.tenantRunning(tenant.Name)
+
+	if tenant.MaxInstances > 0 && running >= tenant.MaxInstances {
+		return "max_instances"
+	}
+	spend := api.Usage.Spend(tenant.Name, usageMonth(api.Clock.Now())) + accrued
+	if tenant.MaxMonthlySpend > 0 && spend >= tenant.MaxMonthlySpend {
+		return "max_monthly_spend"
+	}
+	return ""
+}
+
+func (api *APIServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+
+	running, accrued := api.tenantRunning(tenant.Name)
+	now := api.Clock.Now()
+
+	if err := encodeResponse(w, r, UsageResponse{
+		Tenant: tenant.Name,
+		RequestsToday: api.Usage.Requests(tenant.Name, usageDay(now)),
+		MaxRequestsPerDay: tenant.MaxRequestsPerDay,
+		RunningInstances: running,
+		MaxInstances: tenant.MaxInstances,
+		MonthlySpend: api.Usage.Spend(tenant.Name, usageMonth(now)) + accrued,
+		MaxMonthlySpend: tenant.MaxMonthlySpend,
+	}); err != nil {
+		logWriteError("usage response encoding error", err)
+	}
+}
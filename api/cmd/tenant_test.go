@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForeignDeviceOperationsAreRejected(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "alice", APIKey: "alice-key"},
+		Tenant{Name: "bob", APIKey: "bob-key"},
+	)})
+	startDevice(t, api, server, "alice-key", "alice-pi")
+
+	tests := []struct {
+		name string
+		method string
+		path string
+		body any
+	}{
+		{"stop", "POST", "/control", map[string]any{"device_id": "alice-pi", "run": false}},
+		{"reprovision", "POST", "/reprovision/alice-pi", nil},
+		{"pause", "POST", "/pause/alice-pi", nil},
+		{"resume", "POST", "/resume/alice-pi", nil},
+		{"inference", "POST", "/respond", map[string]any{"device_id": "alice-pi", "prompt": "hi"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, body := doRequest(t, server, test.method, test.path, "bob-key", test.body); status != http.StatusForbidden {
+				t.Fatalf("got %d %s, want 403", status, body)
+			}
+			if status := deviceStatus(api, "alice-pi"); status != "ready" {
+				t.Fatalf("device status %s after a rejected %s", status, test.name)
+			}
+		})
+	}
+
+	if status, body := doRequest(t, server, "POST", "/control", "alice-key", map[string]any{"device_id": "alice-pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("owner stop: %d %s", status, body)
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	tests := []struct {
+		name string
+		tenant Tenant
+		setup func(t *testing.T, api *APIServer, server *httptest.Server)
+		request func(t *testing.T, server *httptest.Server) (int, []byte)
+		quota string
+	}{
+		{
+			name: "max_instances",
+			tenant: Tenant{MaxInstances: 1},
+			setup: func(t *testing.T, api *APIServer, server *httptest.Server) {
+				startDevice(t, api, server, "quota-key", "first")
+			},
+			request: func(t *testing.T, server *httptest.Server) (int, []byte) {
+				return doRequest(t, server, "POST", "/control", "quota-key", map[string]any{"device_id": "second", "run": true})
+			},
+		},
+		{
+			name: "max_monthly_spend",
+			tenant: Tenant{MaxMonthlySpend: 1},
+			setup: func(t *testing.T, api *APIServer, server *httptest.Server) {
+				api.Usage.AddSpend("limited", usageMonth(api.Clock.Now()), 1.5)
+			},
+			request: func(t *testing.T, server *httptest.Server) (int, []byte) {
+				return doRequest(t, server, "POST", "/control", "quota-key", map[string]any{"device_id": "pi", "run": true})
+			},
+		},
+		{
+			name: "max_requests_per_day",
+			tenant: Tenant{MaxRequestsPerDay: 2},
+			setup: func(t *testing.T, api *APIServer, server *httptest.Server) {
+				for range 2 {
+					if status, body := doRequest(t, server, "GET", "/ping", "quota-key", nil); status != http.StatusOK {
+						t.Fatalf("request within the quota: %d %s", status, body)
+					}
+				}
+			},
+			request: func(t *testing.T, server *httptest.Server) (int, []byte) {
+				return doRequest(t, server, "GET", "/ping", "quota-key", nil)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.tenant.Name, test.tenant.APIKey = "limited", "quota-key"
+			api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t, test.tenant)})
+			test.setup(t, api, server)
+
+			status, body := test.request(t, server)
+			var response QuotaResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusForbidden || err != nil || response.Quota != test.name {
+				t.Fatalf("got %d %s, want 403 naming %s", status, body, test.name)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "alice", APIKey: "alice-key", MaxInstances: 3, MaxMonthlySpend: 10, MaxRequestsPerDay: 100},
+	)})
+	startDevice(t, api, server, "alice-key", "pi")
+	api.Usage.AddSpend("alice", usageMonth(api.Clock.Now()), 2)
+
+	status, body := doRequest(t, server, "GET", "/usage", "alice-key", nil)
+	var usage UsageResponse
+	if err := json.Unmarshal(body, &usage); status != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s", status, body)
+	}
+	// The start, the /usage request itself
+	want := UsageResponse{Tenant: "alice", RequestsToday: 2, MaxRequestsPerDay: 100, RunningInstances: 1, MaxInstances: 3, MonthlySpend: 2, MaxMonthlySpend: 10}
+	if usage != want {
+		t.Fatalf("usage %+v, want %+v", usage, want)
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		current string
+		previous string
+	}{
+		{"single key", map[string]string{"API_KEY_PREVIOUS": "old-key"}, testAPIKey, "old-key"},
+		{"tenants file", map[string]string{"TENANTS_FILE": tenantsFile(t, Tenant{Name: "alice", APIKey: "alice-key", APIKeyPrevious: "alice-old"})}, "alice-key", "alice-old"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.env["LOG_DEBUG"] = "true"
+			_, server := newTestServer(t, test.env)
+			logs := captureLog(t)
+
+			keys := []struct {
+				key string
+				status int
+				logged bool // Whether the previous key note is logged
+			}{
+				{test.current, http.StatusOK, false},
+				{test.previous, http.StatusOK, true},
+				{"third-key", http.StatusUnauthorized, false},
+			}
+			for _, key := range keys {
+				logs.Reset()
+				if status, body := doRequest(t, server, "GET", "/ping", key.key, nil); status != key.status {
+					t.Fatalf("%s: got %d %s, want %d", key.key, status, body, key.status)
+				}
+				if logged := strings.Contains(logs.String(), "previous api key"); logged != key.logged {
+					t.Fatalf("%s: previous key logged %v, want %v: %q", key.key, logged, key.logged, logs.String())
+				}
+			}
+		})
+	}
+}
+
+// Control requests leaving out the gpu and region get the defaults of their tenant, then the global ones
+func TestTenantDefaults(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"DEFAULT_GPU_TYPE": "RTX_3090", "DEFAULT_REGION": "DE", "TENANTS_FILE": tenantsFile(t,
+		Tenant{Name: "alice", APIKey: "alice-key", GPUType: "A100", Region: "US"},
+		Tenant{Name: "bob", APIKey: "bob-key", GPUType: "H100"},
+		Tenant{Name: "carol", APIKey: "carol-key"},
+	)})
+	tests := []struct {
+		name string
+		key string
+		request map[string]any
+		gpu_type string
+		region string
+	}{
+		{"tenant gpu and region", "alice-key", nil, "A100", "US"},
+		{"tenant gpu, global region", "bob-key", nil, "H100", "DE"},
+		{"global defaults", "carol-key", nil, "RTX_3090", "DE"},
+		{"request wins", "alice-key", map[string]any{"gpu_type": "RTX_4090", "region": "FR"}, "RTX_4090", "FR"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device_id := strings.ReplaceAll(test.name, " ", "-")
+			body := map[string]any{"device_id": device_id, "run": true}
+			for key, value := range test.request {
+				body[key] = value
+			}
+			if status, response := doRequest(t, server, "POST", "/control", test.key, body); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, response)
+			}
+			compute_state := api.getComputeState(device_id)
+			compute_state.Mu.Lock()
+			spec := compute_state.Spec
+			compute_state.Mu.Unlock()
+			if spec.GPUType != test.gpu_type || spec.Region != test.region {
+				t.Fatalf("rented %s in %q, want %s in %s", spec.GPUType, spec.Region, test.gpu_type, test.region)
+			}
+		})
+	}
+}
+
+// A key may authenticate one tenant only, whether as its current or its previous key
+func TestDuplicateTenantKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		tenants []Tenant
+		valid bool
+	}{
+		{"distinct keys", []Tenant{{Name: "alice", APIKey: "alice-key", APIKeyPrevious: "alice-old"}, {Name: "bob", APIKey: "bob-key"}}, true},
+		{"shared key", []Tenant{{Name: "alice", APIKey: "shared"}, {Name: "bob", APIKey: "shared"}}, false},
+		{"key reused as a previous key", []Tenant{{Name: "alice", APIKey: "alice-key"}, {Name: "bob", APIKey: "bob-key", APIKeyPrevious: "alice-key"}}, false},
+		{"previous key same as the current one", []Tenant{{Name: "alice", APIKey: "alice-key", APIKeyPrevious: "alice-key"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("API_KEY", testAPIKey)
+			t.Setenv("TENANTS_FILE", tenantsFile(t, test.tenants...))
+			_, err := LoadConfig()
+			if valid := err == nil; valid != test.valid {
+				t.Fatalf("got %v, want valid %v", err, test.valid)
+			}
+			if err != nil && (!strings.Contains(err.Error(), "duplicate api key") || strings.Contains(err.Error(), "-key")) {
+				t.Fatalf("error %q should name the duplicate without the key itself", err)
+			}
+		})
+	}
+}
+
+func TestTenantDefaultsValidated(t *testing.T) {
+	tests := []struct {
+		name string
+		tenant Tenant
+	}{
+		{"gpu_type", Tenant{Name: "alice", APIKey: "alice-key", GPUType: "A100;rm"}},
+		{"region", Tenant{Name: "alice", APIKey: "alice-key", Region: "usa"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("API_KEY", testAPIKey)
+			t.Setenv("TENANTS_FILE", tenantsFile(t, test.tenant))
+			if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), test.name) {
+				t.Fatalf("got %v, want an error naming %s", err, test.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+//// Functionality
+
+var errInvalidRequestTimeout = errors.New("invalid X-Request-Timeout header")
+
+// Reads the client requested timeout from X-Request-Timeout (e.g. "30s"), falling back when the
+// header is absent. Values above MAX_REQUEST_TIMEOUT are capped to it
+func (api *APIServer) requestTimeout(r *http.Request, fallback time.Duration) (time.Duration, error) {
+	value := r.Header.Get("X-Request-Timeout")
+	if value == "" {
+		return fallback, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, errInvalidRequestTimeout
+	}
+	return min(timeout, api.Config().MaxRequestTimeout), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		header string
+		want int
+	}{
+		{"absent", "", http.StatusOK},
+		{"honored", "50ms", http.StatusGatewayTimeout},
+		{"above the cap", "10m", http.StatusGatewayTimeout},
+		{"invalid", "soon", http.StatusBadRequest},
+		{"negative", "-1s", http.StatusBadRequest},
+	}
+	// Inference takes 300ms, longer than MAX_REQUEST_TIMEOUT lets a client wait
+	api, server := newTestServer(t, map[string]string{"MOCK_LATENCY": "300ms", "MAX_REQUEST_TIMEOUT": "100ms"})
+	startDevice(t, api, server, testAPIKey, "pi")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+			if test.header != "" {
+				request.Header.Set("X-Request-Timeout", test.header)
+			}
+			response, body := sendRequest(t, request)
+			if response.StatusCode != test.want {
+				t.Fatalf("got %d %s, want %d", response.StatusCode, body, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutParsing(t *testing.T) {
+	tests := []struct {
+		header string
+		want time.Duration
+		err bool
+	}{
+		{"", time.Minute, false},
+		{"30s", 30 * time.Second, false},
+		{"2h", 15 * time.Minute, false},
+		{"0s", 0, true},
+		{"thirty", 0, true},
+	}
+	api, _ := newTestServer(t, nil)
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			request, _ := http.NewRequest("GET", "/", nil)
+			request.Header.Set("X-Request-Timeout", test.header)
+			got, err := api.requestTimeout(request, time.Minute)
+			if (err != nil) != test.err || got != test.want {
+				t.Fatalf("got %s %v, want %s (error %v)", got, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+// Records whether the backend call carried a deadline and how it ended
+type deadlineRecordingBackend struct {
+	InferenceBackend
+	ended chan error
+	deadline chan bool
+}
+
+func (b *deadlineRecordingBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	_, ok := ctx.Deadline()
+	b.deadline <- ok
+	response, err := b.InferenceBackend.Complete(ctx, endpoint, request)
+	b.ended <- ctx.Err()
+	return response, err
+}
+
+func TestInferenceTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		timeout string // "timeout" field of the request
+		status int
+		code string
+	}{
+		{"request timeout", nil, "50ms", http.StatusGatewayTimeout, "inference_timeout"},
+		{"INFERENCE_DEADLINE", map[string]string{"INFERENCE_DEADLINE": "50ms"}, "", http.StatusGatewayTimeout, "inference_timeout"},
+		{"request timeout over INFERENCE_DEADLINE", map[string]string{"INFERENCE_DEADLINE": "50ms"}, "2s", http.StatusOK, ""},
+		{"above INFERENCE_TIMEOUT_MAX", map[string]string{"INFERENCE_TIMEOUT_MAX": "1s"}, "2s", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"MOCK_LATENCY": "300ms"}
+			for key, value := range test.env {
+				env[key] = value
+			}
+			api, server := newTestServer(t, env)
+			backend := &deadlineRecordingBackend{InferenceBackend: api.Backend, ended: make(chan error, 1), deadline: make(chan bool, 1)}
+			api.Backend = backend
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi", "timeout": test.timeout})
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status == http.StatusBadRequest {
+				return
+			}
+			if !<-backend.deadline {
+				t.Fatal("backend call without a deadline")
+			}
+			// The backend call is over by the time the client has its answer
+			select {
+			case err := <-backend.ended:
+				if (err != nil) != (test.code != "") {
+					t.Fatalf("backend context ended with %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("backend call still running")
+			}
+			if test.code != "" {
+				var response ErrorResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Error != test.code {
+					t.Fatalf("got %s, want %s", body, test.code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//// Structure
+
+// Traces every provider call, so cold starts show up in the trace of the request that caused them
+type tracedProvider struct {
+	ComputeProvider
+}
+
+type tracedBackend struct {
+	InferenceBackend
+}
+
+//// Functionality
+
+var tracer = otel.Tracer("RASBERRY_api")
+
+// Exports spans over OTLP/HTTP when TRACING_ENABLED is set, the exporter reads the standard
+// OTEL_EXPORTER_OTLP_* variables. Without it the global tracer stays a no-op. Incoming traceparent
+// headers are honored either way
+func setupTracing(ctx context.Context, config *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !config.TracingEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.TracingServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Ends the span, recording err on it if there was one
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Background work started by a request keeps its trace although it outlives the request context
+func withRequestTrace(ctx context.Context, r *http.Request) context.Context {
+	return trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(r.Context()))
+}
+
+// Starts a server span per request continuing the trace of an incoming traceparent header
+func (api *APIServer) tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeLabel(r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+func (p tracedProvider) CreateInstance(ctx context.Context, spec InstanceSpec) (info *InstanceInfo, err error) {
+	ctx, span := tracer.Start(ctx, "provider.create", trace.WithAttributes(attribute.String("gpu_type", spec.GPUType)))
+	defer func() { endSpan(span, err) }()
+	return p.ComputeProvider.CreateInstance(ctx, spec)
+}
+
+func (p tracedProvider) DestroyInstance(ctx context.Context, instance_id string) (err error) {
+	ctx, span := tracer.Start(ctx, "provider.destroy", trace.WithAttributes(attribute.String("instance_id", instance_id)))
+	defer func() { endSpan(span, err) }()
+	return p.ComputeProvider.DestroyInstance(ctx, instance_id)
+}
+
+func (p tracedProvider) InstanceStatus(ctx context.Context, instance_id string) (info *InstanceInfo, err error) {
+	ctx, span := tracer.Start(ctx, "provider.status", trace.WithAttributes(attribute.String("instance_id", instance_id)))
+	defer func() { endSpan(span, err) }()
+	return p.ComputeProvider.InstanceStatus(ctx, instance_id)
+}
+
+// Pause support is checked on the wrapped provider, so wrapping never hides or adds it
+func (p tracedProvider) PauseInstance(ctx context.Context, instance_id string) (err error) {
+	ctx, span := tracer.Start(ctx, "provider.pause", trace.WithAttributes(attribute.String("instance_id", instance_id)))
+	defer func() { endSpan(span, err) }()
+	return pauseInstance(ctx, p.ComputeProvider, instance_id)
+}
+
+func (p tracedProvider) ResumeInstance(ctx context.Context, instance_id string) (err error) {
+	ctx, span := tracer.Start(ctx, "provider.resume", trace.WithAttributes(attribute.String("instance_id", instance_id)))
+	defer func() { endSpan(span, err) }()
+	return resumeInstance(ctx, p.ComputeProvider, instance_id)
+}
+
+func (b tracedBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (completion string, err error) {
+	ctx, span := tracer.Start(ctx, "backend.forward", trace.WithAttributes(attribute.String("device_id", request.DeviceID)))
+	defer func() { endSpan(span, err) }()
+	return b.InferenceBackend.Complete(ctx, endpoint, request)
+}
+
+func (b tracedBackend) Stream(ctx context.Context, endpoint string, request InferenceRequest, on_token func(token string) error) (err error) {
+	ctx, span := tracer.Start(ctx, "backend.stream", trace.WithAttributes(attribute.String("device_id", request.DeviceID)))
+	defer func() { endSpan(span, err) }()
+	return b.InferenceBackend.Stream(ctx, endpoint, request, on_token)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	span_recorder *tracetest.SpanRecorder
+	span_recorder_once sync.Once
+)
+
+// The global tracer only ever delegates to the first provider set, so every test shares one recorder
+// and picks its spans by trace ID
+func recordSpans() *tracetest.SpanRecorder {
+	span_recorder_once.Do(func() {
+		span_recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(span_recorder)))
+	})
+	return span_recorder
+}
+
+// Ended spans of the trace by name
+func traceSpans(recorder *tracetest.SpanRecorder, trace_id trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == trace_id {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	trace_id, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	remote_parent, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+
+	recorder := recordSpans()
+	api, server := newTestServer(t, nil)
+
+	request := newRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true})
+	request.Header.Set("traceparent", traceparent)
+	if response, body := sendRequest(t, request); response.StatusCode != http.StatusOK {
+		t.Fatalf("start: %d %s", response.StatusCode, body)
+	}
+	waitFor(t, "the provisioning spans", func() bool { _, ok := traceSpans(recorder, trace_id)["provision"]; return ok })
+
+	request = newRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": "pi", "prompt": "hi"})
+	request.Header.Set("traceparent", traceparent)
+	if response, body := sendRequest(t, request); response.StatusCode != http.StatusOK {
+		t.Fatalf("inference: %d %s", response.StatusCode, body)
+	}
+	waitFor(t, "the inference spans", func() bool { _, ok := traceSpans(recorder, trace_id)["POST /respond"]; return ok })
+	if status := deviceStatus(api, "pi"); status != "ready" {
+		t.Fatalf("device %s", status)
+	}
+
+	spans := traceSpans(recorder, trace_id)
+	tests := []struct {
+		span string
+		parent string // Empty for spans continuing the incoming traceparent
+	}{
+		{"POST /control", ""},
+		{"provision", "POST /control"},
+		{"provider.create", "provision"},
+		{"poll", "provision"},
+		{"provider.status", "poll"},
+		{"POST /respond", ""},
+		{"backend.forward", "POST /respond"},
+	}
+	for _, test := range tests {
+		span, ok := spans[test.span]
+		if !ok {
+			t.Errorf("no %s span in the trace", test.span)
+			continue
+		}
+		want := remote_parent
+		if test.parent != "" {
+			parent, ok := spans[test.parent]
+			if !ok {
+				continue
+			}
+			want = parent.SpanContext().SpanID()
+		}
+		if got := span.Parent().SpanID(); got != want {
+			t.Errorf("%s is a child of %s, want %s", test.span, got, want)
+		}
+	}
+}
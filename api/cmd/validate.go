@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//// Structure
+
+type ValidationErrorResponse struct {
+	Error string `json:"error"`
+	Errors []FieldError `json:"errors"` // Every problem of the request, ordered by field
+	Fields map[string]string `json:"fields"` // Problem per json field name, kept for older clients
+}
+
+type FieldError struct {
+	Field string `json:"field"`
+	Problem string `json:"problem"`
+}
+
+// Collects every invalid field of a request so the client can fix them in one go
+type fieldErrors map[string]string
+
+// ControlRequest as sent, run is decoded by hand to tell a missing run from a string one
+type controlRequestBody struct {
+	ControlRequest
+	Run json.RawMessage `json:"run"`
+}
+
+//// Functionality
+
+// Decodes a control request, with lenient set a string boolean run like "true" or "0" is accepted too
+func decodeControlRequest(body io.Reader, lenient bool) (ControlRequest, error) {
+	var decoded controlRequestBody
+	if err := json.NewDecoder(body).Decode(&decoded); err != nil {
+		return ControlRequest{}, err
+	}
+
+	request := decoded.ControlRequest
+	raw := string(bytes.TrimSpace(decoded.Run))
+	if raw == "" || raw == "null" {
+		return request, nil
+	}
+
+	var run bool
+	if err := json.Unmarshal(decoded.Run, &run); err != nil {
+		var text string
+		if !lenient || json.Unmarshal(decoded.Run, &text) != nil {
+			return ControlRequest{}, fmt.Errorf("run must be a boolean, got %s", raw)
+		}
+		if run, err = strconv.ParseBool(strings.TrimSpace(text)); err != nil {
+			return ControlRequest{}, fmt.Errorf("run must be a boolean, got %s", raw)
+		}
+	}
+	request.Run = &run
+	return request, nil
+}
+
+// Records problem for the field unless ok, only the first problem of each field is kept
+func (errs fieldErrors) check(ok bool, field string, problem string) {
+	if _, seen := errs[field]; !ok && !seen {
+		errs[field] = problem
+	}
+}
+
+// Adds the problems of other, fields that already have a problem keep theirs
+func (errs fieldErrors) merge(other fieldErrors) fieldErrors {
+	for field, problem := range other {
+		errs.check(false, field, problem)
+	}
+	return errs
+}
+
+// Problems as a list ordered by field, so responses are stable
+func (errs fieldErrors) list() []FieldError {
+	list := make([]FieldError, 0, len(errs))
+	for field, problem := range errs {
+		list = append(list, FieldError{Field: field, Problem: problem})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Field < list[j].Field })
+	return list
+}
+
+// Timestamps are optional but have to be RFC3339 when sent
+func validTimestamp(timestamp string) bool {
+	if timestamp == "" {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339, timestamp)
+	return err == nil
+}
+
+func (request ControlRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.check(request.DeviceID != "", "device_id", "required")
+	errs.check(validTimestamp(request.Timestamp), "timestamp", "must be RFC3339")
+	errs.check(request.MaxCost >= 0, "max_cost", "must not be negative")
+	errs.check(request.CostCeiling >= 0, "cost_ceiling", "must not be negative")
+	errs.check(request.Run == nil || *request.Run || !request.ReuseExisting, "reuse_existing", "requires run")
+	errs.check(request.GPUType == "" || validGPUType.MatchString(request.GPUType), "gpu_type", "must be letters, digits, '_' and spaces")
+	errs.check(request.Region == "" || validRegion.MatchString(request.Region), "region", "must be an uppercase two letter country code")
+	return errs
+}
+
+func (request InferenceRequest) validate() fieldErrors {
+	errs := fieldErrors{}
+	errs.check(request.DeviceID != "", "device_id", "required")
+	errs.check(validTimestamp(request.Timestamp), "timestamp", "must be RFC3339")
+	errs.check(request.Prompt != "" || len(request.Attachments) > 0, "prompt", "required without attachments")
+	return errs
+}
+
+// Writes the status listing every invalid field, returns false if there were none
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, status int, errs fieldErrors) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	if err := encodeResponseStatus(w, r, status, ValidationErrorResponse{
+		Error: "validation_failed",
+		Errors: errs.list(),
+		Fields: errs,
+	}); err != nil {
+		logWriteError("validation response encoding error", err)
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestValidationErrorsAreAggregated(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body map[string]any
+		fields []string
+	}{
+		{
+			"control",
+			"/control",
+			map[string]any{"run": true, "timestamp": "yesterday", "max_cost": -1, "gpu_type": "RTX;4090", "region": "europe"},
+			[]string{"device_id", "gpu_type", "max_cost", "region", "timestamp"},
+		},
+		{
+			"control stop",
+			"/control",
+			map[string]any{"device_id": "pi", "run": false, "reuse_existing": true, "cost_ceiling": -5},
+			[]string{"cost_ceiling", "reuse_existing"},
+		},
+		{
+			"inference",
+			"/respond",
+			map[string]any{"timestamp": "noon"},
+			[]string{"device_id", "prompt", "timestamp"},
+		},
+		{
+			"inference with parameters",
+			"/respond",
+			map[string]any{"device_id": "pi", "temperature": 9},
+			[]string{"prompt", "temperature"},
+		},
+	}
+	_, server := newTestServer(t, nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := doRequest(t, server, "POST", test.path, testAPIKey, test.body)
+			var response ValidationErrorResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusUnprocessableEntity || err != nil || response.Error != "validation_failed" {
+				t.Fatalf("got %d %s, want 422", status, body)
+			}
+
+			var listed []string
+			for _, problem := range response.Errors {
+				listed = append(listed, problem.Field)
+				if response.Fields[problem.Field] != problem.Problem {
+					t.Fatalf("fields and errors disagree on %s: %s", problem.Field, body)
+				}
+			}
+			if !slices.Equal(listed, test.fields) || len(response.Fields) != len(test.fields) {
+				t.Fatalf("reported %v, want %v", listed, test.fields)
+			}
+		})
+	}
+}
+
+func TestControlRunField(t *testing.T) {
+	tests := []struct {
+		name string
+		lenient bool
+		run string // Raw json of the run field, empty leaves it out
+		status int
+		running bool
+	}{
+		{"missing", false, "", http.StatusUnprocessableEntity, false},
+		{"null", false, "null", http.StatusUnprocessableEntity, false},
+		{"true", false, "true", http.StatusOK, true},
+		{"false", false, "false", http.StatusConflict, false},
+		{"string strict", false, `"true"`, http.StatusBadRequest, false},
+		{"string lenient", true, `"true"`, http.StatusOK, true},
+		{"string false lenient", true, `"0"`, http.StatusConflict, false},
+		{"missing lenient", true, "", http.StatusUnprocessableEntity, false},
+		{"not a boolean lenient", true, `"maybe"`, http.StatusBadRequest, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"CONTROL_LENIENT_RUN": strconv.FormatBool(test.lenient)})
+			body := `{"device_id": "pi"`
+			if test.run != "" {
+				body += `, "run": ` + test.run
+			}
+			status, response := doRequest(t, server, "POST", "/control", testAPIKey, body+"}")
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, response, test.status)
+			}
+			if status == http.StatusUnprocessableEntity && string(response) != `{"error":"run field required"}`+"\n" {
+				t.Fatalf("body %q", response)
+			}
+			compute_state, ok := api.findComputeState("pi")
+			running := false
+			if ok {
+				compute_state.Mu.Lock()
+				running = compute_state.IsRunning
+				compute_state.Mu.Unlock()
+			}
+			if running != test.running {
+				t.Fatalf("running %t after the request, want %t", running, test.running)
+			}
+		})
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		build func() fieldErrors
+		want []FieldError
+	}{
+		{"none", func() fieldErrors {
+			errs := fieldErrors{}
+			errs.check(true, "device_id", "required")
+			return errs
+		}, []FieldError{}},
+		{"first problem of a field kept", func() fieldErrors {
+			errs := fieldErrors{}
+			errs.check(false, "stop", "at most 4 sequences")
+			errs.check(false, "stop", "must not contain empty sequences")
+			return errs
+		}, []FieldError{{Field: "stop", Problem: "at most 4 sequences"}}},
+		{"ordered by field", func() fieldErrors {
+			errs := fieldErrors{}
+			errs.check(false, "timestamp", "must be RFC3339")
+			errs.check(false, "device_id", "required")
+			return errs
+		}, []FieldError{{Field: "device_id", Problem: "required"}, {Field: "timestamp", Problem: "must be RFC3339"}}},
+		{"merged", func() fieldErrors {
+			errs := fieldErrors{"prompt": "required without attachments"}
+			return errs.merge(fieldErrors{"prompt": "other", "top_p": "must be above 0 and at most 1"})
+		}, []FieldError{{Field: "prompt", Problem: "required without attachments"}, {Field: "top_p", Problem: "must be above 0 and at most 1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.build().list(); !slices.Equal(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// With GENERATE_DEVICE_ID a start without device_id gets one the client uses from then on
+func TestGeneratedDeviceID(t *testing.T) {
+	tests := []struct {
+		name string
+		generate string
+		body map[string]any
+		status int
+		device_id string // Expected back, "generated" for a fresh UUID
+	}{
+		{"generated", "true", map[string]any{"run": true}, http.StatusOK, "generated"},
+		{"generated for an empty id", "true", map[string]any{"device_id": "", "run": true}, http.StatusOK, "generated"},
+		{"given id kept", "true", map[string]any{"device_id": "pi", "run": true}, http.StatusOK, "pi"},
+		{"stop without an id", "true", map[string]any{"run": false}, http.StatusUnprocessableEntity, ""},
+		{"rejected when off", "false", map[string]any{"run": true}, http.StatusUnprocessableEntity, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"GENERATE_DEVICE_ID": test.generate})
+			status, body := doRequest(t, server, "POST", "/control", testAPIKey, test.body)
+			if status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+			if status != http.StatusOK {
+				var response ValidationErrorResponse
+				if err := json.Unmarshal(body, &response); err != nil || response.Fields["device_id"] == "" {
+					t.Fatalf("got %s, want device_id reported", body)
+				}
+				api.ComputesMu.Lock()
+				devices := len(api.Computes)
+				api.ComputesMu.Unlock()
+				if devices != 0 {
+					t.Fatalf("%d devices after a rejected start", devices)
+				}
+				return
+			}
+
+			var response StatusResponse
+			if err := json.Unmarshal(body, &response); err != nil {
+				t.Fatal(err)
+			}
+			device_id := response.DeviceID
+			if test.device_id == "generated" {
+				if _, err := uuid.Parse(device_id); err != nil {
+					t.Fatalf("device_id %q is not a uuid", device_id)
+				}
+			} else if device_id != test.device_id {
+				t.Fatalf("device_id %q, want %q", device_id, test.device_id)
+			}
+			if !strings.HasSuffix(response.WebSocketURL, "/status/"+device_id) {
+				t.Fatalf("websocket url %s for %s", response.WebSocketURL, device_id)
+			}
+
+			// Later calls name the device by the returned id
+			waitFor(t, "the device to be ready", func() bool { return deviceStatus(api, device_id) == "ready" })
+			if status, body := doRequest(t, server, "GET", "/status/"+device_id+"/snapshot", testAPIKey, nil); status != http.StatusOK {
+				t.Fatalf("snapshot: %d %s", status, body)
+			}
+			if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, map[string]any{"device_id": device_id, "prompt": "hi"}); status != http.StatusOK {
+				t.Fatalf("inference: %d %s", status, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+)
+
+//// Structure
+
+type VersionResponse struct {
+	Version string `json:"version"`
+	Commit string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+//// Functionality
+
+// Set at build time, e.g.
+// go build -ldflags "-X main.buildVersion=v1.4.0 -X main.buildCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	buildVersion = "dev"
+	buildCommit = "unknown"
+	buildDate = "unknown"
+)
+
+func currentVersion() VersionResponse {
+	return VersionResponse{
+		Version: buildVersion,
+		Commit: buildCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// Identifies the deployed build, unauthenticated like /health
+func (api *APIServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if err := encodeResponse(w, r, currentVersion()); err != nil {
+		logWriteError("version response encoding error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		version, commit, date string // As set with -ldflags -X, empty keeps the defaults
+		want VersionResponse
+	}{
+		{"defaults", "", "", "", VersionResponse{Version: "dev", Commit: "unknown", BuildDate: "unknown"}},
+		{"linker values", "v1.4.0", "3b88d91", "2026-10-14T09:00:00Z", VersionResponse{Version: "v1.4.0", Commit: "3b88d91", BuildDate: "2026-10-14T09:00:00Z"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defaults := []string{buildVersion, buildCommit, buildDate}
+			t.Cleanup(func() { buildVersion, buildCommit, buildDate = defaults[0], defaults[1], defaults[2] })
+			if test.version != "" {
+				buildVersion, buildCommit, buildDate = test.version, test.commit, test.date
+			}
+			_, server := newTestServer(t, nil)
+
+			// No api key, like /health
+			status, body := doRequest(t, server, "GET", "/version", "", nil)
+			var response VersionResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("got %d %s", status, body)
+			}
+			test.want.GoVersion = runtime.Version()
+			if response != test.want {
+				t.Fatalf("got %+v, want %+v", response, test.want)
+			}
+		})
+	}
+}
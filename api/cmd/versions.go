@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+//// Structure
+
+// Response conventions of one API version, mounted under /{name}
+type apiVersion struct {
+	name string
+	field_naming string // Key style of the response bodies, snake_case or camelCase
+}
+
+//// Functionality
+
+const (
+	fieldNamingSnake = "snake_case" // As declared by the json tags
+	fieldNamingCamel = "camelCase"
+)
+
+const apiVersionContextKey contextKey = "api_version"
+
+// Versions RegisterRoutes can mount, a new one with other response shapes is added here first
+var apiVersions = map[string]apiVersion{
+	"v1": {name: "v1", field_naming: fieldNamingSnake},
+}
+
+// Version served on the unprefixed paths, kept for the clients deployed before versioning
+const legacyAPIVersion = "v1"
+
+// Version the request was routed to, the legacy version outside of any versioned route
+func apiVersionFromContext(ctx context.Context) apiVersion {
+	if version, ok := ctx.Value(apiVersionContextKey).(apiVersion); ok {
+		return version
+	}
+	return apiVersions[legacyAPIVersion]
+}
+
+func versionMiddleware(version apiVersion) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionContextKey, version)))
+		})
+	}
+}
+
+// Path prefix the request came in under, empty on the unprefixed legacy paths
+func versionPrefix(r *http.Request) string {
+	prefix := "/" + apiVersionFromContext(r.Context()).name
+	if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		return ""
+	}
+	return prefix
+}
+
+// Status websocket of the device under the same version as the request
+func statusURL(r *http.Request, device_id string) string {
+	return fmt.Sprintf("ws://%s%s/status/%s", r.Host, versionPrefix(r), device_id)
+}
+
+// Renames the keys of the response body to the field naming of the request's version. The json
+// tags are snake_case, so v1 bodies are returned as they are
+func shapeResponse(r *http.Request, v any) (any, error) {
+	naming := apiVersionFromContext(r.Context()).field_naming
+	if naming == fieldNamingSnake {
+		return v, nil
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber() // Keeps integers and floats exactly as they were encoded
+	var shaped any
+	if err := decoder.Decode(&shaped); err != nil {
+		return nil, err
+	}
+	return renameKeys(shaped, camelCase), nil
+}
+
+func renameKeys(value any, rename func(string) string) any {
+	switch value := value.(type) {
+	case map[string]any:
+		renamed := make(map[string]any, len(value))
+		for key, field := range value {
+			renamed[rename(key)] = renameKeys(field, rename)
+		}
+		return renamed
+	case []any:
+		for i, item := range value {
+			value[i] = renameKeys(item, rename)
+		}
+		return value
+	}
+	return value
+}
+
+// e.g. websocket_url becomes websocketUrl
+func camelCase(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if runes := []rune(parts[i]); len(runes) > 0 {
+			runes[0] = unicode.ToUpper(runes[0])
+			parts[i] = string(runes)
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// Mounts every versioned route on r for the given version, the caller picks the prefix r serves.
+// Probes and build info (/health, /ready, /version, /metrics) are unversioned and not part of it
+func (api *APIServer) RegisterRoutes(r *mux.Router, version string) {
+	api_version, ok := apiVersions[version]
+	if !ok {
+		panic("unknown api version " + version)
+	}
+	versioned := r.NewRoute().Subrouter()
+	versioned.Use(versionMiddleware(api_version))
+
+	versioned.HandleFunc("/status/{deviceID}", api.handleWebSocket).Methods("GET")
+	versioned.HandleFunc("/status/{deviceID}/sse", api.handleStatusEvents).Methods("GET")
+	versioned.HandleFunc("/status/{deviceID}/snapshot", api.handleStatusSnapshot).Methods("GET")
+
+	// Routes that require an api key
+	protected := versioned.NewRoute().Subrouter()
+	protected.Use(api.authMiddleware)
+	protected.HandleFunc("/ping", api.handlePing).Methods("GET")
+	protected.HandleFunc("/control", api.handleControlRequest).Methods("POST")
+	protected.HandleFunc("/reprovision/{deviceID}", api.handleReprovisionRequest).Methods("POST")
+	protected.HandleFunc("/pause/{deviceID}", api.handlePauseRequest).Methods("POST")
+	protected.HandleFunc("/resume/{deviceID}", api.handleResumeRequest).Methods("POST")
+	protected.HandleFunc("/compute/{deviceID}/pause", api.handlePauseRequest).Methods("POST")
+	protected.HandleFunc("/compute/{deviceID}/resume", api.handleResumeRequest).Methods("POST")
+	protected.HandleFunc("/respond", api.respondHandler).Methods("POST")
+	protected.HandleFunc("/respond/batch", api.handleBatchRespond).Methods("POST")
+	protected.HandleFunc("/stream/{deviceID}", api.handleStream).Methods("GET")
+	protected.HandleFunc("/usage", api.handleUsage).Methods("GET")
+	protected.HandleFunc("/instances", api.handleInstances).Methods("GET")
+	protected.HandleFunc("/devices", api.handleDevices).Methods("GET")
+	protected.HandleFunc("/devices/{deviceID}/label", api.handleDeviceLabel).Methods("POST")
+
+	// Routes that require an admin tenant
+	admin := protected.NewRoute().Subrouter()
+	admin.Use(api.adminMiddleware)
+	admin.HandleFunc("/costs", api.handleCosts).Methods("GET")
+	admin.HandleFunc("/stats", api.handleStats).Methods("GET")
+	admin.HandleFunc("/admin/shutdown", api.handleShutdown).Methods("POST")
+	admin.HandleFunc("/admin/reload", api.handleReload).Methods("POST")
+	admin.HandleFunc("/compute/stop-all", api.handleStopAll).Methods("POST")
+	admin.HandleFunc("/admin/maintenance", api.handleMaintenance).Methods("GET", "PUT")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestVersionedRoutes(t *testing.T) {
+	api, server := newTestServer(t, nil)
+	tests := []struct {
+		name string
+		prefix string
+		device_id string
+	}{
+		{"v1", "/v1", "pi-v1"},
+		{"unprefixed", "", "pi-legacy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := doRequest(t, server, "POST", test.prefix+"/control", testAPIKey, map[string]any{"device_id": test.device_id, "run": true})
+			var response StatusResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			// The websocket stays under the version the start came in on
+			if want := test.prefix + "/status/" + test.device_id; !strings.HasSuffix(response.WebSocketURL, want) {
+				t.Fatalf("websocket url %s, want it ending in %s", response.WebSocketURL, want)
+			}
+			waitFor(t, "the device to be ready", func() bool { return deviceStatus(api, test.device_id) == "ready" })
+
+			status, body = doRequest(t, server, "GET", test.prefix+"/status/"+test.device_id+"/snapshot", testAPIKey, nil)
+			if status != http.StatusOK || !strings.Contains(string(body), `"status":"ready"`) {
+				t.Fatalf("snapshot: %d %s", status, body)
+			}
+		})
+	}
+}
+
+// Probes and build info answer only on their unversioned paths
+func TestUnversionedRoutes(t *testing.T) {
+	_, server := newTestServer(t, nil)
+	tests := []struct {
+		path string
+		status int
+	}{
+		{"/health", http.StatusOK},
+		{"/version", http.StatusOK},
+		{"/ready", http.StatusOK},
+		{"/metrics", http.StatusOK},
+		{"/v1/health", http.StatusNotFound},
+		{"/v1/version", http.StatusNotFound},
+		{"/v1/metrics", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if status, body := doRequest(t, server, "GET", test.path, "", nil); status != test.status {
+				t.Fatalf("got %d %s, want %d", status, body, test.status)
+			}
+		})
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	tests := []struct {
+		key string
+		want string
+	}{
+		{"status", "status"},
+		{"websocket_url", "websocketUrl"},
+		{"cost_per_hour", "costPerHour"},
+		{"served_at_", "servedAt"},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := camelCase(test.key); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// A version declared with camelCase naming gets its response keys renamed, v1 keeps the json tags
+func TestVersionFieldNaming(t *testing.T) {
+	apiVersions["v2"] = apiVersion{name: "v2", field_naming: fieldNamingCamel}
+	t.Cleanup(func() { delete(apiVersions, "v2") })
+	api, _ := newTestServer(t, nil)
+	router := mux.NewRouter()
+	for _, version := range []string{"v1", "v2"} {
+		api.RegisterRoutes(router.PathPrefix("/"+version).Subrouter(), version)
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tests := []struct {
+		version string
+		key string
+	}{
+		{"v1", "websocket_url"},
+		{"v2", "websocketUrl"},
+	}
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			status, body := doRequest(t, server, "POST", "/"+test.version+"/control", testAPIKey, map[string]any{"device_id": "pi-" + test.version, "run": true})
+			var response map[string]any
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			url, ok := response[test.key].(string)
+			if !ok || !strings.HasSuffix(url, "/"+test.version+"/status/pi-"+test.version) {
+				t.Fatalf("response %s, want %s under /%s", body, test.key, test.version)
+			}
+		})
+	}
+}
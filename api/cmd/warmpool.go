@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// Structure
+
+// Instance rented ahead of demand, booting until ready
+type pooledInstance struct {
+	info InstanceInfo // Known once the provider accepted the instance, Endpoint once it is ready
+	spec InstanceSpec
+	created_at time.Time
+	ready bool
+}
+
+// Instances of WARM_POOL waiting for a device, they belong to no device until claimed
+type warmPool struct {
+	instances map[string][]*pooledInstance // By GPU type, booting and ready alike
+	sizes map[string]int // Sizes shrunk while demand is low, GPU types missing keep their WARM_POOL size
+	scale_down_at time.Time // Last claim or scale down step
+	refill chan struct{} // Wakes watchWarmPool after a claim, holds at most one pending wake up
+	mu sync.Mutex
+}
+
+//// Functionality
+
+// Parses WARM_POOL, a comma separated list of gpu_type:size
+func parseWarmPool(value string) (map[string]int, error) {
+	pool := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		gpu_type, size, ok := strings.Cut(entry, ":")
+		if !ok || !validGPUType.MatchString(gpu_type) {
+			return nil, fmt.Errorf("invalid WARM_POOL entry %q: expected gpu_type:size", entry)
+		}
+		if _, duplicate := pool[gpu_type]; duplicate {
+			return nil, fmt.Errorf("duplicate WARM_POOL gpu type %s", gpu_type)
+		}
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 1 {
+			return nil, fmt.Errorf("invalid WARM_POOL size of %s: must be at least 1", gpu_type)
+		}
+		pool[gpu_type] = parsed
+	}
+	return pool, nil
+}
+
+// Spec pooled instances of the GPU type are rented with, what a control request without
+// gpu_type and region overrides would get
+func (api *APIServer) warmPoolSpec(gpu_type string) InstanceSpec {
+	spec := DefaultInstanceSpec()
+	spec.GPUType = gpu_type
+	spec.Region = api.Config().DefaultRegion
+	spec.Label = api.instanceName("pool", "")
+	return spec
+}
+
+// Instances the pool keeps of the GPU type, caller must hold mu
+func (pool *warmPool) size(config *Config, gpu_type string) int {
+	if size, ok := pool.sizes[gpu_type]; ok {
+		return min(size, config.WarmPool[gpu_type])
+	}
+	return config.WarmPool[gpu_type]
+}
+
+// With WARM_POOL_SCALE_DOWN_INTERVAL set the pool shrinks one instance per step while nothing is
+// claimed, largest GPU type first and never below one instance per type, so some warmth is left
+// for the next burst. Caller must hold mu
+func (pool *warmPool) scaleDown(config *Config, now time.Time) {
+	interval := config.WarmPoolScaleDownInterval
+	if interval <= 0 {
+		pool.sizes = nil
+		return
+	}
+	if pool.scale_down_at.IsZero() {
+		pool.scale_down_at = now
+	}
+	if now.Before(pool.scale_down_at.Add(interval)) {
+		return
+	}
+
+	shrunk := ""
+	for gpu_type := range config.WarmPool {
+		size := pool.size(config, gpu_type)
+		if size > 1 && (shrunk == "" || size > pool.size(config, shrunk) || (size == pool.size(config, shrunk) && gpu_type < shrunk)) {
+			shrunk = gpu_type
+		}
+	}
+	if shrunk == "" {
+		return
+	}
+	if pool.sizes == nil {
+		pool.sizes = make(map[string]int)
+	}
+	pool.sizes[shrunk] = pool.size(config, shrunk) - 1
+	pool.scale_down_at = now
+	log.Println("scaling warm pool down", shrunk, pool.sizes[shrunk])
+}
+
+// Demand is back, the pool returns to its WARM_POOL sizes and a later shrink waits a full interval
+// from now. Caller must hold mu
+func (pool *warmPool) resetScaleDown(now time.Time) {
+	pool.sizes = nil
+	pool.scale_down_at = now
+}
+
+// Periodically tops the pool up to its WARM_POOL sizes and retires instances older than
+// WARM_POOL_MAX_LIFETIME, the sizes are read on every check so a reload applies right away.
+// A claim checks right away instead of waiting for the next tick
+func (api *APIServer) watchWarmPool(ctx context.Context) {
+	api.maintainWarmPool(ctx)
+
+	ticker := time.NewTicker(api.Config().WarmPoolCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			api.maintainWarmPool(ctx)
+		case <-api.warm_pool.refill:
+			api.maintainWarmPool(ctx)
+		}
+	}
+}
+
+func (api *APIServer) maintainWarmPool(ctx context.Context) {
+	config := api.Config()
+	now := api.Clock.Now()
+
+	var retired []*pooledInstance
+	api.warm_pool.mu.Lock()
+	if api.warm_pool.instances == nil {
+		api.warm_pool.instances = make(map[string][]*pooledInstance)
+	}
+	api.warm_pool.scaleDown(config, now)
+	for gpu_type, instances := range api.warm_pool.instances {
+		kept := instances[:0]
+		size := api.warm_pool.size(config, gpu_type)
+		for _, instance := range instances {
+			expired := instance.ready && config.WarmPoolMaxLifetime > 0 && now.Sub(instance.created_at) >= config.WarmPoolMaxLifetime
+			if expired || (instance.ready && len(kept) >= size) {
+				retired = append(retired, instance)
+				continue
+			}
+			kept = append(kept, instance)
+		}
+		api.warm_pool.instances[gpu_type] = kept
+	}
+
+	// Maintenance holds back new provisioning, the pool included
+	if !api.maintenance.Load() && ctx.Err() == nil {
+		for gpu_type := range config.WarmPool {
+			for missing := api.warm_pool.size(config, gpu_type) - len(api.warm_pool.instances[gpu_type]); missing > 0; missing-- {
+				instance := &pooledInstance{spec: api.warmPoolSpec(gpu_type), created_at: now}
+				api.warm_pool.instances[gpu_type] = append(api.warm_pool.instances[gpu_type], instance)
+				api.provisioning.Add(1)
+				go api.fillWarmPool(ctx, instance)
+			}
+		}
+	}
+	api.warm_pool.mu.Unlock()
+
+	for _, instance := range retired {
+		log.Println("retiring pooled instance", instance.spec.GPUType, instance.info.ID, now.Sub(instance.created_at))
+		api.destroyPooledInstance(context.Background(), instance)
+	}
+}
+
+// Rents the pooled instance and waits until its inference server answers. The instance is dropped
+// from the pool on failure, the next check rents a replacement
+func (api *APIServer) fillWarmPool(ctx context.Context, instance *pooledInstance) {
+	defer api.provisioning.Done()
+
+	ctx, cancel := context.WithTimeout(ctx, api.Config().ProvisionTimeout)
+	defer cancel()
+
+	info, err := api.Provider.CreateInstance(ctx, instance.spec)
+	if err != nil {
+		log.Println("pooled instance creation error", instance.spec.GPUType, err)
+		api.removePooledInstance(instance)
+		return
+	}
+	api.warm_pool.mu.Lock()
+	instance.info = *info
+	instance.created_at = api.Clock.Now()
+	api.warm_pool.mu.Unlock()
+
+	endpoint, err := api.waitForPooledInstance(ctx, instance)
+	if err != nil {
+		log.Println("pooled instance boot error", instance.spec.GPUType, info.ID, err)
+		api.removePooledInstance(instance)
+		api.destroyPooledInstance(context.Background(), instance)
+		return
+	}
+
+	api.warm_pool.mu.Lock()
+	pooled := slices.Contains(api.warm_pool.instances[instance.spec.GPUType], instance)
+	if pooled {
+		instance.info.Endpoint = endpoint
+		instance.ready = true
+	}
+	api.warm_pool.mu.Unlock()
+	if !pooled {
+		// Removed while booting, e.g. by the shutdown teardown
+		api.destroyPooledInstance(context.Background(), instance)
+		return
+	}
+	log.Println("pooled instance ready", instance.spec.GPUType, info.ID)
+}
+
+// Polls like waitForInstance, without a device to report the progress to
+func (api *APIServer) waitForPooledInstance(ctx context.Context, instance *pooledInstance) (string, error) {
+	ctx = withBackendToken(ctx, instance.info.BackendToken)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		info, err := api.Provider.InstanceStatus(ctx, instance.info.ID)
+		if err == nil {
+			if err := verifyInstanceSpec(instance.spec, info); err != nil {
+				return "", err
+			}
+			if info.Status == "running" && info.Endpoint != "" && api.Backend.Ready(ctx, info.Endpoint) == nil {
+				return info.Endpoint, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drops the instance from the pool, returns false if it was no longer there
+func (api *APIServer) removePooledInstance(instance *pooledInstance) bool {
+	api.warm_pool.mu.Lock()
+	defer api.warm_pool.mu.Unlock()
+
+	instances := api.warm_pool.instances[instance.spec.GPUType]
+	index := slices.Index(instances, instance)
+	if index == -1 {
+		return false
+	}
+	api.warm_pool.instances[instance.spec.GPUType] = slices.Delete(instances, index, index+1)
+	return true
+}
+
+// Destroys an instance that left the pool unclaimed, its cost goes into the history like any other
+func (api *APIServer) destroyPooledInstance(ctx context.Context, instance *pooledInstance) {
+	api.warm_pool.mu.Lock()
+	info, created_at := instance.info, instance.created_at
+	api.warm_pool.mu.Unlock()
+	if info.ID == "" {
+		return
+	}
+
+	if err := api.Provider.DestroyInstance(ctx, info.ID); err != nil && !errors.Is(err, ErrInstanceNotFound) {
+		log.Println("pooled instance destroy error", info.ID, err)
+		return
+	}
+	api.recordHistoricalCost(instance.spec.GPUType, info.CostPerHour*max(api.Clock.Now().Sub(created_at), 0).Hours())
+}
+
+// Hands a ready pooled instance matching the spec to the device, which must already be claimed
+// for starting. Returns false if the pool has none, the device then provisions as usual. The
+// oldest instance goes first, it is closest to being retired
+func (api *APIServer) claimPooledInstance(device_id string, spec InstanceSpec) bool {
+	if spec.Interruptible {
+		return false
+	}
+
+	api.warm_pool.mu.Lock()
+	if _, pooled := api.Config().WarmPool[spec.GPUType]; pooled {
+		api.warm_pool.resetScaleDown(api.Clock.Now())
+	}
+	var claimed *pooledInstance
+	for _, instance := range api.warm_pool.instances[spec.GPUType] {
+		if instance.ready && instance.spec.Region == spec.Region && instance.spec.Image == spec.Image &&
+			(claimed == nil || instance.created_at.Before(claimed.created_at)) {
+			claimed = instance
+		}
+	}
+	if claimed != nil {
+		instances := api.warm_pool.instances[spec.GPUType]
+		index := slices.Index(instances, claimed)
+		api.warm_pool.instances[spec.GPUType] = slices.Delete(instances, index, index+1)
+	}
+	api.warm_pool.mu.Unlock()
+	if claimed == nil {
+		return false
+	}
+
+	now := api.Clock.Now()
+	info := claimed.info
+	compute_state := api.getComputeState(device_id)
+	api.Events.Publish(InstanceStarting{DeviceID: device_id, Spec: spec})
+	compute_state.Mu.Lock()
+	compute_state.ID = info.ID
+	compute_state.Name = claimed.spec.Label
+	compute_state.Spec.Label = claimed.spec.Label
+	compute_state.Endpoint = info.Endpoint
+	compute_state.CostPerHour = info.CostPerHour
+	compute_state.Metadata = redactMetadata(info.Metadata)
+	compute_state.Account = info.Account
+	compute_state.BackendToken = info.BackendToken
+	compute_state.StartedAt = now
+	compute_state.CancelProvision = nil
+	compute_state.Mu.Unlock()
+
+	api.ComputesMu.Lock()
+	api.InstanceRefs[info.ID] = 1
+	api.ComputesMu.Unlock()
+
+	// What the instance cost while waiting in the pool is settled now, the device accrues the rest
+	api.recordHistoricalCost(claimed.spec.GPUType, info.CostPerHour*max(now.Sub(claimed.created_at), 0).Hours())
+	log.Println("device claimed pooled instance", device_id, info.ID)
+
+	api.instanceReady(device_id, true)
+	// Replenish right away instead of waiting for the next check, a wake up already pending covers this claim too
+	select {
+	case api.warm_pool.refill <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Reports whether the provider instance waits in the pool, so the orphan scan leaves it alone
+func (api *APIServer) inWarmPool(instance InstanceInfo) bool {
+	api.warm_pool.mu.Lock()
+	defer api.warm_pool.mu.Unlock()
+
+	for _, instances := range api.warm_pool.instances {
+		for _, pooled := range instances {
+			if pooled.info.ID == instance.ID || (pooled.info.ID == "" && pooled.spec.Label == instance.Label) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Empties the pool and destroys its instances, used on shutdown. Instances still booting are
+// destroyed by their filler once it sees they left the pool
+func (api *APIServer) drainWarmPool() {
+	api.warm_pool.mu.Lock()
+	var drained []*pooledInstance
+	for gpu_type, instances := range api.warm_pool.instances {
+		for _, instance := range instances {
+			if instance.ready {
+				drained = append(drained, instance)
+			}
+		}
+		delete(api.warm_pool.instances, gpu_type)
+	}
+	api.warm_pool.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, instance := range drained {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			api.destroyPooledInstance(context.Background(), instance)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Ready pooled instances of the GPU type
+func pooledInstances(api *APIServer, gpu_type string) int {
+	api.warm_pool.mu.Lock()
+	defer api.warm_pool.mu.Unlock()
+	ready := 0
+	for _, instance := range api.warm_pool.instances[gpu_type] {
+		if instance.ready {
+			ready++
+		}
+	}
+	return ready
+}
+
+func TestWarmPoolScaleDown(t *testing.T) {
+	const gpu_type = "RTX_4090"
+	api, server := newTestServer(t, map[string]string{
+		"WARM_POOL": gpu_type + ":3",
+		"WARM_POOL_MAX_LIFETIME": "0s",
+		"WARM_POOL_SCALE_DOWN_INTERVAL": "10m",
+		"WARM_POOL_CHECK_INTERVAL": "1h",
+		"DEFAULT_GPU_TYPE": gpu_type,
+	})
+	waitFor(t, "the pool to fill", func() bool { return pooledInstances(api, gpu_type) == 3 })
+	// The fill read the clock before it marked the instances ready, nothing reads it concurrently now
+	clock := newFakeClock()
+	api.Clock = clock
+
+	steps := []struct {
+		advance time.Duration
+		size int
+	}{
+		{9 * time.Minute, 3},
+		{time.Minute, 2},
+		{5 * time.Minute, 2}, // Steps are an interval apart
+		{5 * time.Minute, 1},
+		{2 * time.Hour, 1}, // One instance stays warm
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		api.maintainWarmPool(context.Background())
+		if size := pooledInstances(api, gpu_type); size != step.size {
+			t.Fatalf("step %d: pool of %d, want %d", i, size, step.size)
+		}
+	}
+	if ids := instanceIDs(t, api); len(ids) != 1 {
+		t.Fatalf("shrunk instances left running: %v", ids)
+	}
+
+	// A claim brings the pool back to full size, the next shrink waits an interval from the claim
+	startDevice(t, api, server, testAPIKey, "pi")
+	waitFor(t, "the pool to refill", func() bool { return pooledInstances(api, gpu_type) == 3 })
+	clock.Advance(10 * time.Minute)
+	api.maintainWarmPool(context.Background())
+	if size := pooledInstances(api, gpu_type); size != 2 {
+		t.Fatalf("pool of %d after the first step since the claim, want 2", size)
+	}
+	if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": false}); status != http.StatusAccepted {
+		t.Fatalf("stop: %d %s", status, body)
+	}
+}
+
+func TestWarmPoolKeptFullWithoutScaleDown(t *testing.T) {
+	const gpu_type = "RTX_4090"
+	api, _ := newTestServer(t, map[string]string{"WARM_POOL": gpu_type + ":2", "WARM_POOL_MAX_LIFETIME": "0s", "WARM_POOL_CHECK_INTERVAL": "1h"})
+	waitFor(t, "the pool to fill", func() bool { return pooledInstances(api, gpu_type) == 2 })
+	clock := newFakeClock()
+	api.Clock = clock
+
+	clock.Advance(24 * time.Hour)
+	api.maintainWarmPool(context.Background())
+	if size := pooledInstances(api, gpu_type); size != 2 {
+		t.Fatalf("pool of %d, want it kept full", size)
+	}
+}
+
+// A start matching the pool takes a ready instance at once, the pool refills behind it
+func TestWarmPoolClaim(t *testing.T) {
+	const gpu_type = "RTX_4090"
+	tests := []struct {
+		name string
+		request map[string]any
+		claimed bool
+	}{
+		{"matching start", map[string]any{}, true},
+		{"explicit gpu type", map[string]any{"gpu_type": gpu_type}, true},
+		{"other gpu type", map[string]any{"gpu_type": "A100"}, false},
+		{"interruptible", map[string]any{"interruptible": true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{
+				"WARM_POOL": gpu_type + ":2",
+				"WARM_POOL_CHECK_INTERVAL": "1h", // Only a claim refills before the test ends
+				"DEFAULT_GPU_TYPE": gpu_type,
+			})
+			waitFor(t, "the pool to fill", func() bool { return pooledInstances(api, gpu_type) == 2 })
+			pooled := instanceIDs(t, api)
+
+			request := map[string]any{"device_id": "pi", "run": true}
+			for key, value := range test.request {
+				request[key] = value
+			}
+			status, body := doRequest(t, server, "POST", "/control", testAPIKey, request)
+			var response StatusResponse
+			if err := json.Unmarshal(body, &response); status != http.StatusOK || err != nil {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			if claimed := response.Status == "ready"; claimed != test.claimed {
+				t.Fatalf("answered %s, want claimed %v", response.Status, test.claimed)
+			}
+			if slices.Contains(pooled, instanceID(api, "pi")) != test.claimed {
+				t.Fatalf("device runs %s, pooled were %v, want claimed %v", instanceID(api, "pi"), pooled, test.claimed)
+			}
+			if !test.claimed {
+				waitFor(t, "the usual provisioning", func() bool { return deviceStatus(api, "pi") == "ready" })
+				if size := pooledInstances(api, gpu_type); size != 2 {
+					t.Fatalf("pool of %d, want it untouched", size)
+				}
+				return
+			}
+
+			waitFor(t, "the pool to refill", func() bool { return pooledInstances(api, gpu_type) == 2 })
+			if ids := instanceIDs(t, api); len(ids) != 3 {
+				t.Fatalf("instances %v, want the claimed one and two pooled", ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+//// Functionality
+
+// Sends BACKEND_WARMUP_PROMPT through the fresh instance before it takes inference, so the first
+// client prompt doesn't pay for loading the model into memory. A device without a warmup prompt
+// or started with the skip_warmup feature accepts inference as soon as it is ready
+func (api *APIServer) warmupInstance(device_id string) {
+	config := api.Config()
+	compute_state := api.getComputeState(device_id)
+
+	compute_state.Mu.Lock()
+	instance_id, endpoint, backend_token := compute_state.ID, compute_state.Endpoint, compute_state.BackendToken
+	skip_warmup := compute_state.SkipWarmup
+	compute_state.Mu.Unlock()
+
+	if config.BackendWarmupPrompt != "" && !skip_warmup {
+		ctx, cancel := context.WithTimeout(withBackendToken(api.lifecycle_ctx, backend_token), config.BackendWarmupTimeout)
+		request := InferenceRequest{DeviceID: device_id, Prompt: config.BackendWarmupPrompt}
+		request.InferenceParameters = request.InferenceParameters.withDefaults(config)
+		_, err := api.Backend.Complete(ctx, endpoint, request)
+		cancel()
+		if err != nil {
+			// The health check passed, a failed warmup only means the first prompt is slow
+			log.Println("warning: instance warmup error", device_id, err)
+		}
+	}
+
+	compute_state.Mu.Lock()
+	// The instance may have been stopped or swapped while warming up
+	if compute_state.ID != instance_id || compute_state.Status != "ready" {
+		compute_state.Mu.Unlock()
+		return
+	}
+	compute_state.AcceptingInference = true
+	frame := compute_state.statusResponse()
+	compute_state.Mu.Unlock()
+
+	api.Events.Publish(StatusChanged{DeviceID: device_id, Frame: frame})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+const testWarmupPrompt = "warm up"
+
+// Wraps the mock backend holding the warmup prompt until release is closed
+type warmupBackend struct {
+	InferenceBackend
+	release chan struct{}
+}
+
+func (b *warmupBackend) Complete(ctx context.Context, endpoint string, request InferenceRequest) (string, error) {
+	if request.Prompt == testWarmupPrompt {
+		select {
+		case <-b.release:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	return b.InferenceBackend.Complete(ctx, endpoint, request)
+}
+
+func TestInferenceWaitsForWarmup(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		warming bool
+	}{
+		{"warming up", map[string]string{"BACKEND_WARMUP_PROMPT": testWarmupPrompt}, true},
+		{"without a warmup prompt", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, test.env)
+			backend := &warmupBackend{InferenceBackend: api.Backend, release: make(chan struct{})}
+			api.Backend = backend
+			if status, body := doRequest(t, server, "POST", "/control", testAPIKey, map[string]any{"device_id": "pi", "run": true}); status != http.StatusOK {
+				t.Fatalf("start: %d %s", status, body)
+			}
+			waitFor(t, "the instance to be ready", func() bool { return deviceStatus(api, "pi") == "ready" })
+
+			prompt := map[string]any{"device_id": "pi", "prompt": "hello"}
+			if test.warming {
+				status, body := doRequest(t, server, "POST", "/respond", testAPIKey, prompt)
+				var response ErrorResponse
+				if err := json.Unmarshal(body, &response); status != http.StatusServiceUnavailable || err != nil || response.Error != "compute_warming_up" {
+					t.Fatalf("during warmup got %d %s, want 503 compute_warming_up", status, body)
+				}
+				close(backend.release)
+			}
+			waitFor(t, "the warmup", func() bool {
+				compute_state := api.getComputeState("pi")
+				compute_state.Mu.Lock()
+				defer compute_state.Mu.Unlock()
+				return compute_state.AcceptingInference
+			})
+			if status, body := doRequest(t, server, "POST", "/respond", testAPIKey, prompt); status != http.StatusOK {
+				t.Fatalf("after warmup got %d %s", status, body)
+			}
+		})
+	}
+}
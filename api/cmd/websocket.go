@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//// Structure
+
+// Websocket connection that closes once, the read loop, a failed broadcast, the duplicate policy
+// and shutdown may all race to close it
+type wsConn struct {
+	*websocket.Conn
+	send chan []byte // Status frames waiting for the writer, nil until startWriter
+	done chan struct{} // Closed with the connection, stops the writer
+	close_once sync.Once
+	closed atomic.Bool
+	route string // Route template the connection was upgraded on, labels its metrics
+	opened_at time.Time
+	sent atomic.Int64 // Messages written, observed when the connection closes
+}
+
+//// Functionality
+
+func newWSConn(conn *websocket.Conn, route string) *wsConn {
+	websocketConnectionsOpened.WithLabelValues(route).Inc()
+	websocketConnectionsActive.WithLabelValues(route).Inc()
+	return &wsConn{Conn: conn, done: make(chan struct{}), route: route, opened_at: time.Now()}
+}
+
+func (conn *wsConn) Close() error {
+	var err error
+	conn.close_once.Do(func() {
+		conn.closed.Store(true)
+		close(conn.done)
+		err = conn.Conn.Close()
+
+		websocketConnectionsActive.WithLabelValues(conn.route).Dec()
+		websocketConnectionsClosed.WithLabelValues(conn.route).Inc()
+		websocketConnectionDuration.WithLabelValues(conn.route).Observe(time.Since(conn.opened_at).Seconds())
+		websocketMessagesSent.WithLabelValues(conn.route).Observe(float64(conn.sent.Load()))
+	})
+	return err
+}
+
+// Counts the message for the connection metrics, every frame goes through here
+func (conn *wsConn) WriteMessage(message_type int, data []byte) error {
+	if err := conn.Conn.WriteMessage(message_type, data); err != nil {
+		return err
+	}
+	conn.sent.Add(1)
+	return nil
+}
+
+// Gives the status connection a WS_SEND_BUFFER deep queue drained by its own goroutine, so one
+// slow client never holds up the broadcast to the others
+func (api *APIServer) startWriter(device_id string, conn *wsConn) {
+	conn.send = make(chan []byte, api.Config().WSSendBuffer)
+	go func() {
+		for {
+			select {
+			case <-conn.done:
+				return
+			case data := <-conn.send:
+				if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					// A failed write leaves the connection broken, there is nothing to retry on
+					api.SubscribersMu.Lock()
+					api.dropOnWriteError(device_id, conn, err)
+					api.SubscribersMu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Queues a status frame for the writer, a client whose queue is full has fallen too far behind
+// and is dropped. Caller must hold SubscribersMu
+func (api *APIServer) queueStatus(device_id string, conn *wsConn, frame StatusResponse) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		log.Println("status frame encoding error", device_id, err)
+		return
+	}
+	select {
+	case conn.send <- data:
+	default:
+		if api.unsubscribe(device_id, conn) {
+			log.Println("dropping slow websocket client", device_id)
+			websocketSlowClientDrops.Inc()
+		}
+		// A close frame would only queue up behind the stalled write
+		conn.Close()
+	}
+}
+
+// Negotiated during the upgrade so the status frame format can be versioned
+const statusSubprotocol = "gorasp.status.v1"
+const statusFrameVersion = "v1"
+
+// Browsers are held to ACCEPTED_ORIGIN, read per upgrade so a reload applies to new connections
+func (api *APIServer) checkOrigin(r *http.Request) bool {
+	config := api.Config()
+	origin := r.Header.Get("Origin")
+	// Browsers always send an Origin, so only non-browser clients (CLIs, servers) arrive without one.
+	// Allowing them means any client that can reach the server may connect, since the header is
+	// trivially omitted, so only enable it where the network is trusted. Browsers stay bound to ACCEPTED_ORIGIN
+	if origin == "" && config.AllowEmptyOrigin {
+		return true
+	}
+	if origin == "" {
+		log.Println("websocket origin rejected: missing origin", r.URL.Path, r.RemoteAddr)
+		websocketOriginRejections.WithLabelValues("missing").Inc()
+		return false
+	}
+	if origin != config.security.accepted_origin {
+		log.Printf("websocket origin rejected: %q does not match ACCEPTED_ORIGIN %q %s", origin, config.security.accepted_origin, r.URL.Path)
+		websocketOriginRejections.WithLabelValues("mismatch").Inc()
+		return false
+	}
+	return true
+}
+
+// Reserves one of the MAX_WS_CONNECTIONS slots before upgrading, returns false if all are taken
+func (api *APIServer) acquireWebSocket() bool {
+	if api.ws_connections.Add(1) > int64(api.Config().MaxWSConnections) {
+		api.ws_connections.Add(-1)
+		log.Println("rejecting websocket upgrade, connection limit reached", api.Config().MaxWSConnections)
+		return false
+	}
+	return true
+}
+
+func (api *APIServer) releaseWebSocket() {
+	api.ws_connections.Add(-1)
+}
+
+// Upgrades the request, with WS_COMPRESSION permessage-deflate is negotiated with clients that offer
+// it and everyone else gets uncompressed frames
+func (api *APIServer) upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	upgraded, err := api.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := newWSConn(upgraded, routeLabel(r))
+	if api.Upgrader.EnableCompression {
+		// Only takes effect when the client negotiated the extension
+		conn.EnableWriteCompression(true)
+		if err := conn.SetCompressionLevel(api.Config().WSCompressionLevel); err != nil {
+			log.Println("websocket compression level error", err)
+		}
+	}
+	return conn, nil
+}
+
+// Registers the connection for the device applying the duplicate connection policy,
+// returns false if the connection was rejected
+func (api *APIServer) addSubscriber(device_id string, conn *wsConn, tenant *Tenant) bool {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	if len(api.Subscribers[device_id]) > 0 {
+		switch api.Config().WSDuplicatePolicy {
+		case "reject":
+			log.Println("rejecting duplicate websocket connection", device_id)
+			closeWithCode(conn, websocket.ClosePolicyViolation, "device already connected")
+			return false
+		case "replace":
+			// The read loop of the old connection errors out and unregisters it
+			for existing := range api.Subscribers[device_id] {
+				log.Println("replacing existing websocket connection", device_id)
+				api.unsubscribe(device_id, existing)
+				closeWithCode(existing, websocket.CloseNormalClosure, "replaced by a new connection")
+			}
+		}
+	}
+
+	if api.Subscribers[device_id] == nil {
+		api.Subscribers[device_id] = make(map[*wsConn]*Tenant)
+	}
+	api.Subscribers[device_id][conn] = tenant
+	api.startWriter(device_id, conn)
+	return true
+}
+
+// Marshals v before writing, unlike conn.WriteJSON which sends a truncated frame when encoding fails midway
+func writeJSONMessage(conn *wsConn, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Sends a close frame with the given code and closes the connection, nothing is sent if it is already closed
+func closeWithCode(conn *wsConn, code int, reason string) {
+	if conn.closed.Load() {
+		return
+	}
+	message := websocket.FormatCloseMessage(code, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		logWriteError("websocket close frame write error", err)
+	}
+	conn.Close()
+}
+
+// Removes the connection from the registry, returns false if it was already removed.
+// Caller must hold SubscribersMu
+func (api *APIServer) unsubscribe(device_id string, conn *wsConn) bool {
+	if _, ok := api.Subscribers[device_id][conn]; !ok {
+		return false
+	}
+	delete(api.Subscribers[device_id], conn)
+	if len(api.Subscribers[device_id]) == 0 {
+		delete(api.Subscribers, device_id)
+	}
+	return true
+}
+
+func (api *APIServer) removeSubscriber(device_id string, conn *wsConn) {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	api.unsubscribe(device_id, conn)
+	conn.Close()
+}
+
+// Unregisters a connection whose write failed, quietly if the client just went away.
+// Caller must hold SubscribersMu
+func (api *APIServer) dropOnWriteError(device_id string, conn *wsConn, err error) {
+	if api.unsubscribe(device_id, conn) {
+		logWriteError("websocket status write error "+device_id, err)
+	}
+	conn.Close()
+}
+
+// Sends a status frame to a single connection
+func (api *APIServer) sendStatus(device_id string, conn *wsConn, frame StatusResponse) {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	tenant, ok := api.Subscribers[device_id][conn]
+	if !ok {
+		return
+	}
+	frame.Version = statusFrameVersion
+	frame.ServedAt = api.servedAt()
+	api.queueStatus(device_id, conn, redactStatusFor(frame, tenant))
+}
+
+// Event bus handler pushing status changes to the subscribers of the device
+func (api *APIServer) fanOutStatus(event Event) {
+	if changed, ok := event.(StatusChanged); ok {
+		api.broadcastStatus(changed.DeviceID, changed.Frame)
+	}
+}
+
+// Sends a status frame to every websocket and event stream subscribed to the device
+func (api *APIServer) broadcastStatus(device_id string, frame StatusResponse) {
+	api.SubscribersMu.Lock()
+	defer api.SubscribersMu.Unlock()
+
+	frame.Version = statusFrameVersion
+	frame.ServedAt = api.servedAt()
+	for conn, tenant := range api.Subscribers[device_id] {
+		api.queueStatus(device_id, conn, redactStatusFor(frame, tenant))
+	}
+	api.publishStatusEvent(device_id, frame)
+}
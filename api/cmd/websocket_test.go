@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDuplicateWebSocketPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		closed string // Which connection the server closes
+		code int
+	}{
+		{"replace", "first", websocket.CloseNormalClosure},
+		{"reject", "second", websocket.ClosePolicyViolation},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"WS_DUPLICATE_POLICY": test.policy})
+			knownDevices(api, "pi")
+			first, _, err := dialWebSocket(t, server, "/status/pi", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			readStatusFrame(t, first)
+			second, _, err := dialWebSocket(t, server, "/status/pi", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			closed, open := first, second
+			if test.closed == "second" {
+				closed, open = second, first
+			} else {
+				readStatusFrame(t, second)
+			}
+			closed.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, _, err = closed.ReadMessage()
+			var close_err *websocket.CloseError
+			if !errors.As(err, &close_err) || close_err.Code != test.code {
+				t.Fatalf("%s connection got %v, want close code %d", test.closed, err, test.code)
+			}
+
+			// The connection that survived keeps getting the device's updates
+			api.setStatus("pi", "init")
+			if frame := readStatusFrame(t, open); frame.Status != "init" {
+				t.Fatalf("surviving connection got status %s", frame.Status)
+			}
+		})
+	}
+}
+
+func TestStatusSubprotocolNegotiation(t *testing.T) {
+	tests := []struct {
+		name string
+		requested []string
+		ok bool
+		protocol string
+	}{
+		{"none requested", nil, true, ""},
+		{"supported", []string{statusSubprotocol}, true, statusSubprotocol},
+		{"supported among others", []string{"gorasp.status.v9", statusSubprotocol}, true, statusSubprotocol},
+		{"unsupported version", []string{"gorasp.status.v9"}, false, ""},
+	}
+	api, server := newTestServer(t, nil)
+	knownDevices(api, "pi")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, response, err := dialWebSocket(t, server, "/status/pi", "", test.requested...)
+			if !test.ok {
+				if err == nil || response == nil || response.StatusCode != http.StatusBadRequest {
+					t.Fatalf("unsupported subprotocol upgraded: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.Subprotocol() != test.protocol {
+				t.Fatalf("agreed on %q, want %q", conn.Subprotocol(), test.protocol)
+			}
+			if frame := readStatusFrame(t, conn); frame.Version != statusFrameVersion {
+				t.Fatalf("frame version %q, want %q", frame.Version, statusFrameVersion)
+			}
+		})
+	}
+}
+
+func TestEmptyOrigin(t *testing.T) {
+	tests := []struct {
+		allow string
+		accepted bool
+	}{
+		{"false", false},
+		{"true", true},
+	}
+	for _, test := range tests {
+		t.Run("ALLOW_EMPTY_ORIGIN="+test.allow, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"ALLOW_EMPTY_ORIGIN": test.allow})
+			knownDevices(api, "pi")
+			_, response, err := dialWebSocketFrom(t, server, "/status/pi", testAPIKey, "")
+			if accepted := err == nil; accepted != test.accepted {
+				t.Fatalf("header-less upgrade accepted %v, want %v (%v)", accepted, test.accepted, err)
+			}
+			if !test.accepted && (response == nil || response.StatusCode != http.StatusForbidden) {
+				t.Fatalf("handshake response %v, want 403", response)
+			}
+
+			// Browsers stay bound to ACCEPTED_ORIGIN either way
+			if _, _, err := dialWebSocketFrom(t, server, "/status/pi", testAPIKey, "http://evil.test"); err == nil {
+				t.Fatal("upgrade from a foreign origin was accepted")
+			}
+		})
+	}
+}
+
+func TestWebSocketConnectionLimit(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"MAX_WS_CONNECTIONS": "2"})
+	knownDevices(api, "a", "b", "c")
+	first, _, err := dialWebSocket(t, server, "/status/a", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dialWebSocket(t, server, "/status/b", testAPIKey); err != nil {
+		t.Fatal(err)
+	}
+
+	_, response, err := dialWebSocket(t, server, "/status/c", testAPIKey)
+	if err == nil || response == nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade past the limit got %v %v, want 503", response, err)
+	}
+
+	// A disconnect frees its slot
+	first.Close()
+	waitFor(t, "the slot to be released", func() bool { return api.ws_connections.Load() == 1 })
+	if _, _, err := dialWebSocket(t, server, "/status/c", testAPIKey); err != nil {
+		t.Fatal("upgrade after a disconnect:", err)
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	tests := []struct {
+		name string
+		server bool
+		client bool
+		negotiated bool
+	}{
+		{"enabled", true, true, true},
+		{"client without compression", true, false, false},
+		{"disabled", false, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, map[string]string{"WS_COMPRESSION": strconv.FormatBool(test.server), "WS_COMPRESSION_LEVEL": "9"})
+			startDevice(t, api, server, testAPIKey, "pi")
+
+			header := http.Header{"Origin": {testOrigin}, "X-API-Key": {testAPIKey}}
+			dialer := websocket.Dialer{EnableCompression: test.client, HandshakeTimeout: 5 * time.Second}
+			conn, response, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/status/pi", header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			extensions := response.Header.Get("Sec-WebSocket-Extensions")
+			if negotiated := strings.Contains(extensions, "permessage-deflate"); negotiated != test.negotiated {
+				t.Fatalf("extensions %q, want negotiated %t", extensions, test.negotiated)
+			}
+			if frame := readStatusFrame(t, conn); frame.Status != "ready" || !frame.AcceptingInference {
+				t.Fatalf("frame %+v", frame)
+			}
+		})
+	}
+}
+
+// Run with -race: every close path firing at once closes the connection and unregisters it once
+func TestWebSocketConcurrentClose(t *testing.T) {
+	paths := map[string]func(api *APIServer, conn *wsConn){
+		"close": func(api *APIServer, conn *wsConn) { conn.Close() },
+		"remove": func(api *APIServer, conn *wsConn) { api.removeSubscriber("pi", conn) },
+		"write error": func(api *APIServer, conn *wsConn) {
+			api.SubscribersMu.Lock()
+			api.dropOnWriteError("pi", conn, errors.New("broken pipe"))
+			api.SubscribersMu.Unlock()
+		},
+		"broadcast": func(api *APIServer, conn *wsConn) { api.sendStatus("pi", conn, StatusResponse{Status: "ready"}) },
+	}
+	tests := []struct {
+		name string
+		paths []string
+	}{
+		{"double close", []string{"close", "close"}},
+		{"remove and write error", []string{"remove", "write error"}},
+		{"every path", []string{"close", "remove", "write error", "broadcast", "close", "remove"}},
+	}
+	route := "/status/{deviceID}"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			knownDevices(api, "pi")
+			client, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readStatusFrame(t, client)
+			var conn *wsConn
+			api.SubscribersMu.Lock()
+			for subscribed := range api.Subscribers["pi"] {
+				conn = subscribed
+			}
+			api.SubscribersMu.Unlock()
+			if conn == nil {
+				t.Fatal("connection not subscribed")
+			}
+			active := testutil.ToFloat64(websocketConnectionsActive.WithLabelValues(route))
+			closed := testutil.ToFloat64(websocketConnectionsClosed.WithLabelValues(route))
+
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for _, path := range test.paths {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					paths[path](api, conn)
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			waitFor(t, "the slot to be released", func() bool { return api.ws_connections.Load() == 0 })
+			api.SubscribersMu.Lock()
+			_, subscribed := api.Subscribers["pi"]
+			api.SubscribersMu.Unlock()
+			if subscribed {
+				t.Fatal("connection still subscribed")
+			}
+			if got := testutil.ToFloat64(websocketConnectionsActive.WithLabelValues(route)); got != active-1 {
+				t.Fatalf("active gauge went from %g to %g", active, got)
+			}
+			if got := testutil.ToFloat64(websocketConnectionsClosed.WithLabelValues(route)); got != closed+1 {
+				t.Fatalf("closed counter went from %g to %g", closed, got)
+			}
+		})
+	}
+}
+
+// A client that stops reading is dropped once its send buffer fills, other clients keep receiving
+func TestWebSocketSlowClient(t *testing.T) {
+	api, server := newTestServer(t, map[string]string{"WS_SEND_BUFFER": "2"})
+	knownDevices(api, "slow", "fast")
+	slow, _, err := dialWebSocket(t, server, "/status/slow", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readStatusFrame(t, slow)
+	fast, _, err := dialWebSocket(t, server, "/status/fast", testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readStatusFrame(t, fast)
+	drops := testutil.ToFloat64(websocketSlowClientDrops)
+
+	done := make(chan error, 1)
+	received := make(chan struct{})
+	go func() {
+		for {
+			fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var frame StatusResponse
+			if err := fast.ReadJSON(&frame); err != nil || frame.Status == "done" {
+				done <- err
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+	// Large frames fill the socket buffers of the slow client so its writer blocks
+	padding := strings.Repeat("x", 256<<10)
+	subscribed := func(device_id string) bool {
+		api.SubscribersMu.Lock()
+		defer api.SubscribersMu.Unlock()
+		return len(api.Subscribers[device_id]) > 0
+	}
+	sent := 0
+	for subscribed("slow") && sent < 1000 {
+		api.broadcastStatus("slow", StatusResponse{Status: "ready", Metadata: map[string]any{"padding": padding}})
+		// One frame at a time keeps the fast client within its buffer of 2
+		api.broadcastStatus("fast", StatusResponse{Status: "ready"})
+		select {
+		case <-received:
+		case err := <-done:
+			t.Fatal("fast client stopped receiving:", err)
+		}
+		sent++
+	}
+	if subscribed("slow") {
+		t.Fatalf("slow client still subscribed after %d frames", sent)
+	}
+	if got := testutil.ToFloat64(websocketSlowClientDrops) - drops; got != 1 {
+		t.Fatalf("%g slow client drops recorded", got)
+	}
+
+	api.broadcastStatus("fast", StatusResponse{Status: "done"})
+	if err := <-done; err != nil {
+		t.Fatal("fast client stopped receiving:", err)
+	}
+	if !subscribed("fast") {
+		t.Fatal("fast client dropped with the slow one")
+	}
+}
+
+// Sample count and sum of a histogram
+func histogramSamples(t *testing.T, observer prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+// Opening and closing a status websocket moves the lifetime metrics
+func TestWebSocketConnectionMetrics(t *testing.T) {
+	tests := []struct {
+		name string
+		broadcasts int // Status frames sent after the initial one
+		closed_by string
+	}{
+		{"initial frame only", 0, "client"},
+		{"with broadcasts", 3, "client"},
+		{"closed by the server", 1, "server"},
+	}
+	route := "/status/{deviceID}"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, server := newTestServer(t, nil)
+			knownDevices(api, "pi")
+			opened := testutil.ToFloat64(websocketConnectionsOpened.WithLabelValues(route))
+			active := testutil.ToFloat64(websocketConnectionsActive.WithLabelValues(route))
+			closed := testutil.ToFloat64(websocketConnectionsClosed.WithLabelValues(route))
+			durations, _ := histogramSamples(t, websocketConnectionDuration.WithLabelValues(route))
+			connections, messages := histogramSamples(t, websocketMessagesSent.WithLabelValues(route))
+
+			client, _, err := dialWebSocket(t, server, "/status/pi", testAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readStatusFrame(t, client)
+			for range test.broadcasts {
+				api.broadcastStatus("pi", StatusResponse{Status: "ready"})
+				readStatusFrame(t, client)
+			}
+			if got := testutil.ToFloat64(websocketConnectionsOpened.WithLabelValues(route)) - opened; got != 1 {
+				t.Fatalf("opened counter grew by %g", got)
+			}
+			if got := testutil.ToFloat64(websocketConnectionsActive.WithLabelValues(route)) - active; got != 1 {
+				t.Fatalf("active gauge grew by %g while open", got)
+			}
+
+			if test.closed_by == "server" {
+				api.SubscribersMu.Lock()
+				for conn := range api.Subscribers["pi"] {
+					go conn.Close()
+				}
+				api.SubscribersMu.Unlock()
+			} else {
+				client.Close()
+			}
+			waitFor(t, "the close to be counted", func() bool {
+				return testutil.ToFloat64(websocketConnectionsClosed.WithLabelValues(route))-closed == 1
+			})
+
+			if got := testutil.ToFloat64(websocketConnectionsActive.WithLabelValues(route)); got != active {
+				t.Fatalf("active gauge %g after the close, want %g", got, active)
+			}
+			if count, _ := histogramSamples(t, websocketConnectionDuration.WithLabelValues(route)); count-durations != 1 {
+				t.Fatalf("%d durations observed", count-durations)
+			}
+			count, sum := histogramSamples(t, websocketMessagesSent.WithLabelValues(route))
+			if count-connections != 1 || sum-messages != float64(1+test.broadcasts) {
+				t.Fatalf("%d connections with %g messages observed, want 1 with %d", count-connections, sum-messages, 1+test.broadcasts)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// Package provider declares the compute provider interface the server rents GPU instances through,
+// so fakes outside the server can implement it
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//// Structure
+
+type ComputeProvider interface {
+	CreateInstance(ctx context.Context, spec InstanceSpec) (*InstanceInfo, error)
+	DestroyInstance(ctx context.Context, instance_id string) error
+	InstanceStatus(ctx context.Context, instance_id string) (*InstanceInfo, error)
+	Ping(ctx context.Context) error // Lightweight authenticated call to validate connectivity
+	ListInstances(ctx context.Context) ([]InstanceInfo, error)
+}
+
+type InstanceSpec struct {
+	GPUType string
+	Region string // Country code the instance has to be located in, empty rents anywhere
+	Image string
+	DiskGB float64
+	Label string // Tags the instance as ours, rendered from INSTANCE_NAME_TEMPLATE
+	Interruptible bool // Bid on a cheaper instance the provider may reclaim
+}
+
+type InstanceInfo struct {
+	ID string
+	Status string // Provider status, "running" once the machine is up
+	Endpoint string // host:port of the inference server, empty until assigned
+	CostPerHour float64
+	Label string
+	GPUType string // What the machine actually runs, empty when the provider doesn't report it
+	Image string
+	Metadata map[string]any // Details of the rented offer for the client, set by CreateInstance
+	Account string // Account that rented the instance, set by MultiProvider
+	BackendToken string // Token the inference server of the instance expects, empty if the provider issues none
+}
+
+// Returned when the provider throttles us and said when to come back, unwraps to ErrProviderQuota
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Err error
+}
+
+//// Functionality
+
+// Provider failures callers can act on, wrapped with the provider detail
+var (
+	ErrProviderNoCapacity = errors.New("provider has no capacity")
+	ErrProviderQuota = errors.New("provider quota exceeded")
+	ErrProviderAuth = errors.New("provider authentication failed")
+	ErrInstanceNotFound = errors.New("provider instance not found") // Already destroyed, or never rented on this account
+)
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Err, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
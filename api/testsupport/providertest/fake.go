@@ -0,0 +1,193 @@
+// Package providertest offers an in memory compute provider for tests that would otherwise rent
+// instances on VastAI. The server itself is package main and can't be imported, its own tests plug
+// the fake in through APIServer.Provider
+package providertest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"RASBERRY_api/provider"
+)
+
+//// Structure
+
+// In memory ComputeProvider, instances boot after the boot delay and every call takes the call delay,
+// both are zero until set
+type FakeProvider struct {
+	boot_delay time.Duration
+	call_delay time.Duration
+	instances map[string]*fakeInstance
+	failures map[string][]error // Injected errors per operation, returned before the operation runs
+	calls map[string]int
+	next_id int
+	mu sync.Mutex
+}
+
+type fakeInstance struct {
+	info provider.InstanceInfo
+	ready_at time.Time
+}
+
+//// Functionality
+
+var _ provider.ComputeProvider = (*FakeProvider)(nil)
+
+// Port every fake instance serves on
+const Port = "8080"
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{instances: make(map[string]*fakeInstance), failures: make(map[string][]error), calls: make(map[string]int)}
+}
+
+// How long instances created from now on report created before they run
+func (p *FakeProvider) SetBootDelay(boot_delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.boot_delay = boot_delay
+}
+
+// Latency of every call from now on, a call cancelled while waiting returns the context error
+func (p *FakeProvider) SetCallDelay(call_delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.call_delay = call_delay
+}
+
+// Makes the next call of the operation ("create", "destroy", "status", "list" or "ping") fail with err,
+// repeated calls queue up failures for the calls after it
+func (p *FakeProvider) FailNext(operation string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[operation] = append(p.failures[operation], err)
+}
+
+// Number of calls of the operation so far, failed ones included
+func (p *FakeProvider) Calls(operation string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[operation]
+}
+
+// The rented instance, false once it is destroyed
+func (p *FakeProvider) Instance(instance_id string) (provider.InstanceInfo, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instance, ok := p.instances[instance_id]
+	if !ok {
+		return provider.InstanceInfo{}, false
+	}
+	return p.current(instance), true
+}
+
+// Counts the call and waits out the call delay, then pops the next injected failure of the operation
+func (p *FakeProvider) call(ctx context.Context, operation string) error {
+	p.mu.Lock()
+	p.calls[operation]++
+	delay := p.call_delay
+	p.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	queued := p.failures[operation]
+	if len(queued) == 0 {
+		return nil
+	}
+	p.failures[operation] = queued[1:]
+	return queued[0]
+}
+
+// Info of the instance as of now, caller must hold mu
+func (p *FakeProvider) current(instance *fakeInstance) provider.InstanceInfo {
+	info := instance.info
+	if !time.Now().Before(instance.ready_at) {
+		info.Status = "running"
+		info.Endpoint = "fake-" + info.ID + ":" + Port
+	}
+	return info
+}
+
+func (p *FakeProvider) CreateInstance(ctx context.Context, spec provider.InstanceSpec) (*provider.InstanceInfo, error) {
+	if err := p.call(ctx, "create"); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next_id++
+	instance := &fakeInstance{
+		info: provider.InstanceInfo{ID: strconv.Itoa(p.next_id), Status: "created", Label: spec.Label, GPUType: spec.GPUType, Image: spec.Image},
+		ready_at: time.Now().Add(p.boot_delay),
+	}
+	p.instances[instance.info.ID] = instance
+
+	info := instance.info
+	return &info, nil
+}
+
+func (p *FakeProvider) DestroyInstance(ctx context.Context, instance_id string) error {
+	if err := p.call(ctx, "destroy"); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.instances[instance_id]; !ok {
+		return fmt.Errorf("%w: fake instance %s", provider.ErrInstanceNotFound, instance_id)
+	}
+	delete(p.instances, instance_id)
+	return nil
+}
+
+func (p *FakeProvider) InstanceStatus(ctx context.Context, instance_id string) (*provider.InstanceInfo, error) {
+	if err := p.call(ctx, "status"); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instance, ok := p.instances[instance_id]
+	if !ok {
+		return nil, fmt.Errorf("%w: fake instance %s", provider.ErrInstanceNotFound, instance_id)
+	}
+	info := p.current(instance)
+	return &info, nil
+}
+
+func (p *FakeProvider) Ping(ctx context.Context) error {
+	return p.call(ctx, "ping")
+}
+
+// Every rented instance, ordered by ID
+func (p *FakeProvider) ListInstances(ctx context.Context) ([]provider.InstanceInfo, error) {
+	if err := p.call(ctx, "list"); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instances := make([]provider.InstanceInfo, 0, len(p.instances))
+	for _, instance := range p.instances {
+		instances = append(instances, p.current(instance))
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		a, _ := strconv.Atoi(instances[i].ID)
+		b, _ := strconv.Atoi(instances[j].ID)
+		return a < b
+	})
+	return instances, nil
+}
@@ -0,0 +1,102 @@
+package providertest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"RASBERRY_api/provider"
+)
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFakeProvider()
+	fake.SetBootDelay(50 * time.Millisecond)
+
+	created, err := fake.CreateInstance(ctx, provider.InstanceSpec{GPUType: "RTX_4090", Label: "pi"})
+	if err != nil || created.Status != "created" || created.Endpoint != "" {
+		t.Fatalf("created %+v %v", created, err)
+	}
+	if info, err := fake.InstanceStatus(ctx, created.ID); err != nil || info.Status != "created" {
+		t.Fatalf("status while booting %+v %v", info, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	info, err := fake.InstanceStatus(ctx, created.ID)
+	if err != nil || info.Status != "running" || info.Endpoint != "fake-"+created.ID+":"+Port || info.GPUType != "RTX_4090" || info.Label != "pi" {
+		t.Fatalf("status after the boot %+v %v", info, err)
+	}
+	if instances, err := fake.ListInstances(ctx); err != nil || len(instances) != 1 || instances[0].ID != created.ID {
+		t.Fatalf("instances %+v %v", instances, err)
+	}
+
+	if err := fake.DestroyInstance(ctx, created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.Instance(created.ID); ok {
+		t.Fatal("destroyed instance still registered")
+	}
+	if _, err := fake.InstanceStatus(ctx, created.ID); !errors.Is(err, provider.ErrInstanceNotFound) {
+		t.Fatalf("status of a destroyed instance: %v", err)
+	}
+	if err := fake.DestroyInstance(ctx, created.ID); !errors.Is(err, provider.ErrInstanceNotFound) {
+		t.Fatalf("destroying twice: %v", err)
+	}
+	if calls := fake.Calls("status"); calls != 3 {
+		t.Fatalf("%d status calls, want 3", calls)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		operation string
+		call func(fake *FakeProvider) error
+	}{
+		{"create", func(fake *FakeProvider) error { _, err := fake.CreateInstance(ctx, provider.InstanceSpec{}); return err }},
+		{"destroy", func(fake *FakeProvider) error { return fake.DestroyInstance(ctx, "1") }},
+		{"status", func(fake *FakeProvider) error { _, err := fake.InstanceStatus(ctx, "1"); return err }},
+		{"list", func(fake *FakeProvider) error { _, err := fake.ListInstances(ctx); return err }},
+		{"ping", func(fake *FakeProvider) error { return fake.Ping(ctx) }},
+	}
+	for _, test := range tests {
+		t.Run(test.operation, func(t *testing.T) {
+			fake := NewFakeProvider()
+			if _, err := fake.CreateInstance(ctx, provider.InstanceSpec{}); err != nil {
+				t.Fatal(err)
+			}
+			fake.FailNext(test.operation, provider.ErrProviderNoCapacity)
+			fake.FailNext(test.operation, provider.ErrProviderQuota)
+
+			if err := test.call(fake); !errors.Is(err, provider.ErrProviderNoCapacity) {
+				t.Fatalf("first call: %v", err)
+			}
+			if err := test.call(fake); !errors.Is(err, provider.ErrProviderQuota) {
+				t.Fatalf("second call: %v", err)
+			}
+			if err := test.call(fake); err != nil {
+				t.Fatalf("failures ran out, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCallDelay(t *testing.T) {
+	fake := NewFakeProvider()
+	fake.SetCallDelay(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := fake.Ping(context.Background()); err != nil || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("ping returned %v after %s", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := fake.CreateInstance(ctx, provider.InstanceSpec{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("cancelled create: %v", err)
+	}
+	if instances, _ := fake.ListInstances(context.Background()); len(instances) != 0 {
+		t.Fatalf("cancelled create rented %+v", instances)
+	}
+}